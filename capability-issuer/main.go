@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// The capability issuer is the trust root for relay capabilities. Run it
+// offline: -keygen creates the signing key, whose public half goes into each
+// gateway's capability_public_key; signing prints a token for a relay's
+// capability setting.
+func main() {
+	keygen := flag.Bool("keygen", false, "Generate a new signing key and print it")
+	keyFile := flag.String("key", "capability.key", "File holding the hex ed25519 private key")
+	nodeID := flag.String("node", "", "Relay node ID the capability is issued to")
+	gateways := flag.String("gateways", "", "Comma-separated gateway IDs the relay may use")
+	ttl := flag.Duration("ttl", 30*24*time.Hour, "How long the capability is valid")
+
+	flag.Parse()
+
+	if *keygen {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			log.Fatalf("Key generation failed: %v", err)
+		}
+		if err := os.WriteFile(*keyFile, []byte(hex.EncodeToString(private)+"\n"), 0600); err != nil {
+			log.Fatalf("Failed to write key: %v", err)
+		}
+		fmt.Printf("Private key written to %s\n", *keyFile)
+		fmt.Printf("capability_public_key: %s\n", hex.EncodeToString(public))
+		return
+	}
+
+	if *nodeID == "" || *gateways == "" {
+		fmt.Println("Usage: capability-issuer -node <node_id> -gateways <id,...> [-ttl 720h] [-key file]")
+		fmt.Println("       capability-issuer -keygen [-key file]")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	data, err := os.ReadFile(*keyFile)
+	if err != nil {
+		log.Fatalf("Failed to read key: %v", err)
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(raw) != ed25519.PrivateKeySize {
+		log.Fatalf("%s does not hold a hex ed25519 private key", *keyFile)
+	}
+
+	capability := common.Capability{
+		NodeID:    *nodeID,
+		Gateways:  strings.Split(*gateways, ","),
+		ExpiresAt: time.Now().Add(*ttl).UTC(),
+	}
+
+	token, err := common.SignCapability(capability, ed25519.PrivateKey(raw))
+	if err != nil {
+		log.Fatalf("Signing failed: %v", err)
+	}
+
+	fmt.Println(token)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// spreadResponse proxies a 40-byte response in chunks of 8 with policy
+// spreading them over two downstreams, and returns how many data chunks
+// each received
+func spreadResponse(t *testing.T, policy string) (int, int) {
+	t.Helper()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 40))
+	}))
+	defer target.Close()
+
+	first, second := newRecordingDownstream(t), newRecordingDownstream(t)
+	proxy := newTestCentral(t, `
+listen_port: 8080
+downstream_servers: ["`+first.addr()+`", "`+second.addr()+`"]
+response_chunk_size: 8
+balance_policy: `+policy+`
+encryption:
+  enabled: false
+destinations:
+  allow: ["127.0.0.1/32"]
+`)
+
+	sendRequest(t, proxy, requestChunks(policy, http.MethodGet, target.URL, nil, nil, 8))
+
+	dataChunks := func(d *recordingDownstream) int {
+		var n int
+		for _, chunk := range d.received(policy) {
+			if !chunk.IsControl() && !chunk.IsStream() && !chunk.IsError() {
+				n++
+			}
+		}
+		return n
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for dataChunks(first)+dataChunks(second) < 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %d of 5 chunks delivered", policy, dataChunks(first)+dataChunks(second))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return dataChunks(first), dataChunks(second)
+}
+
+func TestBalancePolicySpreadsResponseChunks(t *testing.T) {
+	if first, second := spreadResponse(t, common.BalanceRoundRobin); first == 0 || second == 0 {
+		t.Errorf("round_robin sent %d and %d chunks, want both downstreams used", first, second)
+	}
+	if first, second := spreadResponse(t, common.BalanceConsistentHash); first != 0 && second != 0 {
+		t.Errorf("consistent_hash sent %d and %d chunks, want one downstream for the session", first, second)
+	}
+}
+
+func TestUnknownBalancePolicyRejected(t *testing.T) {
+	_, err := loadCentralConfig(writeConfig(t, `
+listen_port: 8080
+downstream_servers: ["down:1"]
+balance_policy: fastest
+`))
+	if err == nil || !strings.Contains(err.Error(), `unknown balance_policy "fastest"`) {
+		t.Errorf("got %v, want the policy rejected", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// errRequestCancelled ends a target request the client no longer waits for
+var errRequestCancelled = errors.New("request cancelled by the client")
+
+// trackCancel registers the cancel function of session's target request so
+// cancelSession can abort it. The returned function unregisters it.
+func (p *CentralProxy) trackCancel(sessionID string, cancel context.CancelCauseFunc) func() {
+	p.mu.Lock()
+	p.cancels[sessionID] = cancel
+	p.mu.Unlock()
+
+	return func() {
+		p.mu.Lock()
+		delete(p.cancels, sessionID)
+		p.mu.Unlock()
+	}
+}
+
+// cancelSession stops work on a session the client gave up on, asked for
+// by a cancel chunk. A session still being reassembled is dropped, an
+// in-flight target request is aborted and an open event stream is closed;
+// chunks arriving later are discarded. With session keys the chunk must be
+// sealed with the session's key. The sender learns nothing either way, so
+// cancel chunks can't be used to probe for sessions.
+func (p *CentralProxy) cancelSession(chunk *common.Chunk) {
+	sessionID := chunk.SessionID
+
+	p.mu.Lock()
+	session, pending := p.sessions[sessionID]
+	cancel, inflight := p.cancels[sessionID]
+	stream, streaming := p.streams[sessionID]
+	if !pending {
+		p.mu.Unlock()
+		log.Printf("Ignoring cancellation of unknown session %s", sessionID)
+		return
+	}
+
+	var key []byte
+	if p.agreement != nil {
+		if key = session.SessionKey; key == nil {
+			p.mu.Unlock()
+			log.Printf("Ignoring cancellation of session %s before its handshake", sessionID)
+			return
+		}
+	}
+	if err := common.VerifyCancel(chunk, key); err != nil {
+		p.mu.Unlock()
+		log.Printf("Ignoring cancellation of session %s: %v", sessionID, err)
+		return
+	}
+
+	if !session.Complete {
+		session.Complete = true
+		delete(p.sessions, sessionID)
+		p.forgetSession(sessionID)
+	}
+	p.completed.Add(sessionID)
+	p.mu.Unlock()
+
+	if inflight {
+		cancel(errRequestCancelled)
+	}
+	if streaming {
+		stream.Close()
+	}
+
+	log.Printf("Cancelled session %s at the client's request", sessionID)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+func TestCancelAbortsTargetRequest(t *testing.T) {
+	started := make(chan struct{})
+	aborted := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	sendRequest(t, proxy, requestChunks("cancelled", http.MethodGet, target.URL, nil, nil, 8))
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("target never reached")
+	}
+
+	cancel, err := common.NewCancelChunk("cancelled", "client:7000", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := postChunk(t, proxy, cancel); rec.Code != http.StatusOK {
+		t.Fatalf("cancel chunk: status %d", rec.Code)
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("target request still running after the cancellation")
+	}
+
+	// Nothing is sent back for a request the client gave up on
+	time.Sleep(50 * time.Millisecond)
+	if chunks := downstream.received("cancelled"); len(chunks) != 0 {
+		t.Errorf("downstream got %d chunks for the cancelled session", len(chunks))
+	}
+}
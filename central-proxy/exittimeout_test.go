@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// slowTarget is a target that answers only once the test is over
+func slowTarget(t *testing.T) *httptest.Server {
+	t.Helper()
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(target.Close)
+	t.Cleanup(func() { close(release) })
+	return target
+}
+
+func TestExitTimeoutFiresAtConfiguredValue(t *testing.T) {
+	target := slowTarget(t)
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "exit_timeout: 200\n"))
+
+	start := time.Now()
+	sendRequest(t, proxy, requestChunks("slow", http.MethodGet, target.URL, nil, nil, 8))
+	_, _, report := downstream.waitForResponse(t, "slow")
+	elapsed := time.Since(start)
+
+	if report == nil || report.Code != http.StatusGatewayTimeout {
+		t.Fatalf("error report %+v, want a 504", report)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("timed out after %v, want about 200ms", elapsed)
+	}
+}
+
+func TestExitTimeoutCutToLatencyBudget(t *testing.T) {
+	target := slowTarget(t)
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "exit_timeout: 30000\n"))
+
+	chunks := requestChunks("budget", http.MethodGet, target.URL, nil, nil, 8)
+	chunks[0].Deadline = time.Now().Add(200 * time.Millisecond)
+
+	start := time.Now()
+	sendRequest(t, proxy, chunks)
+	_, _, report := downstream.waitForResponse(t, "budget")
+
+	if report == nil || report.Code != http.StatusGatewayTimeout {
+		t.Fatalf("error report %+v, want a 504", report)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("timed out after %v, not at the client's deadline", elapsed)
+	}
+}
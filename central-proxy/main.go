@@ -2,66 +2,340 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net/http"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/dudelovecamera/proxy-system/common"
-	"gopkg.in/yaml.v3"
 )
 
 // CentralConfig configuration for central proxy
 type CentralConfig struct {
-	ListenPort        int                     `yaml:"listen_port"`
-	DownstreamServers []string                `yaml:"downstream_servers"`
-	ReassemblyTimeout int                     `yaml:"reassembly_timeout"` // milliseconds
-	ProxyMode         string                  `yaml:"proxy_mode"`         // "http" or "socks5"
-	Encryption        common.EncryptionConfig `yaml:"encryption"`
-	EncryptionKey     []byte                  `yaml:"-"`
-	ChunkSize         int                     `yaml:"chunk_size"` // for response fragmentation
+	ListenPort         int                      `yaml:"listen_port"`
+	ListenAddress      string                   `yaml:"listen_address"` // interface to bind, all if empty
+	AdminToken         string                   `yaml:"admin_token"`    // enables POST /shutdown, /panic and /resume, disabled if empty
+	DownstreamServers  []string                 `yaml:"downstream_servers"`
+	BalancePolicy      string                   `yaml:"balance_policy"`      // how response chunks are spread over downstream_servers
+	ReassemblyTimeout  int                      `yaml:"reassembly_timeout"`  // milliseconds, default for idle_timeout
+	IdleTimeout        int                      `yaml:"idle_timeout"`        // milliseconds without a chunk before a session is dropped
+	SessionLifetime    int                      `yaml:"session_lifetime"`    // milliseconds from first chunk before a session is dropped
+	CompletedRetention int                      `yaml:"completed_retention"` // milliseconds late chunks of a finished session are discarded
+	SessionStoreDir    string                   `yaml:"session_store_dir"`   // keeps incomplete sessions across restarts, disabled if empty
+	StreamIdleTimeout  int                      `yaml:"stream_idle_timeout"` // milliseconds without data before an event stream is closed
+	StreamChunked      bool                     `yaml:"stream_chunked"`      // relay chunked target responses as they arrive, like event streams
+	ExitTimeout        int                      `yaml:"exit_timeout"`        // milliseconds a target request may take, body included
+	ProxyMode          string                   `yaml:"proxy_mode"`          // "http" or "socks5"
+	Encryption         common.EncryptionConfig  `yaml:"encryption"`
+	ChunkSize          int                      `yaml:"chunk_size"`          // deprecated, use response_chunk_size
+	ResponseChunkSize  int                      `yaml:"response_chunk_size"` // bytes per response chunk
+	MaxChunkSize       int                      `yaml:"max_chunk_size"`      // largest accepted chunk payload in bytes
+	MaxHeaderSize      int                      `yaml:"max_header_size"`     // largest accepted total of request header names and values in bytes
+	ChunkTTL           int                      `yaml:"chunk_ttl"`           // milliseconds after a chunk was sent that it is dropped, 0 disables
+	PerSessionBps      int                      `yaml:"per_session_bps"`     // response forwarding cap per session in bits per second, 0 = unlimited
+	ChunkCodec         string                   `yaml:"chunk_codec"`         // json or protobuf, must match every hop
+	Compression        common.ChunkCompression  `yaml:"chunk_compression"`   // adaptive compression of response chunks
+	DebugEcho          bool                     `yaml:"debug_echo"`          // answer echoTarget requests locally
+	SessionKeys        common.SessionKeyConfig  `yaml:"session_keys"`
+	EnableHTTP2        *bool                    `yaml:"enable_http2"`        // negotiate HTTP/2 with TLS targets, falling back to HTTP/1.1; on unless set to false
+	ForceH2C           bool                     `yaml:"force_h2c"`           // speak cleartext HTTP/2 to http:// targets
+	UserAgentPool      []string                 `yaml:"user_agent_pool"`     // User-Agents picked at random per request
+	OverrideUserAgent  bool                     `yaml:"override_user_agent"` // replace the client's User-Agent, not just fill it in
+	Redirects          RedirectConfig           `yaml:"redirects"`           // how target redirects are followed
+	Exits              map[string]ExitConfig    `yaml:"exits"`               // named alternative exits for routes
+	Routes             []RouteRule              `yaml:"routes"`              // first match picks the exit, direct if none
+	Destinations       common.DestinationConfig `yaml:"destinations"`        // schemes, hosts and address ranges targets may or may not use
+	Timeouts           common.HTTPTimeouts      `yaml:"timeouts"`            // outbound dial, TLS and response header timeouts
+	WireCapture        common.WireCapture       `yaml:",inline"`             // wire_capture_dir and wire_capture_redact, for debugging
 }
 
+// RedirectConfig controls how target redirects are followed
+type RedirectConfig struct {
+	Disabled bool `yaml:"disabled"`  // return 3xx responses to the client as-is
+	Max      int  `yaml:"max"`       // redirects followed per request
+	SameHost bool `yaml:"same_host"` // return redirects to other hosts to the client instead of following
+}
+
+// echoTarget is the target URL answered by the built-in echo when
+// debug_echo is enabled
+const echoTarget = "proxy-system://echo"
+
+// targetResponse is what the central proxy got back from the target
+type targetResponse struct {
+	StatusCode int
+	Headers    http.Header
+	Body       []byte
+	Stream     io.ReadCloser // body of a streamed response, forwarded as it arrives instead of Body
+	Trailers   http.Header   // trailers sent after Body; a Stream's arrive once it is read to the end
+	FinalURL   string        // URL the response came from, after redirects
+}
+
+// errExitTimeout is returned when a target takes longer than exit_timeout,
+// or than what is left of the request's latency budget
+var errExitTimeout = errors.New("target request timed out")
+
 // CentralProxy aggregates chunks and performs actual proxying
 type CentralProxy struct {
 	config   CentralConfig
 	sessions map[string]*common.Session
 	mu       sync.RWMutex
 	client   *http.Client
+	keys     *common.KeyRing
+	codec    common.ChunkCodec
+	router   *router
+	metrics  *common.Metrics
+	loss     *common.LossMetrics
+
+	duplicates *common.Counter // copies of chunks already received, from client redundancy
+
+	compressor *common.Compressor // nil unless chunk compression is enabled
+
+	destinations *common.DestinationFilter
+	downstream   *http.Client    // to downstream servers, which destination filtering doesn't apply to
+	balancer     common.Balancer // picks the downstream for each response chunk
+	killSwitch   *common.KillSwitch
+	streams      map[string]io.Closer               // open event streams by session ID
+	cancels      map[string]context.CancelCauseFunc // in-flight target requests by session ID
+
+	agreement  *common.SessionKeyAgreement // nil unless session keys are enabled
+	store      *storeQueue                 // nil unless session_store_dir is set
+	completed  *common.CompletedSessions
+	httpServer *http.Server
+}
+
+// loadCentralConfig reads and validates the config file, with settings
+// overridden by PROXY_CENTRAL_* environment variables
+func loadCentralConfig(configPath string) (CentralConfig, error) {
+	return common.LoadConfig(configPath, "PROXY_CENTRAL", setCentralDefaults)
+}
+
+// setCentralDefaults fills in settings left unset
+func setCentralDefaults(config *CentralConfig) {
+	if config.ChunkSize == 0 {
+		config.ChunkSize = 8192
+	}
+	if config.ResponseChunkSize == 0 {
+		config.ResponseChunkSize = config.ChunkSize
+	}
+	if config.MaxChunkSize == 0 {
+		config.MaxChunkSize = common.DefaultMaxChunkSize
+	}
+	if config.MaxHeaderSize == 0 {
+		config.MaxHeaderSize = common.DefaultMaxHeaderSize
+	}
+	if config.ReassemblyTimeout == 0 {
+		config.ReassemblyTimeout = 60000 // 60 seconds default
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = config.ReassemblyTimeout
+	}
+	if config.SessionLifetime == 0 {
+		config.SessionLifetime = 600000 // 10 minutes default
+	}
+	if config.CompletedRetention == 0 {
+		config.CompletedRetention = 120000 // 2 minutes default
+	}
+	if config.StreamIdleTimeout == 0 {
+		config.StreamIdleTimeout = 300000 // 5 minutes default
+	}
+	if config.ExitTimeout == 0 {
+		config.ExitTimeout = 60000 // 60 seconds default
+	}
+	if config.Redirects.Max == 0 {
+		config.Redirects.Max = 10
+	}
+	config.Destinations.SetDefaults()
+}
+
+// Validate reports every problem with the configuration
+func (c CentralConfig) Validate() error {
+	var errs []error
+
+	if c.ListenPort <= 0 || c.ListenPort > 65535 {
+		errs = append(errs, fmt.Errorf("listen_port must be between 1 and 65535, got %d", c.ListenPort))
+	}
+	if len(c.DownstreamServers) == 0 {
+		errs = append(errs, fmt.Errorf("downstream_servers must list at least one server"))
+	}
+	if c.ChunkSize < 0 {
+		errs = append(errs, fmt.Errorf("chunk_size must not be negative, got %d", c.ChunkSize))
+	}
+	if c.ResponseChunkSize < 0 {
+		errs = append(errs, fmt.Errorf("response_chunk_size must not be negative, got %d", c.ResponseChunkSize))
+	}
+	if c.MaxChunkSize < 0 {
+		errs = append(errs, fmt.Errorf("max_chunk_size must not be negative, got %d", c.MaxChunkSize))
+	}
+	if c.MaxHeaderSize < 0 {
+		errs = append(errs, fmt.Errorf("max_header_size must not be negative, got %d", c.MaxHeaderSize))
+	}
+	if c.ChunkTTL < 0 {
+		errs = append(errs, fmt.Errorf("chunk_ttl must not be negative, got %d", c.ChunkTTL))
+	}
+	if c.Redirects.Max < 0 {
+		errs = append(errs, fmt.Errorf("redirects.max must not be negative, got %d", c.Redirects.Max))
+	}
+	if c.PerSessionBps < 0 || (c.PerSessionBps > 0 && c.PerSessionBps < 8) {
+		errs = append(errs, fmt.Errorf("per_session_bps must be 0 (unlimited) or at least 8, got %d", c.PerSessionBps))
+	}
+	if c.ReassemblyTimeout < 0 {
+		errs = append(errs, fmt.Errorf("reassembly_timeout must not be negative, got %d", c.ReassemblyTimeout))
+	}
+	if c.IdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("idle_timeout must not be negative, got %d", c.IdleTimeout))
+	}
+	if c.SessionLifetime < 0 {
+		errs = append(errs, fmt.Errorf("session_lifetime must not be negative, got %d", c.SessionLifetime))
+	}
+	if c.CompletedRetention < 0 {
+		errs = append(errs, fmt.Errorf("completed_retention must not be negative, got %d", c.CompletedRetention))
+	}
+	if c.StreamIdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("stream_idle_timeout must not be negative, got %d", c.StreamIdleTimeout))
+	}
+	if c.ExitTimeout < 0 {
+		errs = append(errs, fmt.Errorf("exit_timeout must not be negative, got %d", c.ExitTimeout))
+	}
+	if err := c.Encryption.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.SessionKeys.Enabled && c.SessionKeys.PrivateKey != "" {
+		if _, err := common.NewSessionKeyAgreement(c.SessionKeys.PrivateKey); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if _, err := common.NewChunkCodec(c.ChunkCodec); err != nil {
+		errs = append(errs, err)
+	}
+	if !common.ValidBalancePolicy(c.BalancePolicy) {
+		errs = append(errs, fmt.Errorf("unknown balance_policy %q", c.BalancePolicy))
+	}
+	if err := c.Compression.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	errs = append(errs, c.validateRouting()...)
+	if err := c.Destinations.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.Timeouts.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
 }
 
 // NewCentralProxy creates a new central proxy instance
 func NewCentralProxy(configPath string) (*CentralProxy, error) {
-	data, err := os.ReadFile(configPath)
+	config, err := loadCentralConfig(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config: %w", err)
+		return nil, err
 	}
 
-	var config CentralConfig
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config: %w", err)
+	keys, err := common.NewKeyRingFromConfig(config.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption keys: %w", err)
 	}
 
-	// Set defaults
-	if config.ChunkSize == 0 {
-		config.ChunkSize = 8192
+	// Never negotiate or decode compression on the client's behalf: the
+	// client's Accept-Encoding goes to the target as-is and the encoded body
+	// is passed back along with its Content-Encoding
+	transport := common.NewHTTPTransport(config.Timeouts)
+	transport.DisableCompression = true
+	transport.Protocols = targetProtocols(config)
+
+	// Check every address dialed, after DNS resolution
+	destinations, err := common.NewDestinationFilter(config.Destinations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destinations: %w", err)
+	}
+	dialer := common.NewDialer(config.Timeouts)
+	dialer.Control = destinations.Control
+	transport.DialContext = dialer.DialContext
+
+	// Already checked by Validate
+	codec, _ := common.NewChunkCodec(config.ChunkCodec)
+
+	// Capture chunks for debugging when wire_capture_dir is set
+	tap, err := common.NewWireTap(config.WireCapture, "central")
+	if err != nil {
+		return nil, err
+	}
+	codec = tap.Codec(codec)
+	keys.SetWireTap(tap)
+
+	router, err := newRouter(config, transport)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routes: %w", err)
+	}
+
+	var agreement *common.SessionKeyAgreement
+	if config.SessionKeys.Enabled {
+		agreement, err = common.NewSessionKeyAgreement(config.SessionKeys.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		if config.SessionKeys.PrivateKey == "" {
+			log.Printf("Generated session key pair, clients must set central_public_key: %s",
+				hex.EncodeToString(agreement.PublicKey()))
+		}
+	}
+
+	metrics := common.NewMetrics()
+
+	var compressor *common.Compressor
+	if config.Compression.Enabled {
+		compressor = common.NewCompressor(config.Compression, common.NewCompressionMetrics(metrics))
 	}
 
-	// Generate or load encryption key
-	config.EncryptionKey = make([]byte, 32)
-	copy(config.EncryptionKey, []byte("your-32-byte-encryption-key-here"))
+	// Already checked by Validate
+	balancer, _ := common.NewBalancer(config.BalancePolicy, config.DownstreamServers)
 
 	proxy := &CentralProxy{
-		config:   config,
-		sessions: make(map[string]*common.Session),
+		config:     config,
+		httpServer: &http.Server{},
+		keys:       keys,
+		codec:      codec,
+		router:     router,
+		metrics:    metrics,
+		loss:       common.NewLossMetrics(metrics),
+		duplicates: metrics.Counter("proxy_duplicate_chunks_total", "Copies of request chunks dropped while their session was still being reassembled"),
+		compressor: compressor,
+		agreement:  agreement,
+		completed:  common.NewCompletedSessions(time.Duration(config.CompletedRetention) * time.Millisecond),
+		sessions:   make(map[string]*common.Session),
 		client: &http.Client{
-			Timeout: 60 * time.Second,
+			Transport:     transport,
+			CheckRedirect: redirectPolicy(config.Redirects),
 		},
+		destinations: destinations,
+		downstream:   common.NewHTTPClient(30*time.Second, config.Timeouts),
+		balancer:     balancer,
+		streams:      make(map[string]io.Closer),
+		cancels:      make(map[string]context.CancelCauseFunc),
+	}
+	proxy.killSwitch = common.NewKillSwitch(proxy.dropTraffic)
+
+	// Pick up sessions a previous run was still reassembling
+	if config.SessionStoreDir != "" {
+		store, err := newFileSessionStore(config.SessionStoreDir)
+		if err != nil {
+			return nil, err
+		}
+		proxy.store = newStoreQueue(store)
+		if err := proxy.restoreSessions(); err != nil {
+			return nil, err
+		}
 	}
 
 	// Start session cleanup goroutine
@@ -77,36 +351,166 @@ func (p *CentralProxy) handleChunk(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
+	if p.killSwitch.Engaged() {
+		http.Error(w, "Kill switch engaged", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := common.ReadChunkBody(w, r, p.config.MaxChunkSize)
 	if err != nil {
+		if errors.Is(err, common.ErrChunkTooLarge) {
+			http.Error(w, "Chunk too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Failed to read body", http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
 
-	chunk, err := common.DeserializeChunk(body)
+	chunk, err := p.codec.Decode(body)
 	if err != nil {
 		http.Error(w, "Invalid chunk format", http.StatusBadRequest)
+		log.Printf("Error deserializing chunk: %v", err)
+		return
+	}
+
+	// Reject oversized chunks before doing any work on them
+	if err := common.CheckChunkSize(chunk, p.config.MaxChunkSize); err != nil {
+		http.Error(w, "Chunk too large", http.StatusRequestEntityTooLarge)
+		log.Printf("Rejected chunk %d for session %s: %v", chunk.SequenceNum, chunk.SessionID, err)
+		return
+	}
+	if err := common.CheckHeaderSize(chunk.Headers, p.config.MaxHeaderSize); err != nil {
+		http.Error(w, "Headers too large", http.StatusRequestHeaderFieldsTooLarge)
+		log.Printf("Rejected chunk %d for session %s: %v", chunk.SequenceNum, chunk.SessionID, err)
+		return
+	}
+
+	// Drop chunks that spent too long in buffers or retries
+	if err := common.CheckChunkAge(chunk, time.Duration(p.config.ChunkTTL)*time.Millisecond); err != nil {
+		http.Error(w, "Chunk expired", http.StatusGone)
+		log.Printf("Rejected chunk %d for session %s: %v", chunk.SequenceNum, chunk.SessionID, err)
 		return
 	}
 
 	// Decrypt if enabled
 	if p.config.Encryption.Enabled {
-		decrypted, err := common.DecryptAES(chunk.Data, p.config.EncryptionKey)
-		if err != nil {
+		if err := p.keys.DecryptChunk(chunk); err != nil {
 			http.Error(w, "Decryption failed", http.StatusInternalServerError)
 			log.Printf("Decryption error: %v", err)
 			return
 		}
-		chunk.Data = decrypted
 	}
 
 	log.Printf("Central received chunk %d/%d for session %s",
 		chunk.SequenceNum, chunk.TotalChunks, chunk.SessionID)
 
-	// Add to session
+	// Answered like any chunk, whether or not the session exists
+	if chunk.IsCancel() {
+		p.cancelSession(chunk)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Chunk received"))
+		return
+	}
+
+	switch err := p.addChunk(chunk, true); {
+	case errors.Is(err, errLateChunk):
+		log.Printf("Discarding late chunk %d for completed session %s", chunk.SequenceNum, chunk.SessionID)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Session already complete"))
+		return
+	case errors.Is(err, errDuplicateChunk):
+		log.Printf("Discarding duplicate chunk %d for session %s", chunk.SequenceNum, chunk.SessionID)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Chunk already received"))
+		return
+	case errors.Is(err, errSessionKeysDisabled):
+		http.Error(w, "Session keys not enabled", http.StatusBadRequest)
+		return
+	case errors.Is(err, common.ErrChunkTooLarge):
+		http.Error(w, "Chunk too large", http.StatusRequestEntityTooLarge)
+		log.Printf("Rejected chunk %d for session %s: %v", chunk.SequenceNum, chunk.SessionID, err)
+		return
+	case errors.Is(err, errChunkCountMismatch):
+		http.Error(w, "Chunk count mismatch", http.StatusBadRequest)
+		log.Printf("Rejected chunk %d for session %s: %v", chunk.SequenceNum, chunk.SessionID, err)
+		return
+	case err != nil:
+		http.Error(w, "Invalid handshake", http.StatusBadRequest)
+		log.Printf("Handshake error for session %s: %v", chunk.SessionID, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Chunk received"))
+}
+
+var (
+	// errLateChunk is returned for chunks of sessions already complete
+	errLateChunk = errors.New("session already complete")
+
+	// errDuplicateChunk is returned for another copy of a chunk the
+	// session already holds, as clients send with redundancy
+	errDuplicateChunk = errors.New("chunk already received")
+
+	// errChunkCountMismatch is returned for a chunk whose total_chunks
+	// differs from the one its session started with
+	errChunkCountMismatch = errors.New("total_chunks differs from the session's")
+
+	// errSessionKeysDisabled is returned for handshakes when session keys
+	// are not enabled
+	errSessionKeysDisabled = errors.New("session keys not enabled")
+)
+
+// addChunk adds a decrypted chunk to its session and starts processing the
+// session once every chunk is in. persist saves the chunk to the session
+// store, if one is configured; restored chunks are already there.
+//
+// Chunks over max_chunk_size are refused rather than re-fragmented: the
+// request is reassembled whole before it goes anywhere, and the response is
+// cut to response_chunk_size afresh, so a client's chunk size never
+// reaches the downstream servers either way.
+func (p *CentralProxy) addChunk(chunk *common.Chunk, persist bool) error {
+	if err := common.CheckChunkSize(chunk, p.config.MaxChunkSize); err != nil {
+		return err
+	}
+
+	// Derive the session key from a handshake chunk
+	var sessionKey []byte
+	if chunk.ChunkType == common.ChunkTypeHandshake {
+		if p.agreement == nil {
+			return errSessionKeysDisabled
+		}
+		var err error
+		sessionKey, err = p.agreement.DeriveKey(chunk.SessionID, chunk.Data)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Add to session. A session still being proxied may outlive its entry
+	// in completed, so both are checked.
 	p.mu.Lock()
 	session, exists := p.sessions[chunk.SessionID]
+	if p.completed.Contains(chunk.SessionID) || (exists && session.Complete) {
+		p.mu.Unlock()
+		return errLateChunk
+	}
+
+	if exists && chunk.TotalChunks != session.TotalChunks {
+		p.mu.Unlock()
+		return fmt.Errorf("%w: chunk %d has %d, session has %d",
+			errChunkCountMismatch, chunk.SequenceNum, chunk.TotalChunks, session.TotalChunks)
+	}
+
+	if exists && sessionKey == nil {
+		if _, duplicate := session.Chunks[chunk.SequenceNum]; duplicate {
+			p.mu.Unlock()
+			p.duplicates.Inc()
+			return errDuplicateChunk
+		}
+	}
+
 	if !exists {
 		session = &common.Session{
 			SessionID:   chunk.SessionID,
@@ -115,118 +519,357 @@ func (p *CentralProxy) handleChunk(w http.ResponseWriter, r *http.Request) {
 			ReceivedAt:  time.Now(),
 			TargetURL:   chunk.TargetURL,
 			Method:      chunk.Method,
-			Headers:     chunk.Headers,
 		}
 		p.sessions[chunk.SessionID] = session
 	}
-	session.Chunks[chunk.SequenceNum] = chunk
+	// Request headers are carried once, by chunk 1
+	if chunk.SequenceNum == 1 {
+		session.Headers = chunk.Headers
+	}
+	session.LastChunkAt = time.Now()
+	if sessionKey != nil {
+		session.SessionKey = sessionKey
+	} else {
+		p.loss.Observe(session, chunk.SequenceNum)
+		session.Chunks[chunk.SequenceNum] = chunk
+	}
+	// With session keys the request can't be read until the handshake is in
+	complete := len(session.Chunks) == session.TotalChunks &&
+		(p.agreement == nil || session.SessionKey != nil)
+	if complete {
+		session.Complete = true
+		p.completed.Add(chunk.SessionID)
+		// Once handed to the target the request is never repeated, so a
+		// restart mid-request doesn't send it twice
+		p.forgetSession(chunk.SessionID)
+	} else if persist {
+		p.persistChunk(chunk)
+	}
 	p.mu.Unlock()
 
 	// Check if we have all chunks
-	if len(session.Chunks) == session.TotalChunks {
+	if complete {
 		go p.processCompleteSession(session)
 	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Chunk received"))
+	return nil
 }
 
-// processCompleteSession reassembles and proxies the request
+// processCompleteSession reassembles and proxies the request. The session
+// is complete, so nothing else writes to it.
 func (p *CentralProxy) processCompleteSession(session *common.Session) {
 	log.Printf("Session %s complete, reassembling and proxying", session.SessionID)
 
+	// Cleanup session
+	defer func() {
+		p.mu.Lock()
+		delete(p.sessions, session.SessionID)
+		p.mu.Unlock()
+	}()
+
 	// Reassemble chunks in order
 	var fullData bytes.Buffer
 	for i := 1; i <= session.TotalChunks; i++ {
 		chunk, exists := session.Chunks[i]
 		if !exists {
 			log.Printf("Missing chunk %d for session %s", i, session.SessionID)
+			p.sendError(session, fmt.Errorf("request chunk %d is missing", i))
 			return
 		}
-		fullData.Write(chunk.Data)
+
+		data := chunk.Data
+		if session.SessionKey != nil {
+			decrypted, err := common.DecryptAESWithAAD(data, session.SessionKey, chunk.AAD())
+			if err != nil {
+				log.Printf("Session key decryption failed for chunk %d of session %s: %v", i, session.SessionID, err)
+				p.sendError(session, fmt.Errorf("request chunk %d could not be decrypted with the session key", i))
+				return
+			}
+			data = decrypted
+		}
+		fullData.Write(data)
 	}
 
 	// Perform actual HTTP proxy request
 	response, err := p.performProxyRequest(session, fullData.Bytes())
+	if errors.Is(err, errRequestCancelled) {
+		log.Printf("Target request for session %s aborted: %v", session.SessionID, err)
+		return
+	}
 	if err != nil {
 		log.Printf("Proxy request failed for session %s: %v", session.SessionID, err)
+		p.sendError(session, err)
 		return
 	}
 
-	// Fragment response and send to downstream servers
-	if err := p.fragmentAndForward(session, response); err != nil {
+	// Fragment response and send to downstream servers, or relay an event
+	// stream until it ends
+	if response.Stream != nil {
+		err = p.streamResponse(session, response)
+	} else {
+		err = p.fragmentAndForward(session, response)
+	}
+	if err != nil {
 		log.Printf("Failed to forward response for session %s: %v", session.SessionID, err)
+		if errors.Is(err, common.ErrKillSwitchEngaged) {
+			p.sendError(session, err)
+		}
 	}
-
-	// Cleanup session
-	p.mu.Lock()
-	delete(p.sessions, session.SessionID)
-	p.mu.Unlock()
 }
 
 // performProxyRequest makes the actual HTTP request
-func (p *CentralProxy) performProxyRequest(session *common.Session, body []byte) ([]byte, error) {
+func (p *CentralProxy) performProxyRequest(session *common.Session, body []byte) (*targetResponse, error) {
+	if err := p.killSwitch.Check(); err != nil {
+		return nil, err
+	}
+
+	if p.config.DebugEcho && session.TargetURL == echoTarget {
+		return echoResponse(session, body)
+	}
+
 	req, err := http.NewRequest(session.Method, session.TargetURL, bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("request creation error: %w", err)
 	}
+	if err := p.destinations.CheckURL(req.URL); err != nil {
+		return nil, err
+	}
 
 	// Set headers from session
 	for k, v := range session.Headers {
 		req.Header.Set(k, v)
 	}
 
-	resp, err := p.client.Do(req)
+	// Target credentials travel sealed for this proxy alone, never as headers
+	auth, err := common.OpenTargetAuth(session.Chunks[1], session.SessionKey)
+	if err != nil {
+		return nil, err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	// Rotate the exit User-Agent so requests don't share a fingerprint
+	if len(p.config.UserAgentPool) > 0 && (p.config.OverrideUserAgent || req.Header.Get("User-Agent") == "") {
+		req.Header.Set("User-Agent", p.config.UserAgentPool[rand.Intn(len(p.config.UserAgentPool))])
+	}
+
+	// Apply the routed exit's header policy and transport
+	client := p.client
+	exitName := "direct"
+	if exit := p.router.Select(req); exit != nil {
+		exit.apply(req)
+		if exit.client != nil {
+			client = exit.client
+		}
+		exitName = exit.name
+	}
+
+	// The timeout covers reading the whole body, except for streamed
+	// responses, which may stay open and are bounded by stream_idle_timeout
+	// instead
+	timeout := p.exitTimeout(session)
+	if timeout <= 0 {
+		return nil, fmt.Errorf("%w: latency budget already spent", errExitTimeout)
+	}
+	ctx, cancelCause := context.WithCancelCause(context.Background())
+	cancel := func() { cancelCause(nil) }
+	timer := time.AfterFunc(timeout, func() {
+		cancelCause(fmt.Errorf("%w after %v", errExitTimeout, timeout))
+	})
+	defer p.trackCancel(session.SessionID, cancelCause)()
+
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
+		timer.Stop()
+		cause := context.Cause(ctx)
+		cancel()
+		if errors.Is(cause, errExitTimeout) || errors.Is(cause, errRequestCancelled) {
+			return nil, cause
+		}
 		return nil, fmt.Errorf("request error: %w", err)
 	}
-	defer resp.Body.Close()
+
+	if isEventStream(resp.Header) || (p.config.StreamChunked && isChunked(resp)) {
+		timer.Stop()
+		log.Printf("Streaming response from %s over %s via %s exit", session.TargetURL, resp.Proto, exitName)
+		return &targetResponse{
+			StatusCode: resp.StatusCode,
+			Headers:    resp.Header,
+			Stream:     &streamBody{ReadCloser: resp.Body, cancel: cancel},
+			Trailers:   resp.Trailer,
+			FinalURL:   resp.Request.URL.String(),
+		}, nil
+	}
+
+	defer cancel()
+	defer timer.Stop()
+	defer common.DrainAndClose(resp)
 
 	responseData, err := io.ReadAll(resp.Body)
 	if err != nil {
+		if cause := context.Cause(ctx); errors.Is(cause, errExitTimeout) || errors.Is(cause, errRequestCancelled) {
+			return nil, cause
+		}
 		return nil, fmt.Errorf("response read error: %w", err)
 	}
 
-	log.Printf("Proxied request to %s, received %d bytes", session.TargetURL, len(responseData))
-	return responseData, nil
+	log.Printf("Proxied request to %s over %s via %s exit, received %d bytes", session.TargetURL, resp.Proto, exitName, len(responseData))
+	return &targetResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    resp.Header,
+		Body:       responseData,
+		Trailers:   resp.Trailer,
+		FinalURL:   resp.Request.URL.String(),
+	}, nil
+}
+
+// exitTimeout is how long the target request of session may take: the
+// configured exit_timeout, cut to what is left of the latency budget when
+// the client set one, as its response is of no use after that
+func (p *CentralProxy) exitTimeout(session *common.Session) time.Duration {
+	timeout := time.Duration(p.config.ExitTimeout) * time.Millisecond
+	if deadline := session.Chunks[1].Deadline; !deadline.IsZero() {
+		timeout = min(timeout, time.Until(deadline))
+	}
+	return timeout
+}
+
+// targetProtocols selects the HTTP versions used towards targets. HTTP/2 is
+// offered over TLS next to HTTP/1.1, so targets without it still work;
+// h2c has no negotiation and replaces HTTP/1.1 for http:// targets.
+func targetProtocols(config CentralConfig) *http.Protocols {
+	protocols := new(http.Protocols)
+	if config.ForceH2C {
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		return protocols
+	}
+
+	protocols.SetHTTP1(true)
+	// Left out of the config, HTTP/2 stays on as with http.DefaultTransport
+	if config.EnableHTTP2 == nil || *config.EnableHTTP2 {
+		protocols.SetHTTP2(true)
+	}
+	return protocols
+}
+
+// redirectPolicy returns the CheckRedirect function for target clients.
+// Redirects that aren't followed reach the client as the 3xx response;
+// loops and chains longer than the limit fail the request.
+func redirectPolicy(config RedirectConfig) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if config.Disabled {
+			return http.ErrUseLastResponse
+		}
+		if config.SameHost && req.URL.Host != via[0].URL.Host {
+			log.Printf("Not following redirect from %s to other host %s", via[0].URL.Host, req.URL.Host)
+			return http.ErrUseLastResponse
+		}
+		for _, prev := range via {
+			if prev.URL.String() == req.URL.String() {
+				return fmt.Errorf("redirect loop at %s", req.URL)
+			}
+		}
+		if len(via) > config.Max {
+			return fmt.Errorf("stopped after %d redirects", config.Max)
+		}
+		return nil
+	}
+}
+
+// echoResponse answers a request to echoTarget with its own method, headers
+// and body, so the chunking pipeline can be checked without a real target
+func echoResponse(session *common.Session, body []byte) (*targetResponse, error) {
+	echo := map[string]interface{}{
+		"method":  session.Method,
+		"headers": session.Headers,
+		"body":    string(body),
+	}
+
+	data, err := json.Marshal(echo)
+	if err != nil {
+		return nil, fmt.Errorf("echo encoding error: %w", err)
+	}
+
+	log.Printf("Echoed %s request for session %s", session.Method, session.SessionID)
+	return &targetResponse{
+		StatusCode: http.StatusOK,
+		Headers:    http.Header{"Content-Type": []string{"application/json"}},
+		Body:       data,
+	}, nil
 }
 
 // fragmentAndForward splits response and sends to downstream servers
-func (p *CentralProxy) fragmentAndForward(session *common.Session, response []byte) error {
-	// Calculate number of chunks
-	totalChunks := (len(response) + p.config.ChunkSize - 1) / p.config.ChunkSize
+func (p *CentralProxy) fragmentAndForward(session *common.Session, target *targetResponse) error {
+	response := target.Body
 
-	log.Printf("Fragmenting response into %d chunks", totalChunks)
+	// Carry the body encoding so the client can decode it
+	var headers map[string]string
+	if encoding := target.Headers.Get("Content-Encoding"); encoding != "" {
+		headers = map[string]string{"Content-Encoding": encoding}
+	}
 
-	for i := 0; i < totalChunks; i++ {
-		start := i * p.config.ChunkSize
-		end := start + p.config.ChunkSize
-		if end > len(response) {
-			end = len(response)
+	// Calculate number of chunks; receivers reassemble purely from TotalChunks
+	chunkSize := p.config.ResponseChunkSize
+	pieces := common.SplitData(response, chunkSize)
+	totalChunks := len(pieces)
+
+	log.Printf("Fragmenting response into %d chunks of ~%d bytes", totalChunks, chunkSize)
+
+	// Status and headers go first so the client has them before the body
+	meta := &common.ResponseMeta{
+		StatusCode:    target.StatusCode,
+		Headers:       common.FlattenHeaders(target.Headers),
+		ContentLength: int64(len(response)),
+		FinalURL:      target.FinalURL,
+		Trailers:      common.FlattenTrailers(target.Trailers),
+	}
+	controlURL := p.balancer.Pick(session.SessionID, 0, 1)[0]
+	err := p.sendControl(session, meta, totalChunks, controlURL)
+	p.balancer.Done(controlURL)
+	if err != nil {
+		log.Printf("Failed to send response metadata for session %s: %v", session.SessionID, err)
+	}
+
+	throttle := p.sessionThrottle()
+	for i, piece := range pieces {
+		if throttle != nil {
+			throttle.Wait(len(piece))
+		}
+
+		if err := p.killSwitch.Check(); err != nil {
+			return err
 		}
 
 		chunk := &common.Chunk{
 			SessionID:    session.SessionID,
 			SequenceNum:  i + 1,
 			TotalChunks:  totalChunks,
-			Data:         response[start:end],
+			Data:         piece,
 			Timestamp:    time.Now(),
 			SourceClient: session.Chunks[1].SourceClient,
 		}
+		// Only chunk 1 carries headers, as on requests
+		if i == 0 {
+			chunk.Headers = headers
+		}
 
-		// Encrypt chunk if enabled
-		if p.config.Encryption.Enabled {
-			encrypted, err := common.EncryptAES(chunk.Data, p.config.EncryptionKey)
-			if err != nil {
-				return fmt.Errorf("encryption error: %w", err)
+		// Compress before sealing; ciphertext doesn't compress
+		if p.compressor != nil {
+			if err := p.compressor.Compress(chunk); err != nil {
+				return fmt.Errorf("compression error: %w", err)
 			}
-			chunk.Data = encrypted
 		}
 
-		// Select downstream server (round-robin)
-		downstreamURL := p.config.DownstreamServers[i%len(p.config.DownstreamServers)]
+		if err := p.seal(session, chunk); err != nil {
+			return err
+		}
 
-		if err := p.sendToDownstream(chunk, downstreamURL); err != nil {
+		// Select downstream server by balance_policy
+		downstreamURL := p.balancer.Pick(session.SessionID, i, 1)[0]
+		err := p.sendToDownstream(chunk, downstreamURL)
+		p.balancer.Done(downstreamURL)
+		if err != nil {
 			log.Printf("Failed to send chunk %d to %s: %v", i+1, downstreamURL, err)
 		}
 	}
@@ -234,9 +877,137 @@ func (p *CentralProxy) fragmentAndForward(session *common.Session, response []by
 	return nil
 }
 
+// sessionThrottle paces the body chunks of one response so it can't starve
+// other sessions. It is nil without per_session_bps.
+func (p *CentralProxy) sessionThrottle() *common.TokenBucket {
+	if p.config.PerSessionBps <= 0 {
+		return nil
+	}
+	return common.NewTokenBucket(p.config.PerSessionBps/8, p.config.ResponseChunkSize)
+}
+
+// sendError tells the client its request failed instead of letting it time
+// out. The error chunk is sealed with the session key like the response
+// would have been, so the message never shows at the downstream.
+func (p *CentralProxy) sendError(session *common.Session, err error) {
+	report := &common.ErrorChunk{
+		Code:    http.StatusBadGateway,
+		Message: err.Error(),
+		Hop:     "central-proxy",
+	}
+	if errors.Is(err, common.ErrDestinationBlocked) {
+		report.Code = http.StatusForbidden
+	}
+	if errors.Is(err, common.ErrKillSwitchEngaged) {
+		report.Code = http.StatusServiceUnavailable
+	}
+	if errors.Is(err, errExitTimeout) {
+		report.Code = http.StatusGatewayTimeout
+	}
+
+	chunk, err := common.NewErrorChunk(session.SessionID, sourceClient(session), report)
+	if err == nil {
+		err = p.seal(session, chunk)
+	}
+	if err == nil {
+		downstreamURL := p.balancer.Pick(session.SessionID, 0, 1)[0]
+		err = p.sendToDownstream(chunk, downstreamURL)
+		p.balancer.Done(downstreamURL)
+	}
+	if err != nil {
+		log.Printf("Failed to send error for session %s: %v", session.SessionID, err)
+	}
+}
+
+// sourceClient is the client address the session's chunks carry. Every
+// chunk carries it, and chunk 1 may be the one missing.
+func sourceClient(session *common.Session) string {
+	for _, chunk := range session.Chunks {
+		return chunk.SourceClient
+	}
+	return ""
+}
+
+// dropTraffic runs when the kill switch is engaged. Sessions still being
+// reassembled are dropped and their clients told why; open event streams
+// are closed. Sessions already past reassembly fail at their next step.
+func (p *CentralProxy) dropTraffic() {
+	var dropped []*common.Session
+
+	p.mu.Lock()
+	for sessionID, session := range p.sessions {
+		if session.Complete {
+			continue
+		}
+		session.Complete = true
+		delete(p.sessions, sessionID)
+		p.completed.Add(sessionID)
+		p.forgetSession(sessionID)
+		if _, exists := session.Chunks[1]; exists {
+			dropped = append(dropped, session)
+		}
+	}
+	for _, stream := range p.streams {
+		stream.Close()
+	}
+	p.mu.Unlock()
+
+	log.Printf("Kill switch engaged: dropped %d pending sessions", len(dropped))
+
+	for _, session := range dropped {
+		p.sendError(session, common.ErrKillSwitchEngaged)
+	}
+}
+
+// sendControl sends the response control chunk for a session through
+// downstreamURL. Downstream servers pass it straight through, so it reaches
+// the client before any chunk sent through the same downstream after it.
+func (p *CentralProxy) sendControl(session *common.Session, meta *common.ResponseMeta, totalChunks int, downstreamURL string) error {
+	data, err := common.EncodeResponseMeta(meta)
+	if err != nil {
+		return err
+	}
+
+	chunk := &common.Chunk{
+		SessionID:    session.SessionID,
+		SequenceNum:  common.ControlSequence,
+		TotalChunks:  totalChunks,
+		ChunkType:    common.ChunkTypeControl,
+		Data:         data,
+		Timestamp:    time.Now(),
+		SourceClient: session.Chunks[1].SourceClient,
+	}
+
+	if err := p.seal(session, chunk); err != nil {
+		return err
+	}
+
+	return p.sendToDownstream(chunk, downstreamURL)
+}
+
+// seal encrypts chunk data end to end with the session key, then applies
+// hop encryption if enabled
+func (p *CentralProxy) seal(session *common.Session, chunk *common.Chunk) error {
+	if session.SessionKey != nil {
+		encrypted, err := common.EncryptAESWithAAD(chunk.Data, session.SessionKey, chunk.AAD())
+		if err != nil {
+			return fmt.Errorf("session key encryption error: %w", err)
+		}
+		chunk.Data = encrypted
+	}
+
+	if p.config.Encryption.Enabled {
+		if err := p.keys.EncryptChunk(chunk); err != nil {
+			return fmt.Errorf("encryption error: %w", err)
+		}
+	}
+
+	return nil
+}
+
 // sendToDownstream forwards chunk to downstream server
 func (p *CentralProxy) sendToDownstream(chunk *common.Chunk, downstreamURL string) error {
-	data, err := common.SerializeChunk(chunk)
+	data, err := p.codec.Encode(chunk)
 	if err != nil {
 		return err
 	}
@@ -247,13 +1018,13 @@ func (p *CentralProxy) sendToDownstream(chunk *common.Chunk, downstreamURL strin
 		return err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", p.codec.ContentType())
 
-	resp, err := p.client.Do(req)
+	resp, err := p.downstream.Do(req)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	defer common.DrainAndClose(resp)
 
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("downstream returned status %d", resp.StatusCode)
@@ -267,18 +1038,31 @@ func (p *CentralProxy) cleanupSessions() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
-	timeout := time.Duration(p.config.ReassemblyTimeout) * time.Millisecond
-
 	for range ticker.C {
-		p.mu.Lock()
-		now := time.Now()
-		for sessionID, session := range p.sessions {
-			if now.Sub(session.ReceivedAt) > timeout {
-				log.Printf("Session %s timed out", sessionID)
-				delete(p.sessions, sessionID)
-			}
+		p.expireSessions(time.Now())
+		p.completed.Cleanup()
+	}
+}
+
+// expireSessions drops sessions idle or incomplete for too long at now,
+// counting the chunks they never received
+func (p *CentralProxy) expireSessions(now time.Time) {
+	idle := time.Duration(p.config.IdleTimeout) * time.Millisecond
+	lifetime := time.Duration(p.config.SessionLifetime) * time.Millisecond
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for sessionID, session := range p.sessions {
+		if session.Complete {
+			continue // removed once processed
+		}
+		if reason := session.Expired(now, idle, lifetime); reason != "" {
+			log.Printf("Session %s timed out: %s", sessionID, reason)
+			p.loss.Expire(session)
+			delete(p.sessions, sessionID)
+			p.forgetSession(sessionID)
 		}
-		p.mu.Unlock()
 	}
 }
 
@@ -288,33 +1072,83 @@ func (p *CentralProxy) healthCheck(w http.ResponseWriter, r *http.Request) {
 	sessionCount := len(p.sessions)
 	p.mu.RUnlock()
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":          "healthy",
-		"role":            "central-proxy",
-		"active_sessions": sessionCount,
-		"time":            time.Now().Format(time.RFC3339),
-	})
+	common.WriteHealth(w, common.NewHealthInfo("central-proxy", map[string]any{
+		"active_sessions":  sessionCount,
+		"completed_recent": p.completed.Size(),
+		"kill_switch":      p.killSwitch.Engaged(),
+	}))
+}
+
+// ready reports whether the kill switch is released and at least one
+// downstream server can be reached
+func (p *CentralProxy) ready() error {
+	if err := p.killSwitch.Check(); err != nil {
+		return err
+	}
+	return common.ProbeAny(p.downstream, p.config.DownstreamServers)
 }
 
 // Start begins the central proxy server
 func (p *CentralProxy) Start() error {
-	http.HandleFunc("/chunk", p.handleChunk)
-	http.HandleFunc("/health", p.healthCheck)
-
-	addr := fmt.Sprintf(":%d", p.config.ListenPort)
+	addr := common.ListenAddr(p.config.ListenAddress, p.config.ListenPort)
 	log.Printf("Central proxy starting on %s", addr)
 	log.Printf("Downstream servers: %v", p.config.DownstreamServers)
 
-	return http.ListenAndServe(addr, nil)
+	p.httpServer.Addr = addr
+	p.httpServer.Handler = p.Handler()
+	if err := p.httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	log.Printf("Central proxy stopped")
+	return nil
+}
+
+// Shutdown stops accepting requests and waits for in-flight ones, then for
+// the session store to catch up
+func (p *CentralProxy) Shutdown(ctx context.Context) error {
+	err := p.httpServer.Shutdown(ctx)
+	if p.store != nil {
+		err = errors.Join(err, p.store.Flush(ctx))
+	}
+	return err
+}
+
+// Handler returns the proxy's routes, for serving or in-process wiring
+func (p *CentralProxy) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chunk", p.handleChunk)
+	mux.HandleFunc("/health", p.healthCheck)
+	mux.HandleFunc("/ready", common.ReadyHandler(p.ready))
+	mux.Handle("/metrics", p.metrics)
+	if p.config.AdminToken != "" {
+		mux.HandleFunc("/shutdown", common.ShutdownHandler(p.config.AdminToken, p))
+		mux.HandleFunc("/panic", common.PanicHandler(p.config.AdminToken, p.killSwitch))
+		mux.HandleFunc("/resume", common.ResumeHandler(p.config.AdminToken, p.killSwitch))
+	}
+	return mux
+}
+
+// SetTransport replaces the transport used for target and downstream requests
+func (p *CentralProxy) SetTransport(rt http.RoundTripper) {
+	p.client.Transport = rt
+	p.downstream.Transport = rt
 }
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
+	check := flag.Bool("check", false, "Validate the config file and exit")
+	flag.Parse()
+
 	configPath := "config/central.yaml"
-	if len(os.Args) > 1 {
-		configPath = os.Args[1]
+	if flag.NArg() > 0 {
+		configPath = flag.Arg(0)
+	}
+
+	if *check {
+		_, err := loadCentralConfig(configPath)
+		common.ReportConfigCheck(configPath, err)
 	}
 
 	proxy, err := NewCentralProxy(configPath)
@@ -322,6 +1156,8 @@ func main() {
 		log.Fatalf("Failed to create proxy: %v", err)
 	}
 
+	common.ShutdownOnSignal(proxy)
+
 	if err := proxy.Start(); err != nil {
 		log.Fatalf("Server error: %v", err)
 	}
@@ -0,0 +1,842 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// writeConfig writes a YAML config to a temporary file and returns its path
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "central.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestCentral builds a central proxy from yaml
+func newTestCentral(t *testing.T, yaml string) *CentralProxy {
+	t.Helper()
+	proxy, err := NewCentralProxy(writeConfig(t, yaml))
+	if err != nil {
+		t.Fatalf("NewCentralProxy: %v", err)
+	}
+	return proxy
+}
+
+// sessionCount returns the number of sessions being reassembled or proxied
+func (p *CentralProxy) sessionCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.sessions)
+}
+
+// requestChunks fragments a request into chunks of size bytes as a client
+// would, without encryption
+func requestChunks(session, method, target string, headers map[string]string, body []byte, size int) []*common.Chunk {
+	pieces := common.SplitData(body, size)
+	chunks := make([]*common.Chunk, len(pieces))
+	for i, piece := range pieces {
+		chunks[i] = &common.Chunk{
+			SessionID:    session,
+			SequenceNum:  i + 1,
+			TotalChunks:  len(pieces),
+			Data:         piece,
+			Timestamp:    time.Now(),
+			SourceClient: "client:7000",
+			TargetURL:    target,
+			Method:       method,
+		}
+	}
+	chunks[0].Headers = headers
+	return chunks
+}
+
+// postChunk sends chunk to the proxy's /chunk handler as an upstream would
+func postChunk(t *testing.T, p *CentralProxy, chunk *common.Chunk) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := p.codec.Encode(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	p.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/chunk", bytes.NewReader(data)))
+	return recorder
+}
+
+// sendRequest posts every chunk of a request and fails the test if one is
+// refused
+func sendRequest(t *testing.T, p *CentralProxy, chunks []*common.Chunk) {
+	t.Helper()
+	for _, chunk := range chunks {
+		if rec := postChunk(t, p, chunk); rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d refused: %d %s", chunk.SequenceNum, rec.Code, rec.Body)
+		}
+	}
+}
+
+// recordingDownstream is a stub downstream server keeping every chunk
+// posted to it, unencrypted configs assumed
+type recordingDownstream struct {
+	server *httptest.Server
+
+	mu     sync.Mutex
+	chunks []*common.Chunk
+	added  chan struct{}
+}
+
+func newRecordingDownstream(t *testing.T) *recordingDownstream {
+	t.Helper()
+	d := &recordingDownstream{added: make(chan struct{}, 1)}
+	d.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		chunk, err := common.DeserializeChunk(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		d.mu.Lock()
+		d.chunks = append(d.chunks, chunk)
+		d.mu.Unlock()
+		select {
+		case d.added <- struct{}{}:
+		default:
+		}
+	}))
+	t.Cleanup(d.server.Close)
+	return d
+}
+
+// addr is the downstream's host:port as used in config
+func (d *recordingDownstream) addr() string {
+	return d.server.Listener.Addr().String()
+}
+
+// received returns the chunks of session received so far
+func (d *recordingDownstream) received(session string) []*common.Chunk {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var chunks []*common.Chunk
+	for _, chunk := range d.chunks {
+		if chunk.SessionID == session {
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
+
+// waitFor waits until done reports true of the chunks of session, failing
+// the test after a few seconds
+func (d *recordingDownstream) waitFor(t *testing.T, session string, done func([]*common.Chunk) bool) []*common.Chunk {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		chunks := d.received(session)
+		if done(chunks) {
+			return chunks
+		}
+		select {
+		case <-d.added:
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("gave up waiting for session %s, have %d chunks", session, len(chunks))
+		}
+	}
+}
+
+// waitForResponse waits for a whole response of session, or an error chunk,
+// and returns its metadata, its reassembled body and any error report
+func (d *recordingDownstream) waitForResponse(t *testing.T, session string) (*common.ResponseMeta, []byte, *common.ErrorChunk) {
+	t.Helper()
+	chunks := d.waitFor(t, session, func(chunks []*common.Chunk) bool {
+		var meta, data, total int
+		for _, chunk := range chunks {
+			switch {
+			case chunk.IsError():
+				return true
+			case chunk.IsControl():
+				meta++
+			case !chunk.IsStream():
+				data++
+				total = chunk.TotalChunks
+			}
+		}
+		return meta > 0 && data > 0 && data == total
+	})
+
+	var meta *common.ResponseMeta
+	parts := make(map[int][]byte)
+	for _, chunk := range chunks {
+		switch {
+		case chunk.IsError():
+			report, err := common.DecodeErrorChunk(chunk.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return nil, nil, report
+		case chunk.IsControl():
+			var err error
+			if meta, err = common.DecodeResponseMeta(chunk.Data); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			data, err := common.Decompress(chunk.Compression, chunk.Data, common.DefaultMaxChunkSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts[chunk.SequenceNum] = data
+		}
+	}
+
+	var body []byte
+	for i := 1; i <= len(parts); i++ {
+		body = append(body, parts[i]...)
+	}
+	return meta, body, nil
+}
+
+// centralConfig is a config for tests against a recordingDownstream at
+// downstream, allowed to reach targets on loopback
+func centralConfig(downstream string, extra string) string {
+	return `
+listen_port: 8080
+downstream_servers: ["` + downstream + `"]
+encryption:
+  enabled: false
+destinations:
+  allow: ["127.0.0.1/32"]
+` + extra
+}
+
+func TestEmptyDownstreamListRejected(t *testing.T) {
+	_, err := loadCentralConfig(writeConfig(t, `
+listen_port: 8080
+downstream_servers: []
+`))
+	if err == nil || !strings.Contains(err.Error(), "downstream_servers must list at least one server") {
+		t.Errorf("got %v, want the empty downstream list rejected", err)
+	}
+}
+
+func TestTinyResponseChunks(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 10)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "response_chunk_size: 3\n"))
+
+	sendRequest(t, proxy, requestChunks("tiny", http.MethodGet, target.URL, nil, nil, 8))
+
+	meta, got, report := downstream.waitForResponse(t, "tiny")
+	if report != nil {
+		t.Fatalf("error chunk: %v", report)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("reassembled %q, want %q", got, body)
+	}
+	if meta.ContentLength != int64(len(body)) {
+		t.Errorf("announced length %d, want %d", meta.ContentLength, len(body))
+	}
+	if n := len(downstream.received("tiny")) - 1; n != 34 {
+		t.Errorf("got %d data chunks, want 34 of at most 3 bytes", n)
+	}
+}
+
+func TestOversizedChunkRejected(t *testing.T) {
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "max_chunk_size: 64\n"))
+
+	chunks := requestChunks("big", http.MethodPost, "http://127.0.0.1/", nil, bytes.Repeat([]byte("x"), 65), 65)
+	if rec := postChunk(t, proxy, chunks[0]); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("65 byte chunk: status %d, want 413", rec.Code)
+	}
+}
+
+func TestGzipPassedThrough(t *testing.T) {
+	body := bytes.Repeat([]byte("compressible "), 20)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(body)
+	zw.Close()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			w.Write(body)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	sendRequest(t, proxy, requestChunks("gzip", http.MethodGet, target.URL, map[string]string{"Accept-Encoding": "gzip"}, nil, 8))
+
+	meta, got, report := downstream.waitForResponse(t, "gzip")
+	if report != nil {
+		t.Fatalf("error chunk: %v", report)
+	}
+	if meta.Headers["Content-Encoding"] != "gzip" {
+		t.Errorf("Content-Encoding %q, want gzip", meta.Headers["Content-Encoding"])
+	}
+	if !bytes.Equal(got, compressed.Bytes()) {
+		t.Error("body was not passed on still compressed")
+	}
+}
+
+func TestInvalidConfigs(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want string
+	}{
+		{"listen_port: 8080\ndownstream_servers: [d:1]\nresponse_chunk_size: -1\n", "response_chunk_size must not be negative"},
+		{"listen_port: 8080\ndownstream_servers: [d:1]\nchunk_size: -1\n", "chunk_size must not be negative"},
+		{"listen_port: -1\ndownstream_servers: [d:1]\n", "listen_port must be between 1 and 65535"},
+		{"listen_port: 8080\ndownstream_servers: [d:1]\nmax_header_size: -1\n", "max_header_size must not be negative"},
+	}
+	for _, tt := range tests {
+		_, err := loadCentralConfig(writeConfig(t, tt.yaml))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.yaml, err, tt.want)
+		}
+	}
+}
+
+func TestEchoTarget(t *testing.T) {
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "debug_echo: true\nresponse_chunk_size: 16\n"))
+
+	body := []byte("a request body spread over several chunks")
+	sendRequest(t, proxy, requestChunks("echo", http.MethodPost, echoTarget, map[string]string{"X-Test": "yes"}, body, 8))
+
+	meta, got, report := downstream.waitForResponse(t, "echo")
+	if report != nil {
+		t.Fatalf("error chunk: %v", report)
+	}
+	if meta.StatusCode != http.StatusOK {
+		t.Errorf("status %d", meta.StatusCode)
+	}
+
+	var echo struct {
+		Method  string            `json:"method"`
+		Headers map[string]string `json:"headers"`
+		Body    string            `json:"body"`
+	}
+	if err := json.Unmarshal(got, &echo); err != nil {
+		t.Fatalf("echo response %q: %v", got, err)
+	}
+	if echo.Method != http.MethodPost || echo.Headers["X-Test"] != "yes" || echo.Body != string(body) {
+		t.Errorf("echoed %+v", echo)
+	}
+}
+
+func TestEchoTargetNeedsDebugEcho(t *testing.T) {
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	sendRequest(t, proxy, requestChunks("no-echo", http.MethodGet, echoTarget, nil, nil, 8))
+
+	if _, _, report := downstream.waitForResponse(t, "no-echo"); report == nil {
+		t.Error("echo target answered with debug_echo off")
+	}
+}
+
+func TestControlChunkCarriesStatusAndHeaders(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Target", "yes")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	sendRequest(t, proxy, requestChunks("meta", http.MethodGet, target.URL, nil, nil, 8))
+
+	meta, got, report := downstream.waitForResponse(t, "meta")
+	if report != nil {
+		t.Fatalf("error chunk: %v", report)
+	}
+	if meta.StatusCode != http.StatusTeapot || meta.Headers["X-Target"] != "yes" {
+		t.Errorf("control chunk %+v, want status 418 and X-Target", meta)
+	}
+	if meta.ContentLength != int64(len(got)) {
+		t.Errorf("announced length %d, body %d bytes", meta.ContentLength, len(got))
+	}
+	for _, chunk := range downstream.received("meta") {
+		if chunk.IsControl() && chunk.SequenceNum != common.ControlSequence {
+			t.Errorf("control chunk numbered %d", chunk.SequenceNum)
+		}
+	}
+}
+
+// userAgentTarget is a target answering with the request's User-Agent
+func userAgentTarget(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(r.Header.Get("User-Agent")))
+}
+
+func TestUserAgentDrawnFromPool(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(userAgentTarget))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "user_agent_pool: [agent-a, agent-b]\noverride_user_agent: true\n"))
+
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		session := fmt.Sprintf("ua-%d", i)
+		sendRequest(t, proxy, requestChunks(session, http.MethodGet, target.URL, map[string]string{"User-Agent": "client-agent"}, nil, 8))
+		_, got, report := downstream.waitForResponse(t, session)
+		if report != nil {
+			t.Fatalf("error chunk: %v", report)
+		}
+		if agent := string(got); agent != "agent-a" && agent != "agent-b" {
+			t.Fatalf("target saw User-Agent %q, want one from the pool", agent)
+		}
+		seen[string(got)] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("20 requests used only %v", seen)
+	}
+}
+
+func TestUserAgentPoolFillsInOnly(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(userAgentTarget))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "user_agent_pool: [agent-a]\n"))
+
+	sendRequest(t, proxy, requestChunks("kept", http.MethodGet, target.URL, map[string]string{"User-Agent": "client-agent"}, nil, 8))
+	if _, got, _ := downstream.waitForResponse(t, "kept"); string(got) != "client-agent" {
+		t.Errorf("client's User-Agent replaced by %q without override_user_agent", got)
+	}
+
+	sendRequest(t, proxy, requestChunks("filled", http.MethodGet, target.URL, nil, nil, 8))
+	if _, got, _ := downstream.waitForResponse(t, "filled"); string(got) != "agent-a" {
+		t.Errorf("missing User-Agent filled in with %q, want agent-a", got)
+	}
+}
+
+func TestLateChunkAfterCompletionDiscarded(t *testing.T) {
+	var mu sync.Mutex
+	hits := 0
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		mu.Unlock()
+		w.Write([]byte("done"))
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "completed_retention: 60000\n"))
+
+	chunks := requestChunks("late", http.MethodPost, target.URL, nil, []byte("two chunks of body"), 10)
+	sendRequest(t, proxy, chunks)
+	if _, _, report := downstream.waitForResponse(t, "late"); report != nil {
+		t.Fatalf("error chunk: %v", report)
+	}
+	// Removed once the response is sent
+	for deadline := time.Now().Add(time.Second); proxy.sessionCount() > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("completed session never removed")
+		}
+	}
+
+	rec := postChunk(t, proxy, chunks[1])
+	if rec.Code != http.StatusOK || rec.Body.String() != "Session already complete" {
+		t.Errorf("late chunk: %d %q, want it acknowledged and discarded", rec.Code, rec.Body)
+	}
+
+	if proxy.sessionCount() != 0 {
+		t.Error("late chunk opened a new session")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if hits != 1 {
+		t.Errorf("target hit %d times, want once", hits)
+	}
+}
+
+func TestPerSessionBandwidthCap(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 5000)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer target.Close()
+
+	// 10000 bytes per second, with a burst of one 1000 byte chunk
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "per_session_bps: 80000\nresponse_chunk_size: 1000\n"))
+
+	start := time.Now()
+	sendRequest(t, proxy, requestChunks("capped", http.MethodGet, target.URL, nil, nil, 8))
+	_, got, report := downstream.waitForResponse(t, "capped")
+	elapsed := time.Since(start)
+	if report != nil {
+		t.Fatalf("error chunk: %v", report)
+	}
+	if len(got) != len(body) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(body))
+	}
+
+	// The 4000 bytes past the burst take 400ms at the cap
+	if elapsed < 350*time.Millisecond {
+		t.Errorf("5000 bytes forwarded in %v, faster than 10000 bytes/s allows", elapsed)
+	}
+}
+
+func TestLostChunksCounted(t *testing.T) {
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	// Chunks 3 and 5 of 5 never arrive
+	chunks := requestChunks("lossy", http.MethodPost, "http://127.0.0.1/", nil, []byte("0123456789"), 2)
+	sendRequest(t, proxy, []*common.Chunk{chunks[0], chunks[1], chunks[3]})
+	proxy.expireSessions(time.Now().Add(24 * time.Hour))
+
+	if proxy.sessionCount() != 0 {
+		t.Fatal("session not expired")
+	}
+	recorder := httptest.NewRecorder()
+	proxy.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		"proxy_chunks_received_total 3\n",
+		"proxy_chunks_lost_total 2\n",
+		"proxy_chunk_sequence_gaps_total 1\n",
+		"proxy_sessions_expired_total 1\n",
+	} {
+		if !strings.Contains(recorder.Body.String(), want) {
+			t.Errorf("metrics lack %q", want)
+		}
+	}
+}
+
+func TestReadyOnceDownstreamReachable(t *testing.T) {
+	var up atomic.Bool
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer downstream.Close()
+	proxy := newTestCentral(t, centralConfig(downstream.Listener.Addr().String(), ""))
+
+	ready := func() int {
+		recorder := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return recorder.Code
+	}
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("downstream down: /ready %d, want 503", code)
+	}
+	up.Store(true)
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("downstream up: /ready %d, want 200", code)
+	}
+}
+
+func TestShortEncryptionKeyFailsFast(t *testing.T) {
+	_, err := NewCentralProxy(writeConfig(t, `
+listen_port: 8080
+downstream_servers: ["d:1"]
+encryption:
+  enabled: true
+  encryption_key_hex: "00112233445566778899"
+`))
+	if err == nil || !strings.Contains(err.Error(), "must decode to 32 bytes for AES-256, got 10") {
+		t.Errorf("got %v, want the 10 byte key rejected", err)
+	}
+}
+
+func TestLinkLocalTargetBlocked(t *testing.T) {
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	sendRequest(t, proxy, requestChunks("metadata", http.MethodGet, "http://169.254.169.254/latest/meta-data/", nil, nil, 8))
+	_, _, report := downstream.waitForResponse(t, "metadata")
+	if report == nil || report.Code != http.StatusForbidden {
+		t.Errorf("got %+v, want a 403 error chunk", report)
+	}
+}
+
+func TestHeadersTakenFromFirstChunk(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Carried")))
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	// Chunk 1 carrying the headers arrives last
+	chunks := requestChunks("headers", http.MethodPost, target.URL, map[string]string{"X-Carried": "once"}, []byte("three chunk body"), 6)
+	slices.Reverse(chunks)
+	sendRequest(t, proxy, chunks)
+
+	if _, got, _ := downstream.waitForResponse(t, "headers"); string(got) != "once" {
+		t.Errorf("target saw X-Carried %q, want it from chunk 1", got)
+	}
+}
+
+func TestOversizedHeadersRejected(t *testing.T) {
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "max_header_size: 64\n"))
+
+	chunks := requestChunks("big-headers", http.MethodGet, "http://127.0.0.1/", map[string]string{"X-Big": strings.Repeat("x", 100)}, nil, 8)
+	if rec := postChunk(t, proxy, chunks[0]); rec.Code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("status %d, want 431", rec.Code)
+	}
+}
+
+func TestKillSwitchRefusesTraffic(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("reached"))
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "admin_token: secret\n"))
+	admin := func(path string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", path, recorder.Code)
+		}
+	}
+
+	admin("/panic")
+	chunks := requestChunks("panicked", http.MethodGet, target.URL, nil, nil, 8)
+	if rec := postChunk(t, proxy, chunks[0]); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("panicked: status %d, want 503", rec.Code)
+	}
+
+	admin("/resume")
+	sendRequest(t, proxy, requestChunks("resumed", http.MethodGet, target.URL, nil, nil, 8))
+	if _, got, report := downstream.waitForResponse(t, "resumed"); report != nil || string(got) != "reached" {
+		t.Errorf("after resume: got %q, error %v", got, report)
+	}
+}
+
+func TestRangeRequestReturnsSlice(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader("0123456789abcdef"))
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	sendRequest(t, proxy, requestChunks("range", http.MethodGet, target.URL, map[string]string{"Range": "bytes=4-9"}, nil, 8))
+
+	meta, got, report := downstream.waitForResponse(t, "range")
+	if report != nil {
+		t.Fatalf("error chunk: %v", report)
+	}
+	if meta.StatusCode != http.StatusPartialContent || string(got) != "456789" {
+		t.Errorf("got %d %q, want 206 with bytes 4 through 9", meta.StatusCode, got)
+	}
+	if meta.Headers["Content-Range"] != "bytes 4-9/16" {
+		t.Errorf("Content-Range %q", meta.Headers["Content-Range"])
+	}
+}
+
+func TestConcurrentChunksOfOneSession(t *testing.T) {
+	var hits atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.Copy(w, r.Body)
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 8)
+	chunks := requestChunks("hammer", http.MethodPost, target.URL, nil, body, 8)
+	encoded := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		data, err := proxy.codec.Encode(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded[i] = data
+	}
+
+	// Every goroutine posts every chunk, from a different starting point
+	const senders = 8
+	var wg sync.WaitGroup
+	for g := 0; g < senders; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range encoded {
+				data := encoded[(i+g)%len(encoded)]
+				proxy.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/chunk", bytes.NewReader(data)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, got, report := downstream.waitForResponse(t, "hammer")
+	if report != nil {
+		t.Fatalf("error chunk: %v", report)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("target echoed %q, want %q", got, body)
+	}
+	for deadline := time.Now().Add(time.Second); proxy.sessionCount() > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("completed session never removed")
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("target hit %d times, want once", n)
+	}
+}
+
+func TestHealthReportsVersionAndUptime(t *testing.T) {
+	proxy := newTestCentral(t, centralConfig("d:1", ""))
+
+	recorder := httptest.NewRecorder()
+	proxy.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var health map[string]any
+	if err := json.NewDecoder(recorder.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	if health["role"] != "central-proxy" || health["version"] != common.Version {
+		t.Errorf("health %v, want role and version", health)
+	}
+	if _, ok := health["uptime_seconds"].(float64); !ok {
+		t.Errorf("health %v without uptime", health)
+	}
+	if _, ok := health["active_sessions"]; !ok {
+		t.Errorf("health %v without the central's own fields", health)
+	}
+}
+
+func TestExpiredChunkDropped(t *testing.T) {
+	proxy := newTestCentral(t, centralConfig("127.0.0.1:1", "chunk_ttl: 60000\n"))
+
+	chunk := requestChunks("old", http.MethodGet, "http://127.0.0.1/", nil, []byte("body"), 8)[0]
+	chunk.Timestamp = time.Now().Add(-2 * time.Minute)
+	if rec := postChunk(t, proxy, chunk); rec.Code != http.StatusGone {
+		t.Errorf("status %d, want 410", rec.Code)
+	}
+	if proxy.sessionCount() != 0 {
+		t.Errorf("%d sessions opened by an expired chunk", proxy.sessionCount())
+	}
+}
+
+func TestTargetFailureReportedInErrorChunk(t *testing.T) {
+	// Nothing listens on the target's port once the server is closed
+	target := httptest.NewServer(http.NotFoundHandler())
+	target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	sendRequest(t, proxy, requestChunks("unreachable", http.MethodGet, target.URL, nil, nil, 8))
+	_, _, report := downstream.waitForResponse(t, "unreachable")
+	if report == nil || report.Code != http.StatusBadGateway || report.Hop != "central-proxy" {
+		t.Errorf("error report %+v, want a 502 from the central proxy", report)
+	}
+}
+
+func TestDuplicateChunkDropped(t *testing.T) {
+	var hits atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.Copy(w, r.Body)
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	// Chunk 1 arrives through two upstreams before chunk 2
+	chunks := requestChunks("copies", http.MethodPost, target.URL, nil, []byte("sixteen bytes!!!"), 8)
+	sendRequest(t, proxy, []*common.Chunk{chunks[0], chunks[0], chunks[1], chunks[1]})
+
+	if _, body, report := downstream.waitForResponse(t, "copies"); report != nil || string(body) != "sixteen bytes!!!" {
+		t.Fatalf("got %q, %v", body, report)
+	}
+	if got := proxy.duplicates.Value(); got != 1 {
+		t.Errorf("duplicate counter %d, want 1", got)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("target hit %d times, want once", got)
+	}
+}
+
+func TestChunkCountMismatchRejected(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	chunks := requestChunks("miscounted", http.MethodPost, target.URL, nil, []byte("sixteen bytes!!!"), 8)
+	sendRequest(t, proxy, chunks[:1])
+
+	// A chunk claiming a longer request must not join the session
+	forged := *chunks[1]
+	forged.TotalChunks = 3
+	if rec := postChunk(t, proxy, &forged); rec.Code != http.StatusBadRequest {
+		t.Errorf("chunk with total_chunks 3 in a session of 2: status %d, want 400", rec.Code)
+	}
+
+	sendRequest(t, proxy, chunks[1:])
+	if _, body, report := downstream.waitForResponse(t, "miscounted"); report != nil || string(body) != "sixteen bytes!!!" {
+		t.Fatalf("got %q, %v", body, report)
+	}
+}
+
+func TestMissingRequestChunkReported(t *testing.T) {
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	// A session handed over for proxying without its chunk 1
+	chunks := requestChunks("gap", http.MethodPost, "http://127.0.0.1/", nil, []byte("sixteen bytes!!!"), 8)
+	session := &common.Session{
+		SessionID:   "gap",
+		Chunks:      map[int]*common.Chunk{2: chunks[1]},
+		TotalChunks: 2,
+		Complete:    true,
+	}
+	proxy.processCompleteSession(session)
+
+	_, _, report := downstream.waitForResponse(t, "gap")
+	if report == nil || report.Hop != "central-proxy" || !strings.Contains(report.Message, "chunk 1") {
+		t.Errorf("error report %+v, want the missing chunk named", report)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// protoTarget is a target answering with the protocol of the request
+func protoTarget(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(r.Proto))
+}
+
+// trustTarget makes proxy trust the certificate of a TLS test target
+func trustTarget(proxy *CentralProxy, target *httptest.Server) {
+	transport := proxy.client.Transport.(*http.Transport)
+	transport.TLSClientConfig = &tls.Config{RootCAs: target.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+}
+
+// negotiated proxies a GET to target and returns the protocol it saw
+func negotiated(t *testing.T, proxy *CentralProxy, downstream *recordingDownstream, session, target string) string {
+	t.Helper()
+	sendRequest(t, proxy, requestChunks(session, http.MethodGet, target, nil, nil, 8))
+	_, body, report := downstream.waitForResponse(t, session)
+	if report != nil {
+		t.Fatalf("error chunk: %v", report)
+	}
+	return string(body)
+}
+
+func TestHTTP2NegotiatedWithTLSTarget(t *testing.T) {
+	target := httptest.NewUnstartedServer(http.HandlerFunc(protoTarget))
+	target.EnableHTTP2 = true
+	target.StartTLS()
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+	trustTarget(proxy, target)
+
+	if proto := negotiated(t, proxy, downstream, "h2", target.URL); proto != "HTTP/2.0" {
+		t.Errorf("target saw %s, want HTTP/2.0", proto)
+	}
+}
+
+func TestHTTP2Disabled(t *testing.T) {
+	target := httptest.NewUnstartedServer(http.HandlerFunc(protoTarget))
+	target.EnableHTTP2 = true
+	target.StartTLS()
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "enable_http2: false\n"))
+	trustTarget(proxy, target)
+
+	if proto := negotiated(t, proxy, downstream, "h1", target.URL); proto != "HTTP/1.1" {
+		t.Errorf("target saw %s, want HTTP/1.1", proto)
+	}
+}
+
+func TestHTTP1OnlyTargetFallsBack(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(protoTarget))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+	trustTarget(proxy, target)
+
+	if proto := negotiated(t, proxy, downstream, "fallback", target.URL); proto != "HTTP/1.1" {
+		t.Errorf("target saw %s, want HTTP/1.1", proto)
+	}
+}
+
+func TestForceH2C(t *testing.T) {
+	target := httptest.NewUnstartedServer(http.HandlerFunc(protoTarget))
+	target.Config.Protocols = new(http.Protocols)
+	target.Config.Protocols.SetUnencryptedHTTP2(true)
+	target.Start()
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "force_h2c: true\n"))
+
+	if proto := negotiated(t, proxy, downstream, "h2c", target.URL); proto != "HTTP/2.0" {
+		t.Errorf("target saw %s, want HTTP/2.0", proto)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// redirectTarget redirects /hops/N to /hops/N-1 until /hops/0, and /loop
+// to /loop/back and back again
+func redirectTarget(t *testing.T) *httptest.Server {
+	t.Helper()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/loop":
+			http.Redirect(w, r, "/loop/back", http.StatusFound)
+		case r.URL.Path == "/loop/back":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case strings.HasPrefix(r.URL.Path, "/hops/"):
+			n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hops/"))
+			if n == 0 {
+				w.Write([]byte("landed"))
+				return
+			}
+			http.Redirect(w, r, "/hops/"+strconv.Itoa(n-1), http.StatusFound)
+		}
+	}))
+	t.Cleanup(target.Close)
+	return target
+}
+
+func TestRedirectNotFollowed(t *testing.T) {
+	target := redirectTarget(t)
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "redirects:\n  disabled: true\n"))
+
+	sendRequest(t, proxy, requestChunks("no-follow", http.MethodGet, target.URL+"/hops/1", nil, nil, 8))
+	meta, _, report := downstream.waitForResponse(t, "no-follow")
+	if report != nil {
+		t.Fatalf("error chunk: %v", report)
+	}
+	if meta.StatusCode != http.StatusFound || meta.Headers["Location"] != "/hops/0" {
+		t.Errorf("got status %d to %q, want the 302 to /hops/0", meta.StatusCode, meta.Headers["Location"])
+	}
+}
+
+func TestRedirectLimit(t *testing.T) {
+	target := redirectTarget(t)
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "redirects:\n  max: 2\n"))
+
+	sendRequest(t, proxy, requestChunks("within", http.MethodGet, target.URL+"/hops/2", nil, nil, 8))
+	meta, got, report := downstream.waitForResponse(t, "within")
+	if report != nil {
+		t.Fatalf("2 redirects: error chunk %v", report)
+	}
+	if string(got) != "landed" || meta.FinalURL != target.URL+"/hops/0" {
+		t.Errorf("2 redirects: got %q from %s", got, meta.FinalURL)
+	}
+
+	sendRequest(t, proxy, requestChunks("beyond", http.MethodGet, target.URL+"/hops/3", nil, nil, 8))
+	if _, _, report := downstream.waitForResponse(t, "beyond"); report == nil || !strings.Contains(report.Message, "stopped after 2 redirects") {
+		t.Errorf("3 redirects: got %v, want the limit reported", report)
+	}
+}
+
+func TestRedirectLoop(t *testing.T) {
+	target := redirectTarget(t)
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	sendRequest(t, proxy, requestChunks("loop", http.MethodGet, target.URL+"/loop", nil, nil, 8))
+	if _, _, report := downstream.waitForResponse(t, "loop"); report == nil || !strings.Contains(report.Message, "redirect loop") {
+		t.Errorf("got %v, want the loop reported", report)
+	}
+}
+
+func TestRedirectSameHost(t *testing.T) {
+	policy := redirectPolicy(RedirectConfig{Max: 10, SameHost: true})
+	first := httptest.NewRequest(http.MethodGet, "http://example.com/a", nil)
+
+	if err := policy(httptest.NewRequest(http.MethodGet, "http://example.com/b", nil), []*http.Request{first}); err != nil {
+		t.Errorf("same host redirect: %v", err)
+	}
+	if err := policy(httptest.NewRequest(http.MethodGet, "http://elsewhere.net/", nil), []*http.Request{first}); err != http.ErrUseLastResponse {
+		t.Errorf("other host redirect: got %v, want the 3xx returned", err)
+	}
+}
+
+func TestFinalURLReported(t *testing.T) {
+	target := redirectTarget(t)
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	for _, tc := range []struct {
+		session, path, final string
+	}{
+		{"redirected", "/hops/1", "/hops/0"},
+		{"direct", "/hops/0", "/hops/0"},
+	} {
+		sendRequest(t, proxy, requestChunks(tc.session, http.MethodGet, target.URL+tc.path, nil, nil, 8))
+		meta, _, report := downstream.waitForResponse(t, tc.session)
+		if report != nil {
+			t.Fatalf("%s: error chunk %v", tc.path, report)
+		}
+		if meta.FinalURL != target.URL+tc.final {
+			t.Errorf("%s: final URL %q, want %q", tc.path, meta.FinalURL, target.URL+tc.final)
+		}
+	}
+}
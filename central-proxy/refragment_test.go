@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+func TestOversizedRequestChunkResplitDownstream(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "response_chunk_size: 16\n"))
+
+	// The client sent the whole body as one chunk, four times the size
+	// the downstream servers get
+	body := bytes.Repeat([]byte("0123456789abcdef"), 4)
+	sendRequest(t, proxy, requestChunks("oversized", http.MethodPost, target.URL, nil, body, len(body)))
+
+	_, got, report := downstream.waitForResponse(t, "oversized")
+	if report != nil {
+		t.Fatalf("error chunk: %v", report)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("reassembled %q, want %q", got, body)
+	}
+
+	var data int
+	for _, chunk := range downstream.received("oversized") {
+		if chunk.IsControl() {
+			continue
+		}
+		data++
+		if len(chunk.Data) > 16 {
+			t.Errorf("chunk %d carries %d bytes, over response_chunk_size", chunk.SequenceNum, len(chunk.Data))
+		}
+	}
+	if data != 4 {
+		t.Errorf("got %d data chunks, want 4", data)
+	}
+}
+
+func TestLongEventSplitIntoChunkSize(t *testing.T) {
+	event := "data: " + strings.Repeat("x", 50) + "\n\n"
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, event)
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "response_chunk_size: 16\n"))
+
+	sendRequest(t, proxy, requestChunks("long", http.MethodGet, target.URL, nil, nil, 8))
+	chunks := downstream.waitFor(t, "long", func(chunks []*common.Chunk) bool {
+		_, ended := streamedEvents(t, chunks)
+		return ended
+	})
+
+	for _, chunk := range chunks {
+		if chunk.IsStream() && len(chunk.Data) > 16 {
+			t.Errorf("stream chunk %d carries %d bytes, over response_chunk_size", chunk.SequenceNum, len(chunk.Data))
+		}
+	}
+	if events, _ := streamedEvents(t, chunks); strings.Join(events, "") != event {
+		t.Errorf("streamed %q, want the event whole", events)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// ExitConfig is one way of reaching targets
+type ExitConfig struct {
+	Mode         string            `yaml:"mode"`           // "direct" (default) or "socks5"
+	SOCKS5       string            `yaml:"socks5_address"` // host:port of the SOCKS5 proxy in socks5 mode
+	Headers      map[string]string `yaml:"headers"`        // set on every request through this exit
+	StripHeaders []string          `yaml:"strip_headers"`  // removed from every request through this exit
+}
+
+// RouteRule sends matching requests through a named exit. A rule with both
+// a URL pattern and a content type needs both to match.
+type RouteRule struct {
+	URLPattern  string `yaml:"url_pattern"`  // regexp matched against the target URL
+	ContentType string `yaml:"content_type"` // media type prefix, e.g. "video/"
+	Exit        string `yaml:"exit"`
+}
+
+// validateRouting reports problems with exits and routes
+func (c CentralConfig) validateRouting() []error {
+	var errs []error
+
+	for name, exit := range c.Exits {
+		switch exit.Mode {
+		case "", "direct":
+		case "socks5":
+			if exit.SOCKS5 == "" {
+				errs = append(errs, fmt.Errorf("exit %q: socks5_address is required in socks5 mode", name))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("exit %q: unknown mode %q", name, exit.Mode))
+		}
+	}
+
+	for i, rule := range c.Routes {
+		if rule.URLPattern == "" && rule.ContentType == "" {
+			errs = append(errs, fmt.Errorf("route %d: url_pattern or content_type is required", i))
+		}
+		if rule.URLPattern != "" {
+			if _, err := regexp.Compile(rule.URLPattern); err != nil {
+				errs = append(errs, fmt.Errorf("route %d: invalid url_pattern: %w", i, err))
+			}
+		}
+		if _, exists := c.Exits[rule.Exit]; !exists {
+			errs = append(errs, fmt.Errorf("route %d: unknown exit %q", i, rule.Exit))
+		}
+	}
+
+	return errs
+}
+
+// exit is a configured exit ready for use
+type exit struct {
+	name   string
+	config ExitConfig
+	client *http.Client // nil to use the proxy's own client
+}
+
+// apply rewrites the request's headers for this exit
+func (e *exit) apply(req *http.Request) {
+	for _, h := range e.config.StripHeaders {
+		req.Header.Del(h)
+	}
+	for k, v := range e.config.Headers {
+		req.Header.Set(k, v)
+	}
+}
+
+// route is a compiled RouteRule
+type route struct {
+	pattern     *regexp.Regexp
+	contentType string
+	exit        *exit
+}
+
+// router picks the exit for each target request. The target's response
+// Content-Type is unknown until an exit has been used, so content_type rules
+// match the media types the request declares in Content-Type and Accept.
+type router struct {
+	routes []route
+}
+
+// newRouter compiles the routing config. Socks5 exits get their own client
+// built on a clone of base.
+func newRouter(config CentralConfig, base *http.Transport) (*router, error) {
+	exits := make(map[string]*exit)
+	for name, exitConfig := range config.Exits {
+		e := &exit{name: name, config: exitConfig}
+
+		if exitConfig.Mode == "socks5" {
+			// The SOCKS5 proxy resolves and dials targets itself, so only
+			// literal IP targets are subject to destination filtering
+			transport := base.Clone()
+			transport.DialContext = common.NewDialer(config.Timeouts).DialContext
+			transport.Proxy = http.ProxyURL(&url.URL{Scheme: "socks5", Host: exitConfig.SOCKS5})
+			e.client = &http.Client{
+				Transport:     transport,
+				CheckRedirect: redirectPolicy(config.Redirects),
+			}
+		}
+
+		exits[name] = e
+	}
+
+	r := &router{}
+	for _, rule := range config.Routes {
+		e, exists := exits[rule.Exit]
+		if !exists {
+			return nil, errors.New("unknown exit " + rule.Exit)
+		}
+
+		var pattern *regexp.Regexp
+		if rule.URLPattern != "" {
+			var err error
+			if pattern, err = regexp.Compile(rule.URLPattern); err != nil {
+				return nil, err
+			}
+		}
+
+		r.routes = append(r.routes, route{
+			pattern:     pattern,
+			contentType: strings.ToLower(rule.ContentType),
+			exit:        e,
+		})
+	}
+
+	return r, nil
+}
+
+// Select returns the exit of the first matching rule, or nil to go direct
+// with the default header policy
+func (r *router) Select(req *http.Request) *exit {
+	for _, rt := range r.routes {
+		if rt.pattern != nil && !rt.pattern.MatchString(req.URL.String()) {
+			continue
+		}
+		if rt.contentType != "" && !declaresMediaType(req, rt.contentType) {
+			continue
+		}
+		return rt.exit
+	}
+	return nil
+}
+
+// declaresMediaType reports whether the request's Content-Type or any of
+// its Accept entries starts with prefix
+func declaresMediaType(req *http.Request, prefix string) bool {
+	values := []string{req.Header.Get("Content-Type")}
+	values = append(values, strings.Split(req.Header.Get("Accept"), ",")...)
+
+	for _, v := range values {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// routingConfig has a tagging exit for /video/ URLs and video requests, and
+// a socks5 exit for .onion hosts
+const routingConfig = `
+exits:
+  tagged:
+    headers: {X-Exit: tagged}
+    strip_headers: [X-Secret]
+  tunnel:
+    mode: socks5
+    socks5_address: 127.0.0.1:1080
+routes:
+  - url_pattern: "/video/"
+    exit: tagged
+  - content_type: "video/"
+    exit: tagged
+  - url_pattern: "\\.onion/"
+    content_type: "text/"
+    exit: tunnel
+`
+
+func TestRouterSelect(t *testing.T) {
+	proxy := newTestCentral(t, centralConfig("d:1", routingConfig))
+
+	tests := []struct {
+		url    string
+		accept string
+		want   string
+	}{
+		{"http://example.com/video/1", "", "tagged"},
+		{"http://example.com/page", "video/mp4, */*", "tagged"},
+		{"http://hidden.onion/", "text/html", "tunnel"},
+		{"http://hidden.onion/", "image/png", ""},
+		{"http://example.com/page", "text/html", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+
+		got := ""
+		if exit := proxy.router.Select(req); exit != nil {
+			got = exit.name
+		}
+		if got != tt.want {
+			t.Errorf("%s with Accept %q: exit %q, want %q", tt.url, tt.accept, got, tt.want)
+		}
+	}
+
+	tunnel := proxy.router.routes[2].exit
+	if tunnel.client == nil || tunnel.client.Transport.(*http.Transport).Proxy == nil {
+		t.Error("socks5 exit has no proxied client of its own")
+	}
+}
+
+func TestRoutedExitHeaderPolicy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Exit") + "|" + r.Header.Get("X-Secret")))
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), routingConfig))
+	headers := map[string]string{"X-Secret": "s3cret"}
+
+	sendRequest(t, proxy, requestChunks("routed", http.MethodGet, target.URL+"/video/1", headers, nil, 8))
+	if _, got, _ := downstream.waitForResponse(t, "routed"); string(got) != "tagged|" {
+		t.Errorf("matching URL: target saw %q, want the tagged exit's headers", got)
+	}
+
+	sendRequest(t, proxy, requestChunks("direct", http.MethodGet, target.URL+"/page", headers, nil, 8))
+	if _, got, _ := downstream.waitForResponse(t, "direct"); string(got) != "|s3cret" {
+		t.Errorf("other URL: target saw %q, want it sent direct and unchanged", got)
+	}
+}
+
+func TestInvalidRouting(t *testing.T) {
+	tests := []struct {
+		extra string
+		want  string
+	}{
+		{"exits:\n  e: {mode: carrier-pigeon}\n", `exit "e": unknown mode`},
+		{"exits:\n  e: {mode: socks5}\n", "socks5_address is required"},
+		{"exits:\n  e: {}\nroutes:\n  - exit: e\n", "url_pattern or content_type is required"},
+		{"exits:\n  e: {}\nroutes:\n  - {url_pattern: \"(\", exit: e}\n", "invalid url_pattern"},
+		{"routes:\n  - {url_pattern: x, exit: nowhere}\n", `unknown exit "nowhere"`},
+	}
+	for _, tt := range tests {
+		_, err := loadCentralConfig(writeConfig(t, centralConfig("d:1", tt.extra)))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.extra, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTargetSchemeAllowlist(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+	// Trusts the target's certificate; plain HTTP to the downstream still works
+	proxy.SetTransport(target.Client().Transport)
+
+	sendRequest(t, proxy, requestChunks("https", http.MethodGet, target.URL, nil, nil, 8))
+	if _, body, report := downstream.waitForResponse(t, "https"); report != nil || string(body) != "secure" {
+		t.Errorf("https target: got %q, %v", body, report)
+	}
+
+	for session, blocked := range map[string]string{"file": "file:///etc/passwd", "ftp": "ftp://127.0.0.1/"} {
+		sendRequest(t, proxy, requestChunks(session, http.MethodGet, blocked, nil, nil, 8))
+		_, _, report := downstream.waitForResponse(t, session)
+		if report == nil || report.Code != http.StatusForbidden || !strings.Contains(report.Message, "scheme") {
+			t.Errorf("%s: got %+v, want a 403 naming the scheme", blocked, report)
+		}
+	}
+}
+
+func TestConfiguredSchemesReplaceDefaults(t *testing.T) {
+	downstream := newRecordingDownstream(t)
+	// Appended under destinations, the last section of centralConfig
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "  schemes: [\"https\"]\n"))
+
+	sendRequest(t, proxy, requestChunks("plain", http.MethodGet, "http://127.0.0.1/", nil, nil, 8))
+	if _, _, report := downstream.waitForResponse(t, "plain"); report == nil || report.Code != http.StatusForbidden {
+		t.Errorf("http with only https allowed: got %+v, want a 403", report)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// SessionStore keeps the chunks of sessions still being reassembled, so a
+// restarted central proxy can pick up where it left off instead of waiting
+// for clients to resend everything. Implementations must be safe for
+// concurrent use.
+type SessionStore interface {
+	// Save records a chunk accepted for its session
+	Save(chunk *common.Chunk) error
+	// Delete forgets every chunk of a session
+	Delete(sessionID string) error
+	// Load returns the chunks of every stored session
+	Load() ([]*common.Chunk, error)
+}
+
+// fileSessionStore is a SessionStore keeping one file per session in a
+// directory, with a chunk per line in the JSON chunk encoding
+type fileSessionStore struct {
+	dir string
+}
+
+// newFileSessionStore returns a store in dir, creating the directory if
+// needed
+func newFileSessionStore(dir string) (*fileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("session store: %w", err)
+	}
+	return &fileSessionStore{dir: dir}, nil
+}
+
+// path names a session's file. Session IDs are arbitrary bytes, so the
+// name is their hex encoding.
+func (s *fileSessionStore) path(sessionID string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(sessionID))+".chunks")
+}
+
+// Save appends the chunk to its session's file and syncs it, along with
+// the directory when the file is new, so an accepted chunk survives a crash
+func (s *fileSessionStore) Save(chunk *common.Chunk) error {
+	data, err := common.SerializeChunk(chunk)
+	if err != nil {
+		return err
+	}
+
+	path := s.path(chunk.SessionID)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	created := errors.Is(err, os.ErrNotExist)
+	if created {
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if created {
+		return s.syncDir()
+	}
+	return nil
+}
+
+func (s *fileSessionStore) Delete(sessionID string) error {
+	err := os.Remove(s.path(sessionID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.syncDir()
+}
+
+// syncDir makes file creations and removals in the store durable
+func (s *fileSessionStore) syncDir() error {
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Load reads every session file. A line that doesn't decode, such as one
+// cut short by a crash, is skipped; the client resends that chunk.
+func (s *fileSessionStore) Load() ([]*common.Chunk, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []*common.Chunk
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".chunks") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			chunk, err := common.DeserializeChunk(line)
+			if err != nil {
+				log.Printf("Skipping unreadable chunk in %s: %v", entry.Name(), err)
+				continue
+			}
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks, nil
+}
+
+// storeQueue applies session store writes on its own goroutine, in the
+// order they were queued, so no file I/O happens under the proxy's lock.
+// Writes are queued under that lock, so a session's chunks are always saved
+// before it is deleted.
+type storeQueue struct {
+	store SessionStore
+	wake  chan struct{}
+
+	mu  sync.Mutex
+	ops []storeOp
+}
+
+// storeOp is one queued write: a chunk to save, or a session to delete
+// when chunk is nil. done, if set, is closed once the queue reaches it.
+type storeOp struct {
+	chunk     *common.Chunk
+	sessionID string
+	done      chan struct{}
+}
+
+func newStoreQueue(store SessionStore) *storeQueue {
+	q := &storeQueue{
+		store: store,
+		wake:  make(chan struct{}, 1),
+	}
+	go q.run()
+	return q
+}
+
+func (q *storeQueue) push(op storeOp) {
+	q.mu.Lock()
+	q.ops = append(q.ops, op)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default: // already woken
+	}
+}
+
+func (q *storeQueue) run() {
+	for range q.wake {
+		for {
+			q.mu.Lock()
+			ops := q.ops
+			q.ops = nil
+			q.mu.Unlock()
+
+			if len(ops) == 0 {
+				break
+			}
+			for _, op := range ops {
+				q.apply(op)
+			}
+		}
+	}
+}
+
+func (q *storeQueue) apply(op storeOp) {
+	switch {
+	case op.done != nil:
+		close(op.done)
+	case op.chunk != nil:
+		if err := q.store.Save(op.chunk); err != nil {
+			log.Printf("Failed to store chunk %d of session %s: %v", op.chunk.SequenceNum, op.chunk.SessionID, err)
+		}
+	default:
+		if err := q.store.Delete(op.sessionID); err != nil {
+			log.Printf("Failed to remove stored session %s: %v", op.sessionID, err)
+		}
+	}
+}
+
+// Flush waits until every write queued so far is applied
+func (q *storeQueue) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	q.push(storeOp{done: done})
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// persistChunk queues an accepted chunk for the store, sealed with the hop
+// key when hop encryption is enabled so request data isn't left on disk in
+// the clear. A chunk that can't be stored is still accepted; it just won't
+// survive a restart. The caller holds mu, so a session is never saved
+// after it was deleted.
+func (p *CentralProxy) persistChunk(chunk *common.Chunk) {
+	if p.store == nil {
+		return
+	}
+
+	stored := *chunk
+	if p.config.Encryption.Enabled {
+		if err := p.keys.EncryptChunk(&stored); err != nil {
+			log.Printf("Not storing chunk %d of session %s: %v", chunk.SequenceNum, chunk.SessionID, err)
+			return
+		}
+	}
+	p.store.push(storeOp{chunk: &stored})
+}
+
+// forgetSession queues the removal of a session from the store once it is
+// complete or dropped. The caller holds mu.
+func (p *CentralProxy) forgetSession(sessionID string) {
+	if p.store == nil {
+		return
+	}
+	p.store.push(storeOp{sessionID: sessionID})
+}
+
+// restoreSessions replays the stored chunks into their sessions. Their
+// clients resend whatever else is missing as usual. Sessions using session
+// keys need a configured session_keys.private_key to be restored, since a
+// generated one doesn't survive the restart.
+func (p *CentralProxy) restoreSessions() error {
+	if p.store == nil {
+		return nil
+	}
+
+	chunks, err := p.store.store.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load stored sessions: %w", err)
+	}
+
+	stored := make(map[string]bool)
+	for _, chunk := range chunks {
+		stored[chunk.SessionID] = true
+		if p.config.Encryption.Enabled {
+			if err := p.keys.DecryptChunk(chunk); err != nil {
+				log.Printf("Dropping stored chunk %d of session %s: %v", chunk.SequenceNum, chunk.SessionID, err)
+				continue
+			}
+		}
+		if err := p.addChunk(chunk, false); err != nil && !errors.Is(err, errLateChunk) {
+			log.Printf("Dropping stored chunk %d of session %s: %v", chunk.SequenceNum, chunk.SessionID, err)
+		}
+	}
+
+	// Nothing came back of some sessions, so their files are of no use
+	p.mu.Lock()
+	restored := len(p.sessions)
+	for sessionID := range stored {
+		if _, exists := p.sessions[sessionID]; !exists {
+			p.forgetSession(sessionID)
+		}
+	}
+	p.mu.Unlock()
+	if restored > 0 {
+		log.Printf("Restored %d sessions from %s", restored, p.config.SessionStoreDir)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRestartResumesStoredSession(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	config := centralConfig(downstream.addr(), "session_store_dir: "+t.TempDir()+"\n")
+	chunks := requestChunks("resumed", http.MethodPost, target.URL, nil, []byte("thirty-two bytes of request body"), 8)
+
+	// The first run gets half the request before it stops
+	before := newTestCentral(t, config)
+	sendRequest(t, before, chunks[:2])
+	if err := before.store.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	after := newTestCentral(t, config)
+	if after.sessionCount() != 1 {
+		t.Fatalf("%d sessions restored, want 1", after.sessionCount())
+	}
+	sendRequest(t, after, chunks[2:])
+
+	_, body, report := downstream.waitForResponse(t, "resumed")
+	if report != nil {
+		t.Fatalf("error chunk: %v", report)
+	}
+	if string(body) != "thirty-two bytes of request body" {
+		t.Errorf("target got %q, want the whole body", body)
+	}
+}
+
+func TestFileSessionStore(t *testing.T) {
+	store, err := newFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chunk := range requestChunks("a/b", http.MethodPost, "http://target/", nil, []byte("sixteen bytes!!!"), 8) {
+		if err := store.Save(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A line cut short by a crash is skipped
+	f, err := os.OpenFile(store.path("a/b"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"session_id": "a/b", "seq`))
+	f.Close()
+
+	chunks, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 || chunks[0].SessionID != "a/b" || string(chunks[1].Data) != "bytes!!!" {
+		t.Errorf("loaded %d chunks, want the 2 saved", len(chunks))
+	}
+
+	if err := store.Delete("a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if chunks, _ := store.Load(); len(chunks) != 0 {
+		t.Errorf("%d chunks left after Delete", len(chunks))
+	}
+	if err := store.Delete("unknown"); err != nil {
+		t.Errorf("deleting an unknown session: %v", err)
+	}
+}
+
+// Stored chunks are sealed with the hop key like chunks on the wire
+func TestStoredChunksEncrypted(t *testing.T) {
+	proxy := newTestCentral(t, `
+listen_port: 8080
+downstream_servers: ["127.0.0.1:1"]
+session_store_dir: `+t.TempDir()+`
+encryption:
+  enabled: true
+  encryption_key_hex: "`+strings.Repeat("ab", 32)+`"
+`)
+
+	// The first of two chunks, so the session stays stored
+	chunk := requestChunks("sealed", http.MethodPost, "http://target/", nil, []byte("secret request body"), 10)[0]
+	sealed := *chunk
+	if err := proxy.keys.EncryptChunk(&sealed); err != nil {
+		t.Fatal(err)
+	}
+	if rec := postChunk(t, proxy, &sealed); rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if err := proxy.store.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := proxy.store.store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || bytes.Equal(stored[0].Data, chunk.Data) || stored[0].KeyID == "" {
+		t.Fatalf("stored %+v, want the chunk sealed", stored)
+	}
+	if err := proxy.keys.DecryptChunk(stored[0]); err != nil || !bytes.Equal(stored[0].Data, chunk.Data) {
+		t.Errorf("stored chunk decrypts to %q, %v", stored[0].Data, err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// isEventStream reports whether a target response is a Server-Sent Events
+// stream, which stays open and can't be read in full
+func isEventStream(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// isChunked reports whether a target response uses chunked transfer
+// encoding, so its body is sent as it is produced. With stream_chunked such
+// responses are relayed piece by piece instead of read in full.
+func isChunked(resp *http.Response) bool {
+	return slices.Contains(resp.TransferEncoding, "chunked")
+}
+
+// streamBody is a streamed response body that releases its request context
+// when closed
+type streamBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *streamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// streamResponse relays a streamed response as it arrives. A control chunk
+// announces the stream, the body follows as stream chunks, an event or a
+// piece of a chunked body at a time, and a final stream chunk marks the
+// end, carrying the target's trailers if it sent any. Everything goes
+// through the one downstream balance_policy picks for the session's first
+// chunk, so it reaches the client in order.
+func (p *CentralProxy) streamResponse(session *common.Session, target *targetResponse) error {
+	defer target.Stream.Close()
+
+	// Registered so the kill switch can close it
+	p.mu.Lock()
+	p.streams[session.SessionID] = target.Stream
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.streams, session.SessionID)
+		p.mu.Unlock()
+	}()
+	if p.killSwitch.Engaged() {
+		return common.ErrKillSwitchEngaged
+	}
+
+	meta := &common.ResponseMeta{
+		StatusCode:    target.StatusCode,
+		Headers:       common.FlattenHeaders(target.Headers),
+		ContentLength: -1,
+		Stream:        true,
+		FinalURL:      target.FinalURL,
+	}
+	downstreamURL := p.balancer.Pick(session.SessionID, 0, 1)[0]
+	defer p.balancer.Done(downstreamURL)
+
+	if err := p.sendControl(session, meta, 1, downstreamURL); err != nil {
+		return fmt.Errorf("failed to send stream metadata: %w", err)
+	}
+
+	// Closing the body from the timer unblocks the read in next
+	idleTimeout := time.Duration(p.config.StreamIdleTimeout) * time.Millisecond
+	idle := time.AfterFunc(idleTimeout, func() { target.Stream.Close() })
+	defer idle.Stop()
+	body := &idleReader{Reader: target.Stream, idle: idle, timeout: idleTimeout}
+
+	next := readPieces(body, p.config.ResponseChunkSize)
+	if isEventStream(target.Headers) {
+		next = readEvents(body, p.config.ResponseChunkSize)
+	}
+
+	throttle := p.sessionThrottle()
+	seq := 0
+	for {
+		data, err := next()
+		// A full buffer on top of earlier lines can take an event past the
+		// chunk size, so it is split to keep every stream chunk within it
+		if len(data) > 0 {
+			for _, piece := range common.SplitData(data, p.config.ResponseChunkSize) {
+				seq++
+				if err := p.sendStreamChunk(session, downstreamURL, throttle, seq, 0, piece); err != nil {
+					return fmt.Errorf("failed to send stream chunk %d: %w", seq, err)
+				}
+			}
+		}
+
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("Stream for session %s ended: %v", session.SessionID, err)
+			}
+			break
+		}
+	}
+
+	log.Printf("Stream for session %s closed after %d chunks", session.SessionID, seq)
+
+	// Trailers are only known once the body was read to the end
+	var end []byte
+	if trailers := common.FlattenTrailers(target.Trailers); trailers != nil {
+		var err error
+		end, err = common.EncodeResponseMeta(&common.ResponseMeta{
+			StatusCode:    target.StatusCode,
+			ContentLength: -1,
+			Stream:        true,
+			Trailers:      trailers,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode trailers: %w", err)
+		}
+	}
+
+	seq++
+	return p.sendStreamChunk(session, downstreamURL, throttle, seq, seq, end)
+}
+
+// idleReader restarts the idle timer of a stream whenever data arrives
+type idleReader struct {
+	io.Reader
+	idle    *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.idle.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// readEvents returns a function that reads the next Server-Sent Event from
+// r, along with the error that ended the stream if it did. A blank line
+// ends an event; events longer than size come out in pieces.
+func readEvents(r io.Reader, size int) func() ([]byte, error) {
+	reader := bufio.NewReaderSize(r, size)
+	return func() ([]byte, error) {
+		var event []byte
+		for {
+			line, err := reader.ReadSlice('\n')
+			event = append(event, line...)
+			if errors.Is(err, bufio.ErrBufferFull) {
+				err = nil // part of a long line, sent once the event is big enough
+			}
+
+			blank := len(line) > 0 && len(bytes.TrimRight(line, "\r\n")) == 0
+			if blank || len(event) >= size || err != nil {
+				return event, err
+			}
+		}
+	}
+}
+
+// readPieces returns a function that reads whatever part of a chunked body
+// has arrived, up to size bytes, along with the error that ended the body
+// if it did
+func readPieces(r io.Reader, size int) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		buf := make([]byte, size)
+		n, err := r.Read(buf)
+		return buf[:n], err
+	}
+}
+
+// sendStreamChunk paces, compresses, seals and sends one piece of a
+// streamed response through downstreamURL like a chunk of a buffered one;
+// total is zero except on the final chunk
+func (p *CentralProxy) sendStreamChunk(session *common.Session, downstreamURL string, throttle *common.TokenBucket, seq, total int, data []byte) error {
+	if throttle != nil {
+		throttle.Wait(len(data))
+	}
+
+	chunk := &common.Chunk{
+		SessionID:    session.SessionID,
+		SequenceNum:  seq,
+		TotalChunks:  total,
+		ChunkType:    common.ChunkTypeStream,
+		Data:         data,
+		Timestamp:    time.Now(),
+		SourceClient: session.Chunks[1].SourceClient,
+	}
+
+	if p.compressor != nil && len(data) > 0 {
+		if err := p.compressor.Compress(chunk); err != nil {
+			return fmt.Errorf("compression error: %w", err)
+		}
+	}
+
+	if err := p.seal(session, chunk); err != nil {
+		return err
+	}
+
+	return p.sendToDownstream(chunk, downstreamURL)
+}
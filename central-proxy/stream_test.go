@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// streamedEvents returns the events of the stream chunks among chunks, in
+// the order they were numbered, and whether the final chunk has arrived
+func streamedEvents(t *testing.T, chunks []*common.Chunk) ([]string, bool) {
+	t.Helper()
+	events := make(map[int]string)
+	ended := false
+	for _, chunk := range chunks {
+		if !chunk.IsStream() {
+			continue
+		}
+		if chunk.IsStreamEnd() {
+			ended = true
+			continue
+		}
+		data, err := common.Decompress(chunk.Compression, chunk.Data, common.DefaultMaxChunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events[chunk.SequenceNum] = string(data)
+	}
+
+	var ordered []string
+	for i := 1; i <= len(events); i++ {
+		ordered = append(ordered, events[i])
+	}
+	return ordered, ended
+}
+
+func TestEventStreamForwardedIncrementally(t *testing.T) {
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: one\n\n")
+		w.(http.Flusher).Flush()
+
+		// The second event waits until the first was seen downstream
+		<-release
+		fmt.Fprint(w, "data: two\n\n")
+	}))
+	defer target.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	sendRequest(t, proxy, requestChunks("sse", http.MethodGet, target.URL, nil, nil, 8))
+
+	chunks := downstream.waitFor(t, "sse", func(chunks []*common.Chunk) bool {
+		events, _ := streamedEvents(t, chunks)
+		return len(events) > 0
+	})
+	var meta *common.ResponseMeta
+	for _, chunk := range chunks {
+		if chunk.IsControl() {
+			var err error
+			if meta, err = common.DecodeResponseMeta(chunk.Data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if meta == nil || !meta.Stream {
+		t.Fatalf("control chunk %+v, want the stream announced", meta)
+	}
+	if events, ended := streamedEvents(t, chunks); events[0] != "data: one\n\n" || ended {
+		t.Fatalf("before the second event: %q, ended %v", events, ended)
+	}
+
+	close(release)
+	chunks = downstream.waitFor(t, "sse", func(chunks []*common.Chunk) bool {
+		_, ended := streamedEvents(t, chunks)
+		return ended
+	})
+	if events, _ := streamedEvents(t, chunks); strings.Join(events, "") != "data: one\n\ndata: two\n\n" {
+		t.Errorf("streamed %q, want both events in order", events)
+	}
+}
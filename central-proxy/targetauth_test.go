@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+func TestTargetAuthAppliedAtTarget(t *testing.T) {
+	seen := make(chan http.Header, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Clone()
+	}))
+	defer target.Close()
+
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "session_keys:\n  enabled: true\n"))
+
+	data, key, err := common.NewClientHandshake("auth", proxy.agreement.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := requestChunks("auth", http.MethodGet, target.URL, map[string]string{"X-Visible": "yes"}, nil, 8)
+	for _, chunk := range chunks {
+		if chunk.Data, err = common.EncryptAESWithAAD(chunk.Data, key, chunk.AAD()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := common.SealTargetAuth(chunks[0], key, "Bearer secret-token"); err != nil {
+		t.Fatal(err)
+	}
+	handshake := &common.Chunk{
+		SessionID:    "auth",
+		SequenceNum:  common.HandshakeSequence,
+		TotalChunks:  len(chunks),
+		ChunkType:    common.ChunkTypeHandshake,
+		Data:         data,
+		Timestamp:    time.Now(),
+		SourceClient: "client:7000",
+		TargetURL:    target.URL,
+		Method:       http.MethodGet,
+	}
+
+	// What the upstream relays holds the credential only sealed
+	for _, chunk := range append([]*common.Chunk{handshake}, chunks...) {
+		encoded, _ := proxy.codec.Encode(chunk)
+		if bytes.Contains(encoded, []byte("secret-token")) {
+			t.Errorf("chunk %d shows the credential in transit", chunk.SequenceNum)
+		}
+	}
+
+	sendRequest(t, proxy, append([]*common.Chunk{handshake}, chunks...))
+	select {
+	case header := <-seen:
+		if header.Get("Authorization") != "Bearer secret-token" || header.Get("X-Visible") != "yes" {
+			t.Errorf("target saw Authorization %q and X-Visible %q", header.Get("Authorization"), header.Get("X-Visible"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("target never reached")
+	}
+}
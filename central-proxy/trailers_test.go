@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// trailerTarget answers with a chunked body in two flushes followed by an
+// X-Checksum trailer
+func trailerTarget(t *testing.T) *httptest.Server {
+	t.Helper()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum, X-Never-Sent")
+		w.Write([]byte("first "))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("second"))
+		w.Header().Set("X-Checksum", "abc123")
+	}))
+	t.Cleanup(target.Close)
+	return target
+}
+
+func TestTrailersForwardedInControlChunk(t *testing.T) {
+	target := trailerTarget(t)
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), ""))
+
+	sendRequest(t, proxy, requestChunks("trailers", http.MethodGet, target.URL, nil, nil, 8))
+
+	meta, body, report := downstream.waitForResponse(t, "trailers")
+	if report != nil {
+		t.Fatalf("error chunk: %+v", report)
+	}
+	if string(body) != "first second" {
+		t.Errorf("body %q, want both writes", body)
+	}
+	if got := meta.Trailers["X-Checksum"]; got != "abc123" {
+		t.Errorf("trailers %v, want X-Checksum abc123", meta.Trailers)
+	}
+	if _, ok := meta.Trailers["X-Never-Sent"]; ok {
+		t.Errorf("trailers %v include one announced but not sent", meta.Trailers)
+	}
+}
+
+func TestChunkedResponseStreamedWithTrailers(t *testing.T) {
+	target := trailerTarget(t)
+	downstream := newRecordingDownstream(t)
+	proxy := newTestCentral(t, centralConfig(downstream.addr(), "stream_chunked: true\n"))
+
+	sendRequest(t, proxy, requestChunks("chunked", http.MethodGet, target.URL, nil, nil, 8))
+
+	chunks := downstream.waitFor(t, "chunked", func(chunks []*common.Chunk) bool {
+		_, ended := streamedEvents(t, chunks)
+		return ended
+	})
+	var announced, end *common.ResponseMeta
+	for _, chunk := range chunks {
+		switch {
+		case chunk.IsControl():
+			var err error
+			if announced, err = common.DecodeResponseMeta(chunk.Data); err != nil {
+				t.Fatal(err)
+			}
+		case chunk.IsStreamEnd():
+			data, err := common.Decompress(chunk.Compression, chunk.Data, common.DefaultMaxChunkSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if end, err = common.DecodeResponseMeta(data); err != nil {
+				t.Fatalf("last chunk %q: %v", data, err)
+			}
+		}
+	}
+	if announced == nil || !announced.Stream {
+		t.Fatalf("control chunk %+v, want the stream announced", announced)
+	}
+	if events, _ := streamedEvents(t, chunks); len(events) == 0 {
+		t.Error("no data streamed")
+	}
+	if end == nil || end.Trailers["X-Checksum"] != "abc123" {
+		t.Errorf("last chunk %+v, want the X-Checksum trailer", end)
+	}
+}
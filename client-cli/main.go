@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dudelovecamera/proxy-system/client"
+	"github.com/dudelovecamera/proxy-system/common"
 )
 
 func main() {
@@ -19,21 +28,29 @@ func main() {
 	url := flag.String("url", "", "Target URL")
 	data := flag.String("data", "", "Request body data (for POST/PUT)")
 	dataFile := flag.String("data-file", "", "File containing request body")
-	header := flag.String("H", "", "Header in format 'Key: Value' (can be used multiple times)")
+	outputFile := flag.String("o", "", "Write the response body to this file instead of stdout")
+	resume := flag.Bool("continue", false, "Resume an incomplete -o download with a Range request for the missing bytes")
+	var headerValues headerFlags
+	flag.Var(&headerValues, "H", "Header in format 'Key: Value' (can be used multiple times)")
+	basicAuth := flag.String("u", "", "Target credentials as 'user:password', sent sealed to the central proxy (needs session_keys)")
+	bearerToken := flag.String("bearer", "", "Bearer token for the target, sent sealed to the central proxy (needs session_keys)")
 	verbose := flag.Bool("v", false, "Verbose output")
 	interactive := flag.Bool("i", false, "Interactive mode")
+	bench := flag.Bool("bench", false, "Benchmark mode: send -n requests to -url")
+	benchRequests := flag.Int("n", 100, "Number of requests in benchmark mode")
+	benchConcurrency := flag.Int("c", 10, "Concurrent requests in benchmark mode")
+	check := flag.Bool("check", false, "Validate the config file and exit")
 
 	flag.Parse()
 
-	// Parse headers
-	headers := make(map[string]string)
-	if *header != "" {
-		parts := strings.SplitN(*header, ":", 2)
-		if len(parts) == 2 {
-			headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
-		}
+	if *check {
+		_, err := client.LoadClientConfig(*configPath)
+		common.ReportConfigCheck(*configPath, err)
 	}
 
+	// Parse headers
+	headers := parseHeaders(headerValues)
+
 	// Initialize client
 	proxyClient, err := client.NewProxyClient(*configPath)
 	if err != nil {
@@ -56,7 +73,7 @@ func main() {
 
 	// Interactive mode
 	if *interactive {
-		runInteractive(proxyClient, *verbose)
+		runInteractive(proxyClient, bufio.NewScanner(os.Stdin), *verbose)
 		return
 	}
 
@@ -78,6 +95,16 @@ func main() {
 		body = []byte(*data)
 	}
 
+	// Benchmark mode
+	if *bench {
+		stats := runBenchmark(proxyClient, *method, *url, body, headers, *benchRequests, *benchConcurrency)
+		printBenchStats(stats)
+		if stats.Errors > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Make request
 	if *verbose {
 		log.Printf("Making %s request to %s", *method, *url)
@@ -86,18 +113,50 @@ func main() {
 		}
 	}
 
+	// Downloads keep what arrived on timeout, and -continue asks only for
+	// the bytes after what is already saved
+	opts := client.RequestOptions{AllowPartial: *outputFile != ""}
+	if *basicAuth != "" {
+		username, password, _ := strings.Cut(*basicAuth, ":")
+		opts.TargetAuth = client.BasicAuth(username, password)
+	}
+	if *bearerToken != "" {
+		opts.TargetAuth = client.BearerAuth(*bearerToken)
+	}
+	var offset int64
+	if *resume {
+		if *outputFile == "" {
+			log.Fatalf("-continue needs -o")
+		}
+		if info, err := os.Stat(*outputFile); err == nil && info.Size() > 0 {
+			offset = info.Size()
+			headers["Range"] = fmt.Sprintf("bytes=%d-", offset)
+			if *verbose {
+				log.Printf("Resuming %s from byte %d", *outputFile, offset)
+			}
+		}
+	}
+
+	// Ctrl-C also stops the target request at the central proxy
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	opts.Context = ctx
+
 	startTime := time.Now()
-	response, err := proxyClient.MakeRequest(*method, *url, body, headers)
+	response, err := proxyClient.MakeRequestWithOptions(*method, *url, body, headers, opts)
 	duration := time.Since(startTime)
 
 	if err != nil {
-		log.Fatalf("Request failed: %v", err)
+		log.Fatal(describeError(err))
 	}
 
 	// Display response
 	if *verbose {
 		log.Printf("Response received in %v", duration)
 		log.Printf("Status: %d", response.StatusCode)
+		if response.FinalURL != *url {
+			log.Printf("Redirected to: %s", response.FinalURL)
+		}
 		log.Printf("Body size: %d bytes", len(response.Body))
 		log.Println("\nResponse headers:")
 		for k, v := range response.Headers {
@@ -106,10 +165,250 @@ func main() {
 		log.Println("\nResponse body:")
 	}
 
-	fmt.Println(string(response.Body))
+	// Event streams are written out as they arrive
+	if response.Events != nil {
+		out := os.Stdout
+		if *outputFile != "" {
+			out, err = os.Create(*outputFile)
+			if err != nil {
+				log.Fatalf("Failed to save response: %v", err)
+			}
+			defer out.Close()
+		}
+		for event := range response.Events {
+			out.Write(event)
+		}
+		if *verbose {
+			logTrailers(response.Trailers)
+		}
+		return
+	}
+
+	if *outputFile != "" {
+		if offset > 0 && response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			log.Printf("%s is already complete", *outputFile)
+			return
+		}
+
+		// A target without range support sends everything again
+		appendBody := offset > 0 && response.StatusCode == http.StatusPartialContent
+		if err := saveResponse(*outputFile, response.Body, appendBody); err != nil {
+			log.Fatalf("Failed to save response: %v", err)
+		}
+		if *verbose {
+			log.Printf("Saved %d bytes to %s", len(response.Body), *outputFile)
+		}
+		if response.Partial {
+			log.Printf("Download incomplete, response chunks %v missing; run again with -continue to fetch the rest", response.Missing)
+			os.Exit(1)
+		}
+		return
+	}
+
+	os.Stdout.Write(response.Body)
+	fmt.Println()
+	if *verbose {
+		logTrailers(response.Trailers)
+	}
+}
+
+// logTrailers lists the trailers the target sent after the body, if any
+func logTrailers(trailers map[string]string) {
+	if len(trailers) == 0 {
+		return
+	}
+	log.Println("\nResponse trailers:")
+	for k, v := range trailers {
+		log.Printf("  %s: %s", k, v)
+	}
+}
+
+// describeError words a failed request for the user. Refused credentials
+// are called out, since retrying won't help until the config is fixed.
+func describeError(err error) string {
+	if errors.Is(err, client.ErrUnauthorized) {
+		return fmt.Sprintf("Authentication failed: %v\nCheck credentials in the client config against the upstream's client_keys", err)
+	}
+	return fmt.Sprintf("Request failed: %v", err)
+}
+
+// saveResponse writes the raw response body to path, or adds it to the end
+// of path when resuming a download
+func saveResponse(path string, body []byte, appendBody bool) error {
+	if !appendBody {
+		return os.WriteFile(path, body, 0644)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(body); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// headerFlags collects every -H occurrence
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	*h = append(*h, value)
+	return nil
+}
+
+// parseHeaders turns "Key: Value" entries into a header map. Repeated keys
+// are joined with ", " as HTTP allows; malformed entries are skipped.
+func parseHeaders(values []string) map[string]string {
+	headers := make(map[string]string)
+
+	for _, value := range values {
+		parts := strings.SplitN(value, ":", 2)
+		key := ""
+		if len(parts) == 2 {
+			key = strings.TrimSpace(parts[0])
+		}
+		if key == "" {
+			log.Printf("Warning: ignoring malformed header %q (expected 'Key: Value')", value)
+			continue
+		}
+
+		val := strings.TrimSpace(parts[1])
+		if existing, exists := headers[key]; exists {
+			log.Printf("Warning: header %s given more than once, combining values", key)
+			val = existing + ", " + val
+		}
+		headers[key] = val
+	}
+
+	return headers
+}
+
+// benchStats summarizes a benchmark run
+type benchStats struct {
+	Requests   int
+	Errors     int
+	Elapsed    time.Duration
+	Throughput float64 // successful requests per second
+	P50        time.Duration
+	P95        time.Duration
+	P99        time.Duration
+}
+
+// runBenchmark issues total requests with the given concurrency through the
+// full proxy path and collects latency statistics
+func runBenchmark(proxyClient *client.ProxyClient, method, url string, body []byte, headers map[string]string, total, concurrency int) benchStats {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	fmt.Printf("Benchmarking %s %s: %d requests, concurrency %d\n", method, url, total, concurrency)
+
+	jobs := make(chan struct{}, total)
+	for i := 0; i < total; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		errors    int
+		wg        sync.WaitGroup
+	)
+
+	startTime := time.Now()
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				reqStart := time.Now()
+				_, err := proxyClient.MakeRequest(method, url, body, headers)
+				latency := time.Since(reqStart)
+
+				mu.Lock()
+				if err != nil {
+					errors++
+				} else {
+					latencies = append(latencies, latency)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return computeBenchStats(latencies, errors, time.Since(startTime))
 }
 
-func runInteractive(proxyClient *client.ProxyClient, verbose bool) {
+// computeBenchStats derives throughput and latency percentiles
+func computeBenchStats(latencies []time.Duration, errors int, elapsed time.Duration) benchStats {
+	stats := benchStats{
+		Requests: len(latencies) + errors,
+		Errors:   errors,
+		Elapsed:  elapsed,
+	}
+
+	if elapsed > 0 {
+		stats.Throughput = float64(len(latencies)) / elapsed.Seconds()
+	}
+
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	stats.P50 = percentile(sorted, 50)
+	stats.P95 = percentile(sorted, 95)
+	stats.P99 = percentile(sorted, 99)
+
+	return stats
+}
+
+// percentile returns the nearest-rank percentile of sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func printBenchStats(stats benchStats) {
+	errorRate := 0.0
+	if stats.Requests > 0 {
+		errorRate = float64(stats.Errors) / float64(stats.Requests) * 100
+	}
+
+	fmt.Println("\n=== Benchmark Results ===")
+	fmt.Printf("Requests:   %d\n", stats.Requests)
+	fmt.Printf("Errors:     %d (%.1f%%)\n", stats.Errors, errorRate)
+	fmt.Printf("Duration:   %v\n", stats.Elapsed.Round(time.Millisecond))
+	fmt.Printf("Throughput: %.2f req/s\n", stats.Throughput)
+	fmt.Printf("Latency:    p50 %v, p95 %v, p99 %v\n",
+		stats.P50.Round(time.Millisecond), stats.P95.Round(time.Millisecond), stats.P99.Round(time.Millisecond))
+}
+
+// readLine prints a prompt and returns the next full input line. ok is
+// false once input is exhausted.
+func readLine(input *bufio.Scanner, prompt string) (line string, ok bool) {
+	fmt.Print(prompt)
+	if !input.Scan() {
+		return "", false
+	}
+	return strings.TrimSpace(input.Text()), true
+}
+
+func runInteractive(proxyClient *client.ProxyClient, input *bufio.Scanner, verbose bool) {
 	fmt.Println("=================================")
 	fmt.Println("  Distributed Proxy CLI")
 	fmt.Println("=================================")
@@ -121,16 +420,24 @@ func runInteractive(proxyClient *client.ProxyClient, verbose bool) {
 		fmt.Println("  2. POST request")
 		fmt.Println("  3. Status")
 		fmt.Println("  4. Exit")
-		fmt.Print("\nChoose option: ")
 
-		var choice int
-		fmt.Scanln(&choice)
+		line, ok := readLine(input, "\nChoose option: ")
+		if !ok {
+			fmt.Println("\nGoodbye!")
+			return
+		}
+
+		choice, err := strconv.Atoi(line)
+		if err != nil {
+			fmt.Printf("Invalid option %q, enter a number from 1 to 4\n", line)
+			continue
+		}
 
 		switch choice {
 		case 1:
-			handleGET(proxyClient, verbose)
+			handleGET(proxyClient, input, verbose)
 		case 2:
-			handlePOST(proxyClient, verbose)
+			handlePOST(proxyClient, input, verbose)
 		case 3:
 			showStatus(proxyClient)
 		case 4:
@@ -142,10 +449,12 @@ func runInteractive(proxyClient *client.ProxyClient, verbose bool) {
 	}
 }
 
-func handleGET(proxyClient *client.ProxyClient, verbose bool) {
-	var url string
-	fmt.Print("Enter URL: ")
-	fmt.Scanln(&url)
+func handleGET(proxyClient *client.ProxyClient, input *bufio.Scanner, verbose bool) {
+	url, ok := readLine(input, "Enter URL: ")
+	if !ok || url == "" {
+		fmt.Println("URL is required")
+		return
+	}
 
 	headers := make(map[string]string)
 	headers["User-Agent"] = "Distributed-Proxy-CLI/1.0"
@@ -159,7 +468,12 @@ func handleGET(proxyClient *client.ProxyClient, verbose bool) {
 	duration := time.Since(startTime)
 
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		fmt.Println(describeError(err))
+		return
+	}
+
+	if response.Events != nil {
+		showStream(response, duration)
 		return
 	}
 
@@ -175,12 +489,13 @@ func handleGET(proxyClient *client.ProxyClient, verbose bool) {
 	fmt.Println(preview)
 }
 
-func handlePOST(proxyClient *client.ProxyClient, verbose bool) {
-	var url, data string
-	fmt.Print("Enter URL: ")
-	fmt.Scanln(&url)
-	fmt.Print("Enter data: ")
-	fmt.Scanln(&data)
+func handlePOST(proxyClient *client.ProxyClient, input *bufio.Scanner, verbose bool) {
+	url, ok := readLine(input, "Enter URL: ")
+	if !ok || url == "" {
+		fmt.Println("URL is required")
+		return
+	}
+	data, _ := readLine(input, "Enter data: ")
 
 	headers := map[string]string{
 		"User-Agent":   "Distributed-Proxy-CLI/1.0",
@@ -196,7 +511,12 @@ func handlePOST(proxyClient *client.ProxyClient, verbose bool) {
 	duration := time.Since(startTime)
 
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		fmt.Println(describeError(err))
+		return
+	}
+
+	if response.Events != nil {
+		showStream(response, duration)
 		return
 	}
 
@@ -206,6 +526,19 @@ func handlePOST(proxyClient *client.ProxyClient, verbose bool) {
 	fmt.Println(string(response.Body))
 }
 
+// showStream prints an event stream as it arrives, returning once it ends
+func showStream(response *client.ProxyResponse, duration time.Duration) {
+	fmt.Printf("\n✓ Stream opened in %v\n", duration)
+	fmt.Printf("Status: %d\n\n", response.StatusCode)
+
+	size := 0
+	for event := range response.Events {
+		size += len(event)
+		os.Stdout.Write(event)
+	}
+	fmt.Printf("\nStream closed after %d bytes\n", size)
+}
+
 func showStatus(proxyClient *client.ProxyClient) {
 	fmt.Println("\n=== Client Status ===")
 	fmt.Println("Status: Running")
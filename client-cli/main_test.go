@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/client"
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// stubUpstream stands in for every hop behind the client: it reassembles
+// request chunks and posts the response straight to the client's handler
+type stubUpstream struct {
+	client  *client.ProxyClient
+	respond func(body []byte) []byte
+
+	mu       sync.Mutex
+	sessions map[string]map[int]*common.Chunk
+}
+
+// RoundTrip serves the client's chunk posts in memory
+func (s *stubUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	body, _ := io.ReadAll(req.Body)
+	chunk, err := common.DeserializeChunk(body)
+	if err != nil {
+		recorder.WriteHeader(http.StatusBadRequest)
+		return recorder.Result(), nil
+	}
+
+	s.mu.Lock()
+	session, exists := s.sessions[chunk.SessionID]
+	if !exists {
+		session = make(map[int]*common.Chunk)
+		s.sessions[chunk.SessionID] = session
+	}
+	session[chunk.SequenceNum] = chunk
+	complete := len(session) == chunk.TotalChunks
+	s.mu.Unlock()
+
+	if complete {
+		go s.deliver(chunk.SessionID, session)
+	}
+	return recorder.Result(), nil
+}
+
+// deliver answers a complete request in 8 byte response chunks
+func (s *stubUpstream) deliver(sessionID string, chunks map[int]*common.Chunk) {
+	var body []byte
+	for i := 1; i <= len(chunks); i++ {
+		body = append(body, chunks[i].Data...)
+	}
+
+	parts := common.SplitData(s.respond(body), 8)
+	for i, part := range parts {
+		data, _ := common.SerializeChunk(&common.Chunk{
+			SessionID:   sessionID,
+			SequenceNum: i + 1,
+			TotalChunks: len(parts),
+			Data:        part,
+			Timestamp:   time.Now(),
+		})
+		s.client.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/chunk", bytes.NewReader(data)))
+	}
+}
+
+// newStubClient returns a client whose requests are answered by respond
+func newStubClient(t *testing.T, respond func(body []byte) []byte) *client.ProxyClient {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "client.yaml")
+	config := `
+upstream_servers: ["up:1"]
+downstream_port: 7000
+chunk_size: 16
+timeout: 2000
+encryption:
+  enabled: false
+`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	proxyClient, err := client.NewProxyClient(path)
+	if err != nil {
+		t.Fatalf("NewProxyClient: %v", err)
+	}
+	proxyClient.SetTransport(&stubUpstream{
+		client:   proxyClient,
+		respond:  respond,
+		sessions: make(map[string]map[int]*common.Chunk),
+	})
+	return proxyClient
+}
+
+func TestComputeBenchStats(t *testing.T) {
+	var latencies []time.Duration
+	for i := 100; i >= 1; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+
+	stats := computeBenchStats(latencies, 5, 2*time.Second)
+	if stats.Requests != 105 || stats.Errors != 5 {
+		t.Errorf("requests %d, errors %d, want 105 and 5", stats.Requests, stats.Errors)
+	}
+	if stats.Throughput != 50 {
+		t.Errorf("throughput %v, want 50 req/s", stats.Throughput)
+	}
+	if stats.P50 != 50*time.Millisecond || stats.P95 != 95*time.Millisecond || stats.P99 != 99*time.Millisecond {
+		t.Errorf("percentiles %v %v %v, want 50ms 95ms 99ms", stats.P50, stats.P95, stats.P99)
+	}
+
+	if empty := computeBenchStats(nil, 3, time.Second); empty.P99 != 0 || empty.Throughput != 0 {
+		t.Errorf("all failed: %+v", empty)
+	}
+}
+
+func TestRunBenchmark(t *testing.T) {
+	proxyClient := newStubClient(t, func(body []byte) []byte {
+		return []byte("pong")
+	})
+
+	stats := runBenchmark(proxyClient, http.MethodGet, "http://target/", nil, nil, 12, 4)
+	if stats.Requests != 12 || stats.Errors != 0 {
+		t.Fatalf("requests %d, errors %d, want 12 and 0", stats.Requests, stats.Errors)
+	}
+	if stats.Throughput <= 0 || stats.P50 <= 0 || stats.P50 > stats.P95 || stats.P95 > stats.P99 {
+		t.Errorf("implausible stats %+v", stats)
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	var values headerFlags
+	for _, h := range []string{
+		"Authorization: Bearer abc",
+		"X-Trace:  id=1 ",
+		"Accept: text/html",
+		"Accept: application/json",
+		"no colon here",
+		": missing key",
+		"X-Empty:",
+	} {
+		values.Set(h)
+	}
+
+	got := parseHeaders(values)
+	want := map[string]string{
+		"Authorization": "Bearer abc",
+		"X-Trace":       "id=1",
+		"Accept":        "text/html, application/json",
+		"X-Empty":       "",
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestReadLineKeepsWholeLine(t *testing.T) {
+	input := bufio.NewScanner(strings.NewReader("http://target/search?q=two words\n  padded  \n"))
+
+	if line, ok := readLine(input, ""); !ok || line != "http://target/search?q=two words" {
+		t.Errorf("got %q, %v", line, ok)
+	}
+	if line, _ := readLine(input, ""); line != "padded" {
+		t.Errorf("got %q, want surrounding space trimmed", line)
+	}
+	if _, ok := readLine(input, ""); ok {
+		t.Error("read past the end of input")
+	}
+}
+
+func TestInteractivePostSendsMultiWordData(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	proxyClient := newStubClient(t, func(body []byte) []byte {
+		mu.Lock()
+		sent = append(sent, string(body))
+		mu.Unlock()
+		return []byte("ok")
+	})
+
+	// A non-numeric choice is reported and the menu shown again; running
+	// out of input ends the session instead of looping
+	input := bufio.NewScanner(strings.NewReader("two\n2\nhttp://target/a b\nhello there world\n"))
+	runInteractive(proxyClient, input, false)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 1 || sent[0] != "hello there world" {
+		t.Errorf("target got %q, want the whole data line", sent)
+	}
+}
+
+func TestSaveResponseIsByteIdentical(t *testing.T) {
+	payload := make([]byte, 1000)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	proxyClient := newStubClient(t, func(body []byte) []byte {
+		return payload
+	})
+
+	response, err := proxyClient.GET("http://target/blob.bin", nil)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "blob.bin")
+	if err := saveResponse(path, response.Body, false); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := os.ReadFile(path)
+	if !bytes.Equal(saved, payload) {
+		t.Fatalf("saved %d bytes differing from the %d byte payload", len(saved), len(payload))
+	}
+
+	// Resuming appends to what is already saved
+	if err := saveResponse(path, []byte{0, 0xff}, true); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ = os.ReadFile(path)
+	if !bytes.Equal(saved, append(payload, 0, 0xff)) {
+		t.Error("appended body does not follow the saved one")
+	}
+}
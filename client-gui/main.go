@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -8,8 +9,10 @@ import (
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/widget"
 	"github.com/dudelovecamera/proxy-system/client"
+	"github.com/dudelovecamera/proxy-system/client/display"
 )
 
 type ProxyGUI struct {
@@ -22,6 +25,22 @@ type ProxyGUI struct {
 	responseText *widget.Entry
 	statusLabel  *widget.Label
 	sendButton   *widget.Button
+	headerBox    *fyne.Container
+	headerRows   []*headerRow
+	lastBody     []byte
+}
+
+// headerRow is one key/value line in the header editor
+type headerRow struct {
+	key       *widget.Entry
+	value     *widget.Entry
+	container *fyne.Container
+}
+
+// defaultHeaders are sent unless the header editor overrides them
+var defaultHeaders = map[string]string{
+	"User-Agent":   "Distributed-Proxy-GUI/1.0",
+	"Content-Type": "application/json",
 }
 
 func main() {
@@ -67,6 +86,14 @@ func (g *ProxyGUI) setupUI() {
 	g.bodyEntry.SetPlaceHolder("Request body (JSON, form data, etc.)")
 	g.bodyEntry.SetMinRowsVisible(5)
 
+	// Header editor; rows persist across requests until removed
+	g.headerBox = container.NewVBox()
+	addHeaderButton := widget.NewButton("Add Header", func() {
+		g.addHeaderRow("", "")
+	})
+	headerScroll := container.NewVScroll(g.headerBox)
+	headerScroll.SetMinSize(fyne.NewSize(0, 90))
+
 	// Response display
 	g.responseText = widget.NewMultiLineEntry()
 	g.responseText.SetPlaceHolder("Response will appear here...")
@@ -85,6 +112,8 @@ func (g *ProxyGUI) setupUI() {
 		g.urlEntry,
 		widget.NewLabel("Method:"),
 		g.methodSelect,
+		container.NewBorder(nil, nil, widget.NewLabel("Headers:"), addHeaderButton),
+		headerScroll,
 		widget.NewLabel("Body:"),
 		g.bodyEntry,
 		g.sendButton,
@@ -104,9 +133,11 @@ func (g *ProxyGUI) setupUI() {
 
 	// Menu
 	fileMenu := fyne.NewMenu("File",
+		fyne.NewMenuItem("Save Response...", g.handleSaveResponse),
 		fyne.NewMenuItem("Clear", func() {
 			g.responseText.SetText("")
 			g.statusLabel.SetText("Ready")
+			g.lastBody = nil
 		}),
 		fyne.NewMenuItem("Quit", func() {
 			g.app.Quit()
@@ -131,6 +162,7 @@ func (g *ProxyGUI) handleSendRequest() {
 	url := g.urlEntry.Text
 	method := g.methodSelect.Selected
 	body := []byte(g.bodyEntry.Text)
+	headers := display.CollectHeaders(defaultHeaders, g.headerPairs())
 
 	if url == "" {
 		g.statusLabel.SetText("Error: URL is required")
@@ -141,34 +173,150 @@ func (g *ProxyGUI) handleSendRequest() {
 	g.sendButton.Disable()
 	g.responseText.SetText("Loading...")
 
-	// Make request in background
+	// Make request in background; widgets are only touched on the UI thread
 	go func() {
-		headers := map[string]string{
-			"User-Agent":   "Distributed-Proxy-GUI/1.0",
-			"Content-Type": "application/json",
+		result := g.performRequest(method, url, body, headers)
+		if result.err == nil && result.response.Events != nil {
+			g.followStream(&result)
 		}
+		fyne.Do(func() {
+			g.showResult(result)
+		})
+	}()
+}
+
+// requestResult carries a finished request from the network goroutine to the UI
+type requestResult struct {
+	response *client.ProxyResponse
+	err      error
+	duration time.Duration
+}
 
-		startTime := time.Now()
-		response, err := g.client.MakeRequest(method, url, body, headers)
-		duration := time.Since(startTime)
+// performRequest runs the proxied request; it must not touch any widget
+func (g *ProxyGUI) performRequest(method, url string, body []byte, headers map[string]string) requestResult {
+	startTime := time.Now()
+	response, err := g.client.MakeRequest(method, url, body, headers)
 
-		// Update UI on main thread
-		g.window.Canvas().Refresh(g.statusLabel)
+	return requestResult{
+		response: response,
+		err:      err,
+		duration: time.Since(startTime),
+	}
+}
+
+// followStream shows an event stream as it arrives and, once it ends,
+// leaves the whole of it in the response body for showResult
+func (g *ProxyGUI) followStream(result *requestResult) {
+	start := time.Now().Add(-result.duration)
+
+	var body []byte
+	for event := range result.response.Events {
+		body = append(body, event...)
+		text := string(body)
+		fyne.Do(func() {
+			g.statusLabel.SetText(fmt.Sprintf("Streaming response (%d bytes)...", len(text)))
+			g.responseText.SetText(text)
+		})
+	}
+
+	result.response.Body = body
+	result.duration = time.Since(start)
+}
+
+// showResult updates the widgets with a finished request; call on the UI thread
+func (g *ProxyGUI) showResult(result requestResult) {
+	if result.err != nil {
+		g.lastBody = nil
+		g.statusLabel.SetText(fmt.Sprintf("Error: %v", result.err))
+		g.responseText.SetText(fmt.Sprintf("Request failed: %v", result.err))
+		if errors.Is(result.err, client.ErrUnauthorized) {
+			g.statusLabel.SetText("Authentication failed: check credentials in config/client.yaml")
+		}
+	} else {
+		body := result.response.Body
+		g.lastBody = body
+		text, mode := display.RenderBody(result.response.Headers, body)
+		g.statusLabel.SetText(fmt.Sprintf("✓ Response received in %v (%s, %d bytes)", result.duration, mode, len(body)))
+		g.responseText.SetText(text)
+
+		// Binary bodies are only previewed; offer to keep the real thing
+		if mode == display.RenderBinary && len(body) > 0 {
+			message := fmt.Sprintf("The response is %d bytes of binary data (%s). Save it to a file?",
+				len(body), result.response.Headers["Content-Type"])
+			dialog.ShowConfirm("Binary response", message, func(save bool) {
+				if save {
+					g.handleSaveResponse()
+				}
+			}, g.window)
+		}
+	}
 
+	g.sendButton.Enable()
+}
+
+// handleSaveResponse writes the raw body of the last response to a chosen file
+func (g *ProxyGUI) handleSaveResponse() {
+	if g.lastBody == nil {
+		g.statusLabel.SetText("No response to save")
+		return
+	}
+
+	body := g.lastBody
+	dialog.ShowFileSave(func(writer fyne.URIWriteCloser, err error) {
 		if err != nil {
-			g.statusLabel.SetText(fmt.Sprintf("Error: %v", err))
-			g.responseText.SetText(fmt.Sprintf("Request failed: %v", err))
-		} else {
-			g.statusLabel.SetText(fmt.Sprintf("✓ Response received in %v", duration))
-			responseBody := string(response.Body)
-			if len(responseBody) > 10000 {
-				responseBody = responseBody[:10000] + "\n\n... (truncated, too large)"
-			}
-			g.responseText.SetText(responseBody)
+			dialog.ShowError(err, g.window)
+			return
 		}
+		if writer == nil {
+			return // cancelled
+		}
+		defer writer.Close()
 
-		g.sendButton.Enable()
-		g.window.Canvas().Refresh(g.responseText)
-		g.window.Canvas().Refresh(g.sendButton)
-	}()
+		if _, err := writer.Write(body); err != nil {
+			dialog.ShowError(err, g.window)
+			return
+		}
+		g.statusLabel.SetText(fmt.Sprintf("Saved %d bytes to %s", len(body), writer.URI().Name()))
+	}, g.window)
+}
+
+// addHeaderRow appends an editable header line
+func (g *ProxyGUI) addHeaderRow(key, value string) {
+	row := &headerRow{
+		key:   widget.NewEntry(),
+		value: widget.NewEntry(),
+	}
+	row.key.SetPlaceHolder("Header")
+	row.key.SetText(key)
+	row.value.SetPlaceHolder("Value")
+	row.value.SetText(value)
+
+	removeButton := widget.NewButton("Remove", func() {
+		g.removeHeaderRow(row)
+	})
+	row.container = container.NewBorder(nil, nil, nil, removeButton,
+		container.NewGridWithColumns(2, row.key, row.value))
+
+	g.headerRows = append(g.headerRows, row)
+	g.headerBox.Add(row.container)
+}
+
+// removeHeaderRow deletes a header line from the editor
+func (g *ProxyGUI) removeHeaderRow(row *headerRow) {
+	for i, r := range g.headerRows {
+		if r == row {
+			g.headerRows = append(g.headerRows[:i], g.headerRows[i+1:]...)
+			break
+		}
+	}
+	g.headerBox.Remove(row.container)
+}
+
+// headerPairs reads the editor rows as key/value pairs
+func (g *ProxyGUI) headerPairs() [][2]string {
+	pairs := make([][2]string, 0, len(g.headerRows))
+	for _, row := range g.headerRows {
+		pairs = append(pairs, [2]string{row.key.Text, row.value.Text})
+	}
+	return pairs
 }
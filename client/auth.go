@@ -0,0 +1,13 @@
+package client
+
+import "encoding/base64"
+
+// BasicAuth returns a RequestOptions.TargetAuth value for HTTP basic auth
+func BasicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// BearerAuth returns a RequestOptions.TargetAuth value for a bearer token
+func BearerAuth(token string) string {
+	return "Bearer " + token
+}
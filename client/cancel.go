@@ -0,0 +1,43 @@
+package client
+
+import (
+	"log"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// cancelSession asks the central proxy to stop working on a session the
+// caller gave up on. The cancel chunk is sealed like the request's own
+// chunks. Any upstream will do, whatever the balance policy: upstreams pick
+// the central proxy by session, so it reaches the one holding the session.
+// The first upstream that takes it is enough.
+func (c *ProxyClient) cancelSession(session *PendingSession) {
+	session.mu.Lock()
+	key := session.SessionKey
+	session.mu.Unlock()
+
+	chunk, err := common.NewCancelChunk(session.SessionID, c.clientAddr(), key)
+	if err == nil && c.config.Encryption.Enabled {
+		err = c.keys.EncryptChunk(chunk)
+	}
+	if err != nil {
+		log.Printf("Failed to cancel session %s: %v", session.SessionID, err)
+		return
+	}
+
+	upstreams := c.chunkUpstreams(session.SessionID, 0)
+	defer func() {
+		for _, upstream := range upstreams {
+			c.balancer.Done(upstream)
+		}
+	}()
+
+	for _, upstream := range upstreams {
+		if _, err := c.sendChunk(chunk, upstream); err != nil {
+			log.Printf("Failed to cancel session %s via %s: %v", session.SessionID, upstream, err)
+			continue
+		}
+		log.Printf("Cancelled session %s", session.SessionID)
+		return
+	}
+}
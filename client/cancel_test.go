@@ -0,0 +1,51 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+func TestCancelledContextSendsCancelChunk(t *testing.T) {
+	client, hops := newStubClient(t, stubConfig, func(req stubRequest) []byte { return nil })
+	hops.drop = func(seq int) bool { return true }
+
+	var mu sync.Mutex
+	var cancels []*common.Chunk
+	sent := make(chan struct{}, 1)
+	hops.reject = func(chunk *common.Chunk) *common.ChunkAck {
+		mu.Lock()
+		defer mu.Unlock()
+		if chunk.IsCancel() {
+			cancels = append(cancels, chunk)
+		} else {
+			sent <- struct{}{}
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-sent
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := client.MakeRequestWithOptions("GET", "http://target/", nil, nil, RequestOptions{Context: ctx})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("returned after %v, want at once", elapsed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(cancels) != 1 || cancels[0].SessionID == "" {
+		t.Errorf("upstream got %d cancel chunks, want 1 for the session", len(cancels))
+	}
+}
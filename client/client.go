@@ -1,34 +1,58 @@
-package main
+// Package client sends HTTP requests through the proxy system: it splits
+// them into chunks for the upstream servers and reassembles the responses
+// that downstream servers deliver to it.
+package client
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/dudelovecamera/proxy-system/common"
-	"gopkg.in/yaml.v3"
 )
 
 // ClientConfig configuration for the client
 type ClientConfig struct {
-	ChunkSize       int      `yaml:"chunk_size"`
-	UpstreamServers []string `yaml:"upstream_servers"`
-	DownstreamPort  int      `yaml:"downstream_port"` // Port to listen for responses
-	Timeout         int      `yaml:"timeout"`         // milliseconds
-	Encryption      struct {
-		Enabled   bool   `yaml:"enabled"`
-		Algorithm string `yaml:"algorithm"`
-		Mode      string `yaml:"mode"`
-	} `yaml:"encryption"`
-	EncryptionKey []byte `yaml:"-"`
+	ChunkSize       int                      `yaml:"chunk_size"`
+	ChunkTuning     common.ChunkTuning       `yaml:"chunk_tuning"` // adjust chunk_size within bounds from observed sends
+	UpstreamServers []string                 `yaml:"upstream_servers"`
+	PollServers     []string                 `yaml:"poll_servers"` // downstream servers to fetch responses from that could not be pushed
+	MaxInflight     int                      `yaml:"max_inflight_per_upstream"`
+	DownstreamPort  int                      `yaml:"downstream_port"` // Port to listen for responses
+	ListenAddress   string                   `yaml:"listen_address"`  // interface for the response listener, all if empty
+	AdvertiseHost   string                   `yaml:"advertise_host"`  // host downstream servers send responses to, "client" if empty
+	Timeout         int                      `yaml:"timeout"`         // milliseconds
+	LatencyBudget   int                      `yaml:"latency_budget"`  // milliseconds hops may take in total before cutting their delays, 0 = unlimited
+	MaxChunkSize    int                      `yaml:"max_chunk_size"`  // largest accepted response chunk payload in bytes
+	MaxHeaderSize   int                      `yaml:"max_header_size"` // largest total of request header names and values in bytes
+	ChunkCodec      string                   `yaml:"chunk_codec"`     // json or protobuf, must match every hop
+	Compression     bool                     `yaml:"compression"`     // ask the target for gzip and decode it here
+	Encryption      common.EncryptionConfig  `yaml:"encryption"`
+	SessionKeys     common.SessionKeyConfig  `yaml:"session_keys"`
+	RequestRetry    RequestRetryConfig       `yaml:"request_retry"`           // resend whole requests whose response never arrived
+	Credentials     common.ClientCredentials `yaml:"credentials"`             // key_id and secret or secret_file, signs requests to upstreams
+	Timeouts        common.HTTPTimeouts      `yaml:"timeouts"`                // outbound dial, TLS and response header timeouts
+	SpoolDir        string                   `yaml:"spool_dir"`               // where streamed bodies of unknown size are spooled, system temp dir if empty
+	MaxConcurrent   int                      `yaml:"max_concurrent_requests"` // requests in flight at once, 0 = unlimited
+	SendConcurrency int                      `yaml:"send_concurrency"`        // chunks of one request sent at once, default 4
+	Redundancy      int                      `yaml:"redundancy"`              // upstreams each chunk is sent to, default 1
+	BalancePolicy   string                   `yaml:"balance_policy"`          // how chunks are spread over upstream_servers
+	SkipLengthCheck bool                     `yaml:"skip_length_check"`       // accept bodies whose size differs from the announced length
+	WireCapture     common.WireCapture       `yaml:",inline"`                 // wire_capture_dir and wire_capture_redact, for debugging
 }
 
 // ProxyClient handles all client operations
@@ -38,6 +62,14 @@ type ProxyClient struct {
 	mu              sync.RWMutex
 	httpClient      *http.Client
 	responseServer  *http.Server
+	listening       bool          // response listener bound
+	queue           *requestQueue // nil when concurrency is unlimited
+	keys            *common.KeyRing
+	codec           common.ChunkCodec
+	balancer        common.Balancer         // picks the upstreams for each chunk
+	chunker         *common.AdaptiveChunker // nil when chunk_tuning is disabled
+	inflight        *inflightLimiter        // nil when chunks per upstream are unlimited
+	secret          []byte                  // from credentials, nil when requests aren't signed
 }
 
 // PendingSession tracks an outgoing request waiting for response
@@ -49,30 +81,136 @@ type PendingSession struct {
 	ResponseChan chan *ProxyResponse
 	Chunks       map[int]*common.Chunk
 	TotalChunks  int
+	Acks         map[int]common.ChunkAck // upstream acknowledgements by request chunk
+	SessionKey   []byte                  // shared with the central proxy, nil without session keys
+	Meta         *common.ResponseMeta    // from the control chunk, nil if none arrived
+	OnProgress   ProgressFunc
+	AllowPartial bool
+	Deadline     time.Time    // end of the latency budget, zero without one
+	stream       *eventStream // set once the control chunk announces an event stream
+	targetAuth   string       // sealed onto chunk 1, never sent as a header
 	mu           sync.Mutex
 }
 
+// ProgressFunc is called as response chunks arrive with the number of
+// distinct chunks received so far and the total expected
+type ProgressFunc func(received, total int)
+
+// RequestOptions tunes a single proxied request
+type RequestOptions struct {
+	OnProgress ProgressFunc // optional, called without any client lock held
+	Priority   int          // queue order under max_concurrent_requests, e.g. PriorityHigh
+
+	// LatencyBudget overrides the configured latency_budget when non-zero
+	LatencyBudget time.Duration
+
+	// AllowPartial returns what arrived instead of an error when the request
+	// times out with some response chunks missing; see ProxyResponse.Partial
+	AllowPartial bool
+
+	// TargetAuth is the Authorization header for the target, e.g. from
+	// BasicAuth or BearerAuth. Unlike headers it is sealed with the session
+	// key, so only the central proxy reads it; session_keys must be enabled.
+	TargetAuth string
+
+	// Context cancels the request when done: the call returns the context's
+	// error and the central proxy is told to abort the target request
+	Context context.Context
+}
+
 // ProxyResponse represents the final assembled response
 type ProxyResponse struct {
 	StatusCode int
 	Headers    map[string]string
 	Body       []byte
-	Error      error
+	Error      error // a *common.ErrorChunk when a hop reported the failure
+
+	// FinalURL is where the response came from: the last URL of any
+	// redirects the central proxy followed, otherwise the request URL
+	FinalURL string
+
+	// Partial is set when a request made with AllowPartial timed out. Body
+	// then holds only the chunks received in order from the first, and
+	// Missing lists every response chunk that never arrived; it is also set
+	// when the downstream server reports that it gave up on the response.
+	Partial bool
+	Missing []int
+
+	// Events is set instead of Body for event streams (text/event-stream).
+	// It receives the stream as it arrives, an event or a piece of a long
+	// event at a time, and is closed when the target ends the stream. Read
+	// it until closed; an unread stream stalls.
+	Events <-chan []byte
+
+	// Trailers holds the trailers the target sent after the body. For
+	// streamed responses it is filled in before Events is closed, so read
+	// it only after that.
+	Trailers map[string]string
 }
 
 // NewProxyClient creates a new client instance
 func NewProxyClient(configPath string) (*ProxyClient, error) {
-	data, err := os.ReadFile(configPath)
+	config, err := LoadClientConfig(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config: %w", err)
+		return nil, err
+	}
+
+	if len(config.UpstreamServers) == 1 {
+		log.Printf("Only one upstream server configured, all chunks will take a single path")
 	}
 
-	var config ClientConfig
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config: %w", err)
+	keys, err := common.NewKeyRingFromConfig(config.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption keys: %w", err)
 	}
 
-	// Set defaults
+	// Already checked by Validate
+	codec, _ := common.NewChunkCodec(config.ChunkCodec)
+	balancer, _ := common.NewBalancer(config.BalancePolicy, config.UpstreamServers)
+
+	// Capture chunks for debugging when wire_capture_dir is set
+	tap, err := common.NewWireTap(config.WireCapture, "client")
+	if err != nil {
+		return nil, err
+	}
+	codec = tap.Codec(codec)
+	keys.SetWireTap(tap)
+
+	client := &ProxyClient{
+		config:          config,
+		keys:            keys,
+		codec:           codec,
+		balancer:        balancer,
+		pendingSessions: make(map[string]*PendingSession),
+		httpClient:      common.NewHTTPClient(time.Duration(config.Timeout)*time.Millisecond, config.Timeouts),
+	}
+	if config.MaxConcurrent > 0 {
+		client.queue = newRequestQueue(config.MaxConcurrent)
+	}
+	if config.MaxInflight > 0 {
+		client.inflight = newInflightLimiter(config.UpstreamServers, config.MaxInflight)
+	}
+	if config.ChunkTuning.Enabled {
+		client.chunker = common.NewAdaptiveChunker(config.ChunkTuning, config.ChunkSize)
+	}
+	if config.Credentials.Enabled() {
+		client.secret, err = config.Credentials.LoadSecret()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+// LoadClientConfig reads and validates the config file, with settings
+// overridden by PROXY_CLIENT_* environment variables
+func LoadClientConfig(configPath string) (ClientConfig, error) {
+	return common.LoadConfig(configPath, "PROXY_CLIENT", setClientDefaults)
+}
+
+// setClientDefaults fills in settings left unset
+func setClientDefaults(config *ClientConfig) {
 	if config.ChunkSize == 0 {
 		config.ChunkSize = 8192
 	}
@@ -82,41 +220,228 @@ func NewProxyClient(configPath string) (*ProxyClient, error) {
 	if config.Timeout == 0 {
 		config.Timeout = 30000
 	}
+	if config.SendConcurrency == 0 {
+		config.SendConcurrency = 4
+	}
+	if config.Redundancy == 0 {
+		config.Redundancy = 1
+	}
+	if config.MaxChunkSize == 0 {
+		config.MaxChunkSize = common.DefaultMaxChunkSize
+	}
+	if config.MaxHeaderSize == 0 {
+		config.MaxHeaderSize = common.DefaultMaxHeaderSize
+	}
+}
 
-	// Generate or load encryption key
-	config.EncryptionKey = make([]byte, 32)
-	copy(config.EncryptionKey, []byte("your-32-byte-encryption-key-here"))
+// Validate reports every problem with the configuration
+func (c ClientConfig) Validate() error {
+	var errs []error
 
-	client := &ProxyClient{
-		config:          config,
-		pendingSessions: make(map[string]*PendingSession),
-		httpClient: &http.Client{
-			Timeout: time.Duration(config.Timeout) * time.Millisecond,
-		},
+	if len(c.UpstreamServers) == 0 {
+		errs = append(errs, fmt.Errorf("no upstream servers configured"))
+	}
+	if c.ChunkSize < 0 {
+		errs = append(errs, fmt.Errorf("chunk_size must not be negative, got %d", c.ChunkSize))
+	}
+	if c.DownstreamPort <= 0 || c.DownstreamPort > 65535 {
+		errs = append(errs, fmt.Errorf("downstream_port must be between 1 and 65535, got %d", c.DownstreamPort))
+	}
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("timeout must not be negative, got %d", c.Timeout))
+	}
+	if c.LatencyBudget < 0 {
+		errs = append(errs, fmt.Errorf("latency_budget must not be negative, got %d", c.LatencyBudget))
+	}
+	if c.MaxChunkSize < 0 {
+		errs = append(errs, fmt.Errorf("max_chunk_size must not be negative, got %d", c.MaxChunkSize))
+	}
+	if c.MaxHeaderSize < 0 {
+		errs = append(errs, fmt.Errorf("max_header_size must not be negative, got %d", c.MaxHeaderSize))
+	}
+	if c.MaxConcurrent < 0 {
+		errs = append(errs, fmt.Errorf("max_concurrent_requests must not be negative, got %d", c.MaxConcurrent))
+	}
+	if c.MaxInflight < 0 {
+		errs = append(errs, fmt.Errorf("max_inflight_per_upstream must not be negative, got %d", c.MaxInflight))
+	}
+	if c.SendConcurrency < 0 {
+		errs = append(errs, fmt.Errorf("send_concurrency must not be negative, got %d", c.SendConcurrency))
+	}
+	if c.Redundancy < 0 {
+		errs = append(errs, fmt.Errorf("redundancy must not be negative, got %d", c.Redundancy))
+	}
+	if !common.ValidBalancePolicy(c.BalancePolicy) {
+		errs = append(errs, fmt.Errorf("unknown balance_policy %q", c.BalancePolicy))
+	}
+	if c.RequestRetry.MaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("request_retry.max_retries must not be negative, got %d", c.RequestRetry.MaxRetries))
+	}
+	if err := c.Encryption.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.SessionKeys.Enabled {
+		if key, err := hex.DecodeString(c.SessionKeys.CentralPublicKey); err != nil || len(key) != 32 {
+			errs = append(errs, fmt.Errorf("session_keys.central_public_key must be 32 hex-encoded bytes"))
+		}
+	}
+	if err := c.Credentials.Validate(); err != nil {
+		errs = append(errs, err)
 	}
 
-	return client, nil
+	if _, err := common.NewChunkCodec(c.ChunkCodec); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.Timeouts.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.ChunkTuning.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
 }
 
 // Start begins listening for downstream responses
 func (c *ProxyClient) Start() error {
 	// Start HTTP server to receive chunks from downstream servers
-	mux := http.NewServeMux()
-	mux.HandleFunc("/chunk", c.handleResponseChunk)
-	mux.HandleFunc("/health", c.healthCheck)
-
 	c.responseServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", c.config.DownstreamPort),
-		Handler: mux,
+		Addr:    common.ListenAddr(c.config.ListenAddress, c.config.DownstreamPort),
+		Handler: c.Handler(),
+	}
+
+	listener, err := net.Listen("tcp", c.responseServer.Addr)
+	if err != nil {
+		return err
 	}
 
+	c.mu.Lock()
+	c.listening = true
+	c.mu.Unlock()
+
 	log.Printf("Client listening for responses on port %d", c.config.DownstreamPort)
 
-	return c.responseServer.ListenAndServe()
+	return c.responseServer.Serve(listener)
+}
+
+// ready reports whether the response listener is bound, since responses
+// sent before then are lost
+func (c *ProxyClient) ready() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.listening {
+		return errors.New("response listener not bound")
+	}
+	return nil
+}
+
+// Handler returns the client's response routes, for serving or in-process wiring
+func (c *ProxyClient) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chunk", c.handleResponseChunk)
+	mux.HandleFunc("/health", c.healthCheck)
+	mux.HandleFunc("/ready", common.ReadyHandler(c.ready))
+	return mux
+}
+
+// SetTransport replaces the transport used to reach upstream servers
+func (c *ProxyClient) SetTransport(rt http.RoundTripper) {
+	c.httpClient.Transport = rt
 }
 
 // MakeRequest sends a proxied HTTP request
 func (c *ProxyClient) MakeRequest(method, url string, body []byte, headers map[string]string) (*ProxyResponse, error) {
+	return c.MakeRequestWithOptions(method, url, body, headers, RequestOptions{})
+}
+
+// MakeRequestWithOptions sends a proxied HTTP request with per-request options
+func (c *ProxyClient) MakeRequestWithOptions(method, url string, body []byte, headers map[string]string, opts RequestOptions) (*ProxyResponse, error) {
+	return c.makeRequest(method, url, bytes.NewReader(body), int64(len(body)), headers, opts)
+}
+
+// MakeRequestStream sends a request whose body is read from body as it is
+// fragmented instead of held in memory. Every chunk carries the chunk count,
+// so the size must be known up front: a seekable body is measured, anything
+// else is spooled to a temporary file first.
+func (c *ProxyClient) MakeRequestStream(method, url string, body io.Reader, headers map[string]string) (*ProxyResponse, error) {
+	seeker, ok := body.(io.ReadSeeker)
+	if !ok {
+		spool, err := os.CreateTemp(c.config.SpoolDir, "proxy-body-*")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create spool file: %w", err)
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		if _, err := io.Copy(spool, body); err != nil {
+			return nil, fmt.Errorf("failed to spool request body: %w", err)
+		}
+		seeker = spool
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	// Measure from the current position to the end, then rewind to it
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return c.makeRequest(method, url, seeker, end-start, headers, RequestOptions{})
+}
+
+// makeRequest sends size bytes read from body and waits for the response,
+// sending the request again if request_retry allows
+func (c *ProxyClient) makeRequest(method, url string, body io.ReadSeeker, size int64, headers map[string]string, opts RequestOptions) (*ProxyResponse, error) {
+	// Hops refuse oversized headers, so fail before sending anything
+	if err := common.CheckHeaderSize(headers, c.config.MaxHeaderSize); err != nil {
+		return nil, err
+	}
+	if opts.TargetAuth != "" && !c.config.SessionKeys.Enabled {
+		return nil, common.ErrTargetAuthUnsealed
+	}
+
+	// Wait for a slot so concurrent requests don't all hit the upstreams at once
+	if c.queue != nil {
+		c.queue.acquire(opts.Priority)
+		defer c.queue.release()
+	}
+
+	retries := 0
+	if c.config.RequestRetry.allows(method, headers) {
+		retries = c.config.RequestRetry.MaxRetries
+	}
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		response, err := c.sendAndWait(method, url, body, size, headers, opts)
+		if attempt == retries || !errors.Is(err, ErrResponseTimeout) {
+			return response, err
+		}
+
+		// Resent whole, under a new session ID
+		log.Printf("Retrying request to %s (retry %d/%d): %v", url, attempt+1, retries, err)
+		if _, err := body.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sendAndWait makes one attempt at a request under a new session
+func (c *ProxyClient) sendAndWait(method, url string, body io.Reader, size int64, headers map[string]string, opts RequestOptions) (*ProxyResponse, error) {
 	// Generate session ID
 	sessionID := generateSessionID()
 
@@ -130,124 +455,374 @@ func (c *ProxyClient) MakeRequest(method, url string, body []byte, headers map[s
 		StartTime:    time.Now(),
 		ResponseChan: make(chan *ProxyResponse, 1),
 		Chunks:       make(map[int]*common.Chunk),
+		Acks:         make(map[int]common.ChunkAck),
+		OnProgress:   opts.OnProgress,
+		AllowPartial: opts.AllowPartial,
+		targetAuth:   opts.TargetAuth,
+	}
+
+	// Hops trim their jitter and batching to leave the budget for the request
+	budget := opts.LatencyBudget
+	if budget == 0 {
+		budget = time.Duration(c.config.LatencyBudget) * time.Millisecond
+	}
+	if budget > 0 {
+		session.Deadline = session.StartTime.Add(budget)
 	}
 
 	c.mu.Lock()
 	c.pendingSessions[sessionID] = session
 	c.mu.Unlock()
 
+	// Ask the target for a compressed body unless the caller chose an encoding.
+	// Ranges would then count bytes of the compressed body, so range requests
+	// are left alone.
+	if c.config.Compression {
+		_, ranged := headers["Range"]
+		if _, exists := headers["Accept-Encoding"]; !exists && !ranged {
+			withEncoding := make(map[string]string, len(headers)+1)
+			for k, v := range headers {
+				withEncoding[k] = v
+			}
+			withEncoding["Accept-Encoding"] = "gzip"
+			headers = withEncoding
+		}
+	}
+
 	// Fragment and send request
-	if err := c.fragmentAndSend(sessionID, method, url, body, headers); err != nil {
+	if err := c.fragmentAndSend(session, body, size, headers); err != nil {
 		c.mu.Lock()
 		delete(c.pendingSessions, sessionID)
 		c.mu.Unlock()
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
 	// Wait for response or timeout
 	timeout := time.Duration(c.config.Timeout) * time.Millisecond
-	select {
-	case response := <-session.ResponseChan:
-		c.mu.Lock()
-		delete(c.pendingSessions, sessionID)
-		c.mu.Unlock()
-		return response, response.Error
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	polled := len(c.config.PollServers) == 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			delete(c.pendingSessions, sessionID)
+			c.mu.Unlock()
+
+			c.cancelSession(session)
+			return nil, ctx.Err()
+
+		case response := <-session.ResponseChan:
+			// Event streams stay pending until their last chunk
+			if response.Events == nil {
+				c.mu.Lock()
+				delete(c.pendingSessions, sessionID)
+				c.mu.Unlock()
+			}
+			return response, response.Error
+
+		case <-timer.C:
+			// A response that could not be pushed may be waiting at a
+			// downstream server; once fetched it gets another timeout
+			if !polled {
+				polled = true
+				if c.pollBuffered(sessionID) {
+					timer.Reset(timeout)
+					continue
+				}
+			}
 
-	case <-time.After(timeout):
-		c.mu.Lock()
-		delete(c.pendingSessions, sessionID)
-		c.mu.Unlock()
-		return nil, fmt.Errorf("request timeout after %v", timeout)
+			c.mu.Lock()
+			delete(c.pendingSessions, sessionID)
+			c.mu.Unlock()
+
+			received, total, missing := session.missingChunks()
+			if total == 0 {
+				log.Printf("Session %s timed out with no response chunks", sessionID)
+				return nil, fmt.Errorf("%w after %v: no response chunks received", ErrResponseTimeout, timeout)
+			}
+
+			// The body is whole but its control chunk never came, as from
+			// hops predating control chunks: only the status is unknown
+			if len(missing) == 0 {
+				log.Printf("Session %s timed out waiting for its control chunk", sessionID)
+				response := c.assembleResponse(session, false)
+				return response, response.Error
+			}
+
+			log.Printf("Session %s timed out with %d/%d response chunks, missing %v",
+				sessionID, received, total, missing)
+			if session.AllowPartial {
+				response := c.assembleResponse(session, true)
+				return response, response.Error
+			}
+			return nil, fmt.Errorf("%w after %v: received %d/%d response chunks, missing %v",
+				ErrResponseTimeout, timeout, received, total, missing)
+		}
+	}
+}
+
+// missingChunks reports how many response chunks arrived, how many were
+// expected, and the sequence numbers still outstanding
+func (s *PendingSession) missingChunks() (int, int, []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var missing []int
+	for i := 1; i <= s.TotalChunks; i++ {
+		if _, exists := s.Chunks[i]; !exists {
+			missing = append(missing, i)
+		}
 	}
+
+	return len(s.Chunks), s.TotalChunks, missing
 }
 
-// fragmentAndSend splits request into chunks and distributes to upstream servers
-func (c *ProxyClient) fragmentAndSend(sessionID, method, url string, body []byte, headers map[string]string) error {
-	// Calculate number of chunks
-	totalChunks := (len(body) + c.config.ChunkSize - 1) / c.config.ChunkSize
+// fragmentAndSend splits request into chunks and distributes to upstream
+// servers, up to send_concurrency chunks at a time. It fails if any chunk
+// could not be sent or an upstream acknowledges a chunk it could not
+// forward, since the central proxy will then never see the whole request.
+func (c *ProxyClient) fragmentAndSend(session *PendingSession, body io.Reader, size int64, headers map[string]string) error {
+	// Calculate number of chunks; a tuned size holds for the whole request
+	chunkSize := int64(c.config.ChunkSize)
+	if c.chunker != nil {
+		chunkSize = int64(c.chunker.Size())
+	}
+	totalChunks := int((size + chunkSize - 1) / chunkSize)
 	if totalChunks == 0 {
 		totalChunks = 1 // At least one chunk even for empty body
 	}
 
-	log.Printf("Fragmenting request into %d chunks of ~%d bytes", totalChunks, c.config.ChunkSize)
+	log.Printf("Fragmenting request into %d chunks of ~%d bytes", totalChunks, chunkSize)
 
-	// Get client IP for downstream to send response back
-	clientAddr := fmt.Sprintf("client:%d", c.config.DownstreamPort)
+	clientAddr := c.clientAddr()
 
-	for i := 0; i < totalChunks; i++ {
-		start := i * c.config.ChunkSize
-		end := start + c.config.ChunkSize
-		if end > len(body) {
-			end = len(body)
+	// Agree a session key with the central proxy; the handshake goes out as
+	// chunk 0 alongside the data chunks
+	if c.config.SessionKeys.Enabled {
+		if err := c.sendHandshake(session, totalChunks, clientAddr); err != nil {
+			return err
 		}
+	}
 
-		chunkData := body[start:end]
-		if len(chunkData) == 0 && i == 0 {
-			chunkData = []byte{} // Empty chunk for requests with no body
-		}
+	// Chunks are read and sealed in order, then sent by up to
+	// send_concurrency goroutines; the body held at once stays bounded
+	sendErrs := make([]error, totalChunks)
+	slots := make(chan struct{}, c.config.SendConcurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
 
-		// Encrypt chunk if enabled
-		if c.config.Encryption.Enabled {
-			encrypted, err := common.EncryptAES(chunkData, c.config.EncryptionKey)
-			if err != nil {
-				return fmt.Errorf("encryption failed: %w", err)
-			}
-			chunkData = encrypted
+	for i := 0; i < totalChunks; i++ {
+		// Read only this chunk, so the body is never held in full
+		n := size - int64(i)*chunkSize
+		if n > chunkSize {
+			n = chunkSize
+		}
+		chunkData := make([]byte, n)
+		if _, err := io.ReadFull(body, chunkData); err != nil {
+			return fmt.Errorf("failed to read request body: %w", err)
 		}
 
 		chunk := &common.Chunk{
-			SessionID:    sessionID,
+			SessionID:    session.SessionID,
 			SequenceNum:  i + 1,
 			TotalChunks:  totalChunks,
 			Data:         chunkData,
 			Timestamp:    time.Now(),
 			SourceClient: clientAddr,
-			TargetURL:    url,
-			Method:       method,
-			Headers:      headers,
+			TargetURL:    session.RequestURL,
+			Method:       session.Method,
+			Deadline:     session.Deadline,
+		}
+		// Headers travel once, on chunk 1, instead of with every chunk
+		if i == 0 {
+			chunk.Headers = headers
 		}
 
-		// Select upstream server (round-robin)
-		upstreamURL := c.config.UpstreamServers[i%len(c.config.UpstreamServers)]
+		// Encrypt end to end with the session key, under any hop encryption
+		if session.SessionKey != nil {
+			encrypted, err := common.EncryptAESWithAAD(chunk.Data, session.SessionKey, chunk.AAD())
+			if err != nil {
+				return fmt.Errorf("session key encryption failed: %w", err)
+			}
+			chunk.Data = encrypted
+		}
+		if i == 0 && session.targetAuth != "" {
+			if err := common.SealTargetAuth(chunk, session.SessionKey, session.targetAuth); err != nil {
+				return err
+			}
+		}
 
-		// Send chunk
-		if err := c.sendChunk(chunk, upstreamURL); err != nil {
-			log.Printf("Failed to send chunk %d to %s: %v", i+1, upstreamURL, err)
-			// Continue sending other chunks
-		} else {
-			log.Printf("Sent chunk %d/%d to %s", i+1, totalChunks, upstreamURL)
+		// Encrypt chunk if enabled
+		if c.config.Encryption.Enabled {
+			if err := c.keys.EncryptChunk(chunk); err != nil {
+				return fmt.Errorf("encryption failed: %w", err)
+			}
 		}
+
+		// Send chunk; a failure doesn't stop the others
+		slots <- struct{}{}
+		upstreams := c.chunkUpstreams(session.SessionID, i)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			sendErrs[i] = c.sendReplicas(session, chunk, upstreams)
+		}(i)
+	}
+	wg.Wait()
+
+	if failed := session.failedAcks(); len(failed) > 0 {
+		return fmt.Errorf("upstream could not forward chunk %d: %s", failed[0].SequenceNum, failed[0].Error)
+	}
+
+	return errors.Join(sendErrs...)
+}
+
+// clientAddr is the source client address chunks carry, for the downstream
+// to send the response back
+func (c *ProxyClient) clientAddr() string {
+	host := c.config.AdvertiseHost
+	if host == "" {
+		host = "client"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(c.config.DownstreamPort))
+}
+
+// sendHandshake derives the session key and sends the handshake chunk
+// carrying the client's ephemeral public key
+func (c *ProxyClient) sendHandshake(session *PendingSession, totalChunks int, clientAddr string) error {
+	centralPublic, err := hex.DecodeString(c.config.SessionKeys.CentralPublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid central public key: %w", err)
+	}
+
+	data, key, err := common.NewClientHandshake(session.SessionID, centralPublic)
+	if err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+
+	chunk := &common.Chunk{
+		SessionID:    session.SessionID,
+		SequenceNum:  common.HandshakeSequence,
+		TotalChunks:  totalChunks,
+		ChunkType:    common.ChunkTypeHandshake,
+		Data:         data,
+		Timestamp:    time.Now(),
+		SourceClient: clientAddr,
+		TargetURL:    session.RequestURL,
+		Method:       session.Method,
+		Deadline:     session.Deadline,
+	}
+
+	if c.config.Encryption.Enabled {
+		if err := c.keys.EncryptChunk(chunk); err != nil {
+			return fmt.Errorf("encryption failed: %w", err)
+		}
+	}
+
+	session.mu.Lock()
+	session.SessionKey = key
+	session.mu.Unlock()
+
+	if err := c.sendReplicas(session, chunk, c.chunkUpstreams(session.SessionID, 0)); err != nil {
+		return fmt.Errorf("failed to send handshake: %w", err)
 	}
 
 	return nil
 }
 
-// sendChunk sends a single chunk to an upstream server
-func (c *ProxyClient) sendChunk(chunk *common.Chunk, upstreamURL string) error {
-	data, err := common.SerializeChunk(chunk)
+// recordAck stores an upstream acknowledgement for a request chunk. With
+// redundancy a chunk counts as forwarded once any copy was, whatever the
+// other upstreams report.
+func (s *PendingSession) recordAck(ack common.ChunkAck) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, exists := s.Acks[ack.SequenceNum]; exists && prev.Forwarded {
+		return
+	}
+	s.Acks[ack.SequenceNum] = ack
+}
+
+// failedAcks returns the acknowledgements that report a forwarding
+// failure, in sequence order
+func (s *PendingSession) failedAcks() []common.ChunkAck {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var failed []common.ChunkAck
+	for _, ack := range s.Acks {
+		if !ack.Forwarded {
+			failed = append(failed, ack)
+		}
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].SequenceNum < failed[j].SequenceNum
+	})
+	return failed
+}
+
+// sendChunk sends a single chunk to an upstream server and returns its
+// acknowledgement. The ack is nil if the upstream sent none.
+func (c *ProxyClient) sendChunk(chunk *common.Chunk, upstreamURL string) (*common.ChunkAck, error) {
+	data, err := c.codec.Encode(chunk)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	url := fmt.Sprintf("http://%s/chunk", upstreamURL)
 	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", c.codec.ContentType())
+	c.sign(req, data)
+
+	// Held until the upstream has answered
+	c.inflight.acquire(upstreamURL)
+	defer c.inflight.release(upstreamURL)
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
+	defer common.DrainAndClose(resp)
 
+	var ack *common.ChunkAck
+	if resp.Header.Get("Content-Type") == "application/json" {
+		ack = &common.ChunkAck{}
+		if err := json.NewDecoder(resp.Body).Decode(ack); err != nil {
+			return nil, fmt.Errorf("invalid ack from upstream: %w", err)
+		}
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return ack, fmt.Errorf("%w by %s", ErrUnauthorized, upstreamURL)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("upstream returned status %d", resp.StatusCode)
+		return ack, fmt.Errorf("upstream returned status %d", resp.StatusCode)
 	}
 
-	return nil
+	return ack, nil
+}
+
+// ErrUnauthorized is returned when an upstream refuses the client's
+// credentials, or requires credentials the client doesn't have
+var ErrUnauthorized = errors.New("request refused: client credentials rejected")
+
+// sign adds the credentials signature to a request to an upstream whose
+// body is body, if credentials are configured
+func (c *ProxyClient) sign(req *http.Request, body []byte) {
+	if c.secret != nil {
+		common.SignClientRequest(req, body, c.config.Credentials.KeyID, c.secret)
+	}
 }
 
 // handleResponseChunk receives response chunks from downstream servers
@@ -257,28 +832,48 @@ func (c *ProxyClient) handleResponseChunk(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
+	body, err := common.ReadChunkBody(w, r, c.config.MaxChunkSize)
 	if err != nil {
+		if errors.Is(err, common.ErrChunkTooLarge) {
+			http.Error(w, "Chunk too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Failed to read body", http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
 
-	chunk, err := common.DeserializeChunk(body)
-	if err != nil {
-		http.Error(w, "Invalid chunk format", http.StatusBadRequest)
+	if status, reason := c.receiveChunk(body); status != http.StatusOK {
+		http.Error(w, reason, status)
 		return
 	}
 
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Chunk received"))
+}
+
+// receiveChunk decodes, decrypts and dispatches one encoded response chunk,
+// whether posted to /chunk or fetched from a downstream's /poll. It returns
+// the HTTP status to answer with and, unless that is 200, why.
+func (c *ProxyClient) receiveChunk(body []byte) (int, string) {
+	chunk, err := c.codec.Decode(body)
+	if err != nil {
+		log.Printf("Error deserializing chunk: %v", err)
+		return http.StatusBadRequest, "Invalid chunk format"
+	}
+
+	// Reject oversized chunks before doing any work on them
+	if err := common.CheckChunkSize(chunk, c.config.MaxChunkSize); err != nil {
+		log.Printf("Rejected chunk %d for session %s: %v", chunk.SequenceNum, chunk.SessionID, err)
+		return http.StatusRequestEntityTooLarge, "Chunk too large"
+	}
+
 	// Decrypt chunk if enabled
 	if c.config.Encryption.Enabled {
-		decrypted, err := common.DecryptAES(chunk.Data, c.config.EncryptionKey)
-		if err != nil {
-			http.Error(w, "Decryption failed", http.StatusInternalServerError)
+		if err := c.keys.DecryptChunk(chunk); err != nil {
 			log.Printf("Decryption error: %v", err)
-			return
+			return http.StatusInternalServerError, "Decryption failed"
 		}
-		chunk.Data = decrypted
 	}
 
 	log.Printf("Received response chunk %d/%d for session %s",
@@ -291,27 +886,179 @@ func (c *ProxyClient) handleResponseChunk(w http.ResponseWriter, r *http.Request
 
 	if !exists {
 		log.Printf("No pending session found for %s", chunk.SessionID)
-		w.WriteHeader(http.StatusOK)
-		return
+		return http.StatusOK, ""
+	}
+
+	if chunk.IsControl() {
+		if err := c.handleControlChunk(session, chunk); err != nil {
+			log.Printf("Control chunk error for session %s: %v", chunk.SessionID, err)
+			return http.StatusBadRequest, "Invalid control chunk"
+		}
+		return http.StatusOK, ""
+	}
+
+	if chunk.IsError() {
+		if err := c.handleErrorChunk(session, chunk); err != nil {
+			log.Printf("Error chunk error for session %s: %v", chunk.SessionID, err)
+			return http.StatusBadRequest, "Invalid error chunk"
+		}
+		return http.StatusOK, ""
+	}
+
+	if chunk.IsStream() {
+		if err := c.handleStreamChunk(session, chunk); err != nil {
+			log.Printf("Stream chunk error for session %s: %v", chunk.SessionID, err)
+			return http.StatusBadRequest, "Invalid stream chunk"
+		}
+		return http.StatusOK, ""
 	}
 
 	// Add chunk to session
 	session.mu.Lock()
 	session.Chunks[chunk.SequenceNum] = chunk
 	session.TotalChunks = chunk.TotalChunks
+	received, total := len(session.Chunks), session.TotalChunks
+	// The status and headers come in the control chunk, which may arrive
+	// after the body
+	complete := received == total && session.Meta != nil
 	session.mu.Unlock()
 
+	// Report progress outside the session lock so callbacks may call back in
+	if session.OnProgress != nil {
+		session.OnProgress(received, total)
+	}
+
 	// Check if we have all chunks
-	if len(session.Chunks) == session.TotalChunks {
-		go c.assembleResponse(session)
+	if complete {
+		go c.deliverResponse(session)
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Chunk received"))
+	return http.StatusOK, ""
+}
+
+// deliverResponse assembles a session whose chunks are all in and hands the
+// response to the waiting request
+func (c *ProxyClient) deliverResponse(session *PendingSession) {
+	select {
+	case session.ResponseChan <- c.assembleResponse(session, false):
+	default:
+		log.Printf("Response channel full for session %s", session.SessionID)
+	}
+}
+
+// handleControlChunk records response metadata, handing an event stream to
+// the caller at once
+func (c *ProxyClient) handleControlChunk(session *PendingSession, chunk *common.Chunk) error {
+	session.mu.Lock()
+	key := session.SessionKey
+	session.mu.Unlock()
+
+	data := chunk.Data
+	if key != nil {
+		decrypted, err := common.DecryptAESWithAAD(data, key, chunk.AAD())
+		if err != nil {
+			return fmt.Errorf("session key decryption failed: %w", err)
+		}
+		data = decrypted
+	}
+
+	meta, err := common.DecodeResponseMeta(data)
+	if err != nil {
+		return err
+	}
+
+	// An event stream is handed to the caller now; its events follow
+	if meta.Stream {
+		stream := newEventStream()
+		stream.trailers = make(map[string]string)
+
+		session.mu.Lock()
+		session.Meta = meta
+		session.stream = stream
+		session.mu.Unlock()
+
+		response := &ProxyResponse{
+			StatusCode: meta.StatusCode,
+			Headers:    make(map[string]string),
+			Events:     stream.events,
+			Trailers:   stream.trailers,
+			FinalURL:   session.RequestURL,
+		}
+		if meta.FinalURL != "" {
+			response.FinalURL = meta.FinalURL
+		}
+		for k, v := range meta.Headers {
+			response.Headers[k] = v
+		}
+
+		select {
+		case session.ResponseChan <- response:
+		default:
+		}
+		return nil
+	}
+
+	// The body may have arrived first, leaving only this to wait for
+	session.mu.Lock()
+	session.Meta = meta
+	complete := session.TotalChunks > 0 && len(session.Chunks) == session.TotalChunks
+	session.mu.Unlock()
+
+	if complete {
+		go c.deliverResponse(session)
+	}
+	return nil
+}
+
+// handleErrorChunk fails the request with the error a hop reported. The
+// central proxy seals its reports with the session key; the downstream
+// server holds none, so its reports arrive as they are.
+func (c *ProxyClient) handleErrorChunk(session *PendingSession, chunk *common.Chunk) error {
+	session.mu.Lock()
+	key := session.SessionKey
+	session.mu.Unlock()
+
+	data := chunk.Data
+	if key != nil {
+		if decrypted, err := common.DecryptAESWithAAD(data, key, chunk.AAD()); err == nil {
+			data = decrypted
+		}
+	}
+
+	report, err := common.DecodeErrorChunk(data)
+	if err != nil {
+		return err
+	}
+
+	// The response is waiting at the downstream server instead
+	if report.Buffered && len(c.config.PollServers) > 0 {
+		go func() {
+			if c.pollBuffered(session.SessionID) {
+				return
+			}
+			select {
+			case session.ResponseChan <- &ProxyResponse{StatusCode: report.Code, Error: report}:
+			default:
+			}
+		}()
+		return nil
+	}
+
+	select {
+	case session.ResponseChan <- &ProxyResponse{
+		StatusCode: report.Code,
+		Missing:    report.Missing,
+		Error:      report,
+	}:
+	default:
+	}
+	return nil
 }
 
-// assembleResponse reassembles all chunks into final response
-func (c *ProxyClient) assembleResponse(session *PendingSession) {
+// assembleResponse reassembles all chunks into final response. With partial
+// set it stops at the first missing chunk and returns the prefix before it,
+// marked Partial.
+func (c *ProxyClient) assembleResponse(session *PendingSession, partial bool) *ProxyResponse {
 	session.mu.Lock()
 	defer session.mu.Unlock()
 
@@ -320,33 +1067,112 @@ func (c *ProxyClient) assembleResponse(session *PendingSession) {
 
 	// Reassemble chunks in order
 	var fullResponse bytes.Buffer
+	var missing []int
 	for i := 1; i <= session.TotalChunks; i++ {
 		chunk, exists := session.Chunks[i]
 		if !exists {
-			session.ResponseChan <- &ProxyResponse{
-				Error: fmt.Errorf("missing chunk %d", i),
+			if !partial {
+				return &ProxyResponse{
+					Error: fmt.Errorf("missing chunk %d", i),
+				}
 			}
-			return
+			missing = append(missing, i)
+			continue
+		}
+		if missing != nil {
+			continue // past the gap, not part of the prefix
+		}
+
+		data := chunk.Data
+		if session.SessionKey != nil {
+			decrypted, err := common.DecryptAESWithAAD(data, session.SessionKey, chunk.AAD())
+			if err != nil {
+				return &ProxyResponse{
+					Error: fmt.Errorf("session key decryption failed for chunk %d: %w", i, err),
+				}
+			}
+			data = decrypted
+		}
+
+		data, err := common.Decompress(chunk.Compression, data, int64(c.config.MaxChunkSize))
+		if err != nil {
+			return &ProxyResponse{
+				Error: fmt.Errorf("chunk %d: %w", i, err),
+			}
+		}
+		fullResponse.Write(data)
+	}
+
+	// A complete body must be as long as the central proxy announced
+	if !partial && session.Meta != nil && session.Meta.ContentLength >= 0 && !c.config.SkipLengthCheck &&
+		int64(fullResponse.Len()) != session.Meta.ContentLength {
+		return &ProxyResponse{
+			Error: fmt.Errorf("%w: reassembled %d bytes, expected %d",
+				common.ErrLengthMismatch, fullResponse.Len(), session.Meta.ContentLength),
 		}
-		fullResponse.Write(chunk.Data)
 	}
 
-	// Create response
+	// Create response; if the control chunk was lost only the body encoding
+	// is known
 	response := &ProxyResponse{
-		StatusCode: 200, // In production, get this from response metadata
+		StatusCode: http.StatusOK,
 		Headers:    make(map[string]string),
 		Body:       fullResponse.Bytes(),
 		Error:      nil,
+		Partial:    len(missing) > 0,
+		Missing:    missing,
+		FinalURL:   session.RequestURL,
+	}
+
+	var encoding string
+	if first, exists := session.Chunks[1]; exists {
+		encoding = first.Headers["Content-Encoding"]
+	}
+	if session.Meta != nil {
+		response.StatusCode = session.Meta.StatusCode
+		for k, v := range session.Meta.Headers {
+			response.Headers[k] = v
+		}
+		encoding = response.Headers["Content-Encoding"]
+		if session.Meta.FinalURL != "" {
+			response.FinalURL = session.Meta.FinalURL
+		}
+		response.Trailers = session.Meta.Trailers
+	}
+
+	// Decode a compressed body; other encodings are passed through as-is
+	if encoding != "" {
+		if encoding == "gzip" {
+			decoded, err := gunzip(response.Body)
+			if partial && (errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)) {
+				err = nil // a truncated body decodes as far as it goes
+			}
+			if err != nil {
+				response.Error = fmt.Errorf("failed to decode gzip response: %w", err)
+			} else {
+				log.Printf("Decompressed response: %d -> %d bytes", len(response.Body), len(decoded))
+				response.Body = decoded
+				delete(response.Headers, "Content-Encoding")
+				delete(response.Headers, "Content-Length")
+			}
+		} else {
+			response.Headers["Content-Encoding"] = encoding
+		}
 	}
 
 	log.Printf("Response assembled: %d bytes", len(response.Body))
+	return response
+}
 
-	// Send to waiting goroutine
-	select {
-	case session.ResponseChan <- response:
-	default:
-		log.Printf("Response channel full for session %s", session.SessionID)
+// gunzip decompresses a gzip body
+func gunzip(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
 	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
 }
 
 // healthCheck endpoint
@@ -355,13 +1181,15 @@ func (c *ProxyClient) healthCheck(w http.ResponseWriter, r *http.Request) {
 	pendingCount := len(c.pendingSessions)
 	c.mu.RUnlock()
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":           "healthy",
-		"role":             "proxy-client",
+	chunkSize := c.config.ChunkSize
+	if c.chunker != nil {
+		chunkSize = c.chunker.Size()
+	}
+
+	common.WriteHealth(w, common.NewHealthInfo("proxy-client", map[string]any{
 		"pending_sessions": pendingCount,
-		"time":             time.Now().Format(time.RFC3339),
-	})
+		"chunk_size":       chunkSize,
+	}))
 }
 
 // GET performs an HTTP GET request through the proxy
@@ -380,57 +1208,3 @@ func generateSessionID() string {
 	rand.Read(b)
 	return hex.EncodeToString(b)
 }
-
-// Example usage
-func main() {
-	configPath := "config/client.yaml"
-	if len(os.Args) > 1 {
-		configPath = os.Args[1]
-	}
-
-	client, err := NewProxyClient(configPath)
-	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
-	}
-
-	// Start listening for responses in background
-	go func() {
-		if err := client.Start(); err != nil {
-			log.Fatalf("Client server error: %v", err)
-		}
-	}()
-
-	// Wait for server to start
-	time.Sleep(1 * time.Second)
-
-	log.Println("Proxy client ready!")
-	log.Println("\nExample usage:")
-	log.Println("  response, err := client.GET(\"http://example.com\", nil)")
-	log.Println("  response, err := client.POST(\"http://api.example.com/data\", body, headers)")
-
-	// Example request (commented out - uncomment to test)
-	/*
-		headers := map[string]string{
-			"User-Agent": "ProxyClient/1.0",
-			"Accept": "text/html",
-		}
-
-		response, err := client.GET("http://example.com", headers)
-		if err != nil {
-			log.Printf("Request failed: %v", err)
-		} else {
-			log.Printf("Response received: %d bytes", len(response.Body))
-			log.Printf("First 100 chars: %s", string(response.Body[:min(100, len(response.Body))]))
-		}
-	*/
-
-	// Keep running
-	select {}
-}
-
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
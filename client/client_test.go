@@ -0,0 +1,541 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+func TestRequestRoundTripInMemory(t *testing.T) {
+	client, hops := newStubClient(t, stubConfig, echo)
+
+	body := []byte("a body spread over several chunks")
+	response, err := client.POST("http://target/echo", body, nil)
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	if !bytes.Equal(response.Body, body) {
+		t.Errorf("got body %q, want %q", response.Body, body)
+	}
+	if want := (len(body) + 3) / 4; hops.requestChunks() != want {
+		t.Errorf("stub received %d request chunks, want %d", hops.requestChunks(), want)
+	}
+}
+
+func TestEmptyUpstreamListRejected(t *testing.T) {
+	_, err := NewProxyClient(writeConfig(t, `
+upstream_servers: []
+downstream_port: 7000
+`))
+	if err == nil || !strings.Contains(err.Error(), "no upstream servers configured") {
+		t.Errorf("got %v, want the empty upstream list rejected", err)
+	}
+}
+
+func TestSingleUpstream(t *testing.T) {
+	client, hops := newStubClient(t, stubConfig, echo)
+
+	body := bytes.Repeat([]byte("x"), 37)
+	response, err := client.POST("http://target/", body, nil)
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	if !bytes.Equal(response.Body, body) {
+		t.Errorf("got %d bytes back, want %d", len(response.Body), len(body))
+	}
+	if hops.requestChunks() != 10 {
+		t.Errorf("the only upstream got %d of 10 chunks", hops.requestChunks())
+	}
+}
+
+func TestManyTinyResponseChunks(t *testing.T) {
+	client, hops := newStubClient(t, stubConfig, func(req stubRequest) []byte {
+		return bytes.Repeat([]byte("abc"), 50)
+	})
+	hops.chunkSize = 1
+
+	response, err := client.GET("http://target/", nil)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if want := strings.Repeat("abc", 50); string(response.Body) != want {
+		t.Errorf("reassembled %q, want %q", response.Body, want)
+	}
+}
+
+func TestProgressEvents(t *testing.T) {
+	client, _ := newStubClient(t, stubConfig, func(req stubRequest) []byte {
+		return []byte("twenty bytes of body")
+	})
+
+	var mu sync.Mutex
+	var events [][2]int
+	response, err := client.MakeRequestWithOptions(http.MethodGet, "http://target/", nil, nil, RequestOptions{
+		OnProgress: func(received, total int) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, [2]int{received, total})
+		},
+	})
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if string(response.Body) != "twenty bytes of body" {
+		t.Errorf("got body %q", response.Body)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := [][2]int{{1, 5}, {2, 5}, {3, 5}, {4, 5}, {5, 5}}
+	if !slices.Equal(events, want) {
+		t.Errorf("progress events %v, want %v", events, want)
+	}
+}
+
+func TestOversizedResponseChunkRejected(t *testing.T) {
+	_, hops := newStubClient(t, stubConfig+"max_chunk_size: 64\n", echo)
+	status := hops.push(&common.Chunk{
+		SessionID:   "big",
+		SequenceNum: 1,
+		TotalChunks: 1,
+		Data:        bytes.Repeat([]byte("x"), 65),
+		Timestamp:   time.Now(),
+	})
+	if status != http.StatusRequestEntityTooLarge {
+		t.Errorf("65 byte response chunk: status %d, want 413", status)
+	}
+}
+
+func TestLostResponseChunkReported(t *testing.T) {
+	client, hops := newStubClient(t, strings.Replace(stubConfig, "timeout: 2000", "timeout: 200", 1), func(req stubRequest) []byte {
+		return []byte("sixteen byte body")
+	})
+	hops.drop = func(seq int) bool { return seq == 3 }
+
+	_, err := client.GET("http://target/", nil)
+	if !errors.Is(err, ErrResponseTimeout) {
+		t.Fatalf("got %v, want ErrResponseTimeout", err)
+	}
+	if !strings.Contains(err.Error(), "received 4/5 response chunks, missing [3]") {
+		t.Errorf("error %q does not name the missing chunk", err)
+	}
+}
+
+func TestLostResponseChunkAllowPartial(t *testing.T) {
+	client, hops := newStubClient(t, strings.Replace(stubConfig, "timeout: 2000", "timeout: 200", 1), func(req stubRequest) []byte {
+		return []byte("0123456789ab")
+	})
+	hops.drop = func(seq int) bool { return seq == 2 }
+
+	response, _ := client.MakeRequestWithOptions(http.MethodGet, "http://target/", nil, nil, RequestOptions{AllowPartial: true})
+	if response == nil || !response.Partial {
+		t.Fatalf("got %+v, want a partial response", response)
+	}
+	if !slices.Equal(response.Missing, []int{2}) {
+		t.Errorf("missing %v, want [2]", response.Missing)
+	}
+	// Chunks 3 and later arrived but only the contiguous prefix is usable
+	if string(response.Body) != "0123" {
+		t.Errorf("partial body %q, want the prefix before chunk 2", response.Body)
+	}
+}
+
+func TestGzipResponseDecoded(t *testing.T) {
+	body := bytes.Repeat([]byte("compressible "), 20)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(body)
+	zw.Close()
+
+	var asked string
+	client, hops := newStubClient(t, stubConfig+"compression: true\n", func(req stubRequest) []byte {
+		asked = req.Headers["Accept-Encoding"]
+		return compressed.Bytes()
+	})
+	hops.headers = map[string]string{"Content-Encoding": "gzip"}
+	hops.meta = &common.ResponseMeta{
+		StatusCode:    http.StatusOK,
+		Headers:       map[string]string{"Content-Encoding": "gzip"},
+		ContentLength: -1,
+	}
+
+	response, err := client.GET("http://target/", nil)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if asked != "gzip" {
+		t.Errorf("target asked for Accept-Encoding %q, want gzip", asked)
+	}
+	if !bytes.Equal(response.Body, body) {
+		t.Errorf("got body %q, want it decompressed", response.Body)
+	}
+	if _, exists := response.Headers["Content-Encoding"]; exists {
+		t.Error("Content-Encoding kept on a decoded body")
+	}
+}
+
+func TestInvalidConfigs(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want string
+	}{
+		{"upstream_servers: [u:1]\ndownstream_port: 7000\nchunk_size: -1\n", "chunk_size must not be negative"},
+		{"upstream_servers: [u:1]\ndownstream_port: -1\n", "downstream_port must be between 1 and 65535"},
+		{"upstream_servers: [u:1]\ndownstream_port: 7000\ntimeout: -1\n", "timeout must not be negative"},
+		{"upstream_servers: [u:1]\ndownstream_port: 7000\nbalance_policy: fastest\n", "unknown balance_policy"},
+	}
+	for _, tt := range tests {
+		_, err := LoadClientConfig(writeConfig(t, tt.yaml))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.yaml, err, tt.want)
+		}
+	}
+}
+
+func TestConfigReportsEveryProblem(t *testing.T) {
+	_, err := LoadClientConfig(writeConfig(t, "upstream_servers: []\ndownstream_port: -1\nchunk_size: -1\n"))
+	for _, want := range []string{"no upstream servers", "downstream_port", "chunk_size"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got %v, want it to mention %s", err, want)
+		}
+	}
+}
+
+func TestForwardingFailureInAckSurfaced(t *testing.T) {
+	client, hops := newStubClient(t, stubConfig, echo)
+	hops.reject = func(chunk *common.Chunk) *common.ChunkAck {
+		if chunk.SequenceNum != 2 {
+			return nil
+		}
+		return &common.ChunkAck{SessionID: chunk.SessionID, SequenceNum: 2, Error: "central proxy unreachable"}
+	}
+
+	start := time.Now()
+	_, err := client.POST("http://target/", []byte("twelve bytes"), nil)
+	if err == nil || !strings.Contains(err.Error(), "upstream could not forward chunk 2: central proxy unreachable") {
+		t.Errorf("got %v, want the failed ack reported", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("failure took %v to surface, want it before the timeout", elapsed)
+	}
+}
+
+func TestControlChunkSetsStatusAndHeaders(t *testing.T) {
+	client, hops := newStubClient(t, stubConfig, func(req stubRequest) []byte {
+		return []byte("not found")
+	})
+	hops.meta = &common.ResponseMeta{
+		StatusCode:    http.StatusNotFound,
+		Headers:       map[string]string{"X-Target": "yes"},
+		ContentLength: 9,
+		FinalURL:      "http://target/moved",
+	}
+
+	response, err := client.GET("http://target/", nil)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("status %d, want 404", response.StatusCode)
+	}
+	if response.Headers["X-Target"] != "yes" {
+		t.Errorf("headers %v, want X-Target from the control chunk", response.Headers)
+	}
+	if response.FinalURL != "http://target/moved" {
+		t.Errorf("final URL %q", response.FinalURL)
+	}
+	if string(response.Body) != "not found" {
+		t.Errorf("body %q", response.Body)
+	}
+}
+
+func TestResponseWithoutControlChunk(t *testing.T) {
+	// Hops predating control chunks send the body alone, which is taken as
+	// it is once the control chunk is given up on
+	client, hops := newStubClient(t, strings.Replace(stubConfig, "timeout: 2000", "timeout: 300", 1), echo)
+	hops.noMeta = true
+
+	response, err := client.POST("http://target/", []byte("legacy body"), nil)
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("status %d, want 200 assumed", response.StatusCode)
+	}
+	if string(response.Body) != "legacy body" {
+		t.Errorf("body %q", response.Body)
+	}
+}
+
+func TestControlChunkAfterBody(t *testing.T) {
+	client, hops := newStubClient(t, stubConfig, echo)
+	hops.meta = &common.ResponseMeta{StatusCode: http.StatusNotFound, ContentLength: 9}
+	hops.metaLast = true
+
+	start := time.Now()
+	response, err := client.POST("http://target/", []byte("not found"), nil)
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	// Completed by the control chunk, not by giving up on it
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("response took %v, want it once the control chunk came", elapsed)
+	}
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("status %d, want the control chunk's 404", response.StatusCode)
+	}
+	if string(response.Body) != "not found" {
+		t.Errorf("body %q", response.Body)
+	}
+}
+
+func TestFinalURLDefaultsToRequestURL(t *testing.T) {
+	client, hops := newStubClient(t, stubConfig, echo)
+	hops.meta = &common.ResponseMeta{StatusCode: http.StatusOK, ContentLength: -1}
+
+	response, err := client.GET("http://target/page", nil)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if response.FinalURL != "http://target/page" {
+		t.Errorf("final URL %q, want the request URL without a redirect", response.FinalURL)
+	}
+}
+
+func TestControlChunkLengthChecked(t *testing.T) {
+	client, hops := newStubClient(t, stubConfig, echo)
+	hops.meta = &common.ResponseMeta{StatusCode: http.StatusOK, ContentLength: 100}
+
+	_, err := client.POST("http://target/", []byte("short"), nil)
+	if !errors.Is(err, common.ErrLengthMismatch) {
+		t.Errorf("got %v, want ErrLengthMismatch", err)
+	}
+}
+
+// digest answers a stub request with the size and SHA-256 of its body
+func digest(req stubRequest) []byte {
+	sum := sha256.Sum256(req.Body)
+	return []byte(fmt.Sprintf("%d %x", len(req.Body), sum))
+}
+
+func TestLargeStreamedUpload(t *testing.T) {
+	spool := t.TempDir()
+	client, _ := newStubClient(t, strings.Replace(stubConfig, "chunk_size: 4", "chunk_size: 65536", 1)+"spool_dir: "+spool+"\n", digest)
+
+	// 4 MiB read through a plain reader, so it is spooled
+	const size = 4 << 20
+	source := io.LimitReader(rand.New(rand.NewSource(1)), size)
+	hash := sha256.New()
+	response, err := client.MakeRequestStream(http.MethodPut, "http://target/upload", io.TeeReader(source, hash), nil)
+	if err != nil {
+		t.Fatalf("MakeRequestStream: %v", err)
+	}
+	if want := fmt.Sprintf("%d %x", size, hash.Sum(nil)); string(response.Body) != want {
+		t.Errorf("target received %q, want %q", response.Body, want)
+	}
+
+	if leftover, _ := os.ReadDir(spool); len(leftover) != 0 {
+		t.Errorf("spool files left behind: %v", leftover)
+	}
+}
+
+func TestStreamedUploadFromSeekPosition(t *testing.T) {
+	client, _ := newStubClient(t, stubConfig, digest)
+
+	body := bytes.NewReader([]byte("skipped|sent on"))
+	body.Seek(int64(len("skipped|")), io.SeekStart)
+	response, err := client.MakeRequestStream(http.MethodPost, "http://target/", body, nil)
+	if err != nil {
+		t.Fatalf("MakeRequestStream: %v", err)
+	}
+	if want := digest(stubRequest{Body: []byte("sent on")}); !bytes.Equal(response.Body, want) {
+		t.Errorf("target received %q, want %q", response.Body, want)
+	}
+}
+
+func TestReadyOnceListenerBound(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	client, err := NewProxyClient(writeConfig(t, fmt.Sprintf("upstream_servers: [up:1]\nlisten_address: 127.0.0.1\ndownstream_port: %d\n", port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready := func() int {
+		recorder := httptest.NewRecorder()
+		client.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return recorder.Code
+	}
+
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("before Start: /ready %d, want 503", code)
+	}
+
+	go client.Start()
+	for deadline := time.Now().Add(2 * time.Second); ready() != http.StatusOK; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("never ready after Start")
+		}
+	}
+	client.responseServer.Close()
+}
+
+func TestShortEncryptionKeyFailsFast(t *testing.T) {
+	_, err := NewProxyClient(writeConfig(t, `
+upstream_servers: [up:1]
+downstream_port: 7000
+encryption:
+  enabled: true
+  encryption_key_hex: "00112233445566778899"
+`))
+	if err == nil || !strings.Contains(err.Error(), "must decode to 32 bytes for AES-256, got 10") {
+		t.Errorf("got %v, want the 10 byte key rejected", err)
+	}
+}
+
+func TestHeadersSentOnce(t *testing.T) {
+	var seen map[string]string
+	client, hops := newStubClient(t, stubConfig, func(req stubRequest) []byte {
+		seen = req.Headers
+		return nil
+	})
+
+	if _, err := client.POST("http://target/", []byte("twelve bytes"), map[string]string{"X-Big": "value"}); err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	if seen["X-Big"] != "value" {
+		t.Errorf("target saw headers %v", seen)
+	}
+
+	hops.mu.Lock()
+	defer hops.mu.Unlock()
+	for _, chunks := range hops.sessions {
+		for seq, chunk := range chunks {
+			if seq != 1 && chunk.Headers != nil {
+				t.Errorf("chunk %d repeats the headers", seq)
+			}
+		}
+	}
+}
+
+func TestOversizedHeadersRejected(t *testing.T) {
+	client, hops := newStubClient(t, stubConfig+"max_header_size: 64\n", echo)
+
+	_, err := client.GET("http://target/", map[string]string{"X-Big": strings.Repeat("x", 100)})
+	if !errors.Is(err, common.ErrHeadersTooLarge) {
+		t.Errorf("got %v, want ErrHeadersTooLarge", err)
+	}
+	if hops.requestChunks() != 0 {
+		t.Errorf("%d chunks sent with oversized headers", hops.requestChunks())
+	}
+}
+
+func TestChunkSizeTunedFromSends(t *testing.T) {
+	yaml := strings.Replace(stubConfig, "chunk_size: 4", "chunk_size: 16", 1) + "chunk_tuning:\n  enabled: true\n  min_size: 2\n  max_size: 64\n"
+	client, hops := newStubClient(t, yaml, echo)
+	hops.reject = func(chunk *common.Chunk) *common.ChunkAck {
+		return &common.ChunkAck{SessionID: chunk.SessionID, SequenceNum: chunk.SequenceNum, Error: "lost"}
+	}
+
+	client.POST("http://target/", bytes.Repeat([]byte("x"), 16), nil)
+	if size := client.chunker.Size(); size != 8 {
+		t.Fatalf("size %d after a lost chunk, want 8", size)
+	}
+
+	hops.reject = nil
+	if _, err := client.POST("http://target/", bytes.Repeat([]byte("x"), 32), nil); err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	if size := client.chunker.Size(); size <= 8 {
+		t.Errorf("size %d after four clean sends, want it grown", size)
+	}
+}
+
+func TestErrorChunkSurfacedAsResponseError(t *testing.T) {
+	client, hops := newStubClient(t, stubConfig, func(req stubRequest) []byte { return nil })
+	hops.drop = func(seq int) bool { return true }
+	hops.reject = func(chunk *common.Chunk) *common.ChunkAck {
+		// Answer the request with an error chunk once it is in
+		go func() {
+			notice, _ := common.NewErrorChunk(chunk.SessionID, "", &common.ErrorChunk{
+				Code:    http.StatusBadGateway,
+				Message: "target unreachable",
+				Hop:     "central-proxy",
+			})
+			hops.push(notice)
+		}()
+		return nil
+	}
+
+	response, err := client.GET("http://target/", nil)
+	var report *common.ErrorChunk
+	if !errors.As(err, &report) || report.Code != http.StatusBadGateway || err.Error() != "central-proxy: target unreachable" {
+		t.Fatalf("got %v, want the central proxy's report", err)
+	}
+	if response == nil || response.StatusCode != http.StatusBadGateway || response.Error != err {
+		t.Errorf("response %+v, want status 502 and the report as its error", response)
+	}
+}
+
+func TestDownstreamNoticeFailsBeforeTimeout(t *testing.T) {
+	client, hops := newStubClient(t, strings.Replace(stubConfig, "timeout: 2000", "timeout: 5000", 1), func(req stubRequest) []byte {
+		return []byte("twelve bytes")
+	})
+	hops.drop = func(seq int) bool { return seq == 2 }
+
+	// Once the other chunks are in, the downstream gives up on chunk 2
+	go func() {
+		for {
+			hops.mu.Lock()
+			var session string
+			for id := range hops.sessions {
+				session = id
+			}
+			hops.mu.Unlock()
+			if session != "" {
+				time.Sleep(20 * time.Millisecond)
+				notice, _ := common.NewErrorChunk(session, "", &common.ErrorChunk{
+					Code:    http.StatusGatewayTimeout,
+					Message: "downstream reassembly timed out",
+					Hop:     "downstream",
+					Missing: []int{2},
+				})
+				hops.push(notice)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	response, err := client.GET("http://target/", nil)
+	var report *common.ErrorChunk
+	if !errors.As(err, &report) || report.Hop != "downstream" {
+		t.Fatalf("got %v, want the downstream's notice", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("failed after %v, want well before the 5s timeout", elapsed)
+	}
+	if response == nil || !slices.Equal(response.Missing, []int{2}) {
+		t.Errorf("response %+v, want chunk 2 reported missing", response)
+	}
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// clientSecretHex is a client secret as written in config
+const clientSecretHex = "00112233445566778899aabbccddeeff"
+
+// verifyingUpstream checks the signature on every request against keys
+// before passing it to next, refusing unsigned ones with 401
+func verifyingUpstream(keys map[string][]byte, next http.Handler, signed *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if _, err := common.VerifyClientRequest(r, body, keys, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		signed.Add(1)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestClientSignsChunks(t *testing.T) {
+	secret, _ := common.DecodeClientSecret(clientSecretHex)
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte(clientSecretHex+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, credentials := range map[string]string{
+		"secret":      "  secret: \"" + clientSecretHex + "\"\n",
+		"secret_file": "  secret_file: " + secretFile + "\n",
+	} {
+		var signed atomic.Int32
+		hops := newStubHops(echo)
+		hops.client = newTestClient(t, stubConfig+"credentials:\n  key_id: laptop\n"+credentials,
+			map[string]http.Handler{"up:1": verifyingUpstream(map[string][]byte{"laptop": secret}, hops, &signed)})
+
+		response, err := hops.client.POST("http://target/", []byte("signed body"), nil)
+		if err != nil {
+			t.Fatalf("%s: POST: %v", name, err)
+		}
+		if string(response.Body) != "signed body" {
+			t.Errorf("%s: body %q", name, response.Body)
+		}
+		if got := signed.Load(); got != 3 {
+			t.Errorf("%s: %d signed chunks, want 3", name, got)
+		}
+	}
+}
+
+func TestRefusedCredentialsReported(t *testing.T) {
+	var signed atomic.Int32
+	hops := newStubHops(echo)
+	other := map[string][]byte{"laptop": []byte("fedcba9876543210")}
+	hops.client = newTestClient(t, stubConfig+"credentials:\n  key_id: laptop\n  secret: \""+clientSecretHex+"\"\n",
+		map[string]http.Handler{"up:1": verifyingUpstream(other, hops, &signed)})
+
+	_, err := hops.client.POST("http://target/", []byte("body"), nil)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("got %v, want ErrUnauthorized", err)
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestChunksDispatchedConcurrently(t *testing.T) {
+	hops := newStubHops(echo)
+	gauge := &inflightGauge{next: hops}
+	hops.client = newTestClient(t, `
+upstream_servers: ["up:1"]
+downstream_port: 7000
+chunk_size: 4
+timeout: 5000
+send_concurrency: 3
+encryption:
+  enabled: false
+`, map[string]http.Handler{"up:1": gauge})
+
+	body := bytes.Repeat([]byte("x"), 96)
+	response, err := hops.client.POST("http://target/", body, nil)
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	if !bytes.Equal(response.Body, body) {
+		t.Errorf("got %d bytes back, want %d", len(response.Body), len(body))
+	}
+	if peak := gauge.peak.Load(); peak != 3 {
+		t.Errorf("%d chunks in flight at most, want send_concurrency 3", peak)
+	}
+}
+
+func TestDispatchErrorsAggregated(t *testing.T) {
+	hops := newStubHops(echo)
+	failing := map[int]bool{2: true, 4: true}
+	hops.client = newTestClient(t, `
+upstream_servers: ["up:1"]
+downstream_port: 7000
+chunk_size: 4
+timeout: 2000
+send_concurrency: 4
+encryption:
+  enabled: false
+`, map[string]http.Handler{"up:1": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		chunk, err := hops.client.codec.Decode(data)
+		if err == nil && failing[chunk.SequenceNum] {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		hops.ServeHTTP(w, r)
+	})})
+
+	_, err := hops.client.POST("http://target/", []byte("twenty bytes of body"), nil)
+	if err == nil {
+		t.Fatal("POST succeeded with two chunks refused")
+	}
+	for _, want := range []string{"chunk 2 to up:1", "chunk 4 to up:1"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not report %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "chunk 1 ") || strings.Contains(err.Error(), "chunk 3 ") {
+		t.Errorf("error %q reports chunks that were sent", err)
+	}
+}
@@ -0,0 +1,25 @@
+// Package display holds the parts of the client front ends that don't
+// depend on a UI toolkit: editing request headers and formatting response
+// bodies for display.
+package display
+
+import "strings"
+
+// CollectHeaders merges editor pairs over the defaults. Rows with an empty
+// key are ignored; later rows win over earlier ones with the same key.
+func CollectHeaders(defaults map[string]string, pairs [][2]string) map[string]string {
+	headers := make(map[string]string, len(defaults)+len(pairs))
+	for k, v := range defaults {
+		headers[k] = v
+	}
+
+	for _, pair := range pairs {
+		key := strings.TrimSpace(pair[0])
+		if key == "" {
+			continue
+		}
+		headers[key] = strings.TrimSpace(pair[1])
+	}
+
+	return headers
+}
@@ -0,0 +1,37 @@
+package display
+
+import "testing"
+
+func TestCollectHeaders(t *testing.T) {
+	defaults := map[string]string{
+		"User-Agent": "Distributed-Proxy-GUI/1.0",
+		"Accept":     "*/*",
+	}
+	pairs := [][2]string{
+		{"Authorization", "Bearer abc"},
+		{" X-Trace ", " id=1 "},
+		{"", "row without a key"},
+		{"Accept", "application/json"},
+		{"X-Trace", "id=2"},
+	}
+
+	got := CollectHeaders(defaults, pairs)
+	want := map[string]string{
+		"User-Agent":    "Distributed-Proxy-GUI/1.0",
+		"Accept":        "application/json",
+		"Authorization": "Bearer abc",
+		"X-Trace":       "id=2",
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+
+	if defaults["Accept"] != "*/*" {
+		t.Error("CollectHeaders modified the defaults")
+	}
+}
@@ -0,0 +1,166 @@
+package display
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// RenderMode is how a response body is shown in the response area
+type RenderMode int
+
+const (
+	RenderText   RenderMode = iota // as received
+	RenderJSON                     // pretty-printed
+	RenderHTML                     // source, broken into lines at block elements
+	RenderBinary                   // hex preview, with an offer to save it
+)
+
+// String names the mode in status messages
+func (m RenderMode) String() string {
+	switch m {
+	case RenderJSON:
+		return "JSON"
+	case RenderHTML:
+		return "HTML"
+	case RenderBinary:
+		return "binary"
+	default:
+		return "text"
+	}
+}
+
+const (
+	maxDisplayBytes = 10000 // text shown before the rest is cut off
+	hexPreviewBytes = 512   // bytes of a binary body shown as hex
+	binarySniffSize = 1024  // bytes looked at to tell text from binary
+)
+
+// RenderBody formats a response body for display, picking the mode from
+// its Content-Type and, when that says nothing useful, from the body itself
+func RenderBody(headers map[string]string, body []byte) (string, RenderMode) {
+	mode := SelectRenderMode(headers["Content-Type"], body)
+
+	var text string
+	switch mode {
+	case RenderJSON:
+		pretty, err := prettyJSON(body)
+		if err != nil {
+			mode, text = RenderText, string(body) // mislabelled, show it as is
+		} else {
+			text = pretty
+		}
+	case RenderHTML:
+		text = formatHTML(body)
+	case RenderBinary:
+		return hexPreview(body), mode
+	default:
+		text = string(body)
+	}
+
+	return truncateText(text, maxDisplayBytes), mode
+}
+
+// SelectRenderMode maps a Content-Type to a render mode. Bodies without a
+// usable type are sniffed: binary if they don't look like text, JSON if
+// they parse as JSON, text otherwise.
+func SelectRenderMode(contentType string, body []byte) RenderMode {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "" || mediaType == "application/octet-stream" {
+		switch {
+		case isBinary(body):
+			return RenderBinary
+		case json.Valid(body):
+			return RenderJSON
+		default:
+			return RenderText
+		}
+	}
+
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return RenderJSON
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		return RenderHTML
+	case strings.HasPrefix(mediaType, "text/"),
+		mediaType == "application/xml" || strings.HasSuffix(mediaType, "+xml"),
+		mediaType == "application/javascript",
+		mediaType == "application/x-www-form-urlencoded":
+		return RenderText
+	default:
+		return RenderBinary
+	}
+}
+
+// isBinary reports whether the start of body looks like binary data:
+// invalid UTF-8, or control characters that text doesn't contain
+func isBinary(body []byte) bool {
+	sample := body
+	if len(sample) > binarySniffSize {
+		sample = sample[:binarySniffSize]
+		// Don't count a rune cut in half by the sample as invalid
+		for i := 0; i < utf8.UTFMax-1 && !utf8.Valid(sample); i++ {
+			sample = sample[:len(sample)-1]
+		}
+	}
+
+	if !utf8.Valid(sample) {
+		return true
+	}
+	for _, b := range sample {
+		if b < 0x20 && b != '\n' && b != '\r' && b != '\t' && b != '\f' {
+			return true
+		}
+	}
+	return false
+}
+
+// prettyJSON indents a JSON body two spaces per level
+func prettyJSON(body []byte) (string, error) {
+	var out bytes.Buffer
+	if err := json.Indent(&out, body, "", "  "); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// htmlBreak matches tags after which a new line starts: line breaks and
+// the ends of block elements
+var htmlBreak = regexp.MustCompile(`(?i)<(?:br\s*/?|/(?:p|div|li|ul|ol|tr|table|h[1-6]|head|title|header|footer|section|article|pre|blockquote))>`)
+
+// blankLines matches runs of lines holding only whitespace
+var blankLines = regexp.MustCompile(`\n(?:[ \t]*\n)+`)
+
+// formatHTML shows HTML source with a line per block element, so minified
+// pages don't end up as a single line
+func formatHTML(body []byte) string {
+	text := htmlBreak.ReplaceAllString(string(body), "$0\n")
+	return strings.TrimSpace(blankLines.ReplaceAllString(text, "\n\n"))
+}
+
+// hexPreview dumps the start of a binary body as hex and notes how much
+// more there is
+func hexPreview(body []byte) string {
+	if len(body) <= hexPreviewBytes {
+		return hex.Dump(body)
+	}
+	return hex.Dump(body[:hexPreviewBytes]) +
+		fmt.Sprintf("\n... %d more bytes, use File > Save Response to keep them", len(body)-hexPreviewBytes)
+}
+
+// truncateText cuts text to at most limit bytes, on a rune boundary
+func truncateText(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + "\n\n... (truncated, too large)"
+}
@@ -0,0 +1,100 @@
+package display
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPrettyJSON(t *testing.T) {
+	got, err := prettyJSON([]byte(`{"name":"proxy","ports":[1,2],"nested":{"ok":true}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "name": "proxy",
+  "ports": [
+    1,
+    2
+  ],
+  "nested": {
+    "ok": true
+  }
+}`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	if _, err := prettyJSON([]byte(`{"cut short":`)); err == nil {
+		t.Error("invalid JSON indented")
+	}
+}
+
+func TestIsBinary(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   []byte
+		binary bool
+	}{
+		{"ascii", []byte("plain text\r\n\twith whitespace"), false},
+		{"utf-8", []byte("héllo wörld, 日本語"), false},
+		{"empty", nil, false},
+		{"nul bytes", []byte("PK\x03\x04\x00\x00"), true},
+		{"png", []byte("\x89PNG\r\n\x1a\n"), true},
+		{"invalid utf-8", []byte{0xff, 0xfe, 'a'}, true},
+		// A rune cut in half at the end of the sample is still text
+		{"long utf-8", []byte("a" + strings.Repeat("é", binarySniffSize)), false},
+	}
+	for _, tt := range tests {
+		if got := isBinary(tt.body); got != tt.binary {
+			t.Errorf("%s: isBinary = %v, want %v", tt.name, got, tt.binary)
+		}
+	}
+}
+
+func TestSelectRenderMode(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        RenderMode
+	}{
+		{"application/json; charset=utf-8", `{}`, RenderJSON},
+		{"application/problem+json", `{}`, RenderJSON},
+		{"text/html", "<p>hi</p>", RenderHTML},
+		{"text/plain", "hi", RenderText},
+		{"application/xml", "<a/>", RenderText},
+		{"image/png", "\x89PNG", RenderBinary},
+		{"", `{"sniffed": true}`, RenderJSON},
+		{"", "just words", RenderText},
+		{"application/octet-stream", "\x00\x01", RenderBinary},
+	}
+	for _, tt := range tests {
+		if got := SelectRenderMode(tt.contentType, []byte(tt.body)); got != tt.want {
+			t.Errorf("%q with %q: got %v, want %v", tt.contentType, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestRenderBody(t *testing.T) {
+	// Mislabelled JSON is shown as it came
+	text, mode := RenderBody(map[string]string{"Content-Type": "application/json"}, []byte("not json"))
+	if mode != RenderText || text != "not json" {
+		t.Errorf("mislabelled JSON: %v %q", mode, text)
+	}
+
+	text, mode = RenderBody(map[string]string{"Content-Type": "text/html"}, []byte("<div>a</div><div>b</div>"))
+	if mode != RenderHTML || text != "<div>a</div>\n<div>b</div>" {
+		t.Errorf("HTML: %v %q", mode, text)
+	}
+
+	body := bytes.Repeat([]byte{0x00}, hexPreviewBytes+10)
+	text, mode = RenderBody(map[string]string{"Content-Type": "application/octet-stream"}, body)
+	if mode != RenderBinary || !strings.Contains(text, "10 more bytes") {
+		t.Errorf("binary: %v, preview ends %q", mode, text[len(text)-60:])
+	}
+
+	text, _ = RenderBody(nil, bytes.Repeat([]byte("a"), maxDisplayBytes+1))
+	if !strings.HasSuffix(text, "(truncated, too large)") {
+		t.Error("long text not truncated")
+	}
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// freePort returns a loopback port nothing is listening on
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startComponent builds the component in dir of the module, runs it with
+// config and waits until its /health answers
+func startComponent(t *testing.T, dir string, port int, config string) {
+	t.Helper()
+	work := t.TempDir()
+
+	binary := filepath.Join(work, dir)
+	build := exec.Command("go", "build", "-o", binary, "./"+dir)
+	build.Dir = ".."
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building %s: %v\n%s", dir, err, out)
+	}
+
+	configPath := filepath.Join(work, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	cmd := exec.Command(binary, configPath)
+	cmd.Stdout, cmd.Stderr = &logs, &logs
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("%s output:\n%s", dir, logs.String())
+		}
+	})
+
+	health := fmt.Sprintf("http://127.0.0.1:%d/health", port)
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if resp, err := http.Get(health); err == nil {
+			resp.Body.Close()
+			return
+		}
+	}
+	t.Fatalf("%s did not come up on port %d", dir, port)
+}
+
+// TestEndToEnd sends requests through a real upstream, central proxy and
+// downstream server, all on loopback, and checks the target's answers come
+// back whole
+func TestEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs every server")
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Target", "reached")
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+	}))
+	defer target.Close()
+
+	upstream, central, downstream, client := freePort(t), freePort(t), freePort(t), freePort(t)
+
+	startComponent(t, "downstream-server", downstream, fmt.Sprintf(`
+listen_port: %d
+encryption:
+  enabled: true
+`, downstream))
+	startComponent(t, "central-proxy", central, fmt.Sprintf(`
+listen_port: %d
+downstream_servers: ["127.0.0.1:%d"]
+response_chunk_size: 64
+encryption:
+  enabled: true
+destinations:
+  allow: ["127.0.0.1/32"]
+`, central, downstream))
+	startComponent(t, "upstream-server", upstream, fmt.Sprintf(`
+listen_port: %d
+central_proxy: "127.0.0.1:%d"
+encryption:
+  enabled: true
+`, upstream, central))
+
+	proxy, err := NewProxyClient(writeConfig(t, fmt.Sprintf(`
+upstream_servers: ["127.0.0.1:%d"]
+downstream_port: %d
+advertise_host: "127.0.0.1"
+listen_address: "127.0.0.1"
+chunk_size: 16
+timeout: 10000
+encryption:
+  enabled: true
+`, upstream, client)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Start()
+	for proxy.ready() != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer proxy.responseServer.Close()
+
+	response, err := proxy.GET(target.URL+"/hello", nil)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if response.StatusCode != http.StatusOK || string(response.Body) != "GET /hello " {
+		t.Errorf("GET got %d %q", response.StatusCode, response.Body)
+	}
+	if response.Headers["X-Target"] != "reached" {
+		t.Errorf("target header lost: %v", response.Headers)
+	}
+
+	// Larger than a chunk each way, so both directions reassemble
+	body := bytes.Repeat([]byte("payload-"), 40)
+	response, err = proxy.POST(target.URL+"/upload", body, map[string]string{"Content-Type": "text/plain"})
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	if want := "POST /upload " + string(body); string(response.Body) != want {
+		t.Errorf("POST got %d bytes, want %d", len(response.Body), len(want))
+	}
+}
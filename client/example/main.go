@@ -0,0 +1,57 @@
+// Command example starts a proxy client and waits, showing how the client
+// library is used
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/client"
+)
+
+func main() {
+	configPath := "config/client.yaml"
+	if len(os.Args) > 1 {
+		configPath = os.Args[1]
+	}
+
+	proxyClient, err := client.NewProxyClient(configPath)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+
+	// Start listening for responses in background
+	go func() {
+		if err := proxyClient.Start(); err != nil {
+			log.Fatalf("Client server error: %v", err)
+		}
+	}()
+
+	// Wait for server to start
+	time.Sleep(1 * time.Second)
+
+	log.Println("Proxy client ready!")
+	log.Println("\nExample usage:")
+	log.Println("  response, err := client.GET(\"http://example.com\", nil)")
+	log.Println("  response, err := client.POST(\"http://api.example.com/data\", body, headers)")
+
+	// Example request (commented out - uncomment to test)
+	/*
+		headers := map[string]string{
+			"User-Agent": "ProxyClient/1.0",
+			"Accept": "text/html",
+		}
+
+		response, err := proxyClient.GET("http://example.com", headers)
+		if err != nil {
+			log.Printf("Request failed: %v", err)
+		} else {
+			log.Printf("Response received: %d bytes", len(response.Body))
+			log.Printf("First 100 chars: %s", string(response.Body[:min(100, len(response.Body))]))
+		}
+	*/
+
+	// Keep running
+	select {}
+}
@@ -0,0 +1,232 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// writeConfig writes a YAML config to a temporary file and returns its path
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "client.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestClient builds a client from yaml whose upstreams are served in
+// memory by the handlers given for their addresses
+func newTestClient(t *testing.T, yaml string, upstreams map[string]http.Handler) *ProxyClient {
+	t.Helper()
+	client, err := NewProxyClient(writeConfig(t, yaml))
+	if err != nil {
+		t.Fatalf("NewProxyClient: %v", err)
+	}
+
+	transport := newMemoryTransport()
+	for addr, handler := range upstreams {
+		transport.Register(addr, handler)
+	}
+	client.SetTransport(transport)
+	client.listening = true
+	return client
+}
+
+// stubRequest is a request as the stub hops reassembled it
+type stubRequest struct {
+	Method  string
+	URL     string
+	Headers map[string]string
+	Body    []byte
+}
+
+// stubHops stands in for the upstream, central proxy and downstream server
+// at once: it acknowledges request chunks like an upstream and, once a
+// session's chunks are all in, pushes the response back to the client's
+// handler in chunks of chunkSize bytes
+type stubHops struct {
+	client    *ProxyClient
+	chunkSize int
+	respond   func(req stubRequest) []byte
+	headers   map[string]string    // carried by the first response chunk
+	meta      *common.ResponseMeta // sent in a control chunk ahead of the body, a plain 200 if nil
+	noMeta    bool                 // send the body alone, as hops predating control chunks did
+	metaLast  bool                 // send the control chunk after the body
+	drop      func(seq int) bool   // response chunks never delivered, none if nil
+	reject    func(chunk *common.Chunk) *common.ChunkAck
+
+	mu       sync.Mutex
+	sessions map[string]map[int]*common.Chunk
+	received int
+}
+
+func newStubHops(respond func(req stubRequest) []byte) *stubHops {
+	return &stubHops{
+		chunkSize: 4,
+		respond:   respond,
+		sessions:  make(map[string]map[int]*common.Chunk),
+	}
+}
+
+func (h *stubHops) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	chunk, err := h.client.codec.Decode(body)
+	if err != nil {
+		http.Error(w, "Invalid chunk format", http.StatusBadRequest)
+		return
+	}
+
+	ack := common.ChunkAck{SessionID: chunk.SessionID, SequenceNum: chunk.SequenceNum, Forwarded: true}
+	status := http.StatusOK
+	if h.reject != nil {
+		if rejected := h.reject(chunk); rejected != nil {
+			ack, status = *rejected, http.StatusBadGateway
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ack)
+	if status != http.StatusOK {
+		return
+	}
+
+	h.mu.Lock()
+	h.received++
+	session, exists := h.sessions[chunk.SessionID]
+	if !exists {
+		session = make(map[int]*common.Chunk)
+		h.sessions[chunk.SessionID] = session
+	}
+	session[chunk.SequenceNum] = chunk
+	// A handshake, numbered 0, is kept but isn't part of the body
+	data := len(session)
+	if _, handshake := session[common.HandshakeSequence]; handshake {
+		data--
+	}
+	complete := chunk.SequenceNum != common.HandshakeSequence && data == chunk.TotalChunks
+	if complete {
+		// Chunks arriving later, such as a cancel chunk, don't touch the
+		// copy being delivered
+		session = maps.Clone(session)
+	}
+	h.mu.Unlock()
+
+	if complete {
+		go h.deliver(chunk.SessionID, session)
+	}
+}
+
+// deliver reassembles a request and posts its response to the client
+func (h *stubHops) deliver(sessionID string, chunks map[int]*common.Chunk) {
+	req := stubRequest{Method: chunks[1].Method, URL: chunks[1].TargetURL, Headers: chunks[1].Headers}
+	for i := 1; i <= chunks[1].TotalChunks; i++ {
+		req.Body = append(req.Body, chunks[i].Data...)
+	}
+
+	parts := common.SplitData(h.respond(req), h.chunkSize)
+	sendMeta := func() {
+		if h.noMeta {
+			return
+		}
+		meta := h.meta
+		if meta == nil {
+			meta = &common.ResponseMeta{StatusCode: http.StatusOK, ContentLength: -1}
+		}
+		data, err := common.EncodeResponseMeta(meta)
+		if err != nil {
+			panic(err)
+		}
+		h.push(&common.Chunk{
+			SessionID:   sessionID,
+			SequenceNum: common.ControlSequence,
+			TotalChunks: len(parts),
+			ChunkType:   common.ChunkTypeControl,
+			Data:        data,
+			Timestamp:   time.Now(),
+		})
+	}
+	if !h.metaLast {
+		sendMeta()
+	}
+	for i, part := range parts {
+		if h.drop != nil && h.drop(i+1) {
+			continue
+		}
+		chunk := &common.Chunk{
+			SessionID:   sessionID,
+			SequenceNum: i + 1,
+			TotalChunks: len(parts),
+			Data:        part,
+			Timestamp:   time.Now(),
+		}
+		if i == 0 {
+			chunk.Headers = h.headers
+		}
+		h.push(chunk)
+	}
+	if h.metaLast {
+		sendMeta()
+	}
+}
+
+// push posts one response chunk to the client's handler
+func (h *stubHops) push(chunk *common.Chunk) int {
+	data, err := h.client.codec.Encode(chunk)
+	if err != nil {
+		panic(err)
+	}
+	recorder := httptest.NewRecorder()
+	h.client.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/chunk", bytes.NewReader(data)))
+	return recorder.Code
+}
+
+// requestChunks reports how many request chunks the stub accepted
+func (h *stubHops) requestChunks() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.received
+}
+
+// stubConfig is a client config for tests against stubHops at "up:1"
+const stubConfig = `
+upstream_servers: ["up:1"]
+downstream_port: 7000
+chunk_size: 4
+timeout: 2000
+encryption:
+  enabled: false
+`
+
+// newStubClient wires a client built from yaml to stub hops answering with
+// respond at every upstream address in addrs, "up:1" if none are given
+func newStubClient(t *testing.T, yaml string, respond func(req stubRequest) []byte, addrs ...string) (*ProxyClient, *stubHops) {
+	t.Helper()
+	if len(addrs) == 0 {
+		addrs = []string{"up:1"}
+	}
+
+	hops := newStubHops(respond)
+	upstreams := make(map[string]http.Handler)
+	for _, addr := range addrs {
+		upstreams[addr] = hops
+	}
+	hops.client = newTestClient(t, yaml, upstreams)
+	return hops.client, hops
+}
+
+// echo answers a stub request with its body
+func echo(req stubRequest) []byte {
+	return req.Body
+}
@@ -0,0 +1,37 @@
+package client
+
+// inflightLimiter caps the chunks outstanding to each upstream at once, so
+// a huge request or many concurrent ones can't flood a small upstream
+type inflightLimiter struct {
+	slots map[string]chan struct{}
+}
+
+// newInflightLimiter allows limit chunks in flight to each upstream
+func newInflightLimiter(upstreams []string, limit int) *inflightLimiter {
+	l := &inflightLimiter{slots: make(map[string]chan struct{})}
+	for _, upstream := range upstreams {
+		l.slots[upstream] = make(chan struct{}, limit)
+	}
+	return l
+}
+
+// acquire blocks until a chunk may be sent to upstream. A nil limiter
+// never blocks.
+func (l *inflightLimiter) acquire(upstream string) {
+	if l == nil {
+		return
+	}
+	if slots, exists := l.slots[upstream]; exists {
+		slots <- struct{}{}
+	}
+}
+
+// release frees the slot taken by acquire
+func (l *inflightLimiter) release(upstream string) {
+	if l == nil {
+		return
+	}
+	if slots, exists := l.slots[upstream]; exists {
+		<-slots
+	}
+}
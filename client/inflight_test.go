@@ -0,0 +1,86 @@
+package client
+
+import (
+	"bytes"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// inflightGauge tracks how many requests are being handled at once by the
+// handler it wraps, and the most seen
+type inflightGauge struct {
+	next          http.Handler
+	running, peak atomic.Int32
+}
+
+func (g *inflightGauge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := g.running.Add(1)
+	defer g.running.Add(-1)
+	for {
+		seen := g.peak.Load()
+		if now <= seen || g.peak.CompareAndSwap(seen, now) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	g.next.ServeHTTP(w, r)
+}
+
+func TestMaxInflightPerUpstream(t *testing.T) {
+	hops := newStubHops(echo)
+	gauges := map[string]*inflightGauge{"up:1": {next: hops}, "up:2": {next: hops}}
+	hops.client = newTestClient(t, `
+upstream_servers: ["up:1", "up:2"]
+downstream_port: 7000
+chunk_size: 4
+timeout: 5000
+max_inflight_per_upstream: 2
+encryption:
+  enabled: false
+`, map[string]http.Handler{"up:1": gauges["up:1"], "up:2": gauges["up:2"]})
+
+	body := bytes.Repeat([]byte("x"), 160)
+	response, err := hops.client.POST("http://target/", body, nil)
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	if !bytes.Equal(response.Body, body) {
+		t.Errorf("got %d bytes back, want %d", len(response.Body), len(body))
+	}
+
+	for addr, gauge := range gauges {
+		if peak := gauge.peak.Load(); peak > 2 {
+			t.Errorf("%s had %d chunks in flight at once, want at most 2", addr, peak)
+		}
+	}
+}
+
+func TestInflightLimiterBlocksAtLimit(t *testing.T) {
+	limiter := newInflightLimiter([]string{"up:1"}, 1)
+	limiter.acquire("up:1")
+
+	acquired := make(chan struct{})
+	go func() {
+		limiter.acquire("up:1")
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("second chunk sent while the first was in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	limiter.release("up:1")
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("release did not free the slot")
+	}
+
+	// Unknown upstreams and a nil limiter never block
+	limiter.acquire("up:9")
+	var unlimited *inflightLimiter
+	unlimited.acquire("up:1")
+}
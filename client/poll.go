@@ -0,0 +1,71 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// pollResponse is a downstream server's answer to /poll: the response
+// chunks of a session it could not push, each encoded as if posted
+type pollResponse struct {
+	SessionID string   `json:"session_id"`
+	Chunks    [][]byte `json:"chunks"`
+}
+
+// pollBuffered fetches the response chunks of a session that a downstream
+// server in poll_servers kept after failing to push them, and takes them in
+// as if they had been posted. It reports whether any server had them.
+func (c *ProxyClient) pollBuffered(sessionID string) bool {
+	for _, server := range c.config.PollServers {
+		chunks, err := c.fetchBuffered(server, sessionID)
+		if err != nil {
+			log.Printf("Failed to poll %s for session %s: %v", server, sessionID, err)
+			continue
+		}
+		if chunks == nil {
+			continue
+		}
+
+		log.Printf("Fetched %d buffered chunks of session %s from %s", len(chunks), sessionID, server)
+		for _, data := range chunks {
+			if status, reason := c.receiveChunk(data); status != http.StatusOK {
+				log.Printf("Dropped buffered chunk of session %s: %s", sessionID, reason)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// fetchBuffered asks one downstream server for a session's buffered
+// chunks. It returns nil without an error when the server has none.
+func (c *ProxyClient) fetchBuffered(server, sessionID string) ([][]byte, error) {
+	target := fmt.Sprintf("http://%s/poll?session_id=%s", server, url.QueryEscape(sessionID))
+	resp, err := c.httpClient.Get(target)
+	if err != nil {
+		return nil, err
+	}
+	defer common.DrainAndClose(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var polled pollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&polled); err != nil {
+		return nil, fmt.Errorf("invalid poll response: %w", err)
+	}
+	if polled.SessionID != sessionID {
+		return nil, fmt.Errorf("poll response is for session %q", polled.SessionID)
+	}
+	return polled.Chunks, nil
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// Request priorities; higher values are admitted first when the client is
+// at max_concurrent_requests
+const (
+	PriorityLow    = -1
+	PriorityNormal = 0
+	PriorityHigh   = 1
+)
+
+// requestQueue bounds the number of requests in flight. Waiting requests
+// are admitted by priority, then in arrival order.
+type requestQueue struct {
+	limit   int
+	running int
+	waiting waiterHeap
+	seq     uint64
+	mu      sync.Mutex
+}
+
+// waiter is a request waiting for a slot
+type waiter struct {
+	priority int
+	seq      uint64
+	admit    chan struct{}
+}
+
+// newRequestQueue creates a queue allowing limit concurrent requests
+func newRequestQueue(limit int) *requestQueue {
+	return &requestQueue{limit: limit}
+}
+
+// acquire blocks until the request may run
+func (q *requestQueue) acquire(priority int) {
+	q.mu.Lock()
+	if q.running < q.limit && len(q.waiting) == 0 {
+		q.running++
+		q.mu.Unlock()
+		return
+	}
+
+	w := &waiter{priority: priority, seq: q.seq, admit: make(chan struct{})}
+	q.seq++
+	heap.Push(&q.waiting, w)
+	q.mu.Unlock()
+
+	<-w.admit
+}
+
+// release frees a slot, handing it to the highest priority waiter
+func (q *requestQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.waiting) > 0 {
+		w := heap.Pop(&q.waiting).(*waiter)
+		close(w.admit) // the slot passes straight to w
+		return
+	}
+	q.running--
+}
+
+// waiterHeap orders waiters by priority, then arrival
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int { return len(h) }
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h waiterHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *waiterHeap) Push(x any)   { *h = append(*h, x.(*waiter)) }
+func (h *waiterHeap) Pop() any {
+	old := *h
+	w := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return w
+}
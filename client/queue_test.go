@@ -0,0 +1,117 @@
+package client
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRequestQueueBoundsConcurrency(t *testing.T) {
+	queue := newRequestQueue(2)
+
+	var running, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			queue.acquire(PriorityNormal)
+			defer queue.release()
+
+			now := running.Add(1)
+			for {
+				seen := peak.Load()
+				if now <= seen || peak.CompareAndSwap(seen, now) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			running.Add(-1)
+		}()
+	}
+	wg.Wait()
+
+	if peak.Load() > 2 {
+		t.Errorf("%d requests ran at once, want at most 2", peak.Load())
+	}
+}
+
+// waitingCount returns how many requests wait for a slot
+func (q *requestQueue) waitingCount() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+func TestRequestQueuePriorityOrder(t *testing.T) {
+	queue := newRequestQueue(1)
+	queue.acquire(PriorityNormal) // hold the only slot
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for i, w := range []struct {
+		name     string
+		priority int
+	}{
+		{"low", PriorityLow},
+		{"normal-1", PriorityNormal},
+		{"high", PriorityHigh},
+		{"normal-2", PriorityNormal},
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			queue.acquire(w.priority)
+			mu.Lock()
+			order = append(order, w.name)
+			mu.Unlock()
+			queue.release()
+		}()
+		// Queue them in a known arrival order
+		for queue.waitingCount() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	queue.release()
+	wg.Wait()
+
+	if want := []string{"high", "normal-1", "normal-2", "low"}; !slices.Equal(order, want) {
+		t.Errorf("admitted %v, want %v", order, want)
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	var running, peak atomic.Int32
+	client, _ := newStubClient(t, stubConfig+"max_concurrent_requests: 2\n", func(req stubRequest) []byte {
+		now := running.Add(1)
+		defer running.Add(-1)
+		for {
+			seen := peak.Load()
+			if now <= seen || peak.CompareAndSwap(seen, now) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		return req.Body
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.POST("http://target/", []byte("body"), nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak.Load() > 2 {
+		t.Errorf("%d requests reached the target at once, want at most 2", peak.Load())
+	}
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// chunkUpstreams picks the upstreams for the i-th chunk of a session by
+// balance_policy: one, plus more when redundancy asks for copies. Copies
+// never share an upstream, so there are at most as many as upstreams. Each
+// must be handed back to the balancer once sent, as sendReplicas does.
+func (c *ProxyClient) chunkUpstreams(sessionID string, i int) []string {
+	return c.balancer.Pick(sessionID, i, max(c.config.Redundancy, 1))
+}
+
+// sendReplicas sends a chunk to each of upstreams at once. The central
+// proxy keeps the first copy to arrive and drops the rest, so the chunk is
+// delivered if any copy was, and sendReplicas fails only if all failed.
+func (c *ProxyClient) sendReplicas(session *PendingSession, chunk *common.Chunk, upstreams []string) error {
+	errs := make([]error, len(upstreams))
+	var wg sync.WaitGroup
+	for j, upstreamURL := range upstreams {
+		wg.Add(1)
+		go func(j int, upstreamURL string) {
+			defer wg.Done()
+			defer c.balancer.Done(upstreamURL)
+			errs[j] = c.sendCopy(session, chunk, upstreamURL)
+		}(j, upstreamURL)
+	}
+	wg.Wait()
+
+	if slices.Contains(errs, nil) {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// sendCopy sends a chunk to one upstream, recording its acknowledgement
+// and, for data chunks, how the send went for chunk size tuning
+func (c *ProxyClient) sendCopy(session *PendingSession, chunk *common.Chunk, upstreamURL string) error {
+	sent := time.Now()
+	ack, err := c.sendChunk(chunk, upstreamURL)
+	if ack != nil {
+		session.recordAck(*ack)
+	}
+	if c.chunker != nil && chunk.ChunkType == "" {
+		c.chunker.Observe(len(chunk.Data), time.Since(sent), err == nil && (ack == nil || ack.Forwarded))
+	}
+	if err != nil {
+		log.Printf("Failed to send chunk %d to %s: %v", chunk.SequenceNum, upstreamURL, err)
+		return fmt.Errorf("chunk %d to %s: %w", chunk.SequenceNum, upstreamURL, err)
+	}
+
+	log.Printf("Sent chunk %d/%d to %s", chunk.SequenceNum, chunk.TotalChunks, upstreamURL)
+	return nil
+}
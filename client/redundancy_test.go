@@ -0,0 +1,57 @@
+package client
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRedundantCopyCompletesSession(t *testing.T) {
+	var refused atomic.Int32
+	hops := newStubHops(echo)
+	hops.client = newTestClient(t, `
+upstream_servers: ["up:1", "up:2"]
+downstream_port: 7000
+chunk_size: 4
+timeout: 2000
+redundancy: 2
+encryption:
+  enabled: false
+`, map[string]http.Handler{
+		"up:1": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			refused.Add(1)
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}),
+		"up:2": hops,
+	})
+
+	response, err := hops.client.POST("http://target/", []byte("twelve bytes"), nil)
+	if err != nil {
+		t.Fatalf("POST with one upstream down: %v", err)
+	}
+	if string(response.Body) != "twelve bytes" {
+		t.Errorf("body %q", response.Body)
+	}
+	// Every chunk went to both upstreams
+	if got := refused.Load(); got != 3 {
+		t.Errorf("failing upstream got %d chunks, want all 3", got)
+	}
+}
+
+func TestSingleCopyFailsWithoutRedundancy(t *testing.T) {
+	hops := newStubHops(echo)
+	hops.client = newTestClient(t, `
+upstream_servers: ["up:1"]
+downstream_port: 7000
+chunk_size: 4
+timeout: 2000
+encryption:
+  enabled: false
+`, map[string]http.Handler{"up:1": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	})})
+
+	if _, err := hops.client.POST("http://target/", []byte("twelve bytes"), nil); err == nil {
+		t.Error("POST succeeded with its only upstream down")
+	}
+}
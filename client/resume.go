@@ -0,0 +1,109 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GetRange fetches bytes start through end of url, inclusive. A negative end
+// reads to the end of the resource. Targets that support ranges answer 206
+// with just that slice; others answer 200 with the whole body.
+func (c *ProxyClient) GetRange(url string, start, end int64, headers map[string]string) (*ProxyResponse, error) {
+	return c.MakeRequest(http.MethodGet, url, nil, withRange(headers, start, end))
+}
+
+// Resume completes a download that timed out with a Partial response, asking
+// the target only for the bytes after the prefix already received. The
+// result holds the whole body as if it had arrived in one go; if the resumed
+// request times out too it is Partial again and can be resumed in turn. If
+// the target ignores the range, or the resource changed since (checked with
+// If-Range), the full body from the new response is used instead.
+func (c *ProxyClient) Resume(url string, partial *ProxyResponse, headers map[string]string) (*ProxyResponse, error) {
+	if !partial.Partial {
+		return partial, nil
+	}
+
+	offset := int64(len(partial.Body))
+	headers = withRange(headers, offset, -1)
+	if validator := rangeValidator(partial.Headers); validator != "" {
+		headers["If-Range"] = validator
+	}
+
+	response, err := c.MakeRequestWithOptions(http.MethodGet, url, nil, headers, RequestOptions{AllowPartial: true})
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusPartialContent {
+		return response, nil // the full body, not a continuation
+	}
+
+	start, err := contentRangeStart(response.Headers["Content-Range"])
+	if err != nil {
+		return nil, err
+	}
+	if start != offset {
+		return nil, fmt.Errorf("resumed response starts at byte %d, expected %d", start, offset)
+	}
+
+	body := make([]byte, 0, len(partial.Body)+len(response.Body))
+	body = append(body, partial.Body...)
+	body = append(body, response.Body...)
+
+	resumed := *response
+	resumed.StatusCode = http.StatusOK
+	resumed.Body = body
+	resumed.Headers = make(map[string]string, len(response.Headers))
+	for k, v := range response.Headers {
+		resumed.Headers[k] = v
+	}
+	delete(resumed.Headers, "Content-Range")
+	delete(resumed.Headers, "Content-Length")
+	return &resumed, nil
+}
+
+// withRange copies headers adding a Range header for start through end
+func withRange(headers map[string]string, start, end int64) map[string]string {
+	ranged := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		ranged[k] = v
+	}
+
+	if end < 0 {
+		ranged["Range"] = fmt.Sprintf("bytes=%d-", start)
+	} else {
+		ranged["Range"] = fmt.Sprintf("bytes=%d-%d", start, end)
+	}
+	return ranged
+}
+
+// rangeValidator picks the If-Range value that ties a resumed request to the
+// version of the resource the prefix came from. Weak ETags can't be used.
+func rangeValidator(headers map[string]string) string {
+	if etag := headers["Etag"]; etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return headers["Last-Modified"]
+}
+
+// contentRangeStart parses the first byte position of a Content-Range
+// header such as "bytes 100-199/200"
+func contentRangeStart(value string) (int64, error) {
+	spec, found := strings.CutPrefix(value, "bytes ")
+	if !found {
+		return 0, fmt.Errorf("unsupported Content-Range %q", value)
+	}
+
+	first, _, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, fmt.Errorf("malformed Content-Range %q", value)
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed Content-Range %q", value)
+	}
+	return start, nil
+}
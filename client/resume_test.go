@@ -0,0 +1,84 @@
+package client
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// rangedBody answers a stub request with the slice of body its Range header
+// asks for, or all of it without one
+func rangedBody(body string) func(req stubRequest) []byte {
+	return func(req stubRequest) []byte {
+		spec, ranged := strings.CutPrefix(req.Headers["Range"], "bytes=")
+		if !ranged {
+			return []byte(body)
+		}
+		first, last, _ := strings.Cut(spec, "-")
+		start, _ := strconv.Atoi(first)
+		end := len(body) - 1
+		if last != "" {
+			end, _ = strconv.Atoi(last)
+		}
+		return []byte(body[start : end+1])
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	client, hops := newStubClient(t, stubConfig, rangedBody("0123456789abcdef"))
+	hops.meta = &common.ResponseMeta{
+		StatusCode:    http.StatusPartialContent,
+		Headers:       map[string]string{"Content-Range": "bytes 4-9/16"},
+		ContentLength: 6,
+	}
+
+	response, err := client.GetRange("http://target/file", 4, 9, nil)
+	if err != nil {
+		t.Fatalf("GetRange: %v", err)
+	}
+	if response.StatusCode != http.StatusPartialContent || string(response.Body) != "456789" {
+		t.Errorf("got %d %q, want 206 with bytes 4 through 9", response.StatusCode, response.Body)
+	}
+}
+
+func TestResumeCompletesPartialDownload(t *testing.T) {
+	const body = "0123456789abcdef"
+	client, hops := newStubClient(t, strings.Replace(stubConfig, "timeout: 2000", "timeout: 200", 1), rangedBody(body))
+	hops.drop = func(seq int) bool { return seq == 3 }
+
+	partial, _ := client.MakeRequestWithOptions(http.MethodGet, "http://target/file", nil, nil, RequestOptions{AllowPartial: true})
+	if partial == nil || !partial.Partial || string(partial.Body) != "01234567" {
+		t.Fatalf("got %+v, want the first 8 bytes as a partial response", partial)
+	}
+
+	hops.drop = nil
+	hops.meta = &common.ResponseMeta{
+		StatusCode:    http.StatusPartialContent,
+		Headers:       map[string]string{"Content-Range": "bytes 8-15/16"},
+		ContentLength: 8,
+	}
+	response, err := client.Resume("http://target/file", partial, nil)
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if response.StatusCode != http.StatusOK || string(response.Body) != body {
+		t.Errorf("resumed %d %q, want the whole body", response.StatusCode, response.Body)
+	}
+	if _, exists := response.Headers["Content-Range"]; exists {
+		t.Error("Content-Range kept on the completed body")
+	}
+}
+
+func TestContentRangeStart(t *testing.T) {
+	if start, err := contentRangeStart("bytes 100-199/200"); err != nil || start != 100 {
+		t.Errorf("got %d, %v, want 100", start, err)
+	}
+	for _, value := range []string{"", "items 1-2/3", "bytes x-2/3", "bytes 12"} {
+		if _, err := contentRangeStart(value); err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+}
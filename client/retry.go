@@ -0,0 +1,41 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrResponseTimeout is returned when the response doesn't arrive in full
+// within the client's timeout
+var ErrResponseTimeout = errors.New("request timeout")
+
+// RequestRetryConfig controls sending a whole request again, under a new
+// session, when its response never fully arrives. Only requests that are
+// safe to repeat are resent unless non_idempotent is set.
+type RequestRetryConfig struct {
+	MaxRetries    int  `yaml:"max_retries"`    // resends after a timeout, 0 disables
+	NonIdempotent bool `yaml:"non_idempotent"` // resend any request, such as a POST without an idempotency key
+}
+
+// allows reports whether a request may be resent: its method is one that
+// doesn't change anything, it carries an idempotency key, or the config
+// accepts the risk of the target acting twice
+func (c RequestRetryConfig) allows(method string, headers map[string]string) bool {
+	if c.MaxRetries == 0 {
+		return false
+	}
+	if c.NonIdempotent {
+		return true
+	}
+
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	for k := range headers {
+		if key := http.CanonicalHeaderKey(k); key == "Idempotency-Key" || key == "X-Idempotency-Key" {
+			return true
+		}
+	}
+	return false
+}
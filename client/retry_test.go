@@ -0,0 +1,74 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// retryConfig times out quickly and resends a request once
+var retryConfig = strings.Replace(stubConfig, "timeout: 2000", "timeout: 300", 1) + "request_retry:\n  max_retries: 1\n"
+
+// loseFirst returns a drop function losing response chunk seq of the first
+// response only
+func loseFirst(seq int) func(int) bool {
+	var lost atomic.Bool
+	return func(s int) bool {
+		return s == seq && lost.CompareAndSwap(false, true)
+	}
+}
+
+// sessionCount returns how many sessions the stub hops saw
+func (h *stubHops) sessionCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.sessions)
+}
+
+func TestRequestRetriedAfterLostChunk(t *testing.T) {
+	client, hops := newStubClient(t, retryConfig, func(req stubRequest) []byte {
+		return []byte("twelve bytes")
+	})
+	hops.drop = loseFirst(2)
+
+	response, err := client.GET("http://target/", nil)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if string(response.Body) != "twelve bytes" {
+		t.Errorf("body %q", response.Body)
+	}
+	if n := hops.sessionCount(); n != 2 {
+		t.Errorf("request sent under %d sessions, want a fresh one for the retry", n)
+	}
+}
+
+func TestNonIdempotentRequestNotRetried(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		headers  map[string]string
+		sessions int
+	}{
+		{"plain POST", retryConfig, nil, 1},
+		{"idempotency key", retryConfig, map[string]string{"idempotency-key": "abc"}, 2},
+		{"non_idempotent set", retryConfig + "  non_idempotent: true\n", nil, 2},
+	}
+	for _, tt := range tests {
+		client, hops := newStubClient(t, tt.config, echo)
+		hops.drop = loseFirst(1)
+
+		_, err := client.MakeRequest(http.MethodPost, "http://target/", []byte("body"), tt.headers)
+		if tt.sessions == 1 && !errors.Is(err, ErrResponseTimeout) {
+			t.Errorf("%s: got %v, want ErrResponseTimeout", tt.name, err)
+		}
+		if tt.sessions == 2 && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if n := hops.sessionCount(); n != tt.sessions {
+			t.Errorf("%s: sent under %d sessions, want %d", tt.name, n, tt.sessions)
+		}
+	}
+}
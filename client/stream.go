@@ -0,0 +1,107 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// eventStream delivers the chunks of a streamed response in order
+type eventStream struct {
+	events   chan []byte
+	next     int                   // sequence number to deliver next
+	pending  map[int]*common.Chunk // arrived ahead of next
+	trailers map[string]string     // the response's Trailers, filled in from the last chunk
+	closed   bool
+	mu       sync.Mutex // held while delivering so handlers can't interleave
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{
+		events:  make(chan []byte, 64),
+		next:    1,
+		pending: make(map[int]*common.Chunk),
+	}
+}
+
+// deliver queues chunk and sends every chunk that is now in order to the
+// events channel, closing it after the last. It reports whether the stream
+// has ended. Sends block while the channel is full, holding up the stream
+// until the reader catches up.
+func (s *eventStream) deliver(chunk *common.Chunk) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || chunk.SequenceNum < s.next {
+		return false // duplicate
+	}
+	s.pending[chunk.SequenceNum] = chunk
+
+	for {
+		next, exists := s.pending[s.next]
+		if !exists {
+			return false
+		}
+		delete(s.pending, s.next)
+		s.next++
+
+		if next.IsStreamEnd() {
+			s.addTrailers(next.Data)
+			close(s.events)
+			s.closed = true
+			return true
+		}
+		s.events <- next.Data
+	}
+}
+
+// addTrailers copies the trailers carried by the last chunk of a stream,
+// which is empty when the target sent none
+func (s *eventStream) addTrailers(data []byte) {
+	if len(data) == 0 || s.trailers == nil {
+		return
+	}
+	meta, err := common.DecodeResponseMeta(data)
+	if err != nil {
+		log.Printf("Ignoring stream trailers: %v", err)
+		return
+	}
+	for k, v := range meta.Trailers {
+		s.trailers[k] = v
+	}
+}
+
+// handleStreamChunk passes a chunk of an announced event stream on to the
+// caller, and drops the session once the stream ends
+func (c *ProxyClient) handleStreamChunk(session *PendingSession, chunk *common.Chunk) error {
+	session.mu.Lock()
+	stream, key := session.stream, session.SessionKey
+	session.mu.Unlock()
+
+	if stream == nil {
+		return fmt.Errorf("stream chunk %d arrived before the stream was announced", chunk.SequenceNum)
+	}
+
+	if key != nil {
+		decrypted, err := common.DecryptAESWithAAD(chunk.Data, key, chunk.AAD())
+		if err != nil {
+			return fmt.Errorf("session key decryption failed: %w", err)
+		}
+		chunk.Data = decrypted
+	}
+
+	data, err := common.Decompress(chunk.Compression, chunk.Data, int64(c.config.MaxChunkSize))
+	if err != nil {
+		return fmt.Errorf("stream chunk %d: %w", chunk.SequenceNum, err)
+	}
+	chunk.Data = data
+
+	if stream.deliver(chunk) {
+		c.mu.Lock()
+		delete(c.pendingSessions, session.SessionID)
+		c.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+func TestEventStreamDeliveredIncrementally(t *testing.T) {
+	client, hops := newStubClient(t, stubConfig, func(req stubRequest) []byte {
+		return nil
+	})
+	// Only the control chunk announcing the stream; the test pushes the events
+	hops.meta = &common.ResponseMeta{StatusCode: http.StatusOK, ContentLength: -1, Stream: true}
+	hops.drop = func(seq int) bool { return true }
+
+	response, err := client.GET("http://target/events", nil)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if response.Events == nil {
+		t.Fatal("no event channel for a streamed response")
+	}
+
+	hops.mu.Lock()
+	var session string
+	for id := range hops.sessions {
+		session = id
+	}
+	hops.mu.Unlock()
+
+	streamChunk := func(seq, total int, data string) {
+		t.Helper()
+		status := hops.push(&common.Chunk{
+			SessionID:   session,
+			SequenceNum: seq,
+			TotalChunks: total,
+			ChunkType:   common.ChunkTypeStream,
+			Data:        []byte(data),
+			Timestamp:   time.Now(),
+		})
+		if status != http.StatusOK {
+			t.Fatalf("stream chunk %d: status %d", seq, status)
+		}
+	}
+
+	// Each event is readable before the next one is sent
+	for seq, event := range []string{"data: one\n\n", "data: two\n\n"} {
+		streamChunk(seq+1, 0, event)
+		select {
+		case got := <-response.Events:
+			if string(got) != event {
+				t.Errorf("event %d: got %q, want %q", seq+1, got, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not delivered", seq+1)
+		}
+	}
+
+	streamChunk(3, 3, "")
+	select {
+	case _, open := <-response.Events:
+		if open {
+			t.Error("event after the end of the stream")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("events not closed at the end of the stream")
+	}
+}
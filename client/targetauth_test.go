@@ -0,0 +1,71 @@
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+func TestTargetAuthHiddenFromUpstream(t *testing.T) {
+	central, err := common.NewSessionKeyAgreement("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	yaml := strings.Replace(stubConfig, "timeout: 2000", "timeout: 200", 1) +
+		"session_keys:\n  enabled: true\n  central_public_key: " + hex.EncodeToString(central.PublicKey()) + "\n"
+	client, hops := newStubClient(t, yaml, echo)
+
+	// The stub can't answer under the session key, so only what was sent
+	// matters
+	client.MakeRequestWithOptions(http.MethodGet, "http://target/", nil, map[string]string{"X-Visible": "yes"},
+		RequestOptions{TargetAuth: BearerAuth("secret-token")})
+
+	hops.mu.Lock()
+	defer hops.mu.Unlock()
+	if len(hops.sessions) != 1 {
+		t.Fatalf("stub saw %d sessions, want 1", len(hops.sessions))
+	}
+	for session, chunks := range hops.sessions {
+		first, handshake := chunks[1], chunks[common.HandshakeSequence]
+		if first == nil || handshake == nil {
+			t.Fatalf("chunks %v, want the handshake and chunk 1", chunks)
+		}
+		if first.Headers["X-Visible"] != "yes" {
+			t.Errorf("headers %v, want the plain headers sent", first.Headers)
+		}
+		for _, chunk := range chunks {
+			if _, exists := chunk.Headers["Authorization"]; exists {
+				t.Errorf("chunk %d carries Authorization in its headers", chunk.SequenceNum)
+			}
+			data, _ := client.codec.Encode(chunk)
+			if bytes.Contains(data, []byte("secret-token")) {
+				t.Errorf("chunk %d shows the credential to the upstream", chunk.SequenceNum)
+			}
+		}
+
+		// Only the central proxy's key opens it
+		key, err := central.DeriveKey(session, handshake.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth, err := common.OpenTargetAuth(first, key); err != nil || auth != "Bearer secret-token" {
+			t.Errorf("central proxy opened %q, %v", auth, err)
+		}
+	}
+}
+
+func TestTargetAuthNeedsSessionKeys(t *testing.T) {
+	client, hops := newStubClient(t, stubConfig, echo)
+	_, err := client.MakeRequestWithOptions(http.MethodGet, "http://target/", nil, nil, RequestOptions{TargetAuth: BearerAuth("secret-token")})
+	if !errors.Is(err, common.ErrTargetAuthUnsealed) {
+		t.Errorf("got %v, want ErrTargetAuthUnsealed", err)
+	}
+	if hops.requestChunks() != 0 {
+		t.Errorf("%d chunks sent without a session key", hops.requestChunks())
+	}
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+func TestTrailersReachResponse(t *testing.T) {
+	client, hops := newStubClient(t, stubConfig, func(req stubRequest) []byte {
+		return []byte("body")
+	})
+	hops.meta = &common.ResponseMeta{
+		StatusCode:    http.StatusOK,
+		ContentLength: 4,
+		Trailers:      map[string]string{"X-Checksum": "abc123"},
+	}
+
+	response, err := client.GET("http://target/", nil)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if string(response.Body) != "body" {
+		t.Errorf("body %q", response.Body)
+	}
+	if got := response.Trailers["X-Checksum"]; got != "abc123" {
+		t.Errorf("trailers %v, want X-Checksum abc123", response.Trailers)
+	}
+}
+
+func TestStreamTrailersFilledAtEnd(t *testing.T) {
+	client, hops := newStubClient(t, stubConfig, func(req stubRequest) []byte {
+		return nil
+	})
+	hops.meta = &common.ResponseMeta{StatusCode: http.StatusOK, ContentLength: -1, Stream: true}
+	hops.drop = func(seq int) bool { return true }
+
+	response, err := client.GET("http://target/chunked", nil)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if response.Events == nil {
+		t.Fatal("no event channel for a streamed response")
+	}
+
+	hops.mu.Lock()
+	var session string
+	for id := range hops.sessions {
+		session = id
+	}
+	hops.mu.Unlock()
+
+	end, err := common.EncodeResponseMeta(&common.ResponseMeta{
+		StatusCode:    http.StatusOK,
+		ContentLength: -1,
+		Stream:        true,
+		Trailers:      map[string]string{"X-Checksum": "abc123"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The total is 0 until the last chunk, which carries the trailers
+	for _, chunk := range []struct {
+		seq, total int
+		data       []byte
+	}{{1, 0, []byte("part")}, {2, 2, end}} {
+		status := hops.push(&common.Chunk{
+			SessionID:   session,
+			SequenceNum: chunk.seq,
+			TotalChunks: chunk.total,
+			ChunkType:   common.ChunkTypeStream,
+			Data:        chunk.data,
+			Timestamp:   time.Now(),
+		})
+		if status != http.StatusOK {
+			t.Fatalf("stream chunk %d: status %d", chunk.seq, status)
+		}
+	}
+
+	var parts []string
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case part, open := <-response.Events:
+			if !open {
+				done = true
+				break
+			}
+			parts = append(parts, string(part))
+		case <-timeout:
+			t.Fatal("stream not closed")
+		}
+	}
+	if len(parts) != 1 || parts[0] != "part" {
+		t.Errorf("streamed %q, want the one part", parts)
+	}
+	// Trailers are only known once the stream ended
+	if got := response.Trailers["X-Checksum"]; got != "abc123" {
+		t.Errorf("trailers %v, want X-Checksum abc123", response.Trailers)
+	}
+}
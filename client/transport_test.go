@@ -0,0 +1,47 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// memoryTransport is an http.RoundTripper that delivers requests straight to
+// registered in-process handlers, keyed by host:port, so a client can be
+// wired to stub hops without opening ports
+type memoryTransport struct {
+	handlers map[string]http.Handler
+	mu       sync.RWMutex
+}
+
+func newMemoryTransport() *memoryTransport {
+	return &memoryTransport{
+		handlers: make(map[string]http.Handler),
+	}
+}
+
+// Register attaches handler at addr (host:port as used in config)
+func (t *memoryTransport) Register(addr string, handler http.Handler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handlers[addr] = handler
+}
+
+// RoundTrip serves the request with the handler registered for its host
+func (t *memoryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.RLock()
+	handler, exists := t.handlers[req.URL.Host]
+	t.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("no in-memory handler for %s", req.URL.Host)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	resp := recorder.Result()
+	resp.Request = req
+	return resp, nil
+}
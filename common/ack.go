@@ -0,0 +1,11 @@
+package common
+
+// ChunkAck is the upstream's reply to a chunk. It names the chunk it
+// handled and whether forwarding to the central proxy succeeded, so a
+// client can tell an accepted-but-dropped chunk from a delivered one.
+type ChunkAck struct {
+	SessionID   string `json:"session_id"`
+	SequenceNum int    `json:"sequence_num"`
+	Forwarded   bool   `json:"forwarded"`
+	Error       string `json:"error,omitempty"`
+}
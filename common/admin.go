@@ -0,0 +1,95 @@
+package common
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ShutdownTimeout bounds how long a graceful shutdown waits for in-flight
+// requests to finish
+const ShutdownTimeout = 10 * time.Second
+
+// Shutdowner is a component that can stop gracefully
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// GracefulShutdown stops s, waiting at most ShutdownTimeout
+func GracefulShutdown(s Shutdowner) {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown error: %v", err)
+	}
+}
+
+// ShutdownOnSignal stops s gracefully on SIGINT or SIGTERM
+func ShutdownOnSignal(s Shutdowner) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, shutting down", sig)
+		GracefulShutdown(s)
+	}()
+}
+
+// ShutdownHandler serves POST /shutdown behind AdminHandler. The shutdown
+// runs after the response is written and only once.
+func ShutdownHandler(token string, s Shutdowner) http.HandlerFunc {
+	var once sync.Once
+
+	return AdminHandler(token, "shutdown", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Shutdown requested by %s", r.RemoteAddr)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("Shutting down"))
+
+		once.Do(func() {
+			go GracefulShutdown(s)
+		})
+	})
+}
+
+// AdminHandler guards an admin endpoint: only POST requests carrying the
+// admin token as "Authorization: Bearer <token>" reach next; anything else
+// gets 401. action names the endpoint in logs.
+func AdminHandler(token, action string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !validAdminToken(r, token) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			log.Printf("Rejected unauthenticated %s request from %s", action, r.RemoteAddr)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// validAdminToken compares the bearer token in constant time
+func validAdminToken(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
@@ -0,0 +1,90 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingShutdowner counts calls to Shutdown
+type countingShutdowner struct {
+	calls atomic.Int32
+	done  chan struct{}
+}
+
+func (s *countingShutdowner) Shutdown(ctx context.Context) error {
+	if s.calls.Add(1) == 1 {
+		close(s.done)
+	}
+	return nil
+}
+
+func shutdownRequest(method, authorization string) *http.Request {
+	req := httptest.NewRequest(method, "/shutdown", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return req
+}
+
+func TestShutdownRejectsUnauthenticated(t *testing.T) {
+	target := &countingShutdowner{done: make(chan struct{})}
+	handler := ShutdownHandler("secret", target)
+
+	tests := []struct {
+		req  *http.Request
+		want int
+	}{
+		{shutdownRequest(http.MethodPost, ""), http.StatusUnauthorized},
+		{shutdownRequest(http.MethodPost, "Bearer wrong"), http.StatusUnauthorized},
+		{shutdownRequest(http.MethodPost, "secret"), http.StatusUnauthorized},
+		{shutdownRequest(http.MethodGet, "Bearer secret"), http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		handler(recorder, tt.req)
+		if recorder.Code != tt.want {
+			t.Errorf("%s with %q: status %d, want %d", tt.req.Method, tt.req.Header.Get("Authorization"), recorder.Code, tt.want)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if target.calls.Load() != 0 {
+		t.Errorf("shut down %d times without the token", target.calls.Load())
+	}
+}
+
+func TestShutdownWithToken(t *testing.T) {
+	target := &countingShutdowner{done: make(chan struct{})}
+	handler := ShutdownHandler("secret", target)
+
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		handler(recorder, shutdownRequest(http.MethodPost, "Bearer secret"))
+		if recorder.Code != http.StatusAccepted {
+			t.Errorf("request %d: status %d, want 202", i, recorder.Code)
+		}
+	}
+
+	select {
+	case <-target.done:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown never started")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if target.calls.Load() != 1 {
+		t.Errorf("shut down %d times, want once", target.calls.Load())
+	}
+}
+
+func TestEmptyAdminTokenRejectsAll(t *testing.T) {
+	target := &countingShutdowner{done: make(chan struct{})}
+	recorder := httptest.NewRecorder()
+	ShutdownHandler("", target)(recorder, shutdownRequest(http.MethodPost, "Bearer "))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401", recorder.Code)
+	}
+}
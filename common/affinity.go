@@ -0,0 +1,98 @@
+package common
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// defaultVirtualNodes is the number of ring points placed per member
+const defaultVirtualNodes = 64
+
+// HashRing maps keys to members using consistent hashing so that every
+// chunk of a session is routed to the same member of a pool
+type HashRing struct {
+	points  []uint32
+	members map[uint32]string
+}
+
+// NewHashRing builds a ring over the given members
+func NewHashRing(members []string) *HashRing {
+	ring := &HashRing{
+		members: make(map[uint32]string),
+	}
+
+	for _, member := range members {
+		for v := 0; v < defaultVirtualNodes; v++ {
+			point := hashKey(fmt.Sprintf("%s#%d", member, v))
+			if _, exists := ring.members[point]; exists {
+				continue
+			}
+			ring.members[point] = member
+			ring.points = append(ring.points, point)
+		}
+	}
+
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i] < ring.points[j]
+	})
+
+	return ring
+}
+
+// Get returns the member responsible for key, or "" if the ring is empty
+func (r *HashRing) Get(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	h := hashKey(key)
+	idx := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	if idx == len(r.points) {
+		idx = 0
+	}
+
+	return r.members[r.points[idx]]
+}
+
+// hashKey hashes a string onto the ring. FNV alone leaves keys that differ
+// only in their last bytes, like "session-1" and "session-2", close
+// together on the ring, so its result is mixed with the murmur3 finalizer.
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// Successors returns every member in ring order starting with the one
+// responsible for key, so a key's fallbacks are the same wherever it is
+// looked up
+func (r *HashRing) Successors(key string) []string {
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	h := hashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+
+	seen := make(map[string]bool)
+	var members []string
+	for i := 0; i < len(r.points); i++ {
+		member := r.members[r.points[(start+i)%len(r.points)]]
+		if !seen[member] {
+			seen[member] = true
+			members = append(members, member)
+		}
+	}
+	return members
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestHashRingAgreesAcrossMemberOrder(t *testing.T) {
+	members := []string{"central-a:8080", "central-b:8080", "central-c:8080"}
+	reversed := slices.Clone(members)
+	slices.Reverse(reversed)
+
+	ring, other := NewHashRing(members), NewHashRing(reversed)
+	used := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("session-%d", i)
+		got := ring.Get(key)
+		if got != other.Get(key) {
+			t.Fatalf("Get(%s) differs with member order: %q and %q", key, got, other.Get(key))
+		}
+		used[got] = true
+	}
+	if len(used) != len(members) {
+		t.Errorf("200 keys used only %d of %d members", len(used), len(members))
+	}
+}
+
+func TestHashRingSuccessors(t *testing.T) {
+	members := []string{"a", "b", "c"}
+	ring := NewHashRing(members)
+
+	successors := ring.Successors("session")
+	if successors[0] != ring.Get("session") {
+		t.Errorf("Successors starts with %q, Get returns %q", successors[0], ring.Get("session"))
+	}
+	sorted := slices.Sorted(slices.Values(successors))
+	if !slices.Equal(sorted, members) {
+		t.Errorf("Successors = %v, want every member once", successors)
+	}
+
+	if got := NewHashRing(nil).Get("session"); got != "" {
+		t.Errorf("empty ring Get = %q", got)
+	}
+}
+
+func TestHashRingSpreadsSimilarKeys(t *testing.T) {
+	// Members and session IDs as a test setup would name them: loopback
+	// ports and numbered sessions
+	for port := 40000; port < 40100; port += 2 {
+		a, b := fmt.Sprintf("127.0.0.1:%d", port), fmt.Sprintf("127.0.0.1:%d", port+1)
+		ring := NewHashRing([]string{a, b})
+
+		used := make(map[string]int)
+		for i := 0; i < 20; i++ {
+			used[ring.Get(fmt.Sprintf("session-%d", i))]++
+		}
+		if len(used) != 2 {
+			t.Errorf("members %s and %s: 20 sessions all went to one (%v)", a, b, used)
+		}
+	}
+}
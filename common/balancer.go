@@ -0,0 +1,184 @@
+package common
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// Balancer spreads the chunks of a session over a fixed set of targets,
+// such as a client's upstreams or the central proxy's downstreams
+type Balancer interface {
+	// Pick returns up to n distinct targets for the i-th chunk of a
+	// session, in order of preference
+	Pick(sessionID string, i, n int) []string
+	// Done reports that a chunk sent to a target picked earlier finished,
+	// whether or not it was delivered
+	Done(target string)
+}
+
+// BalancerFactory builds a balancer over targets
+type BalancerFactory func(targets []string) Balancer
+
+// Balancing policies registered by default
+const (
+	BalanceRoundRobin       = "round_robin"       // chunk i goes to target i, wrapping around
+	BalanceRandom           = "random"            // any target, at random
+	BalanceLeastOutstanding = "least_outstanding" // the target with the fewest chunks in flight
+	BalanceConsistentHash   = "consistent_hash"   // every chunk of a session to the same target
+)
+
+var (
+	balancers   = make(map[string]BalancerFactory)
+	balancersMu sync.RWMutex
+)
+
+func init() {
+	RegisterBalancer(BalanceRoundRobin, newRoundRobinBalancer)
+	RegisterBalancer(BalanceRandom, newRandomBalancer)
+	RegisterBalancer(BalanceLeastOutstanding, newLeastOutstandingBalancer)
+	RegisterBalancer(BalanceConsistentHash, newConsistentHashBalancer)
+}
+
+// RegisterBalancer makes a balancing policy available under the given name
+func RegisterBalancer(name string, factory BalancerFactory) {
+	balancersMu.Lock()
+	defer balancersMu.Unlock()
+	balancers[name] = factory
+}
+
+// NewBalancer returns the balancer registered for policy over targets. An
+// empty policy is round-robin, which is how chunks were always spread.
+func NewBalancer(policy string, targets []string) (Balancer, error) {
+	if policy == "" {
+		policy = BalanceRoundRobin
+	}
+
+	balancersMu.RLock()
+	factory, exists := balancers[policy]
+	balancersMu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("unknown balancing policy %q", policy)
+	}
+
+	return factory(targets), nil
+}
+
+// ValidBalancePolicy reports whether policy names a registered balancer
+func ValidBalancePolicy(policy string) bool {
+	_, err := NewBalancer(policy, nil)
+	return err == nil
+}
+
+// rotate returns n distinct targets starting with the one at start
+func rotate(targets []string, start, n int) []string {
+	n = min(n, len(targets))
+	picked := make([]string, n)
+	for j := range picked {
+		picked[j] = targets[(start+j)%len(targets)]
+	}
+	return picked
+}
+
+// roundRobinBalancer sends chunk i to target i modulo the number of
+// targets, so a session's chunks are spread evenly
+type roundRobinBalancer struct {
+	targets []string
+}
+
+func newRoundRobinBalancer(targets []string) Balancer {
+	return &roundRobinBalancer{targets: targets}
+}
+
+func (b *roundRobinBalancer) Pick(sessionID string, i, n int) []string {
+	if len(b.targets) == 0 {
+		return nil
+	}
+	return rotate(b.targets, i%len(b.targets), n)
+}
+
+func (b *roundRobinBalancer) Done(target string) {}
+
+// randomBalancer picks targets at random, so the order of a session's
+// chunks says nothing about their paths
+type randomBalancer struct {
+	targets []string
+}
+
+func newRandomBalancer(targets []string) Balancer {
+	return &randomBalancer{targets: targets}
+}
+
+func (b *randomBalancer) Pick(sessionID string, i, n int) []string {
+	n = min(n, len(b.targets))
+	picked := make([]string, n)
+	for j, k := range rand.Perm(len(b.targets))[:n] {
+		picked[j] = b.targets[k]
+	}
+	return picked
+}
+
+func (b *randomBalancer) Done(target string) {}
+
+// leastOutstandingBalancer picks the targets with the fewest chunks in
+// flight, so a slow target gets less work until it catches up. Ties go
+// round-robin.
+type leastOutstandingBalancer struct {
+	targets     []string
+	outstanding map[string]int
+	mu          sync.Mutex
+}
+
+func newLeastOutstandingBalancer(targets []string) Balancer {
+	return &leastOutstandingBalancer{
+		targets:     targets,
+		outstanding: make(map[string]int),
+	}
+}
+
+func (b *leastOutstandingBalancer) Pick(sessionID string, i, n int) []string {
+	if len(b.targets) == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	candidates := rotate(b.targets, i%len(b.targets), len(b.targets))
+	sort.SliceStable(candidates, func(x, y int) bool {
+		return b.outstanding[candidates[x]] < b.outstanding[candidates[y]]
+	})
+
+	picked := candidates[:min(n, len(candidates))]
+	for _, target := range picked {
+		b.outstanding[target]++
+	}
+	return picked
+}
+
+func (b *leastOutstandingBalancer) Done(target string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.outstanding[target] > 0 {
+		b.outstanding[target]--
+	}
+}
+
+// consistentHashBalancer sends every chunk of a session to the same target,
+// with copies going to the next targets on the ring
+type consistentHashBalancer struct {
+	ring *HashRing
+}
+
+func newConsistentHashBalancer(targets []string) Balancer {
+	return &consistentHashBalancer{ring: NewHashRing(targets)}
+}
+
+func (b *consistentHashBalancer) Pick(sessionID string, i, n int) []string {
+	successors := b.ring.Successors(sessionID)
+	return successors[:min(n, len(successors))]
+}
+
+func (b *consistentHashBalancer) Done(target string) {}
@@ -0,0 +1,165 @@
+package common
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+var balancerTargets = []string{"a", "b", "c"}
+
+// newTestBalancer returns the balancer for policy over balancerTargets
+func newTestBalancer(t *testing.T, policy string) Balancer {
+	t.Helper()
+	balancer, err := NewBalancer(policy, balancerTargets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balancer
+}
+
+// distinct reports whether picked names no target twice
+func distinct(picked []string) bool {
+	seen := make(map[string]bool)
+	for _, target := range picked {
+		if seen[target] {
+			return false
+		}
+		seen[target] = true
+	}
+	return true
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	balancer := newTestBalancer(t, BalanceRoundRobin)
+
+	var got []string
+	for i := 0; i < 6; i++ {
+		got = append(got, balancer.Pick("s", i, 1)...)
+	}
+	if want := []string{"a", "b", "c", "a", "b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("picked %v, want %v", got, want)
+	}
+
+	// Copies go to the following targets, and never more than there are
+	if got := balancer.Pick("s", 2, 2); !slices.Equal(got, []string{"c", "a"}) {
+		t.Errorf("two copies of chunk 2 to %v, want [c a]", got)
+	}
+	if got := balancer.Pick("s", 0, 5); !slices.Equal(got, balancerTargets) {
+		t.Errorf("five copies to %v, want each target once", got)
+	}
+}
+
+func TestRandomBalancer(t *testing.T) {
+	balancer := newTestBalancer(t, BalanceRandom)
+
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		picked := balancer.Pick("s", 0, 2)
+		if len(picked) != 2 || !distinct(picked) {
+			t.Fatalf("picked %v, want two distinct targets", picked)
+		}
+		counts[picked[0]]++
+	}
+	for _, target := range balancerTargets {
+		if counts[target] < 50 {
+			t.Errorf("%s picked first %d times in 300, want about 100", target, counts[target])
+		}
+	}
+}
+
+func TestLeastOutstandingBalancer(t *testing.T) {
+	balancer := newTestBalancer(t, BalanceLeastOutstanding)
+
+	// With nothing in flight it goes round-robin
+	for i, want := range balancerTargets {
+		if got := balancer.Pick("s", i, 1); !slices.Equal(got, []string{want}) {
+			t.Errorf("chunk %d to %v, want [%s]", i, got, want)
+		}
+	}
+
+	// a and c finish, b is stuck: the next chunks avoid b
+	balancer.Done("a")
+	balancer.Done("c")
+	for i := 3; i < 5; i++ {
+		if got := balancer.Pick("s", i, 1)[0]; got == "b" {
+			t.Errorf("chunk %d sent to b with a chunk still in flight", i)
+		}
+	}
+
+	// Finishing more chunks than were sent leaves b with none in flight, so
+	// it takes one chunk before ties go round-robin again
+	balancer.Done("b")
+	balancer.Done("b")
+	var got []string
+	for i := 0; i < 2; i++ {
+		got = append(got, balancer.Pick("s", 0, 1)...)
+	}
+	if !slices.Equal(got, []string{"b", "a"}) {
+		t.Errorf("picked %v, want [b a]", got)
+	}
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	balancer := newTestBalancer(t, BalanceConsistentHash)
+
+	// Every chunk of a session goes to the same target
+	first := balancer.Pick("session-1", 0, 1)[0]
+	for i := 1; i < 10; i++ {
+		if got := balancer.Pick("session-1", i, 1)[0]; got != first {
+			t.Errorf("chunk %d to %s, chunk 0 to %s", i, got, first)
+		}
+	}
+
+	// Copies go to other targets, and sessions spread over all of them
+	if got := balancer.Pick("session-1", 0, 3); got[0] != first || len(got) != 3 || !distinct(got) {
+		t.Errorf("three copies to %v, want every target starting with %s", got, first)
+	}
+	used := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		used[balancer.Pick(fmt.Sprintf("session-%d", i), 0, 1)[0]] = true
+	}
+	if len(used) != len(balancerTargets) {
+		t.Errorf("100 sessions used %d targets, want %d", len(used), len(balancerTargets))
+	}
+}
+
+func TestBalancerWithoutTargets(t *testing.T) {
+	for _, policy := range []string{BalanceRoundRobin, BalanceRandom, BalanceLeastOutstanding, BalanceConsistentHash} {
+		balancer, err := NewBalancer(policy, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := balancer.Pick("s", 0, 1); len(got) != 0 {
+			t.Errorf("%s: picked %v from no targets", policy, got)
+		}
+	}
+}
+
+func TestBalancePolicies(t *testing.T) {
+	for _, policy := range []string{"", BalanceRoundRobin, BalanceRandom, BalanceLeastOutstanding, BalanceConsistentHash} {
+		if !ValidBalancePolicy(policy) {
+			t.Errorf("policy %q refused", policy)
+		}
+	}
+	if ValidBalancePolicy("fastest") {
+		t.Error("unknown policy accepted")
+	}
+	if _, err := NewBalancer("fastest", balancerTargets); err == nil {
+		t.Error("balancer built for an unknown policy")
+	}
+
+	// The default is round-robin
+	balancer, err := NewBalancer("", balancerTargets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := balancer.Pick("s", 1, 1); !slices.Equal(got, []string{"b"}) {
+		t.Errorf("default policy sent chunk 1 to %v, want [b]", got)
+	}
+
+	RegisterBalancer("test_policy", newRandomBalancer)
+	if !ValidBalancePolicy("test_policy") {
+		t.Error("registered policy refused")
+	}
+}
@@ -0,0 +1,48 @@
+package common
+
+import (
+	"net/http"
+	"time"
+)
+
+// DeadlineHeader carries a request's latency deadline between relay nodes
+// and the gateway, which see the request as an opaque body. Chunks carry
+// it in Chunk.Deadline instead.
+const DeadlineHeader = "X-Deadline"
+
+// budgetShare is how much of a request's remaining latency budget one hop
+// may spend on artificial delay, leaving the rest to later hops and the
+// target itself
+const budgetShare = 0.5
+
+// BudgetDelay trims an artificial delay (jitter, a batch window) to what the
+// deadline leaves room for. Without a deadline delay is returned unchanged;
+// once the budget is spent it is skipped entirely.
+func BudgetDelay(delay time.Duration, deadline time.Time) time.Duration {
+	if deadline.IsZero() || delay <= 0 {
+		return delay
+	}
+
+	allowed := time.Duration(float64(time.Until(deadline)) * budgetShare)
+	if allowed <= 0 {
+		return 0
+	}
+	return min(delay, allowed)
+}
+
+// DeadlineFromHeader reads DeadlineHeader, returning the zero time if it is
+// absent or malformed
+func DeadlineFromHeader(header http.Header) time.Time {
+	deadline, err := time.Parse(time.RFC3339Nano, header.Get(DeadlineHeader))
+	if err != nil {
+		return time.Time{}
+	}
+	return deadline
+}
+
+// SetDeadlineHeader passes deadline on to the next hop, if there is one
+func SetDeadlineHeader(header http.Header, deadline time.Time) {
+	if !deadline.IsZero() {
+		header.Set(DeadlineHeader, deadline.UTC().Format(time.RFC3339Nano))
+	}
+}
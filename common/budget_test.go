@@ -0,0 +1,42 @@
+package common
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBudgetDelay(t *testing.T) {
+	second := time.Second
+	if got := BudgetDelay(second, time.Time{}); got != second {
+		t.Errorf("no deadline: %v, want the delay unchanged", got)
+	}
+	if got := BudgetDelay(second, time.Now().Add(time.Hour)); got != second {
+		t.Errorf("ample budget: %v, want the delay unchanged", got)
+	}
+	if got := BudgetDelay(second, time.Now().Add(time.Second)); got <= 0 || got > second/2 {
+		t.Errorf("one second left: %v, want at most half of it", got)
+	}
+	if got := BudgetDelay(second, time.Now().Add(-time.Second)); got != 0 {
+		t.Errorf("spent budget: %v, want the delay skipped", got)
+	}
+}
+
+func TestDeadlineHeader(t *testing.T) {
+	header := make(http.Header)
+	SetDeadlineHeader(header, time.Time{})
+	if header.Get(DeadlineHeader) != "" {
+		t.Error("header set without a deadline")
+	}
+
+	deadline := time.Now().Add(time.Minute)
+	SetDeadlineHeader(header, deadline)
+	if got := DeadlineFromHeader(header); !got.Equal(deadline) {
+		t.Errorf("read back %v, want %v", got, deadline)
+	}
+
+	header.Set(DeadlineHeader, "soon")
+	if got := DeadlineFromHeader(header); !got.IsZero() {
+		t.Errorf("malformed header read as %v", got)
+	}
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// ErrCancelNotAuthorized is returned for a cancel chunk whose seal does not
+// match the session key
+var ErrCancelNotAuthorized = errors.New("cancel chunk not sealed with the session key")
+
+// NewCancelChunk builds the chunk asking the central proxy to stop work on
+// a session. It travels like a request chunk, hop encryption included. With
+// a session key its data is the session ID sealed with that key, so only
+// the client that made the request can cancel it; without one it relies on
+// hop encryption alone, like the request itself.
+func NewCancelChunk(sessionID, sourceClient string, sessionKey []byte) (*Chunk, error) {
+	chunk := &Chunk{
+		SessionID:    sessionID,
+		SequenceNum:  ControlSequence,
+		TotalChunks:  1, // the request stands alone
+		ChunkType:    ChunkTypeCancel,
+		Timestamp:    time.Now(),
+		SourceClient: sourceClient,
+	}
+
+	if sessionKey != nil {
+		sealed, err := EncryptAESWithAAD([]byte(sessionID), sessionKey, chunk.AAD())
+		if err != nil {
+			return nil, err
+		}
+		chunk.Data = sealed
+	}
+	return chunk, nil
+}
+
+// VerifyCancel checks that a cancel chunk was sealed with sessionKey. A nil
+// key accepts any cancel chunk that got through hop decryption.
+func VerifyCancel(chunk *Chunk, sessionKey []byte) error {
+	if sessionKey == nil {
+		return nil
+	}
+
+	data, err := DecryptAESWithAAD(chunk.Data, sessionKey, chunk.AAD())
+	if err != nil || !bytes.Equal(data, []byte(chunk.SessionID)) {
+		return ErrCancelNotAuthorized
+	}
+	return nil
+}
+
+// IsCancel reports whether the chunk asks to cancel its session
+func (c *Chunk) IsCancel() bool {
+	return c.ChunkType == ChunkTypeCancel
+}
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCapability is returned for malformed or forged capability tokens
+var ErrInvalidCapability = errors.New("invalid capability token")
+
+// ErrCapabilityExpired is returned for capability tokens past their expiry
+var ErrCapabilityExpired = errors.New("capability token expired")
+
+// Capability grants a relay the right to use a set of gateways. A trust
+// root signs it offline; gateways only hold the root's public key, so a
+// relay reconfigured to reach some other gateway has nothing to present.
+type Capability struct {
+	NodeID    string    `json:"node_id"`
+	Gateways  []string  `json:"gateways"` // gateway IDs the node may use
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Allows reports whether the capability covers gatewayID
+func (c *Capability) Allows(gatewayID string) bool {
+	for _, id := range c.Gateways {
+		if id == gatewayID {
+			return true
+		}
+	}
+	return false
+}
+
+// SignCapability encodes and signs a capability as
+// base64url(payload) "." base64url(signature)
+func SignCapability(capability Capability, key ed25519.PrivateKey) (string, error) {
+	payload, err := json.Marshal(capability)
+	if err != nil {
+		return "", err
+	}
+
+	signature := ed25519.Sign(key, payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// VerifyCapability checks a token's signature and expiry at now and
+// returns the capability it grants
+func VerifyCapability(token string, key ed25519.PublicKey, now time.Time) (*Capability, error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing signature", ErrInvalidCapability)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCapability, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCapability, err)
+	}
+
+	if !ed25519.Verify(key, payload, signature) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidCapability)
+	}
+
+	var capability Capability
+	if err := json.Unmarshal(payload, &capability); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCapability, err)
+	}
+
+	if now.After(capability.ExpiresAt) {
+		return nil, fmt.Errorf("%w: expired at %s", ErrCapabilityExpired, capability.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return &capability, nil
+}
+
+// ParseCapabilityKey decodes a hex ed25519 public key from config
+func ParseCapabilityKey(hexKey string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, fmt.Errorf("capability key is not valid hex: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("capability key must be %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
@@ -0,0 +1,86 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCapabilityKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+func TestCapabilityAccepted(t *testing.T) {
+	public, private := testCapabilityKey(t)
+	token, err := SignCapability(Capability{NodeID: "relay-1", Gateways: []string{"gw-a", "gw-b"}, ExpiresAt: time.Now().Add(time.Hour)}, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	capability, err := VerifyCapability(token, public, time.Now())
+	if err != nil {
+		t.Fatalf("VerifyCapability: %v", err)
+	}
+	if capability.NodeID != "relay-1" || !capability.Allows("gw-b") || capability.Allows("gw-c") {
+		t.Errorf("got %+v", capability)
+	}
+}
+
+func TestForgedCapabilityRejected(t *testing.T) {
+	public, _ := testCapabilityKey(t)
+	_, forger := testCapabilityKey(t)
+	capability := Capability{NodeID: "relay-1", Gateways: []string{"gw-a"}, ExpiresAt: time.Now().Add(time.Hour)}
+
+	forged, _ := SignCapability(capability, forger)
+	if _, err := VerifyCapability(forged, public, time.Now()); !errors.Is(err, ErrInvalidCapability) {
+		t.Errorf("signed by another key: got %v, want ErrInvalidCapability", err)
+	}
+
+	// A payload widened after signing no longer matches the signature
+	_, private := testCapabilityKey(t)
+	token, _ := SignCapability(capability, private)
+	_, signature, _ := strings.Cut(token, ".")
+	capability.Gateways = append(capability.Gateways, "gw-evil")
+	widened, _ := SignCapability(capability, private)
+	payload, _, _ := strings.Cut(widened, ".")
+	if _, err := VerifyCapability(payload+"."+signature, private.Public().(ed25519.PublicKey), time.Now()); !errors.Is(err, ErrInvalidCapability) {
+		t.Errorf("tampered payload: got %v, want ErrInvalidCapability", err)
+	}
+
+	for _, token := range []string{"", "no-signature", "!!!.!!!"} {
+		if _, err := VerifyCapability(token, public, time.Now()); !errors.Is(err, ErrInvalidCapability) {
+			t.Errorf("%q: got %v, want ErrInvalidCapability", token, err)
+		}
+	}
+}
+
+func TestExpiredCapabilityRejected(t *testing.T) {
+	public, private := testCapabilityKey(t)
+	token, _ := SignCapability(Capability{NodeID: "relay-1", Gateways: []string{"gw-a"}, ExpiresAt: time.Now().Add(-time.Minute)}, private)
+
+	if _, err := VerifyCapability(token, public, time.Now()); !errors.Is(err, ErrCapabilityExpired) {
+		t.Errorf("got %v, want ErrCapabilityExpired", err)
+	}
+}
+
+func TestParseCapabilityKey(t *testing.T) {
+	public, _ := testCapabilityKey(t)
+	key, err := ParseCapabilityKey(hex.EncodeToString(public))
+	if err != nil || !key.Equal(public) {
+		t.Errorf("got %x, %v", key, err)
+	}
+
+	for _, bad := range []string{"zz", hex.EncodeToString(public[:16])} {
+		if _, err := ParseCapabilityKey(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
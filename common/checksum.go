@@ -0,0 +1,39 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// ErrChunkCorrupted is returned when a chunk's Data doesn't match its checksum
+var ErrChunkCorrupted = errors.New("chunk corrupted")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// DataChecksum returns the CRC-32C of a chunk's Data as carried in the
+// Checksum field. It catches accidental damage, such as a middlebox
+// rewriting the body, not tampering: anyone can recompute it.
+func DataChecksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
+
+// withChecksum returns a shallow copy of chunk with Checksum set, leaving
+// the caller's chunk untouched
+func withChecksum(chunk *Chunk) *Chunk {
+	c := *chunk
+	c.Checksum = DataChecksum(c.Data)
+	return &c
+}
+
+// VerifyChecksum checks Data against Checksum. Chunks from peers that
+// don't send a checksum carry none and are accepted.
+func (c *Chunk) VerifyChecksum() error {
+	if c.Checksum == 0 {
+		return nil
+	}
+	if sum := DataChecksum(c.Data); sum != c.Checksum {
+		return fmt.Errorf("%w: checksum %08x, data hashes to %08x", ErrChunkCorrupted, c.Checksum, sum)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+// corrupt replaces the bytes of data in an encoded chunk with a copy of data
+// with one bit flipped, as encoded by the codec named
+func corrupt(t *testing.T, name string, encoded, data []byte) []byte {
+	t.Helper()
+	damaged := bytes.Clone(data)
+	damaged[len(damaged)/2] ^= 0x01
+
+	original, replacement := data, damaged
+	if name == CodecJSON {
+		original = []byte(base64.StdEncoding.EncodeToString(data))
+		replacement = []byte(base64.StdEncoding.EncodeToString(damaged))
+	}
+	if !bytes.Contains(encoded, original) {
+		t.Fatalf("%s: data not found in the encoded chunk", name)
+	}
+	return bytes.Replace(encoded, original, replacement, 1)
+}
+
+func TestCorruptedDataDetected(t *testing.T) {
+	for _, name := range []string{CodecJSON, CodecProtobuf} {
+		codec, err := NewChunkCodec(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chunk := codecTestChunk(64)
+		encoded, err := codec.Encode(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunk.Checksum != 0 {
+			t.Errorf("%s: Encode set the checksum on the caller's chunk", name)
+		}
+
+		if _, err := codec.Decode(corrupt(t, name, encoded, chunk.Data)); !errors.Is(err, ErrChunkCorrupted) {
+			t.Errorf("%s: got %v, want ErrChunkCorrupted", name, err)
+		}
+	}
+}
+
+func TestSerializedChunkChecksum(t *testing.T) {
+	chunk := codecTestChunk(64)
+	encoded, err := SerializeChunk(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeserializeChunk(encoded); err != nil {
+		t.Fatalf("intact chunk: %v", err)
+	}
+	if _, err := DeserializeChunk(corrupt(t, CodecJSON, encoded, chunk.Data)); !errors.Is(err, ErrChunkCorrupted) {
+		t.Errorf("got %v, want ErrChunkCorrupted", err)
+	}
+}
+
+func TestChunkWithoutChecksumAccepted(t *testing.T) {
+	// Peers that predate checksums send none
+	chunk := &Chunk{Data: []byte("data")}
+	if err := chunk.VerifyChecksum(); err != nil {
+		t.Errorf("chunk without checksum: %v", err)
+	}
+
+	chunk.Checksum = DataChecksum([]byte("other"))
+	if err := chunk.VerifyChecksum(); !errors.Is(err, ErrChunkCorrupted) {
+		t.Errorf("mismatched checksum: got %v, want ErrChunkCorrupted", err)
+	}
+}
@@ -0,0 +1,144 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Adaptive chunk size tuning
+const (
+	chunkGrowAfter   = 4    // clean sends before trying a larger size
+	chunkGrowFactor  = 1.25 // growth per step
+	chunkMinGoodput  = 0.9  // share of the previous goodput a larger size must keep
+	goodputSmoothing = 0.3  // weight of the newest sample in the goodput average
+)
+
+// ChunkTuning bounds automatic tuning of the request chunk size
+type ChunkTuning struct {
+	Enabled bool `yaml:"enabled"`
+	MinSize int  `yaml:"min_size"` // bytes (default 1024)
+	MaxSize int  `yaml:"max_size"` // bytes (default 65536)
+}
+
+// Validate checks the tuning bounds
+func (c ChunkTuning) Validate() error {
+	if c.MinSize < 0 || c.MaxSize < 0 {
+		return fmt.Errorf("chunk_tuning.min_size and max_size must not be negative")
+	}
+	if c.MaxSize > 0 && c.MinSize > c.MaxSize {
+		return fmt.Errorf("chunk_tuning.min_size %d exceeds max_size %d", c.MinSize, c.MaxSize)
+	}
+	if c.MaxSize > DefaultMaxChunkSize {
+		return fmt.Errorf("chunk_tuning.max_size must not exceed %d", DefaultMaxChunkSize)
+	}
+	return nil
+}
+
+// AdaptiveChunker picks the chunk size from how sends have gone. A failed
+// send halves the size, on the guess that the path drops or times out large
+// bodies. After a run of clean sends it grows by a quarter, and keeps
+// growing for as long as goodput (bytes delivered per second of round trip)
+// holds up; a step that made goodput worse is taken back.
+type AdaptiveChunker struct {
+	min, max int
+
+	mu        sync.Mutex
+	size      int
+	successes int     // clean sends since the last change
+	goodput   float64 // smoothed bytes per second at the current size
+	previous  float64 // goodput before the last growth step, 0 if none
+}
+
+// NewAdaptiveChunker starts tuning from initial, clamped to the bounds
+func NewAdaptiveChunker(config ChunkTuning, initial int) *AdaptiveChunker {
+	if config.MinSize == 0 {
+		config.MinSize = 1024
+	}
+	if config.MaxSize == 0 {
+		config.MaxSize = 65536
+	}
+	if config.MaxSize < config.MinSize {
+		config.MaxSize = config.MinSize
+	}
+
+	return &AdaptiveChunker{
+		min:  config.MinSize,
+		max:  config.MaxSize,
+		size: min(max(initial, config.MinSize), config.MaxSize),
+	}
+}
+
+// Size returns the chunk size to use for the next request
+func (a *AdaptiveChunker) Size() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.size
+}
+
+// Observe records the outcome of sending a chunk of n bytes that took rtt
+func (a *AdaptiveChunker) Observe(n int, rtt time.Duration, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !ok {
+		a.resize(a.size / 2)
+		a.previous = 0
+		return
+	}
+
+	if rtt > 0 {
+		sample := float64(n) / rtt.Seconds()
+		if a.goodput == 0 {
+			a.goodput = sample
+		} else {
+			a.goodput += goodputSmoothing * (sample - a.goodput)
+		}
+	}
+
+	a.successes++
+	if a.successes < chunkGrowAfter {
+		return
+	}
+
+	// The last step up cost goodput, so go back to where it was better
+	if a.previous > 0 && a.goodput < a.previous*chunkMinGoodput {
+		a.resize(int(float64(a.size) / chunkGrowFactor))
+		a.previous = 0
+		return
+	}
+
+	goodput := a.goodput
+	if a.resize(int(float64(a.size) * chunkGrowFactor)) {
+		a.previous = goodput
+	}
+}
+
+// resize moves to size within the bounds and starts measuring afresh. It
+// reports whether the size changed.
+func (a *AdaptiveChunker) resize(size int) bool {
+	size = min(max(size, a.min), a.max)
+	a.successes = 0
+	a.goodput = 0
+	if size == a.size {
+		return false
+	}
+	a.size = size
+	return true
+}
+
+// SplitData cuts data into pieces of at most size bytes, sharing its
+// backing array. Empty data yields one empty piece, so even an empty body
+// is sent as a chunk.
+func SplitData(data []byte, size int) [][]byte {
+	if len(data) <= size || size <= 0 {
+		return [][]byte{data}
+	}
+
+	pieces := make([][]byte, 0, (len(data)+size-1)/size)
+	for len(data) > size {
+		pieces = append(pieces, data[:size:size])
+		data = data[size:]
+	}
+	return append(pieces, data)
+}
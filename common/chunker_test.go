@@ -0,0 +1,111 @@
+package common
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveChunkerShrinksOnLoss(t *testing.T) {
+	chunker := NewAdaptiveChunker(ChunkTuning{Enabled: true, MinSize: 1024, MaxSize: 65536}, 8192)
+
+	for _, want := range []int{4096, 2048, 1024, 1024} {
+		chunker.Observe(chunker.Size(), 10*time.Millisecond, false)
+		if got := chunker.Size(); got != want {
+			t.Fatalf("after a failed send: size %d, want %d", got, want)
+		}
+	}
+}
+
+func TestAdaptiveChunkerGrowsWhenClean(t *testing.T) {
+	chunker := NewAdaptiveChunker(ChunkTuning{Enabled: true, MinSize: 1024, MaxSize: 4096}, 1024)
+
+	// A fixed round trip, so goodput rises with the size
+	for i := 0; i < chunkGrowAfter-1; i++ {
+		chunker.Observe(chunker.Size(), 10*time.Millisecond, true)
+	}
+	if chunker.Size() != 1024 {
+		t.Fatalf("grew to %d before %d clean sends", chunker.Size(), chunkGrowAfter)
+	}
+	chunker.Observe(chunker.Size(), 10*time.Millisecond, true)
+	if chunker.Size() != 1280 {
+		t.Fatalf("size %d after %d clean sends, want 1280", chunker.Size(), chunkGrowAfter)
+	}
+
+	for i := 0; i < 100; i++ {
+		chunker.Observe(chunker.Size(), 10*time.Millisecond, true)
+	}
+	if chunker.Size() != 4096 {
+		t.Errorf("size %d after many clean sends, want max_size", chunker.Size())
+	}
+}
+
+func TestAdaptiveChunkerTakesBackCostlyGrowth(t *testing.T) {
+	chunker := NewAdaptiveChunker(ChunkTuning{Enabled: true, MinSize: 1000, MaxSize: 4000}, 1000)
+	for i := 0; i < chunkGrowAfter; i++ {
+		chunker.Observe(chunker.Size(), 10*time.Millisecond, true)
+	}
+	if chunker.Size() != 1250 {
+		t.Fatalf("size %d, want one growth step", chunker.Size())
+	}
+
+	// The larger chunks take far longer, so goodput falls
+	for i := 0; i < chunkGrowAfter; i++ {
+		chunker.Observe(chunker.Size(), 100*time.Millisecond, true)
+	}
+	if chunker.Size() != 1000 {
+		t.Errorf("size %d after goodput fell, want the step taken back", chunker.Size())
+	}
+}
+
+func TestChunkTuningValidate(t *testing.T) {
+	tests := []struct {
+		config ChunkTuning
+		want   string
+	}{
+		{ChunkTuning{MinSize: -1}, "chunk_tuning.min_size and max_size must not be negative"},
+		{ChunkTuning{MinSize: 4096, MaxSize: 1024}, "chunk_tuning.min_size 4096 exceeds max_size 1024"},
+		{ChunkTuning{MaxSize: DefaultMaxChunkSize + 1}, "chunk_tuning.max_size must not exceed"},
+	}
+	for _, tt := range tests {
+		err := tt.config.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v: got %v, want %q", tt.config, err, tt.want)
+		}
+	}
+	if err := (ChunkTuning{MinSize: 512, MaxSize: 2048}).Validate(); err != nil {
+		t.Errorf("valid bounds: %v", err)
+	}
+}
+
+func TestSplitData(t *testing.T) {
+	tests := []struct {
+		data string
+		size int
+		want []string
+	}{
+		{"", 4, []string{""}},
+		{"abc", 4, []string{"abc"}},
+		{"abcd", 4, []string{"abcd"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"abc", 0, []string{"abc"}},
+	}
+	for _, tt := range tests {
+		pieces := SplitData([]byte(tt.data), tt.size)
+		var got []string
+		for _, piece := range pieces {
+			got = append(got, string(piece))
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("SplitData(%q, %d) = %q, want %q", tt.data, tt.size, got, tt.want)
+		}
+	}
+
+	// Appending to a piece must not overwrite the next one
+	pieces := SplitData([]byte("abcdefgh"), 4)
+	_ = append(pieces[0], 'x')
+	if string(pieces[1]) != "efgh" {
+		t.Errorf("appending to a piece changed the next to %q", pieces[1])
+	}
+}
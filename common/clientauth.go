@@ -0,0 +1,136 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClientAuthHeader carries a client's request signature to upstream
+// servers, as "<key ID>:<unix time>:<hex HMAC-SHA256>"
+const ClientAuthHeader = "X-Client-Auth"
+
+// ClientAuthSkew is how far a signature's time may be from the upstream's
+// clock before it is refused
+const ClientAuthSkew = 5 * time.Minute
+
+// ErrClientAuth is returned for requests without a valid client signature
+var ErrClientAuth = errors.New("client authentication failed")
+
+// ClientCredentials identify a client to upstream servers that require
+// signed requests. The secret is given inline or read from secret_file;
+// both are hex encoded.
+type ClientCredentials struct {
+	KeyID      string `yaml:"key_id"`
+	Secret     string `yaml:"secret"`
+	SecretFile string `yaml:"secret_file"`
+}
+
+// Enabled reports whether requests are to be signed
+func (c ClientCredentials) Enabled() bool {
+	return c.KeyID != ""
+}
+
+// Validate checks the credentials without reading secret_file
+func (c ClientCredentials) Validate() error {
+	switch {
+	case !c.Enabled():
+		if c.Secret != "" || c.SecretFile != "" {
+			return errors.New("credentials.key_id is required with a secret")
+		}
+	case strings.Contains(c.KeyID, ":"):
+		return fmt.Errorf("credentials.key_id %q must not contain ':'", c.KeyID)
+	case (c.Secret == "") == (c.SecretFile == ""):
+		return errors.New("credentials need exactly one of secret and secret_file")
+	case c.Secret != "":
+		if _, err := DecodeClientSecret(c.Secret); err != nil {
+			return fmt.Errorf("credentials.secret: %w", err)
+		}
+	}
+	return nil
+}
+
+// LoadSecret returns the decoded secret, reading secret_file if set
+func (c ClientCredentials) LoadSecret() ([]byte, error) {
+	encoded := c.Secret
+	if c.SecretFile != "" {
+		data, err := os.ReadFile(c.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("credentials.secret_file: %w", err)
+		}
+		encoded = strings.TrimSpace(string(data))
+	}
+	return DecodeClientSecret(encoded)
+}
+
+// DecodeClientSecret decodes a hex secret of at least 16 bytes
+func DecodeClientSecret(encoded string) ([]byte, error) {
+	secret, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("secret is not hex: %w", err)
+	}
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("secret must be at least 16 bytes, got %d", len(secret))
+	}
+	return secret, nil
+}
+
+// clientSignature is the HMAC-SHA256 over the key ID, time, method, path
+// and body hash, so a signature can't be moved to another request
+func clientSignature(secret []byte, keyID string, unix int64, method, uri string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%d\n%s\n%s\n%x", keyID, unix, method, uri, bodyHash)
+	return mac.Sum(nil)
+}
+
+// SignClientRequest adds the ClientAuthHeader to req, whose body is body
+func SignClientRequest(req *http.Request, body []byte, keyID string, secret []byte) {
+	unix := time.Now().Unix()
+	signature := clientSignature(secret, keyID, unix, req.Method, req.URL.RequestURI(), body)
+	req.Header.Set(ClientAuthHeader, fmt.Sprintf("%s:%d:%x", keyID, unix, signature))
+}
+
+// VerifyClientRequest checks the signature on r, whose body is body,
+// against the secrets in keys by key ID, and returns the key ID
+func VerifyClientRequest(r *http.Request, body []byte, keys map[string][]byte, now time.Time) (string, error) {
+	value := r.Header.Get(ClientAuthHeader)
+	if value == "" {
+		return "", fmt.Errorf("%w: no signature", ErrClientAuth)
+	}
+
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 {
+		return "", fmt.Errorf("%w: malformed signature", ErrClientAuth)
+	}
+	keyID := parts[0]
+
+	secret, exists := keys[keyID]
+	if !exists {
+		return keyID, fmt.Errorf("%w: unknown key ID %q", ErrClientAuth, keyID)
+	}
+	unix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return keyID, fmt.Errorf("%w: malformed time", ErrClientAuth)
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > ClientAuthSkew || skew < -ClientAuthSkew {
+		return keyID, fmt.Errorf("%w: signed %v away from now", ErrClientAuth, skew.Round(time.Second))
+	}
+	signature, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return keyID, fmt.Errorf("%w: malformed signature", ErrClientAuth)
+	}
+
+	expected := clientSignature(secret, keyID, unix, r.Method, r.URL.RequestURI(), body)
+	if !hmac.Equal(signature, expected) {
+		return keyID, fmt.Errorf("%w: bad signature for key ID %q", ErrClientAuth, keyID)
+	}
+	return keyID, nil
+}
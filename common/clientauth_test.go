@@ -0,0 +1,90 @@
+package common
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var clientSecret = []byte("0123456789abcdef")
+
+func TestClientSignatureVerifies(t *testing.T) {
+	keys := map[string][]byte{"laptop": clientSecret}
+	body := []byte("chunk body")
+
+	req := httptest.NewRequest("POST", "/chunk", nil)
+	SignClientRequest(req, body, "laptop", clientSecret)
+	if keyID, err := VerifyClientRequest(req, body, keys, time.Now()); err != nil || keyID != "laptop" {
+		t.Fatalf("signed request: %q, %v", keyID, err)
+	}
+
+	tests := []struct {
+		name string
+		req  func() ([]byte, map[string][]byte, time.Time)
+	}{
+		{"other body", func() ([]byte, map[string][]byte, time.Time) { return []byte("other"), keys, time.Now() }},
+		{"unknown key", func() ([]byte, map[string][]byte, time.Time) {
+			return body, map[string][]byte{"desktop": clientSecret}, time.Now()
+		}},
+		{"wrong secret", func() ([]byte, map[string][]byte, time.Time) {
+			return body, map[string][]byte{"laptop": []byte("fedcba9876543210")}, time.Now()
+		}},
+		{"too old", func() ([]byte, map[string][]byte, time.Time) {
+			return body, keys, time.Now().Add(ClientAuthSkew + time.Minute)
+		}},
+	}
+	for _, tt := range tests {
+		body, keys, now := tt.req()
+		if _, err := VerifyClientRequest(req, body, keys, now); !errors.Is(err, ErrClientAuth) {
+			t.Errorf("%s: got %v, want ErrClientAuth", tt.name, err)
+		}
+	}
+
+	// A signature can't be moved to another path
+	moved := httptest.NewRequest("POST", "/cancel", nil)
+	moved.Header = req.Header
+	if _, err := VerifyClientRequest(moved, body, keys, time.Now()); !errors.Is(err, ErrClientAuth) {
+		t.Errorf("moved signature: got %v, want ErrClientAuth", err)
+	}
+	if _, err := VerifyClientRequest(httptest.NewRequest("POST", "/chunk", nil), body, keys, time.Now()); !errors.Is(err, ErrClientAuth) {
+		t.Errorf("unsigned request: got %v, want ErrClientAuth", err)
+	}
+}
+
+func TestClientCredentialsValidate(t *testing.T) {
+	secret := "00112233445566778899aabbccddeeff"
+	tests := []struct {
+		credentials ClientCredentials
+		want        string
+	}{
+		{ClientCredentials{}, ""},
+		{ClientCredentials{KeyID: "laptop", Secret: secret}, ""},
+		{ClientCredentials{KeyID: "laptop", SecretFile: "/secret"}, ""},
+		{ClientCredentials{Secret: secret}, "key_id is required"},
+		{ClientCredentials{KeyID: "a:b", Secret: secret}, "must not contain ':'"},
+		{ClientCredentials{KeyID: "laptop"}, "exactly one of secret and secret_file"},
+		{ClientCredentials{KeyID: "laptop", Secret: secret, SecretFile: "/secret"}, "exactly one of secret and secret_file"},
+		{ClientCredentials{KeyID: "laptop", Secret: "0011"}, "at least 16 bytes"},
+	}
+	for _, tt := range tests {
+		err := tt.credentials.Validate()
+		if (tt.want == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%+v: got %v, want %q", tt.credentials, err, tt.want)
+		}
+	}
+}
+
+func TestClientSecretFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("30313233343536373839616263646566\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := ClientCredentials{KeyID: "laptop", SecretFile: path}.LoadSecret()
+	if err != nil || string(secret) != string(clientSecret) {
+		t.Errorf("got %q, %v", secret, err)
+	}
+}
@@ -0,0 +1,250 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Chunk codec names for the chunk_codec config option
+const (
+	CodecJSON     = "json"
+	CodecProtobuf = "protobuf"
+)
+
+// ChunkCodec encodes chunks on the wire. Every hop must be configured with
+// the same codec.
+type ChunkCodec interface {
+	Name() string
+	ContentType() string
+	Encode(chunk *Chunk) ([]byte, error)
+	Decode(data []byte) (*Chunk, error) // validates like DeserializeChunk
+}
+
+// NewChunkCodec returns the codec called name; "" selects JSON
+func NewChunkCodec(name string) (ChunkCodec, error) {
+	switch name {
+	case "", CodecJSON:
+		return JSONCodec{}, nil
+	case CodecProtobuf:
+		return ProtobufCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown chunk_codec %q", name)
+	}
+}
+
+// JSONCodec is the default, human-readable codec
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string                        { return CodecJSON }
+func (JSONCodec) ContentType() string                 { return "application/json" }
+func (JSONCodec) Encode(chunk *Chunk) ([]byte, error) { return SerializeChunk(chunk) }
+func (JSONCodec) Decode(data []byte) (*Chunk, error)  { return DeserializeChunk(data) }
+
+// ProtobufCodec encodes chunks in the protobuf wire format, carrying Data as
+// raw bytes instead of base64. It is compatible with this schema:
+//
+//	message Chunk {
+//	  string session_id = 1;
+//	  int64 sequence_num = 2;
+//	  int64 total_chunks = 3;
+//	  bytes data = 4;
+//	  int64 timestamp_unix_nano = 5;
+//	  string source_client = 6;
+//	  string target_url = 7;
+//	  string method = 8;
+//	  map<string, string> headers = 9;
+//	  string key_id = 10;
+//	  string chunk_type = 11;
+//	  string compression = 12;
+//	  int64 deadline_unix_nano = 13;
+//	  bytes target_auth = 14;
+//	  uint32 checksum = 15;
+//	}
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Name() string        { return CodecProtobuf }
+func (ProtobufCodec) ContentType() string { return "application/x-protobuf" }
+
+// Protobuf wire types
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// Encode writes the chunk's non-zero fields, with the checksum of its data
+func (ProtobufCodec) Encode(chunk *Chunk) ([]byte, error) {
+	chunk = withChecksum(chunk)
+	buf := make([]byte, 0, len(chunk.Data)+256)
+
+	buf = appendString(buf, 1, chunk.SessionID)
+	buf = appendVarint(buf, 2, int64(chunk.SequenceNum))
+	buf = appendVarint(buf, 3, int64(chunk.TotalChunks))
+	buf = appendBytes(buf, 4, chunk.Data)
+	if !chunk.Timestamp.IsZero() {
+		buf = appendVarint(buf, 5, chunk.Timestamp.UnixNano())
+	}
+	buf = appendString(buf, 6, chunk.SourceClient)
+	buf = appendString(buf, 7, chunk.TargetURL)
+	buf = appendString(buf, 8, chunk.Method)
+
+	// Sorted so equal chunks encode identically
+	keys := make([]string, 0, len(chunk.Headers))
+	for k := range chunk.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = appendString(entry, 1, k)
+		entry = appendString(entry, 2, chunk.Headers[k])
+		buf = appendBytes(buf, 9, entry)
+	}
+
+	buf = appendString(buf, 10, chunk.KeyID)
+	buf = appendString(buf, 11, chunk.ChunkType)
+	buf = appendString(buf, 12, chunk.Compression)
+	if !chunk.Deadline.IsZero() {
+		buf = appendVarint(buf, 13, chunk.Deadline.UnixNano())
+	}
+	buf = appendBytes(buf, 14, chunk.TargetAuth)
+	buf = appendVarint(buf, 15, int64(chunk.Checksum))
+
+	return buf, nil
+}
+
+// Decode parses a chunk, skipping unknown fields
+func (ProtobufCodec) Decode(data []byte) (*Chunk, error) {
+	var chunk Chunk
+
+	err := readFields(data, func(field int, varint int64, value []byte) error {
+		switch field {
+		case 1:
+			chunk.SessionID = string(value)
+		case 2:
+			chunk.SequenceNum = int(varint)
+		case 3:
+			chunk.TotalChunks = int(varint)
+		case 4:
+			chunk.Data = append([]byte(nil), value...)
+		case 5:
+			chunk.Timestamp = time.Unix(0, varint)
+		case 6:
+			chunk.SourceClient = string(value)
+		case 7:
+			chunk.TargetURL = string(value)
+		case 8:
+			chunk.Method = string(value)
+		case 9:
+			var k, v string
+			err := readFields(value, func(field int, _ int64, value []byte) error {
+				switch field {
+				case 1:
+					k = string(value)
+				case 2:
+					v = string(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if chunk.Headers == nil {
+				chunk.Headers = make(map[string]string)
+			}
+			chunk.Headers[k] = v
+		case 10:
+			chunk.KeyID = string(value)
+		case 11:
+			chunk.ChunkType = string(value)
+		case 12:
+			chunk.Compression = string(value)
+		case 13:
+			chunk.Deadline = time.Unix(0, varint)
+		case 14:
+			chunk.TargetAuth = append([]byte(nil), value...)
+		case 15:
+			chunk.Checksum = uint32(varint)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := chunk.Validate(); err != nil {
+		return nil, err
+	}
+	if err := chunk.VerifyChecksum(); err != nil {
+		return nil, err
+	}
+
+	return &chunk, nil
+}
+
+var errMalformedProtobuf = errors.New("malformed protobuf chunk")
+
+// readFields calls fn for each field in data with its varint or
+// length-delimited value
+func readFields(data []byte, fn func(field int, varint int64, value []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errMalformedProtobuf
+		}
+		data = data[n:]
+
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errMalformedProtobuf
+			}
+			data = data[n:]
+			if err := fn(field, int64(v), nil); err != nil {
+				return err
+			}
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return errMalformedProtobuf
+			}
+			value := data[n : n+int(length)]
+			data = data[n+int(length):]
+			if err := fn(field, 0, value); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: unsupported wire type %d", errMalformedProtobuf, tag&7)
+		}
+	}
+	return nil
+}
+
+func appendTag(buf []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(buf, uint64(field)<<3|uint64(wireType))
+}
+
+func appendVarint(buf []byte, field int, v int64) []byte {
+	if v == 0 {
+		return buf
+	}
+	buf = appendTag(buf, field, wireVarint)
+	return binary.AppendUvarint(buf, uint64(v))
+}
+
+func appendBytes(buf []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return buf
+	}
+	buf = appendTag(buf, field, wireBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+func appendString(buf []byte, field int, v string) []byte {
+	return appendBytes(buf, field, []byte(v))
+}
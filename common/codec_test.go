@@ -0,0 +1,113 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"testing"
+	"time"
+)
+
+// codecTestChunk sets every field a codec must carry
+func codecTestChunk(size int) *Chunk {
+	return &Chunk{
+		SessionID:    "session-1234",
+		SequenceNum:  3,
+		TotalChunks:  7,
+		Data:         bytes.Repeat([]byte{0x00, 0xff, 0x7f, 0x80}, size/4),
+		Timestamp:    time.Now(),
+		SourceClient: "client:7000",
+		TargetURL:    "https://example.com/path?q=1",
+		Method:       "POST",
+		Headers:      map[string]string{"Content-Type": "application/octet-stream", "X-Empty": ""},
+		KeyID:        "2024-06",
+		ChunkType:    ChunkTypeData,
+		Compression:  "gzip",
+		Deadline:     time.Now().Add(time.Minute),
+		TargetAuth:   []byte("sealed"),
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, name := range []string{CodecJSON, CodecProtobuf} {
+		codec, err := NewChunkCodec(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := codecTestChunk(1024)
+		data, err := codec.Encode(want)
+		if err != nil {
+			t.Fatalf("%s: Encode: %v", name, err)
+		}
+		got, err := codec.Decode(data)
+		if err != nil {
+			t.Fatalf("%s: Decode: %v", name, err)
+		}
+
+		if got.SessionID != want.SessionID || got.SequenceNum != want.SequenceNum || got.TotalChunks != want.TotalChunks ||
+			got.SourceClient != want.SourceClient || got.TargetURL != want.TargetURL || got.Method != want.Method ||
+			got.KeyID != want.KeyID || got.ChunkType != want.ChunkType || got.Compression != want.Compression {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+		if !bytes.Equal(got.Data, want.Data) || !bytes.Equal(got.TargetAuth, want.TargetAuth) {
+			t.Errorf("%s: binary fields differ", name)
+		}
+		if !maps.Equal(got.Headers, want.Headers) {
+			t.Errorf("%s: headers %v, want %v", name, got.Headers, want.Headers)
+		}
+		if !got.Timestamp.Equal(want.Timestamp) || !got.Deadline.Equal(want.Deadline) {
+			t.Errorf("%s: times %v, %v, want %v, %v", name, got.Timestamp, got.Deadline, want.Timestamp, want.Deadline)
+		}
+		if got.Checksum == 0 {
+			t.Errorf("%s: no checksum carried", name)
+		}
+	}
+}
+
+func TestCodecRejectsInvalidChunks(t *testing.T) {
+	for _, name := range []string{CodecJSON, CodecProtobuf} {
+		codec, _ := NewChunkCodec(name)
+
+		data, _ := codec.Encode(&Chunk{SequenceNum: 1, TotalChunks: 1})
+		if _, err := codec.Decode(data); !errors.Is(err, ErrInvalidChunk) {
+			t.Errorf("%s: chunk without session: got %v, want ErrInvalidChunk", name, err)
+		}
+
+		data, _ = codec.Encode(codecTestChunk(64))
+		if _, err := codec.Decode(data[:len(data)/2]); err == nil {
+			t.Errorf("%s: truncated chunk decoded", name)
+		}
+	}
+}
+
+func TestUnknownCodec(t *testing.T) {
+	if _, err := NewChunkCodec("msgpack"); err == nil {
+		t.Error("unknown codec accepted")
+	}
+	if codec, err := NewChunkCodec(""); err != nil || codec.Name() != CodecJSON {
+		t.Errorf("default codec: got %v, %v", codec, err)
+	}
+}
+
+func BenchmarkCodecs(b *testing.B) {
+	chunk := codecTestChunk(8192)
+	for _, name := range []string{CodecJSON, CodecProtobuf} {
+		codec, _ := NewChunkCodec(name)
+		data, _ := codec.Encode(chunk)
+
+		b.Run(name+"/encode", func(b *testing.B) {
+			b.ReportMetric(float64(len(data)), "wire-bytes")
+			for i := 0; i < b.N; i++ {
+				codec.Encode(chunk)
+			}
+		})
+		b.Run(name+"/decode", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := codec.Decode(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
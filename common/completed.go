@@ -0,0 +1,59 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// CompletedSessions remembers recently finished session IDs so chunks that
+// arrive late, such as duplicates from a retry, are discarded instead of
+// opening a new session that can never complete
+type CompletedSessions struct {
+	retention time.Duration
+	done      map[string]time.Time
+	mu        sync.Mutex
+}
+
+// NewCompletedSessions creates a set that keeps IDs for retention
+func NewCompletedSessions(retention time.Duration) *CompletedSessions {
+	return &CompletedSessions{
+		retention: retention,
+		done:      make(map[string]time.Time),
+	}
+}
+
+// Add marks a session as completed
+func (c *CompletedSessions) Add(sessionID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done[sessionID] = time.Now()
+}
+
+// Contains reports whether the session completed within the retention window
+func (c *CompletedSessions) Contains(sessionID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	completedAt, exists := c.done[sessionID]
+	return exists && time.Since(completedAt) <= c.retention
+}
+
+// Cleanup forgets sessions older than the retention window
+func (c *CompletedSessions) Cleanup() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cutoff := time.Now().Add(-c.retention)
+	for sessionID, completedAt := range c.done {
+		if completedAt.Before(cutoff) {
+			delete(c.done, sessionID)
+		}
+	}
+}
+
+// Size returns the number of remembered sessions
+func (c *CompletedSessions) Size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.done)
+}
@@ -0,0 +1,27 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompletedSessionsRetention(t *testing.T) {
+	completed := NewCompletedSessions(20 * time.Millisecond)
+	completed.Add("done")
+
+	if !completed.Contains("done") {
+		t.Error("just completed session not found")
+	}
+	if completed.Contains("other") {
+		t.Error("unknown session reported completed")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if completed.Contains("done") {
+		t.Error("session still reported completed after the retention window")
+	}
+	completed.Cleanup()
+	if completed.Size() != 0 {
+		t.Errorf("%d sessions left after cleanup", completed.Size())
+	}
+}
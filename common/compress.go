@@ -0,0 +1,159 @@
+package common
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"math"
+)
+
+// CompressionDeflate marks chunk data compressed with raw DEFLATE
+const CompressionDeflate = "deflate"
+
+// entropySample is how much of a payload the entropy estimate looks at
+const entropySample = 4096
+
+// ChunkCompression controls adaptive chunk compression
+type ChunkCompression struct {
+	Enabled    bool    `yaml:"enabled"`
+	MinSize    int     `yaml:"min_size"`    // bytes; smaller chunks are sent as-is (default 256)
+	MaxEntropy float64 `yaml:"max_entropy"` // bits per byte; noisier data is sent as-is (default 7.5)
+}
+
+// Validate checks the compression settings
+func (c ChunkCompression) Validate() error {
+	if c.MinSize < 0 {
+		return fmt.Errorf("chunk_compression.min_size must not be negative")
+	}
+	if c.MaxEntropy < 0 || c.MaxEntropy > 8 {
+		return fmt.Errorf("chunk_compression.max_entropy must be between 0 and 8 bits per byte")
+	}
+	return nil
+}
+
+// CompressionMetrics counts compression decisions and their savings
+type CompressionMetrics struct {
+	Compressed *Counter
+	Skipped    *Counter
+	BytesIn    *Counter
+	BytesOut   *Counter
+}
+
+// NewCompressionMetrics registers the compression counters with m
+func NewCompressionMetrics(m *Metrics) *CompressionMetrics {
+	return &CompressionMetrics{
+		Compressed: m.Counter("proxy_chunks_compressed_total", "Chunks sent compressed"),
+		Skipped:    m.Counter("proxy_chunks_compression_skipped_total", "Chunks sent uncompressed because compression would not pay off"),
+		BytesIn:    m.Counter("proxy_compression_bytes_in_total", "Bytes of chunk data before compression, compressed chunks only"),
+		BytesOut:   m.Counter("proxy_compression_bytes_out_total", "Bytes of chunk data after compression, compressed chunks only"),
+	}
+}
+
+// Compressor compresses chunk data when it is likely to pay off. Tiny
+// payloads and payloads that already look random (images, video, gzip
+// bodies) are left alone, as is anything that comes out no smaller.
+type Compressor struct {
+	config  ChunkCompression
+	metrics *CompressionMetrics
+}
+
+// NewCompressor creates a compressor recording its decisions in metrics
+func NewCompressor(config ChunkCompression, metrics *CompressionMetrics) *Compressor {
+	if config.MinSize == 0 {
+		config.MinSize = 256
+	}
+	if config.MaxEntropy == 0 {
+		config.MaxEntropy = 7.5
+	}
+	return &Compressor{config: config, metrics: metrics}
+}
+
+// Compress replaces chunk data with its compressed form and marks the chunk,
+// or leaves the chunk untouched. Call it before encryption.
+func (c *Compressor) Compress(chunk *Chunk) error {
+	data := chunk.Data
+	if len(data) < c.config.MinSize || Entropy(data) > c.config.MaxEntropy {
+		c.metrics.Skipped.Inc()
+		return nil
+	}
+
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	if buf.Len() >= len(data) {
+		c.metrics.Skipped.Inc()
+		return nil
+	}
+
+	c.metrics.Compressed.Inc()
+	c.metrics.BytesIn.Add(int64(len(data)))
+	c.metrics.BytesOut.Add(int64(buf.Len()))
+
+	chunk.Data = buf.Bytes()
+	chunk.Compression = CompressionDeflate
+	return nil
+}
+
+// Decompress undoes Compress for chunk data marked with compression, after
+// decryption. Unmarked data is returned as-is; the output is capped at
+// maxSize so a small chunk can't expand without limit.
+func Decompress(compression string, data []byte, maxSize int64) ([]byte, error) {
+	switch compression {
+	case "":
+		return data, nil
+	case CompressionDeflate:
+	default:
+		return nil, fmt.Errorf("unknown chunk compression %q", compression)
+	}
+
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompression failed: %w", err)
+	}
+	if int64(len(decompressed)) > maxSize {
+		return nil, fmt.Errorf("decompressed chunk exceeds %d bytes", maxSize)
+	}
+
+	return decompressed, nil
+}
+
+// Entropy estimates the Shannon entropy of data in bits per byte from its
+// first few kilobytes. Text is typically 4-5; compressed or encrypted data
+// is close to 8.
+func Entropy(data []byte) float64 {
+	if len(data) > entropySample {
+		data = data[:entropySample]
+	}
+	if len(data) == 0 {
+		return 0
+	}
+
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+
+	var entropy float64
+	n := float64(len(data))
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
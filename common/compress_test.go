@@ -0,0 +1,80 @@
+package common
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// jpegLike is high entropy data starting with a JPEG header
+func jpegLike(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(data)
+	copy(data, []byte{0xff, 0xd8, 0xff, 0xe0})
+	return data
+}
+
+var htmlPage = []byte(strings.Repeat(`<div class="item"><a href="/products/widget">Widget</a><span>In stock</span></div>`+"\n", 40))
+
+func TestAdaptiveCompression(t *testing.T) {
+	metrics := NewCompressionMetrics(NewMetrics())
+	compressor := NewCompressor(ChunkCompression{Enabled: true}, metrics)
+
+	image := &Chunk{Data: jpegLike(4096)}
+	if err := compressor.Compress(image); err != nil {
+		t.Fatal(err)
+	}
+	if image.Compression != "" || !bytes.Equal(image.Data, jpegLike(4096)) {
+		t.Error("high entropy payload was compressed")
+	}
+
+	page := &Chunk{Data: htmlPage}
+	if err := compressor.Compress(page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Compression != CompressionDeflate || len(page.Data) >= len(htmlPage) {
+		t.Fatalf("HTML sent as %q in %d of %d bytes, want it compressed", page.Compression, len(page.Data), len(htmlPage))
+	}
+	restored, err := Decompress(page.Compression, page.Data, DefaultMaxChunkSize)
+	if err != nil || !bytes.Equal(restored, htmlPage) {
+		t.Errorf("round trip: %v", err)
+	}
+
+	tiny := &Chunk{Data: []byte("aaaaaaaaaa")}
+	compressor.Compress(tiny)
+	if tiny.Compression != "" {
+		t.Error("payload below min_size was compressed")
+	}
+
+	if metrics.Compressed.Value() != 1 || metrics.Skipped.Value() != 2 {
+		t.Errorf("compressed %d, skipped %d, want 1 and 2", metrics.Compressed.Value(), metrics.Skipped.Value())
+	}
+	if metrics.BytesIn.Value() != int64(len(htmlPage)) || metrics.BytesOut.Value() != int64(len(page.Data)) {
+		t.Errorf("savings recorded as %d -> %d bytes", metrics.BytesIn.Value(), metrics.BytesOut.Value())
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	if e := Entropy(jpegLike(4096)); e < 7.5 {
+		t.Errorf("random data: %.2f bits per byte", e)
+	}
+	if e := Entropy(htmlPage); e > 6 {
+		t.Errorf("HTML: %.2f bits per byte", e)
+	}
+	if e := Entropy(bytes.Repeat([]byte("a"), 100)); e != 0 {
+		t.Errorf("one repeated byte: %.2f bits per byte", e)
+	}
+}
+
+func TestDecompressLimits(t *testing.T) {
+	chunk := &Chunk{Data: bytes.Repeat([]byte("zero "), 1000)}
+	NewCompressor(ChunkCompression{Enabled: true}, NewCompressionMetrics(NewMetrics())).Compress(chunk)
+
+	if _, err := Decompress(chunk.Compression, chunk.Data, 100); err == nil {
+		t.Error("output past maxSize accepted")
+	}
+	if _, err := Decompress("lz4", chunk.Data, DefaultMaxChunkSize); err == nil {
+		t.Error("unknown compression accepted")
+	}
+}
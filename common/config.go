@@ -0,0 +1,241 @@
+package common
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Validate checks the obfuscation settings
+func (c ObfuscationConfig) Validate() error {
+	var errs []error
+
+	if _, err := NewObfuscator(c); err != nil {
+		errs = append(errs, fmt.Errorf("obfuscation.type: %w", err))
+	}
+	if c.Jitter < 0 {
+		errs = append(errs, fmt.Errorf("obfuscation.jitter must not be negative, got %d", c.Jitter))
+	}
+	if c.JitterMin < 0 || c.JitterMax < 0 {
+		errs = append(errs, fmt.Errorf("obfuscation.jitter_min_ms and jitter_max_ms must not be negative"))
+	}
+	// The minimum applies against whichever maximum JitterDelay uses
+	switch {
+	case c.JitterMax > 0 && c.JitterMin > c.JitterMax:
+		errs = append(errs, fmt.Errorf("obfuscation.jitter_min_ms %d exceeds jitter_max_ms %d", c.JitterMin, c.JitterMax))
+	case c.JitterMax == 0 && c.Jitter > 0 && c.JitterMin > c.Jitter:
+		errs = append(errs, fmt.Errorf("obfuscation.jitter_min_ms %d exceeds jitter %d", c.JitterMin, c.Jitter))
+	case c.JitterMax == 0 && c.Jitter == 0 && c.JitterMin > 0:
+		errs = append(errs, fmt.Errorf("obfuscation.jitter_min_ms requires jitter_max_ms"))
+	}
+	if !ValidJitterDistribution(c.JitterDistribution) {
+		errs = append(errs, fmt.Errorf("unknown obfuscation.jitter_distribution %q", c.JitterDistribution))
+	}
+	for name, tmpl := range c.HeaderTemplates {
+		if _, err := ExpandHeaderTemplate(tmpl); err != nil {
+			errs = append(errs, fmt.Errorf("obfuscation.header_templates[%s]: %w", name, err))
+		}
+	}
+	if c.RealHost != "" && c.FrontDomain == "" {
+		errs = append(errs, fmt.Errorf("obfuscation.real_host requires obfuscation.front_domain"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// JitterDelay draws the delay to apply before forwarding a chunk. The older
+// jitter setting counts as a maximum with no minimum.
+func (c ObfuscationConfig) JitterDelay() time.Duration {
+	max := c.JitterMax
+	if max == 0 {
+		max = c.Jitter
+	}
+	if max == 0 {
+		return 0
+	}
+	return JitterDelay(c.JitterMin, max, c.JitterDistribution)
+}
+
+// decodeKey decodes a hex key and checks it is 32 bytes for AES-256, so
+// binary keys fit in YAML
+func decodeKey(name, encoded string) ([]byte, error) {
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not valid hex: %w", name, err)
+	}
+	if err := checkKeyLength(name, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// checkKeyLength checks a decoded key is 32 bytes for AES-256
+func checkKeyLength(name string, key []byte) error {
+	if len(key) != 32 {
+		return fmt.Errorf("%s must decode to 32 bytes for AES-256, got %d", name, len(key))
+	}
+	return nil
+}
+
+// InlineKey decodes the key given as encryption_key_hex or
+// encryption_key_b64. It returns nil when neither is set.
+func (c EncryptionConfig) InlineKey() ([]byte, error) {
+	switch {
+	case c.KeyHex != "" && c.KeyB64 != "":
+		return nil, errors.New("set only one of encryption.encryption_key_hex and encryption.encryption_key_b64")
+	case c.KeyHex != "":
+		return decodeKey("encryption.encryption_key_hex", c.KeyHex)
+	case c.KeyB64 != "":
+		key, err := base64.StdEncoding.DecodeString(c.KeyB64)
+		if err != nil {
+			return nil, fmt.Errorf("encryption.encryption_key_b64 is not valid base64: %w", err)
+		}
+		if err := checkKeyLength("encryption.encryption_key_b64", key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	default:
+		return nil, nil
+	}
+}
+
+// VersionedKeys decodes encryption.keys
+func (c EncryptionConfig) VersionedKeys() (map[string][]byte, error) {
+	var errs []error
+	keys := make(map[string][]byte, len(c.Keys))
+	for id, encoded := range c.Keys {
+		key, err := decodeKey("encryption.keys."+id, encoded)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		keys[id] = key
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// FallbackKeys decodes encryption.previous_keys
+func (c EncryptionConfig) FallbackKeys() ([][]byte, error) {
+	keys := make([][]byte, 0, len(c.PreviousKeys))
+	for i, encoded := range c.PreviousKeys {
+		key, err := decodeKey(fmt.Sprintf("encryption.previous_keys[%d]", i), encoded)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Key policies for encryption.key_policy
+const (
+	KeyPolicyWarn   = "warn"   // fall back to the built-in key with a warning
+	KeyPolicyStrict = "strict" // refuse to start without a configured key
+)
+
+// builtinKey is used when encryption is enabled but no key is configured.
+// It is public, so it only keeps test setups working.
+var builtinKey = []byte("your-32-byte-encryption-key-here")
+
+var errNoEncryptionKey = errors.New("encryption is enabled but no key is configured; set encryption.encryption_key_hex, encryption.encryption_key_b64 or encryption.keys")
+
+// DefaultKey returns the key to use for the default key ID: the inline key
+// if one is configured, otherwise the built-in key. With encryption enabled
+// and nothing configured, the strict key policy fails here at startup.
+func (c EncryptionConfig) DefaultKey() ([]byte, error) {
+	key, err := c.InlineKey()
+	if err != nil || key != nil {
+		return key, err
+	}
+
+	if c.Enabled && len(c.Keys) == 0 {
+		if c.KeyPolicy == KeyPolicyStrict {
+			return nil, errNoEncryptionKey
+		}
+		log.Printf("WARNING: encryption is enabled but no key is configured, using the insecure built-in key")
+	}
+
+	return append([]byte(nil), builtinKey...), nil
+}
+
+// Validate checks the encryption settings
+func (c EncryptionConfig) Validate() error {
+	var errs []error
+
+	inline, err := c.InlineKey()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	switch c.KeyPolicy {
+	case "", KeyPolicyWarn:
+	case KeyPolicyStrict:
+		if c.Enabled && err == nil && inline == nil && len(c.Keys) == 0 {
+			errs = append(errs, errNoEncryptionKey)
+		}
+	default:
+		errs = append(errs, fmt.Errorf("encryption.key_policy must be %q or %q, got %q", KeyPolicyWarn, KeyPolicyStrict, c.KeyPolicy))
+	}
+	if _, err := c.FallbackKeys(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := c.VersionedKeys(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.ActiveKey == "" && len(c.Keys) > 1 {
+		errs = append(errs, fmt.Errorf("encryption.active_key is required when several keys are configured"))
+	}
+	if _, exists := c.Keys[c.ActiveKey]; c.ActiveKey != "" && !exists {
+		errs = append(errs, fmt.Errorf("encryption.active_key %q is not in encryption.keys", c.ActiveKey))
+	}
+
+	return errors.Join(errs...)
+}
+
+// ListenAddr joins a configured listen address and port. An empty address
+// listens on all interfaces.
+func ListenAddr(address string, port int) string {
+	return net.JoinHostPort(address, strconv.Itoa(port))
+}
+
+// ReportConfigCheck prints the result of a -check run and exits with
+// status 0 when the config is valid and 1 otherwise
+func ReportConfigCheck(configPath string, err error) {
+	if err != nil {
+		fmt.Printf("%s: invalid configuration\n", configPath)
+		for _, line := range splitErrors(err) {
+			fmt.Printf("  - %s\n", line)
+		}
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s: configuration OK\n", configPath)
+	os.Exit(0)
+}
+
+// splitErrors flattens joined errors into one message per problem
+func splitErrors(err error) []string {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var lines []string
+		for _, e := range joined.Unwrap() {
+			lines = append(lines, splitErrors(e)...)
+		}
+		return lines
+	}
+	// LoadConfig wraps the joined problems as "invalid config: ..."
+	if inner := errors.Unwrap(err); inner != nil {
+		if _, ok := inner.(interface{ Unwrap() []error }); ok {
+			return splitErrors(inner)
+		}
+	}
+	return []string{err.Error()}
+}
@@ -0,0 +1,129 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestInlineKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, 32)
+
+	got, err := EncryptionConfig{KeyHex: hex.EncodeToString(key)}.InlineKey()
+	if err != nil || !bytes.Equal(got, key) {
+		t.Errorf("valid hex: got %x, %v", got, err)
+	}
+
+	got, err = EncryptionConfig{KeyB64: base64.StdEncoding.EncodeToString(key)}.InlineKey()
+	if err != nil || !bytes.Equal(got, key) {
+		t.Errorf("valid base64: got %x, %v", got, err)
+	}
+
+	if got, err := (EncryptionConfig{}).InlineKey(); got != nil || err != nil {
+		t.Errorf("unset: got %x, %v, want nil", got, err)
+	}
+
+	tests := []struct {
+		name    string
+		encoded string
+		want    string
+	}{
+		{"wrong length", hex.EncodeToString(key[:16]), "must decode to 32 bytes for AES-256, got 16"},
+		{"malformed", strings.Repeat("zz", 32), "is not valid hex"},
+		{"odd length", hex.EncodeToString(key)[1:], "is not valid hex"},
+		{"base64", base64.StdEncoding.EncodeToString(key), "is not valid hex"},
+	}
+	for _, tt := range tests {
+		_, err := EncryptionConfig{KeyHex: tt.encoded}.InlineKey()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+		if err := (EncryptionConfig{KeyHex: tt.encoded}).Validate(); err == nil {
+			t.Errorf("%s: Validate accepted the key", tt.name)
+		}
+	}
+}
+
+func TestInlineKeyBase64(t *testing.T) {
+	key := bytes.Repeat([]byte{0xcd}, 32)
+
+	tests := []struct {
+		name   string
+		config EncryptionConfig
+		want   string
+	}{
+		{"wrong length", EncryptionConfig{KeyB64: base64.StdEncoding.EncodeToString(key[:24])}, "encryption_key_b64 must decode to 32 bytes for AES-256, got 24"},
+		{"malformed", EncryptionConfig{KeyB64: "not*base64!"}, "encryption_key_b64 is not valid base64"},
+		{"url alphabet", EncryptionConfig{KeyB64: base64.URLEncoding.EncodeToString(bytes.Repeat([]byte{0xfb}, 32))}, "is not valid base64"},
+		{"both set", EncryptionConfig{KeyHex: hex.EncodeToString(key), KeyB64: base64.StdEncoding.EncodeToString(key)}, "set only one of"},
+	}
+	for _, tt := range tests {
+		_, err := tt.config.InlineKey()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+		if err := tt.config.Validate(); err == nil {
+			t.Errorf("%s: Validate accepted the key", tt.name)
+		}
+	}
+
+	// A base64 key is used in place of the built-in one
+	config := EncryptionConfig{Enabled: true, KeyPolicy: KeyPolicyStrict, KeyB64: base64.StdEncoding.EncodeToString(key)}
+	if err := config.Validate(); err != nil {
+		t.Errorf("strict policy with a base64 key: %v", err)
+	}
+	ring, err := NewKeyRingFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ring.Key(DefaultKeyID); !bytes.Equal(got, key) {
+		t.Errorf("default key %x, want the base64 key", got)
+	}
+}
+
+func TestConfiguredKeysNameTheBadEntry(t *testing.T) {
+	good := hex.EncodeToString(bytes.Repeat([]byte{1}, 32))
+
+	_, err := EncryptionConfig{Keys: map[string]string{"v1": good, "v2": "beef"}}.VersionedKeys()
+	if err == nil || !strings.Contains(err.Error(), "encryption.keys.v2") {
+		t.Errorf("got %v, want the error to name encryption.keys.v2", err)
+	}
+
+	_, err = EncryptionConfig{PreviousKeys: []string{good, "not hex"}}.FallbackKeys()
+	if err == nil || !strings.Contains(err.Error(), "encryption.previous_keys[1]") {
+		t.Errorf("got %v, want the error to name encryption.previous_keys[1]", err)
+	}
+}
+
+func TestStrictKeyPolicy(t *testing.T) {
+	config := EncryptionConfig{Enabled: true, KeyPolicy: KeyPolicyStrict}
+	if err := config.Validate(); err == nil {
+		t.Error("strict policy accepted encryption without a key")
+	}
+	if _, err := config.DefaultKey(); err == nil {
+		t.Error("strict policy fell back to the built-in key")
+	}
+
+	config.KeyHex = hex.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	if err := config.Validate(); err != nil {
+		t.Errorf("strict policy with an inline key: %v", err)
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"", ":8080"},
+		{"127.0.0.1", "127.0.0.1:8080"},
+		{"::1", "[::1]:8080"},
+	}
+	for _, tt := range tests {
+		if got := ListenAddr(tt.address, 8080); got != tt.want {
+			t.Errorf("ListenAddr(%q, 8080) = %q, want %q", tt.address, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Validator is a config that can report its own problems
+type Validator interface {
+	Validate() error
+}
+
+// LoadConfig reads a component's YAML config file, applies environment
+// overrides and then defaults, and validates the result. Every component
+// loads its config this way, so they agree on precedence: environment over
+// file over defaults.
+//
+// An override is named envPrefix, then the YAML keys leading to the
+// setting, upper-cased and joined by underscores: PROXY_CENTRAL_LISTEN_PORT
+// sets listen_port and PROXY_CENTRAL_TIMEOUTS_DIAL_TIMEOUT sets
+// timeouts.dial_timeout. String settings take the value as is; anything
+// else is parsed as YAML, so lists are written [a, b]. Defaults run after
+// the overrides and fill in zero values, so an override of 0 or "" asks for
+// the default just as leaving the setting out of the file does; settings
+// where zero means something else are pointers, which defaults leave alone
+// once set.
+func LoadConfig[T Validator](configPath, envPrefix string, defaults func(*T)) (T, error) {
+	var config T
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return config, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	if err := applyEnvOverrides(reflect.ValueOf(&config).Elem(), envPrefix); err != nil {
+		return config, err
+	}
+
+	if defaults != nil {
+		defaults(&config)
+	}
+
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return config, nil
+}
+
+var yamlUnmarshaler = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// applyEnvOverrides sets the fields of the struct v named by environment
+// variables under prefix, descending into nested settings
+func applyEnvOverrides(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		key, opts, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if key == "-" {
+			continue
+		}
+		if key == "" {
+			key = strings.ToLower(field.Name)
+		}
+
+		value := v.Field(i)
+		if field.Type.Kind() == reflect.Struct && !reflect.PointerTo(field.Type).Implements(yamlUnmarshaler) {
+			name := prefix
+			if opts != "inline" {
+				name = envName(prefix, key)
+			}
+			if err := applyEnvOverrides(value, name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := envName(prefix, key)
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if field.Type.Kind() == reflect.String {
+			value.SetString(env)
+			continue
+		}
+		// Parse into a fresh value so a bad override leaves the file's alone
+		parsed := reflect.New(field.Type)
+		if err := yaml.Unmarshal([]byte(env), parsed.Interface()); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		value.Set(parsed.Elem())
+	}
+	return nil
+}
+
+// envName appends a YAML key to an environment variable prefix
+func envName(prefix, key string) string {
+	key = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, key)
+	return prefix + "_" + strings.ToUpper(key)
+}
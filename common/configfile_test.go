@@ -0,0 +1,118 @@
+package common
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testConfig struct {
+	ListenPort int      `yaml:"listen_port"`
+	Name       string   `yaml:"name"`
+	Peers      []string `yaml:"peers"`
+	Retries    *int     `yaml:"retries"`
+	Timeouts   struct {
+		DialTimeout int `yaml:"dial_timeout"`
+	} `yaml:"timeouts"`
+}
+
+func (c testConfig) Validate() error {
+	if c.ListenPort > 65535 {
+		return errors.New("listen_port out of range")
+	}
+	return nil
+}
+
+func setTestDefaults(c *testConfig) {
+	if c.ListenPort == 0 {
+		c.ListenPort = 8080
+	}
+	if c.Name == "" {
+		c.Name = "default"
+	}
+	if c.Retries == nil {
+		retries := 3
+		c.Retries = &retries
+	}
+	if c.Timeouts.DialTimeout == 0 {
+		c.Timeouts.DialTimeout = 1000
+	}
+}
+
+// writeConfig writes a config file and returns its path
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	path := writeConfig(t, "name: file\nretries: 0\n")
+
+	config, err := LoadConfig(path, "PROXY_TEST", setTestDefaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Name != "file" {
+		t.Errorf("name %q, want the file's", config.Name)
+	}
+	if config.ListenPort != 8080 || config.Timeouts.DialTimeout != 1000 {
+		t.Errorf("listen_port %d, dial_timeout %d, want the defaults", config.ListenPort, config.Timeouts.DialTimeout)
+	}
+	if config.Retries == nil || *config.Retries != 0 {
+		t.Errorf("retries %v, want the file's 0 kept", config.Retries)
+	}
+}
+
+func TestLoadConfigEnvOverrides(t *testing.T) {
+	path := writeConfig(t, "listen_port: 9000\nname: file\npeers: [a]\ntimeouts:\n  dial_timeout: 500\n")
+	t.Setenv("PROXY_TEST_LISTEN_PORT", "9100")
+	t.Setenv("PROXY_TEST_NAME", "env: not yaml")
+	t.Setenv("PROXY_TEST_PEERS", "[b, c]")
+	t.Setenv("PROXY_TEST_TIMEOUTS_DIAL_TIMEOUT", "0")
+	t.Setenv("PROXY_OTHER_RETRIES", "7")
+
+	config, err := LoadConfig(path, "PROXY_TEST", setTestDefaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenPort != 9100 {
+		t.Errorf("listen_port %d, want the environment's 9100", config.ListenPort)
+	}
+	if config.Name != "env: not yaml" {
+		t.Errorf("name %q, want the environment's as is", config.Name)
+	}
+	if strings.Join(config.Peers, ",") != "b,c" {
+		t.Errorf("peers %v, want [b c]", config.Peers)
+	}
+	// An override of 0 asks for the default
+	if config.Timeouts.DialTimeout != 1000 {
+		t.Errorf("dial_timeout %d, want the default", config.Timeouts.DialTimeout)
+	}
+	if *config.Retries != 3 {
+		t.Errorf("retries %d, another prefix's override applied", *config.Retries)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	path := writeConfig(t, "listen_port: 9000\n")
+
+	t.Setenv("PROXY_TEST_LISTEN_PORT", "not a port")
+	if _, err := LoadConfig(path, "PROXY_TEST", setTestDefaults); err == nil || !strings.Contains(err.Error(), "PROXY_TEST_LISTEN_PORT") {
+		t.Errorf("bad override: got %v, want it named", err)
+	}
+
+	t.Setenv("PROXY_TEST_LISTEN_PORT", "70000")
+	if _, err := LoadConfig(path, "PROXY_TEST", setTestDefaults); err == nil || !strings.Contains(err.Error(), "invalid config") {
+		t.Errorf("out of range override: got %v, want it refused", err)
+	}
+
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"), "PROXY_TEST", setTestDefaults); err == nil {
+		t.Error("missing file loaded")
+	}
+}
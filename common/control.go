@@ -0,0 +1,98 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Chunk types. Data chunks are sent with an empty type, which means the
+// same as ChunkTypeData.
+const (
+	ChunkTypeData      = "data"
+	ChunkTypeControl   = "control"
+	ChunkTypeHandshake = "handshake"
+	ChunkTypeStream    = "stream"
+	ChunkTypeError     = "error"
+	ChunkTypeCancel    = "cancel" // the client gave up on the session
+)
+
+// ControlSequence is the sequence number of a response's control chunk
+const ControlSequence = 0
+
+// ErrLengthMismatch is returned when a reassembled response body differs in
+// size from the ContentLength its control chunk announced, as when chunks
+// were truncated or miscounted
+var ErrLengthMismatch = errors.New("response length mismatch")
+
+// ResponseMeta is the data of a response control chunk. The central proxy
+// sends it ahead of the body chunks so the client learns the target's status
+// and headers.
+type ResponseMeta struct {
+	StatusCode    int               `json:"status_code"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	ContentLength int64             `json:"content_length"`
+	FinalURL      string            `json:"final_url,omitempty"`
+	Stream        bool              `json:"stream,omitempty"`   // body follows as stream chunks
+	Trailers      map[string]string `json:"trailers,omitempty"` // sent by the target after the body
+}
+
+// IsControl reports whether the chunk carries response metadata
+func (c *Chunk) IsControl() bool {
+	return c.ChunkType == ChunkTypeControl
+}
+
+// IsStream reports whether the chunk carries part of a streamed response.
+// Stream chunks are numbered from 1 and delivered as they arrive; the total
+// is unknown until the last one, whose TotalChunks equals its SequenceNum.
+// All others have TotalChunks 0. The last carries no body data: it is empty,
+// or holds a ResponseMeta with the trailers the target sent.
+func (c *Chunk) IsStream() bool {
+	return c.ChunkType == ChunkTypeStream
+}
+
+// IsStreamEnd reports whether the chunk is the last of a streamed response
+func (c *Chunk) IsStreamEnd() bool {
+	return c.IsStream() && c.TotalChunks == c.SequenceNum
+}
+
+// FlattenHeaders joins repeated header values into one comma-separated value
+func FlattenHeaders(header http.Header) map[string]string {
+	flat := make(map[string]string, len(header))
+	for k, values := range header {
+		flat[k] = strings.Join(values, ", ")
+	}
+	return flat
+}
+
+// FlattenTrailers is FlattenHeaders for a response's trailers, leaving out
+// those the target announced but never sent. It returns nil if none were.
+func FlattenTrailers(trailer http.Header) map[string]string {
+	var flat map[string]string
+	for k, values := range trailer {
+		if len(values) == 0 {
+			continue
+		}
+		if flat == nil {
+			flat = make(map[string]string)
+		}
+		flat[k] = strings.Join(values, ", ")
+	}
+	return flat
+}
+
+// EncodeResponseMeta serializes meta as control chunk data
+func EncodeResponseMeta(meta *ResponseMeta) ([]byte, error) {
+	return json.Marshal(meta)
+}
+
+// DecodeResponseMeta parses the data of a control chunk
+func DecodeResponseMeta(data []byte) (*ResponseMeta, error) {
+	var meta ResponseMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("invalid response metadata: %w", err)
+	}
+	return &meta, nil
+}
@@ -0,0 +1,179 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// DestinationConfig limits the targets an exit may reach, so it can't be
+// pointed at internal services or cloud metadata endpoints. The central
+// proxy and the gateway both use it.
+type DestinationConfig struct {
+	Schemes []string `yaml:"schemes"` // URL schemes targets may use; http and https if unset
+	Hosts   []string `yaml:"hosts"`   // hostnames refused, along with their subdomains
+	Allow   []string `yaml:"allow"`   // CIDRs permitted even inside a denied range
+	Deny    []string `yaml:"deny"`    // CIDRs refused; defaultDeny if unset, [] to allow everything
+}
+
+// defaultSchemes are the target URL schemes allowed when none are configured
+var defaultSchemes = []string{"http", "https"}
+
+// defaultDeny covers loopback, link-local, private and otherwise
+// non-public ranges
+var defaultDeny = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// ErrDestinationBlocked is returned for targets the destination filter refuses
+var ErrDestinationBlocked = errors.New("destination is blocked")
+
+// SetDefaults fills in the schemes and denied ranges left unset. An empty
+// deny list is kept, so "deny: []" allows everything.
+func (c *DestinationConfig) SetDefaults() {
+	if c.Schemes == nil {
+		c.Schemes = defaultSchemes
+	}
+	if c.Deny == nil {
+		c.Deny = defaultDeny
+	}
+}
+
+// Validate reports malformed entries
+func (c DestinationConfig) Validate() error {
+	var errs []error
+
+	for _, scheme := range c.Schemes {
+		if scheme == "" || strings.Contains(scheme, ":") {
+			errs = append(errs, fmt.Errorf("destinations.schemes: invalid scheme %q", scheme))
+		}
+	}
+	for _, host := range c.Hosts {
+		if host == "" {
+			errs = append(errs, errors.New("destinations.hosts: empty hostname"))
+		}
+	}
+	for _, cidr := range c.Allow {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("destinations.allow: %w", err))
+		}
+	}
+	for _, cidr := range c.Deny {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("destinations.deny: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// DestinationFilter is a compiled DestinationConfig
+type DestinationFilter struct {
+	schemes map[string]bool
+	hosts   []string // lower case, without trailing dots
+	allow   []netip.Prefix
+	deny    []netip.Prefix
+}
+
+// NewDestinationFilter compiles config
+func NewDestinationFilter(config DestinationConfig) (*DestinationFilter, error) {
+	f := &DestinationFilter{schemes: make(map[string]bool)}
+	for _, scheme := range config.Schemes {
+		f.schemes[strings.ToLower(scheme)] = true
+	}
+	for _, host := range config.Hosts {
+		f.hosts = append(f.hosts, normalizeHost(host))
+	}
+	for _, cidr := range config.Allow {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		f.allow = append(f.allow, prefix)
+	}
+	for _, cidr := range config.Deny {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		f.deny = append(f.deny, prefix)
+	}
+	return f, nil
+}
+
+// normalizeHost lower-cases a hostname and drops a trailing dot, so
+// "Example.COM." and "example.com" compare equal
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Allowed reports whether addr may be dialed. Allow entries win over deny
+// entries.
+func (f *DestinationFilter) Allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	for _, prefix := range f.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	for _, prefix := range f.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckURL refuses targets with a disallowed scheme, before any transport
+// gets to handle it, a blocked hostname or a literal IP address in a denied
+// range. Other hostnames pass here and are checked by Control once
+// resolved.
+func (f *DestinationFilter) CheckURL(target *url.URL) error {
+	if !f.schemes[strings.ToLower(target.Scheme)] {
+		return fmt.Errorf("%w: scheme %q", ErrDestinationBlocked, target.Scheme)
+	}
+
+	host := normalizeHost(target.Hostname())
+	for _, blocked := range f.hosts {
+		if host == blocked || strings.HasSuffix(host, "."+blocked) {
+			return fmt.Errorf("%w: host %s", ErrDestinationBlocked, host)
+		}
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil
+	}
+	if !f.Allowed(addr) {
+		return fmt.Errorf("%w: %s", ErrDestinationBlocked, addr)
+	}
+	return nil
+}
+
+// Control is a net.Dialer Control hook. It runs after DNS resolution for
+// every address tried, so a hostname resolving to a denied address is
+// refused as well.
+func (f *DestinationFilter) Control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !f.Allowed(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrDestinationBlocked, addrPort.Addr())
+	}
+	return nil
+}
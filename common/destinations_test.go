@@ -0,0 +1,82 @@
+package common
+
+import (
+	"errors"
+	"net/netip"
+	"net/url"
+	"testing"
+)
+
+// defaultFilter is a filter with the default denied ranges
+func defaultFilter(t *testing.T, config DestinationConfig) *DestinationFilter {
+	t.Helper()
+	config.SetDefaults()
+	filter, err := NewDestinationFilter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filter
+}
+
+func TestDefaultDeniedRanges(t *testing.T) {
+	filter := defaultFilter(t, DestinationConfig{})
+
+	for _, blocked := range []string{"169.254.169.254", "127.0.0.1", "10.1.2.3", "192.168.0.1", "172.16.5.5", "::1", "fe80::1", "::ffff:169.254.169.254"} {
+		if filter.Allowed(netip.MustParseAddr(blocked)) {
+			t.Errorf("%s allowed", blocked)
+		}
+	}
+	for _, public := range []string{"93.184.216.34", "1.1.1.1", "2606:4700::1111"} {
+		if !filter.Allowed(netip.MustParseAddr(public)) {
+			t.Errorf("%s blocked", public)
+		}
+	}
+}
+
+func TestDestinationAllowOverridesDeny(t *testing.T) {
+	filter := defaultFilter(t, DestinationConfig{Allow: []string{"10.0.0.5/32"}})
+	if !filter.Allowed(netip.MustParseAddr("10.0.0.5")) || filter.Allowed(netip.MustParseAddr("10.0.0.6")) {
+		t.Error("allow entry not applied to exactly its range")
+	}
+
+	open := defaultFilter(t, DestinationConfig{Deny: []string{}})
+	if !open.Allowed(netip.MustParseAddr("127.0.0.1")) {
+		t.Error("an empty deny list still blocked loopback")
+	}
+}
+
+func TestDestinationCheckURL(t *testing.T) {
+	filter := defaultFilter(t, DestinationConfig{Hosts: []string{"internal.example"}})
+
+	tests := []struct {
+		url     string
+		blocked bool
+	}{
+		{"http://169.254.169.254/latest/meta-data/", true},
+		{"http://[::1]:8080/", true},
+		{"file:///etc/passwd", true},
+		{"gopher://example.com/", true},
+		{"https://Internal.Example./", true},
+		{"https://db.internal.example/", true},
+		{"https://example.com/", false},
+		{"http://93.184.216.34/", false},
+		{"https://notinternal.example/", false},
+	}
+	for _, tt := range tests {
+		target, _ := url.Parse(tt.url)
+		err := filter.CheckURL(target)
+		if blocked := errors.Is(err, ErrDestinationBlocked); blocked != tt.blocked {
+			t.Errorf("%s: got %v, want blocked %v", tt.url, err, tt.blocked)
+		}
+	}
+}
+
+func TestDestinationControlChecksResolvedAddress(t *testing.T) {
+	filter := defaultFilter(t, DestinationConfig{})
+	if err := filter.Control("tcp4", "169.254.169.254:80", nil); !errors.Is(err, ErrDestinationBlocked) {
+		t.Errorf("link-local dial: got %v", err)
+	}
+	if err := filter.Control("tcp4", "93.184.216.34:443", nil); err != nil {
+		t.Errorf("public dial: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ErrorChunk is the data of an error chunk: a hop's report that it gave up
+// on a request, sent toward the client in place of the response. The client
+// turns it into the error of its ProxyResponse.
+type ErrorChunk struct {
+	Code     int    `json:"code"`               // HTTP status reported to the caller, e.g. 502
+	Message  string `json:"message"`            // what went wrong
+	Hop      string `json:"hop,omitempty"`      // role of the hop that raised it, e.g. "central-proxy"
+	Missing  []int  `json:"missing,omitempty"`  // response chunks that never arrived, if that is the reason
+	Buffered bool   `json:"buffered,omitempty"` // the response is held for the client to fetch from the hop's /poll
+}
+
+// Error formats the report as "<hop>: <message>"
+func (e *ErrorChunk) Error() string {
+	if e.Hop == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Hop, e.Message)
+}
+
+// NewErrorChunk builds the error chunk reporting e for a session. The
+// caller seals and sends it like any response chunk: hops holding the
+// session key encrypt Data with it, others rely on hop encryption alone.
+func NewErrorChunk(sessionID, sourceClient string, e *ErrorChunk) (*Chunk, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Chunk{
+		SessionID:    sessionID,
+		SequenceNum:  ControlSequence,
+		TotalChunks:  1, // the report stands alone
+		ChunkType:    ChunkTypeError,
+		Data:         data,
+		Timestamp:    time.Now(),
+		SourceClient: sourceClient,
+	}, nil
+}
+
+// DecodeErrorChunk parses the data of an error chunk, after any session key
+// encryption has been removed
+func DecodeErrorChunk(data []byte) (*ErrorChunk, error) {
+	var e ErrorChunk
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("invalid error chunk: %w", err)
+	}
+	return &e, nil
+}
+
+// IsError reports whether the chunk is a hop's error report. Like control
+// chunks, error chunks are passed straight through to the client.
+func (c *Chunk) IsError() bool {
+	return c.ChunkType == ChunkTypeError
+}
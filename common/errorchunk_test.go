@@ -0,0 +1,42 @@
+package common
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestErrorChunkRoundTrip(t *testing.T) {
+	report := &ErrorChunk{Code: http.StatusGatewayTimeout, Message: "reassembly timed out", Hop: "downstream", Missing: []int{2, 5}}
+	chunk, err := NewErrorChunk("session", "client:7000", report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !chunk.IsError() || chunk.IsControl() || chunk.SequenceNum != ControlSequence || chunk.TotalChunks != 1 {
+		t.Errorf("chunk %+v, want a standalone error chunk", chunk)
+	}
+	if chunk.SessionID != "session" || chunk.SourceClient != "client:7000" {
+		t.Errorf("addressed to %s at %s", chunk.SessionID, chunk.SourceClient)
+	}
+
+	decoded, err := DecodeErrorChunk(chunk.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Code != report.Code || decoded.Message != report.Message || decoded.Hop != report.Hop || !slices.Equal(decoded.Missing, report.Missing) {
+		t.Errorf("decoded %+v, want %+v", decoded, report)
+	}
+
+	if _, err := DecodeErrorChunk([]byte("not json")); err == nil {
+		t.Error("malformed error chunk decoded")
+	}
+}
+
+func TestErrorChunkMessage(t *testing.T) {
+	if got := (&ErrorChunk{Message: "target unreachable", Hop: "central-proxy"}).Error(); got != "central-proxy: target unreachable" {
+		t.Errorf("with a hop: %q", got)
+	}
+	if got := (&ErrorChunk{Message: "target unreachable"}).Error(); got != "target unreachable" {
+		t.Errorf("without a hop: %q", got)
+	}
+}
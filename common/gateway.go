@@ -0,0 +1,49 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// GatewayResponse is the result of a request the gateway performed on behalf
+// of a relay node. Requests run at once are answered with the target's
+// response itself. In traffic mixing mode a request that names a
+// callback_url is answered 202 at once, and the gateway later POSTs this as
+// JSON to that URL, with the request ID also in X-Request-ID; the callback
+// answers 200 or 202. Batched requests without a callback are held open
+// until their batch runs.
+type GatewayResponse struct {
+	RequestID  string            `json:"request_id"`
+	StatusCode int               `json:"status_code"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       []byte            `json:"body,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// PostGatewayResponse delivers response to a node's callback URL
+func PostGatewayResponse(client *http.Client, callbackURL string, response *GatewayResponse) error {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("request creation error: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", response.RequestID)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request error: %w", err)
+	}
+	defer DrainAndClose(resp)
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("callback returned status %d", resp.StatusCode)
+	}
+	return nil
+}
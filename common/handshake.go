@@ -0,0 +1,126 @@
+package common
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// HandshakeSequence is the sequence number of the chunk carrying a session's
+// key exchange; data chunks are numbered from 1
+const HandshakeSequence = 0
+
+// SessionKeyConfig enables per-session keys agreed between the client and
+// the central proxy. The client sends an ephemeral X25519 public key in the
+// handshake chunk and both sides derive the session key from it and the
+// central proxy's static key, so hop nodes never hold it.
+type SessionKeyConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Central proxy: hex X25519 private key, generated at startup if empty
+	PrivateKey string `yaml:"private_key"`
+
+	// Client: hex X25519 public key of the central proxy
+	CentralPublicKey string `yaml:"central_public_key"`
+}
+
+// HandshakeMessage is the data of a handshake chunk
+type HandshakeMessage struct {
+	PublicKey []byte `json:"public_key"` // client's ephemeral X25519 key
+}
+
+// NewClientHandshake creates an ephemeral key pair for sessionID and derives
+// the session key shared with the central proxy. It returns the handshake
+// chunk data to send and the derived key.
+func NewClientHandshake(sessionID string, centralPublic []byte) ([]byte, []byte, error) {
+	peer, err := ecdh.X25519().NewPublicKey(centralPublic)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid central public key: %w", err)
+	}
+
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret, err := private.ECDH(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := deriveSessionKey(secret, sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := json.Marshal(HandshakeMessage{PublicKey: private.PublicKey().Bytes()})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, key, nil
+}
+
+// SessionKeyAgreement derives session keys on the central proxy
+type SessionKeyAgreement struct {
+	private *ecdh.PrivateKey
+}
+
+// NewSessionKeyAgreement loads the hex private key, or generates a new one
+// when privateHex is empty
+func NewSessionKeyAgreement(privateHex string) (*SessionKeyAgreement, error) {
+	if privateHex == "" {
+		private, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return &SessionKeyAgreement{private: private}, nil
+	}
+
+	raw, err := hex.DecodeString(privateHex)
+	if err != nil {
+		return nil, fmt.Errorf("session_keys.private_key is not valid hex: %w", err)
+	}
+
+	private, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session_keys.private_key: %w", err)
+	}
+
+	return &SessionKeyAgreement{private: private}, nil
+}
+
+// PublicKey returns the public key clients configure as central_public_key
+func (a *SessionKeyAgreement) PublicKey() []byte {
+	return a.private.PublicKey().Bytes()
+}
+
+// DeriveKey derives the session key from a handshake chunk's data
+func (a *SessionKeyAgreement) DeriveKey(sessionID string, data []byte) ([]byte, error) {
+	var msg HandshakeMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("invalid handshake: %w", err)
+	}
+
+	peer, err := ecdh.X25519().NewPublicKey(msg.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid handshake public key: %w", err)
+	}
+
+	secret, err := a.private.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return deriveSessionKey(secret, sessionID)
+}
+
+// deriveSessionKey expands the shared secret into a 32-byte key bound to
+// the session ID
+func deriveSessionKey(secret []byte, sessionID string) ([]byte, error) {
+	return hkdf.Key(sha256.New, secret, nil, "proxy-system session "+sessionID, 32)
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestSessionKeysDifferPerSession(t *testing.T) {
+	central, err := NewSessionKeyAgreement("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make(map[string][]byte)
+	for _, session := range []string{"session-a", "session-b"} {
+		data, clientKey, err := NewClientHandshake(session, central.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		centralKey, err := central.DeriveKey(session, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(clientKey, centralKey) {
+			t.Fatalf("%s: client and central derived different keys", session)
+		}
+		keys[session] = clientKey
+
+		// Data sealed by the client opens at the central proxy
+		sealed, err := EncryptAESWithAAD([]byte("body of "+session), clientKey, []byte(session))
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened, err := DecryptAESWithAAD(sealed, centralKey, []byte(session))
+		if err != nil || string(opened) != "body of "+session {
+			t.Errorf("%s: got %q, %v", session, opened, err)
+		}
+	}
+
+	if bytes.Equal(keys["session-a"], keys["session-b"]) {
+		t.Error("two sessions share a key")
+	}
+	sealed, _ := EncryptAESWithAAD([]byte("body"), keys["session-a"], nil)
+	if _, err := DecryptAESWithAAD(sealed, keys["session-b"], nil); err == nil {
+		t.Error("one session's key opened another's data")
+	}
+}
+
+func TestSessionKeyBoundToSessionID(t *testing.T) {
+	central, _ := NewSessionKeyAgreement("")
+	data, clientKey, _ := NewClientHandshake("session-a", central.PublicKey())
+
+	// A handshake replayed under another session derives a different key
+	other, err := central.DeriveKey("session-b", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(other, clientKey) {
+		t.Error("handshake derived the same key under another session ID")
+	}
+}
+
+func TestSessionKeyAgreementFromConfig(t *testing.T) {
+	generated, _ := NewSessionKeyAgreement("")
+	loaded, err := NewSessionKeyAgreement(hex.EncodeToString(generated.private.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.PublicKey(), generated.PublicKey()) {
+		t.Error("loaded key has a different public key")
+	}
+
+	for _, bad := range []string{"not hex", "abcd"} {
+		if _, err := NewSessionKeyAgreement(bad); err == nil {
+			t.Errorf("private key %q accepted", bad)
+		}
+	}
+	if _, err := generated.DeriveKey("s", []byte("{}")); err == nil {
+		t.Error("handshake without a public key accepted")
+	}
+}
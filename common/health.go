@@ -0,0 +1,64 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Version is the build version reported by /health, set at build time with
+//
+//	go build -ldflags "-X github.com/dudelovecamera/proxy-system/common.Version=v1.2.3"
+var Version = "dev"
+
+// startedAt is when the process started, for uptime
+var startedAt = time.Now()
+
+// HealthInfo is the /health payload every component serves. Extra holds
+// component-specific fields, written alongside the common ones.
+type HealthInfo struct {
+	Status        string
+	Role          string
+	Version       string
+	StartedAt     time.Time
+	UptimeSeconds float64
+	Time          time.Time
+	Extra         map[string]any
+}
+
+// NewHealthInfo describes a healthy component of role as of now
+func NewHealthInfo(role string, extra map[string]any) HealthInfo {
+	now := time.Now()
+	return HealthInfo{
+		Status:        "healthy",
+		Role:          role,
+		Version:       Version,
+		StartedAt:     startedAt,
+		UptimeSeconds: now.Sub(startedAt).Seconds(),
+		Time:          now,
+		Extra:         extra,
+	}
+}
+
+// MarshalJSON writes one flat object, so monitors read the common fields
+// and the extras the same way. Extras can't replace a common field.
+func (h HealthInfo) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]any, len(h.Extra)+6)
+	for k, v := range h.Extra {
+		fields[k] = v
+	}
+	fields["status"] = h.Status
+	fields["role"] = h.Role
+	fields["version"] = h.Version
+	fields["started_at"] = h.StartedAt.Format(time.RFC3339)
+	fields["uptime_seconds"] = h.UptimeSeconds
+	fields["time"] = h.Time.Format(time.RFC3339)
+	return json.Marshal(fields)
+}
+
+// WriteHealth serves info as the /health response
+func WriteHealth(w http.ResponseWriter, info HealthInfo) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// healthFields serves info through WriteHealth and decodes the response
+func healthFields(t *testing.T, info HealthInfo) map[string]any {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	WriteHealth(recorder, info)
+	if ct := recorder.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q", ct)
+	}
+
+	var fields map[string]any
+	if err := json.NewDecoder(recorder.Body).Decode(&fields); err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+func TestHealthReportsVersionAndUptime(t *testing.T) {
+	first := healthFields(t, NewHealthInfo("tester", map[string]any{"active_sessions": 3}))
+	time.Sleep(10 * time.Millisecond)
+	second := healthFields(t, NewHealthInfo("tester", nil))
+
+	if first["version"] != Version || first["role"] != "tester" || first["status"] != "healthy" {
+		t.Errorf("health %v, want role, status and version", first)
+	}
+	if first["active_sessions"] != float64(3) {
+		t.Errorf("extra field lost: %v", first)
+	}
+	if _, err := time.Parse(time.RFC3339, first["started_at"].(string)); err != nil {
+		t.Errorf("started_at: %v", err)
+	}
+
+	before, after := first["uptime_seconds"].(float64), second["uptime_seconds"].(float64)
+	if before < 0 || after <= before {
+		t.Errorf("uptime went from %v to %v, want it increasing", before, after)
+	}
+}
+
+func TestHealthExtrasCannotReplaceCommonFields(t *testing.T) {
+	fields := healthFields(t, NewHealthInfo("tester", map[string]any{"status": "spoofed", "version": "v0"}))
+	if fields["status"] != "healthy" || fields["version"] != Version {
+		t.Errorf("extras replaced common fields: %v", fields)
+	}
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Phase timeout defaults in milliseconds. The response header wait has no
+// default limit of its own and is bounded by the overall timeout.
+const (
+	DefaultDialTimeout         = 10000
+	DefaultTLSHandshakeTimeout = 10000
+)
+
+// HTTPTimeouts bounds the phases of an outbound request separately from the
+// overall request timeout, so a dead host fails at connect time instead of
+// when the whole budget runs out. Values are milliseconds; zero uses the
+// default.
+type HTTPTimeouts struct {
+	Dial           int `yaml:"dial_timeout"`
+	TLSHandshake   int `yaml:"tls_handshake_timeout"`
+	ResponseHeader int `yaml:"response_header_timeout"`
+}
+
+// Validate checks the timeout settings
+func (t HTTPTimeouts) Validate() error {
+	var errs []error
+
+	if t.Dial < 0 {
+		errs = append(errs, fmt.Errorf("timeouts.dial_timeout must not be negative, got %d", t.Dial))
+	}
+	if t.TLSHandshake < 0 {
+		errs = append(errs, fmt.Errorf("timeouts.tls_handshake_timeout must not be negative, got %d", t.TLSHandshake))
+	}
+	if t.ResponseHeader < 0 {
+		errs = append(errs, fmt.Errorf("timeouts.response_header_timeout must not be negative, got %d", t.ResponseHeader))
+	}
+
+	return errors.Join(errs...)
+}
+
+// NewDialer returns a dialer using the configured connect timeout
+func NewDialer(t HTTPTimeouts) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   millisOr(t.Dial, DefaultDialTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+}
+
+// NewHTTPTransport returns a transport based on http.DefaultTransport with
+// the configured dial, TLS handshake and response header timeouts. Unlike
+// http.DefaultTransport it ignores HTTP_PROXY and friends: a proxy would
+// dial targets itself, past any destination filter on the dialer, so one
+// is only used where configured explicitly, as by socks5 exits.
+func NewHTTPTransport(t HTTPTimeouts) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = NewDialer(t).DialContext
+	transport.TLSHandshakeTimeout = millisOr(t.TLSHandshake, DefaultTLSHandshakeTimeout)
+	transport.ResponseHeaderTimeout = millisOr(t.ResponseHeader, 0)
+	return transport
+}
+
+// NewHTTPClient returns a client with an overall timeout and per-phase
+// timeouts from t
+func NewHTTPClient(timeout time.Duration, t HTTPTimeouts) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: NewHTTPTransport(t),
+	}
+}
+
+// maxDrain is how much of an unread response body DrainAndClose reads so
+// the connection can be reused; larger remainders close the connection
+const maxDrain = 64 * 1024
+
+// DrainAndClose reads what is left of resp's body, up to maxDrain, and
+// closes it. A body closed unread can't hand its connection back to the
+// pool, so error paths that skip the body would otherwise leak connections.
+func DrainAndClose(resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+	io.CopyN(io.Discard, resp.Body, maxDrain)
+	resp.Body.Close()
+}
+
+// millisOr converts ms to a duration, using def when ms is zero
+func millisOr(ms, def int) time.Duration {
+	if ms == 0 {
+		ms = def
+	}
+	return time.Duration(ms) * time.Millisecond
+}
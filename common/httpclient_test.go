@@ -0,0 +1,102 @@
+package common
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// silentServer accepts connections and never answers on them
+func silentServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		var held []net.Conn
+		defer func() {
+			for _, conn := range held {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			held = append(held, conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	addr := silentServer(t)
+	client := NewHTTPClient(10*time.Second, HTTPTimeouts{ResponseHeader: 50})
+
+	start := time.Now()
+	_, err := client.Get("http://" + addr + "/")
+	if err == nil || !strings.Contains(err.Error(), "timeout awaiting response headers") {
+		t.Fatalf("got %v, want the response header timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %v, want the 50ms header timeout rather than the overall one", elapsed)
+	}
+}
+
+func TestHTTPTimeoutDefaults(t *testing.T) {
+	transport := NewHTTPTransport(HTTPTimeouts{})
+	if transport.TLSHandshakeTimeout != DefaultTLSHandshakeTimeout*time.Millisecond {
+		t.Errorf("TLS handshake timeout %v", transport.TLSHandshakeTimeout)
+	}
+	if transport.ResponseHeaderTimeout != 0 {
+		t.Errorf("response header timeout %v, want none", transport.ResponseHeaderTimeout)
+	}
+	if dialer := NewDialer(HTTPTimeouts{}); dialer.Timeout != DefaultDialTimeout*time.Millisecond {
+		t.Errorf("dial timeout %v", dialer.Timeout)
+	}
+	if dialer := NewDialer(HTTPTimeouts{Dial: 250}); dialer.Timeout != 250*time.Millisecond {
+		t.Errorf("configured dial timeout: got %v", dialer.Timeout)
+	}
+}
+
+func TestHTTPTimeoutsValidate(t *testing.T) {
+	err := HTTPTimeouts{Dial: -1, TLSHandshake: -1, ResponseHeader: -1}.Validate()
+	for _, want := range []string{"dial_timeout", "tls_handshake_timeout", "response_header_timeout"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got %v, want it to mention %s", err, want)
+		}
+	}
+}
+
+// trackedBody records whether it was read to the end and closed
+type trackedBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *trackedBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestDrainAndClose(t *testing.T) {
+	body := &trackedBody{Reader: strings.NewReader("unread remainder")}
+	DrainAndClose(&http.Response{Body: body})
+	if !body.closed {
+		t.Error("body not closed")
+	}
+	if rest, _ := io.ReadAll(body); len(rest) != 0 {
+		t.Errorf("%q left unread", rest)
+	}
+
+	// Nothing to close is fine
+	DrainAndClose(nil)
+	DrainAndClose(&http.Response{})
+}
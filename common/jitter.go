@@ -0,0 +1,70 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// Jitter distributions
+const (
+	JitterUniform     = "uniform"
+	JitterExponential = "exponential"
+)
+
+// JitterDelay returns a random delay between minMs and maxMs milliseconds.
+// The uniform distribution (the default) spreads delays evenly; the
+// exponential one favours short delays with an occasional long one, which
+// looks more like real network latency. Randomness comes from crypto/rand
+// so delays can't be predicted from a seeded generator.
+func JitterDelay(minMs, maxMs int, distribution string) time.Duration {
+	if maxMs <= minMs {
+		return time.Duration(minMs) * time.Millisecond
+	}
+
+	span := float64(maxMs - minMs)
+	var offset float64
+
+	switch distribution {
+	case JitterExponential:
+		// Mean of a quarter of the range, redrawn when past the maximum so
+		// the result is a truncated exponential rather than piling up at max
+		offset = span
+		for attempt := 0; attempt < 8 && offset >= span; attempt++ {
+			offset = -math.Log(1-randomFloat()) * span / 4
+		}
+		offset = math.Min(offset, span)
+	default:
+		offset = randomFloat() * span
+	}
+
+	ms := float64(minMs) + offset
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// RetryDelay returns the backoff before the given retry attempt, counting
+// from 1: baseMs milliseconds doubled per attempt and capped at maxMs, with
+// up to half of it randomized so failed senders don't retry in step
+func RetryDelay(attempt, baseMs, maxMs int) time.Duration {
+	delay := time.Duration(baseMs) * time.Millisecond << (attempt - 1)
+	maxDelay := time.Duration(maxMs) * time.Millisecond
+	if delay > maxDelay || delay <= 0 {
+		delay = maxDelay
+	}
+
+	half := delay / 2
+	return half + time.Duration(randomFloat()*float64(half+1))
+}
+
+// ValidJitterDistribution reports whether name is a known distribution
+func ValidJitterDistribution(name string) bool {
+	return name == "" || name == JitterUniform || name == JitterExponential
+}
+
+// randomFloat returns a uniform value in [0, 1) from crypto/rand
+func randomFloat() float64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53)
+}
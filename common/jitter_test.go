@@ -0,0 +1,81 @@
+package common
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJitterDelayVariesWithinBounds(t *testing.T) {
+	for _, distribution := range []string{"", JitterUniform, JitterExponential} {
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 1000; i++ {
+			delay := JitterDelay(10, 50, distribution)
+			if delay < 10*time.Millisecond || delay > 50*time.Millisecond {
+				t.Fatalf("%q: delay %v outside 10ms..50ms", distribution, delay)
+			}
+			seen[delay] = true
+		}
+		if len(seen) < 100 {
+			t.Errorf("%q: only %d distinct delays in 1000 draws", distribution, len(seen))
+		}
+	}
+}
+
+func TestJitterDelayExponentialFavoursShortDelays(t *testing.T) {
+	var short int
+	for i := 0; i < 1000; i++ {
+		if JitterDelay(0, 100, JitterExponential) < 50*time.Millisecond {
+			short++
+		}
+	}
+	// With a mean of a quarter of the range, about 86% fall in the lower half
+	if short < 700 {
+		t.Errorf("%d of 1000 delays in the lower half, want most", short)
+	}
+}
+
+func TestJitterDelayFixedRange(t *testing.T) {
+	if delay := JitterDelay(20, 20, JitterUniform); delay != 20*time.Millisecond {
+		t.Errorf("equal bounds: got %v, want 20ms", delay)
+	}
+}
+
+func TestObfuscationJitterDelay(t *testing.T) {
+	if delay := (ObfuscationConfig{}).JitterDelay(); delay != 0 {
+		t.Errorf("no jitter configured: got %v", delay)
+	}
+	// The older jitter setting is a maximum with no minimum
+	for i := 0; i < 100; i++ {
+		if delay := (ObfuscationConfig{Jitter: 5}).JitterDelay(); delay > 5*time.Millisecond {
+			t.Fatalf("jitter 5: got %v", delay)
+		}
+		if delay := (ObfuscationConfig{Jitter: 5, JitterMin: 2, JitterMax: 3}).JitterDelay(); delay < 2*time.Millisecond || delay > 3*time.Millisecond {
+			t.Fatalf("jitter_max_ms 3 over jitter 5: got %v", delay)
+		}
+	}
+}
+
+func TestObfuscationJitterValidate(t *testing.T) {
+	tests := []struct {
+		config ObfuscationConfig
+		want   string
+	}{
+		{ObfuscationConfig{Jitter: -1}, "obfuscation.jitter must not be negative"},
+		{ObfuscationConfig{JitterMin: -1, JitterMax: 5}, "must not be negative"},
+		{ObfuscationConfig{JitterMin: 10, JitterMax: 5}, "jitter_min_ms 10 exceeds jitter_max_ms 5"},
+		{ObfuscationConfig{JitterMin: 10, Jitter: 5}, "jitter_min_ms 10 exceeds jitter 5"},
+		{ObfuscationConfig{JitterMin: 10}, "jitter_min_ms requires jitter_max_ms"},
+		{ObfuscationConfig{JitterMax: 5, JitterDistribution: "normal"}, "unknown obfuscation.jitter_distribution"},
+	}
+	for _, tt := range tests {
+		err := tt.config.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v: got %v, want %q", tt.config, err, tt.want)
+		}
+	}
+
+	if err := (ObfuscationConfig{JitterMin: 5, JitterMax: 10, JitterDistribution: JitterExponential}).Validate(); err != nil {
+		t.Errorf("valid range: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DefaultKeyID names the key used when no keyring is configured
+const DefaultKeyID = "default"
+
+// KeyRing holds versioned encryption keys. Senders encrypt with the active
+// key and tag chunks with its ID; receivers decrypt with whichever key the
+// chunk names, so several keys can be live while a rotation rolls out.
+// Fallback keys cover senders that can't be told apart by key ID, such as
+// nodes still on an old default key: they are tried in order when the named
+// key fails.
+type KeyRing struct {
+	keys     map[string][]byte
+	active   string
+	fallback [][]byte
+	tap      *WireTap // captures chunks on the plaintext side, nil if off
+	mu       sync.RWMutex
+}
+
+// NewKeyRing creates a keyring with the given keys and active key ID
+func NewKeyRing(keys map[string][]byte, active string) (*KeyRing, error) {
+	ring := &KeyRing{
+		keys: make(map[string][]byte),
+	}
+
+	for id, key := range keys {
+		if err := ring.Add(id, key); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ring.SetActive(active); err != nil {
+		return nil, err
+	}
+
+	return ring, nil
+}
+
+// NewKeyRingFromConfig builds a keyring from the encryption config, the
+// one place every component loads its keys. Without configured keys the
+// ring holds only the default key (see EncryptionConfig.DefaultKey) under
+// DefaultKeyID. Previous keys from the config become fallback keys.
+func NewKeyRingFromConfig(config EncryptionConfig) (*KeyRing, error) {
+	previous, err := config.FallbackKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := config.VersionedKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	active := config.ActiveKey
+	if len(keys) == 0 {
+		key, err := config.DefaultKey()
+		if err != nil {
+			return nil, err
+		}
+		keys[DefaultKeyID] = key
+		active = DefaultKeyID
+	} else if active == "" && len(keys) == 1 {
+		for id := range keys {
+			active = id
+		}
+	}
+
+	ring, err := NewKeyRing(keys, active)
+	if err != nil {
+		return nil, err
+	}
+
+	ring.SetFallbackKeys(previous)
+	return ring, nil
+}
+
+// Add registers a key under id
+func (k *KeyRing) Add(id string, key []byte) error {
+	if id == "" {
+		return fmt.Errorf("key ID must not be empty")
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("key %s must be 32 bytes, got %d", id, len(key))
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = key
+	return nil
+}
+
+// Remove retires a key; the active key cannot be removed
+func (k *KeyRing) Remove(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if id == k.active {
+		return fmt.Errorf("cannot remove active key %s", id)
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+// SetActive switches the key used for encryption
+func (k *KeyRing) SetActive(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, exists := k.keys[id]; !exists {
+		return fmt.Errorf("unknown active key %q", id)
+	}
+	k.active = id
+	return nil
+}
+
+// Active returns the ID of the key used for encryption
+func (k *KeyRing) Active() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// Key returns the key registered under id
+func (k *KeyRing) Key(id string) ([]byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, exists := k.keys[id]
+	return key, exists
+}
+
+// SetFallbackKeys sets the keys tried, in order, when a chunk doesn't
+// decrypt with the key it names
+func (k *KeyRing) SetFallbackKeys(keys [][]byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.fallback = keys
+}
+
+// SetWireTap captures every chunk before encryption and after decryption
+func (k *KeyRing) SetWireTap(tap *WireTap) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.tap = tap
+}
+
+// EncryptChunk encrypts chunk data with the active key and tags its key ID
+func (k *KeyRing) EncryptChunk(chunk *Chunk) error {
+	k.mu.RLock()
+	id := k.active
+	key := k.keys[id]
+	tap := k.tap
+	k.mu.RUnlock()
+
+	tap.Capture("out", CapturePlaintext, chunk, nil, nil)
+
+	encrypted, err := EncryptAESWithAAD(chunk.Data, key, chunk.AAD())
+	if err != nil {
+		return err
+	}
+
+	chunk.Data = encrypted
+	chunk.KeyID = id
+	return nil
+}
+
+// DecryptChunk decrypts chunk data with the key named by its key ID, then
+// with each fallback key. Untagged chunks are decrypted with the active key.
+func (k *KeyRing) DecryptChunk(chunk *Chunk) error {
+	k.mu.RLock()
+	id := chunk.KeyID
+	if id == "" {
+		id = k.active
+	}
+	key, exists := k.keys[id]
+	fallback := k.fallback
+	tap := k.tap
+	k.mu.RUnlock()
+
+	if !exists && len(fallback) == 0 {
+		return fmt.Errorf("unknown key ID %q", id)
+	}
+
+	candidates := make([][]byte, 0, len(fallback)+1)
+	if exists {
+		candidates = append(candidates, key)
+	}
+	candidates = append(candidates, fallback...)
+
+	decrypted, err := DecryptWithKeysAAD(chunk.Data, candidates, chunk.AAD())
+	if err != nil {
+		return err
+	}
+
+	chunk.Data = decrypted
+
+	tap.Capture("in", CapturePlaintext, chunk, nil, nil)
+	return nil
+}
+
+// DecryptWithKeys decrypts data with the first of keys that succeeds
+func DecryptWithKeys(ciphertext []byte, keys [][]byte) ([]byte, error) {
+	return DecryptWithKeysAAD(ciphertext, keys, nil)
+}
+
+// DecryptWithKeysAAD is DecryptWithKeys for data encrypted with
+// EncryptAESWithAAD. It returns the last key's error if none succeeds.
+func DecryptWithKeysAAD(ciphertext []byte, keys [][]byte, aad []byte) ([]byte, error) {
+	err := errors.New("no decryption keys")
+	for _, key := range keys {
+		var plaintext []byte
+		if plaintext, err = DecryptAESWithAAD(ciphertext, key, aad); err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,157 @@
+package common
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestKeyRingDecryptsWithTaggedKey(t *testing.T) {
+	sender, err := NewKeyRing(map[string][]byte{"v2": testKey(2)}, "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := NewKeyRing(map[string][]byte{"v1": testKey(1), "v2": testKey(2)}, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := &Chunk{SessionID: "s", SequenceNum: 1, TotalChunks: 1, Data: []byte("secret"), Timestamp: time.Now()}
+	if err := sender.EncryptChunk(chunk); err != nil {
+		t.Fatal(err)
+	}
+	if chunk.KeyID != "v2" {
+		t.Errorf("chunk tagged %q, want v2", chunk.KeyID)
+	}
+	if err := receiver.DecryptChunk(chunk); err != nil {
+		t.Fatalf("receiver on v1 holding v2: %v", err)
+	}
+	if string(chunk.Data) != "secret" {
+		t.Errorf("decrypted %q", chunk.Data)
+	}
+}
+
+func TestKeyRingUnknownKeyID(t *testing.T) {
+	sender, _ := NewKeyRing(map[string][]byte{"v3": testKey(3)}, "v3")
+	receiver, _ := NewKeyRing(map[string][]byte{"v1": testKey(1)}, "v1")
+
+	chunk := &Chunk{SessionID: "s", SequenceNum: 1, TotalChunks: 1, Data: []byte("secret"), Timestamp: time.Now()}
+	sender.EncryptChunk(chunk)
+	if err := receiver.DecryptChunk(chunk); err == nil {
+		t.Error("chunk under an unknown key ID decrypted")
+	}
+}
+
+func TestKeyRingFallbackKeys(t *testing.T) {
+	old, err := NewKeyRing(map[string][]byte{DefaultKeyID: testKey(1)}, DefaultKeyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, _ := NewKeyRing(map[string][]byte{"v2": testKey(2)}, "v2")
+	receiver.SetFallbackKeys([][]byte{testKey(9), testKey(1)})
+
+	chunk := &Chunk{SessionID: "s", SequenceNum: 1, TotalChunks: 1, Data: []byte("secret"), Timestamp: time.Now()}
+	if err := old.EncryptChunk(chunk); err != nil {
+		t.Fatal(err)
+	}
+	chunk.KeyID = ""
+	if err := receiver.DecryptChunk(chunk); err != nil {
+		t.Fatalf("untagged chunk under a previous key: %v", err)
+	}
+	if string(chunk.Data) != "secret" {
+		t.Errorf("decrypted %q", chunk.Data)
+	}
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	ring, _ := NewKeyRing(map[string][]byte{"v1": testKey(1)}, "v1")
+	if err := ring.Add("v2", testKey(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.SetActive("v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Remove("v2"); err == nil {
+		t.Error("removed the active key")
+	}
+	if err := ring.Remove("v1"); err != nil {
+		t.Errorf("removing the old key: %v", err)
+	}
+	if err := ring.Add("short", []byte("too short")); err == nil {
+		t.Error("accepted a key that is not 32 bytes")
+	}
+}
+
+func TestNewKeyRingFromConfig(t *testing.T) {
+	ring, err := NewKeyRingFromConfig(EncryptionConfig{
+		Keys:      map[string]string{"v1": hex.EncodeToString(testKey(1)), "v2": hex.EncodeToString(testKey(2))},
+		ActiveKey: "v2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring.Active() != "v2" {
+		t.Errorf("active key %q, want v2", ring.Active())
+	}
+	if key, _ := ring.Key("v1"); !bytes.Equal(key, testKey(1)) {
+		t.Error("v1 not decoded from hex")
+	}
+
+	single, err := NewKeyRingFromConfig(EncryptionConfig{KeyHex: hex.EncodeToString(testKey(4))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := single.Key(DefaultKeyID); single.Active() != DefaultKeyID || !bytes.Equal(key, testKey(4)) {
+		t.Error("inline key not loaded as the default key")
+	}
+}
+
+func TestDecryptWithKeys(t *testing.T) {
+	sealed, err := EncryptAES([]byte("secret"), testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := DecryptWithKeys(sealed, [][]byte{testKey(2), testKey(1)})
+	if err != nil || string(plaintext) != "secret" {
+		t.Errorf("old key after the current one: %q, %v", plaintext, err)
+	}
+	if _, err := DecryptWithKeys(sealed, [][]byte{testKey(2)}); err == nil {
+		t.Error("decrypted without the old key")
+	}
+	if _, err := DecryptWithKeys(sealed, nil); err == nil {
+		t.Error("decrypted with no keys")
+	}
+}
+
+func TestKeyRingFromConfigWithPreviousKeys(t *testing.T) {
+	old, err := NewKeyRing(map[string][]byte{DefaultKeyID: testKey(1)}, DefaultKeyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := NewKeyRingFromConfig(EncryptionConfig{
+		KeyHex:       hex.EncodeToString(testKey(2)),
+		PreviousKeys: []string{hex.EncodeToString(testKey(1))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tagged with the default key ID, which now names the new key
+	chunk := &Chunk{SessionID: "s", SequenceNum: 1, TotalChunks: 1, Data: []byte("secret"), Timestamp: time.Now()}
+	if err := old.EncryptChunk(chunk); err != nil {
+		t.Fatal(err)
+	}
+	if err := receiver.DecryptChunk(chunk); err != nil || string(chunk.Data) != "secret" {
+		t.Errorf("chunk under the previous key: %q, %v", chunk.Data, err)
+	}
+
+	if _, err := NewKeyRingFromConfig(EncryptionConfig{KeyHex: hex.EncodeToString(testKey(2)), PreviousKeys: []string{"not hex"}}); err == nil {
+		t.Error("malformed previous key accepted")
+	}
+}
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// ErrKillSwitchEngaged is returned for traffic refused while the kill
+// switch is engaged
+var ErrKillSwitchEngaged = errors.New("kill switch engaged")
+
+// KillSwitch halts a component's exit traffic until it is released.
+// Operators engage it through POST /panic when anonymity may be
+// compromised.
+type KillSwitch struct {
+	engaged  atomic.Bool
+	onEngage func()
+}
+
+// NewKillSwitch creates a released switch. onEngage runs each time the
+// switch is engaged, to drop whatever traffic the component holds.
+func NewKillSwitch(onEngage func()) *KillSwitch {
+	return &KillSwitch{onEngage: onEngage}
+}
+
+// Engaged reports whether exit traffic is halted
+func (k *KillSwitch) Engaged() bool {
+	return k.engaged.Load()
+}
+
+// Check returns ErrKillSwitchEngaged while the switch is engaged
+func (k *KillSwitch) Check() error {
+	if k.Engaged() {
+		return ErrKillSwitchEngaged
+	}
+	return nil
+}
+
+// Engage halts exit traffic. It reports false if the switch was already
+// engaged.
+func (k *KillSwitch) Engage() bool {
+	if !k.engaged.CompareAndSwap(false, true) {
+		return false
+	}
+	if k.onEngage != nil {
+		k.onEngage()
+	}
+	return true
+}
+
+// Release lets exit traffic resume. It reports false if the switch was not
+// engaged.
+func (k *KillSwitch) Release() bool {
+	return k.engaged.CompareAndSwap(true, false)
+}
+
+// PanicHandler serves POST /panic, engaging k. Like /shutdown it needs the
+// admin token.
+func PanicHandler(token string, k *KillSwitch) http.HandlerFunc {
+	return killSwitchHandler(token, "panic", func() string {
+		if !k.Engage() {
+			return "Kill switch already engaged"
+		}
+		return "Kill switch engaged"
+	})
+}
+
+// ResumeHandler serves POST /resume, releasing k
+func ResumeHandler(token string, k *KillSwitch) http.HandlerFunc {
+	return killSwitchHandler(token, "resume", func() string {
+		if !k.Release() {
+			return "Kill switch not engaged"
+		}
+		return "Kill switch released"
+	})
+}
+
+func killSwitchHandler(token, action string, flip func() string) http.HandlerFunc {
+	return AdminHandler(token, action, func(w http.ResponseWriter, r *http.Request) {
+		result := flip()
+		log.Printf("%s (%s requested by %s)", result, action, r.RemoteAddr)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(result))
+	})
+}
@@ -0,0 +1,58 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKillSwitch(t *testing.T) {
+	dropped := 0
+	k := NewKillSwitch(func() { dropped++ })
+
+	if k.Check() != nil {
+		t.Fatal("new switch engaged")
+	}
+	if !k.Engage() || k.Engage() {
+		t.Error("Engage should report true once, then false")
+	}
+	if k.Check() != ErrKillSwitchEngaged {
+		t.Errorf("engaged: Check = %v", k.Check())
+	}
+	if dropped != 1 {
+		t.Errorf("traffic dropped %d times, want once per engagement", dropped)
+	}
+
+	if !k.Release() || k.Release() {
+		t.Error("Release should report true once, then false")
+	}
+	if k.Check() != nil {
+		t.Error("still engaged after Release")
+	}
+}
+
+func TestPanicAndResumeHandlers(t *testing.T) {
+	k := NewKillSwitch(nil)
+	call := func(handler http.HandlerFunc, authorization string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		return recorder.Code
+	}
+
+	if code := call(PanicHandler("secret", k), "Bearer wrong"); code != http.StatusUnauthorized || k.Engaged() {
+		t.Errorf("wrong token: status %d, engaged %v", code, k.Engaged())
+	}
+	if code := call(PanicHandler("secret", k), "Bearer secret"); code != http.StatusOK || !k.Engaged() {
+		t.Errorf("/panic: status %d, engaged %v", code, k.Engaged())
+	}
+	if code := call(ResumeHandler("secret", k), ""); code != http.StatusUnauthorized || !k.Engaged() {
+		t.Errorf("unauthenticated /resume: status %d, engaged %v", code, k.Engaged())
+	}
+	if code := call(ResumeHandler("secret", k), "Bearer secret"); code != http.StatusOK || k.Engaged() {
+		t.Errorf("/resume: status %d, engaged %v", code, k.Engaged())
+	}
+}
@@ -0,0 +1,53 @@
+package common
+
+// LossMetrics counts chunk loss seen by a receiver that reassembles
+// sessions. Sends between hops are fire-and-forget, so these are the only
+// measure of how many chunks go missing on the way.
+type LossMetrics struct {
+	Received *Counter
+	Gaps     *Counter
+	Lost     *Counter
+	Expired  *Counter
+}
+
+// NewLossMetrics registers the loss counters with m
+func NewLossMetrics(m *Metrics) *LossMetrics {
+	return &LossMetrics{
+		Received: m.Counter("proxy_chunks_received_total", "Data chunks received"),
+		Gaps:     m.Counter("proxy_chunk_sequence_gaps_total", "Chunks missing below the highest one received when their session expired"),
+		Lost:     m.Counter("proxy_chunks_lost_total", "Chunks never received before their session expired"),
+		Expired:  m.Counter("proxy_sessions_expired_total", "Sessions dropped before all chunks arrived"),
+	}
+}
+
+// Observe records a data chunk of session. Callers must hold the lock
+// guarding the session. Chunks take different paths, so one arriving ahead
+// of an earlier one is not loss; gaps are only counted once the session
+// expires.
+func (l *LossMetrics) Observe(session *Session, seq int) {
+	l.Received.Inc()
+
+	if seq > session.MaxSequence {
+		session.MaxSequence = seq
+	}
+}
+
+// Expire records the chunks an expired session never received, and how
+// many of them were gaps before the highest sequence number that arrived.
+// A session that completes has nothing missing, so only expiry counts.
+func (l *LossMetrics) Expire(session *Session) {
+	l.Expired.Inc()
+	if missing := session.TotalChunks - len(session.Chunks); missing > 0 {
+		l.Lost.Add(int64(missing))
+	}
+
+	gaps := 0
+	for seq := 1; seq < session.MaxSequence; seq++ {
+		if _, exists := session.Chunks[seq]; !exists {
+			gaps++
+		}
+	}
+	if gaps > 0 {
+		l.Gaps.Add(int64(gaps))
+	}
+}
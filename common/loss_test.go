@@ -0,0 +1,23 @@
+package common
+
+import "testing"
+
+func TestLossMetricsCountOnExpiry(t *testing.T) {
+	loss := NewLossMetrics(NewMetrics())
+	session := &Session{TotalChunks: 6, Chunks: make(map[int]*Chunk)}
+
+	// Out of order arrival is not loss by itself
+	for _, seq := range []int{4, 1, 2} {
+		session.Chunks[seq] = &Chunk{}
+		loss.Observe(session, seq)
+	}
+	if loss.Lost.Value() != 0 || loss.Gaps.Value() != 0 {
+		t.Errorf("loss counted before expiry: lost %d, gaps %d", loss.Lost.Value(), loss.Gaps.Value())
+	}
+
+	loss.Expire(session)
+	if loss.Received.Value() != 3 || loss.Lost.Value() != 3 || loss.Gaps.Value() != 1 || loss.Expired.Value() != 1 {
+		t.Errorf("received %d, lost %d, gaps %d, expired %d, want 3, 3, 1, 1",
+			loss.Received.Value(), loss.Lost.Value(), loss.Gaps.Value(), loss.Expired.Value())
+	}
+}
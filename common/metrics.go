@@ -0,0 +1,64 @@
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing metric
+type Counter struct {
+	name  string
+	help  string
+	value atomic.Int64
+}
+
+// Add increases the counter by n
+func (c *Counter) Add(n int64) {
+	c.value.Add(n)
+}
+
+// Inc increases the counter by one
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Value returns the current count
+func (c *Counter) Value() int64 {
+	return c.value.Load()
+}
+
+// Metrics is a set of counters served at /metrics in the Prometheus text
+// format
+type Metrics struct {
+	counters []*Counter
+	mu       sync.Mutex
+}
+
+// NewMetrics creates an empty set
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// Counter registers a new counter
+func (m *Metrics) Counter(name, help string) *Counter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := &Counter{name: name, help: help}
+	m.counters = append(m.counters, c)
+	return c
+}
+
+// ServeHTTP writes every counter in registration order
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	counters := append([]*Counter(nil), m.counters...)
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.Value())
+	}
+}
@@ -0,0 +1,124 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	rando "math/rand"
+	"net/http"
+	"sync"
+)
+
+// Obfuscator disguises the HTTP request carrying a chunk from one node to
+// the next. It only sets headers of that request: the chunk's own headers
+// are the target request's and must reach the target as the client sent
+// them.
+type Obfuscator interface {
+	Obfuscate(req *http.Request)
+}
+
+// ObfuscatorFactory builds an obfuscator from its configuration
+type ObfuscatorFactory func(config ObfuscationConfig) Obfuscator
+
+var (
+	obfuscators   = make(map[string]ObfuscatorFactory)
+	obfuscatorsMu sync.RWMutex
+)
+
+func init() {
+	RegisterObfuscator("headers", newHeaderObfuscator)
+	RegisterObfuscator("http_mimic", newHTTPMimicObfuscator)
+	RegisterObfuscator("cdn_fronting", newCDNObfuscator)
+}
+
+// RegisterObfuscator makes an obfuscator available under the given type name
+func RegisterObfuscator(name string, factory ObfuscatorFactory) {
+	obfuscatorsMu.Lock()
+	defer obfuscatorsMu.Unlock()
+	obfuscators[name] = factory
+}
+
+// NewObfuscator returns the obfuscator registered for config.Type.
+// An empty type falls back to the static header merge.
+func NewObfuscator(config ObfuscationConfig) (Obfuscator, error) {
+	name := config.Type
+	if name == "" {
+		name = "headers"
+	}
+
+	obfuscatorsMu.RLock()
+	factory, exists := obfuscators[name]
+	obfuscatorsMu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("unknown obfuscation type %q", config.Type)
+	}
+
+	return factory(config), nil
+}
+
+// headerObfuscator merges the configured static headers
+type headerObfuscator struct {
+	config ObfuscationConfig
+}
+
+func newHeaderObfuscator(config ObfuscationConfig) Obfuscator {
+	return &headerObfuscator{config: config}
+}
+
+func (o *headerObfuscator) Obfuscate(req *http.Request) {
+	ApplyObfuscation(req.Header, o.config)
+}
+
+// httpMimicObfuscator makes hop requests look like ordinary browser
+// traffic by adding varying browser headers and a fake session cookie
+type httpMimicObfuscator struct {
+	config ObfuscationConfig
+}
+
+var mimicUserAgents = []string{
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15",
+	"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+}
+
+var mimicLanguages = []string{
+	"en-US,en;q=0.9",
+	"en-GB,en;q=0.8",
+	"de-DE,de;q=0.9,en;q=0.7",
+}
+
+func newHTTPMimicObfuscator(config ObfuscationConfig) Obfuscator {
+	return &httpMimicObfuscator{config: config}
+}
+
+func (o *httpMimicObfuscator) Obfuscate(req *http.Request) {
+	req.Header.Set("User-Agent", mimicUserAgents[rando.Intn(len(mimicUserAgents))])
+	req.Header.Set("Accept-Language", mimicLanguages[rando.Intn(len(mimicLanguages))])
+	req.Header.Set("Cookie", "sid="+randomHex(16))
+	ApplyObfuscation(req.Header, o.config)
+}
+
+// cdnObfuscator adds the headers a CDN edge would put on proxied requests
+type cdnObfuscator struct {
+	config ObfuscationConfig
+}
+
+func newCDNObfuscator(config ObfuscationConfig) Obfuscator {
+	return &cdnObfuscator{config: config}
+}
+
+func (o *cdnObfuscator) Obfuscate(req *http.Request) {
+	req.Header.Set("Via", "1.1 varnish")
+	req.Header.Set("X-Cache", "MISS")
+	req.Header.Set("X-Request-Id", randomHex(16))
+	req.Header.Set("Cache-Control", "no-cache")
+	ApplyObfuscation(req.Header, o.config)
+}
+
+// randomHex returns n random bytes hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
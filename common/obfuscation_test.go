@@ -0,0 +1,81 @@
+package common
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestObfuscators(t *testing.T) {
+	config := ObfuscationConfig{Headers: map[string]string{"X-Static": "yes"}}
+
+	tests := []struct {
+		typ  string
+		want []string // headers set besides the static one
+	}{
+		{"", nil},
+		{"headers", nil},
+		{"http_mimic", []string{"User-Agent", "Accept-Language", "Cookie"}},
+		{"cdn_fronting", []string{"Via", "X-Cache", "X-Request-Id", "Cache-Control"}},
+	}
+	for _, tt := range tests {
+		config.Type = tt.typ
+		obfuscator, err := NewObfuscator(config)
+		if err != nil {
+			t.Fatalf("type %q: %v", tt.typ, err)
+		}
+
+		req, _ := http.NewRequest(http.MethodPost, "http://central/chunk", nil)
+		obfuscator.Obfuscate(req)
+		if req.Header.Get("X-Static") != "yes" {
+			t.Errorf("type %q dropped the static headers", tt.typ)
+		}
+		for _, name := range tt.want {
+			if req.Header.Get(name) == "" {
+				t.Errorf("type %q did not set %s", tt.typ, name)
+			}
+		}
+		if len(req.Header) != len(tt.want)+1 {
+			t.Errorf("type %q set %v", tt.typ, req.Header)
+		}
+	}
+}
+
+func TestObfuscatorsVaryPerRequest(t *testing.T) {
+	for typ, header := range map[string]string{"http_mimic": "Cookie", "cdn_fronting": "X-Request-Id"} {
+		obfuscator, _ := NewObfuscator(ObfuscationConfig{Type: typ})
+		first, _ := http.NewRequest(http.MethodPost, "http://central/chunk", nil)
+		second, _ := http.NewRequest(http.MethodPost, "http://central/chunk", nil)
+		obfuscator.Obfuscate(first)
+		obfuscator.Obfuscate(second)
+		if first.Header.Get(header) == second.Header.Get(header) {
+			t.Errorf("type %q repeated %s %q", typ, header, first.Header.Get(header))
+		}
+	}
+}
+
+func TestUnknownObfuscatorRejected(t *testing.T) {
+	if _, err := NewObfuscator(ObfuscationConfig{Type: "carrier_pigeon"}); err == nil {
+		t.Error("unknown obfuscation type accepted")
+	}
+}
+
+func TestRegisterObfuscator(t *testing.T) {
+	RegisterObfuscator("test_marker", func(config ObfuscationConfig) Obfuscator {
+		return markerObfuscator{}
+	})
+	obfuscator, err := NewObfuscator(ObfuscationConfig{Type: "test_marker"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, "http://central/chunk", nil)
+	obfuscator.Obfuscate(req)
+	if req.Header.Get("X-Marker") != "1" {
+		t.Error("registered obfuscator was not used")
+	}
+}
+
+type markerObfuscator struct{}
+
+func (markerObfuscator) Obfuscate(req *http.Request) {
+	req.Header.Set("X-Marker", "1")
+}
@@ -0,0 +1,35 @@
+package common
+
+// WorkerPool runs submitted jobs on a fixed number of goroutines, so a large
+// batch can't spawn a goroutine per item
+type WorkerPool struct {
+	jobs chan func()
+}
+
+// NewWorkerPool starts a pool of size workers
+func NewWorkerPool(size int) *WorkerPool {
+	if size < 1 {
+		size = 1
+	}
+
+	pool := &WorkerPool{
+		jobs: make(chan func()),
+	}
+
+	for i := 0; i < size; i++ {
+		go pool.work()
+	}
+
+	return pool
+}
+
+// Submit hands job to the next free worker, blocking until one is free
+func (p *WorkerPool) Submit(job func()) {
+	p.jobs <- job
+}
+
+func (p *WorkerPool) work() {
+	for job := range p.jobs {
+		job()
+	}
+}
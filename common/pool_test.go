@@ -0,0 +1,51 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolBoundsConcurrency(t *testing.T) {
+	const size = 4
+	pool := NewWorkerPool(size)
+
+	var running, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		pool.Submit(func() {
+			defer wg.Done()
+			now := running.Add(1)
+			for {
+				seen := peak.Load()
+				if now <= seen || peak.CompareAndSwap(seen, now) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			running.Add(-1)
+		})
+	}
+	wg.Wait()
+
+	if peak.Load() > size {
+		t.Errorf("%d jobs ran at once, want at most %d", peak.Load(), size)
+	}
+	if peak.Load() < 2 {
+		t.Errorf("jobs never ran concurrently")
+	}
+}
+
+func TestWorkerPoolMinimumSize(t *testing.T) {
+	pool := NewWorkerPool(0)
+	done := make(chan struct{})
+	pool.Submit(func() { close(done) })
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a pool of size 0 never ran the job")
+	}
+}
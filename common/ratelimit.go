@@ -0,0 +1,44 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket limits throughput to rate tokens per second, allowing bursts
+// of up to burst tokens
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+// NewTokenBucket creates a full bucket
+func NewTokenBucket(rate, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until n tokens are available and takes them. n may exceed the
+// burst; the bucket then goes into debt and the caller waits it out.
+func (b *TokenBucket) Wait(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	time.Sleep(wait)
+}
@@ -0,0 +1,33 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketPaces(t *testing.T) {
+	bucket := NewTokenBucket(1000, 100)
+
+	start := time.Now()
+	bucket.Wait(100) // the burst
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("burst waited %v", elapsed)
+	}
+
+	for i := 0; i < 3; i++ {
+		bucket.Wait(100)
+	}
+	if elapsed := time.Since(start); elapsed < 270*time.Millisecond {
+		t.Errorf("400 tokens at 1000/s with a burst of 100 took %v, want about 300ms", elapsed)
+	}
+}
+
+func TestTokenBucketDebt(t *testing.T) {
+	bucket := NewTokenBucket(1000, 10)
+
+	start := time.Now()
+	bucket.Wait(110) // past the burst, waits out the debt
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("100 tokens of debt at 1000/s waited %v, want about 100ms", elapsed)
+	}
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// readyProbeTimeout bounds each dependency probe made for /ready
+const readyProbeTimeout = 2 * time.Second
+
+// ReadyHandler serves /ready for orchestrators: 200 when check passes, 503
+// with the reason otherwise. /health stays a plain liveness check.
+func ReadyHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := check(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status": "not ready",
+				"reason": err.Error(),
+			})
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+	}
+}
+
+// ProbeAny returns nil once any of addrs (host:port) answers /health with
+// 200, or an error naming the last failure
+func ProbeAny(client *http.Client, addrs []string) error {
+	err := errors.New("no servers configured")
+	for _, addr := range addrs {
+		if err = probeHealth(client, addr); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func probeHealth(client *http.Client, addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), readyProbeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/health", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s unreachable: %w", addr, err)
+	}
+	defer DrainAndClose(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", addr, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadyHandler(t *testing.T) {
+	var err error
+	handler := ReadyHandler(func() error { return err })
+
+	err = errors.New("no downstream reachable")
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	var body map[string]string
+	json.NewDecoder(recorder.Body).Decode(&body)
+	if recorder.Code != http.StatusServiceUnavailable || body["reason"] != "no downstream reachable" {
+		t.Errorf("failing check: %d %v, want 503 with the reason", recorder.Code, body)
+	}
+
+	err = nil
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("passing check: status %d, want 200", recorder.Code)
+	}
+}
+
+func TestProbeAny(t *testing.T) {
+	var up atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	if err := ProbeAny(server.Client(), []string{addr}); err == nil || !strings.Contains(err.Error(), "status 503") {
+		t.Errorf("unhealthy server: got %v", err)
+	}
+	up.Store(true)
+	if err := ProbeAny(server.Client(), []string{"127.0.0.1:1", addr}); err != nil {
+		t.Errorf("one healthy server: %v", err)
+	}
+	if err := ProbeAny(server.Client(), nil); err == nil {
+		t.Error("no servers reported ready")
+	}
+}
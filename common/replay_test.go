@@ -0,0 +1,77 @@
+package common
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReplayGuardRejectsStaleTimestamps(t *testing.T) {
+	guard := NewReplayGuard(time.Minute)
+
+	for _, offset := range []time.Duration{-2 * time.Minute, 2 * time.Minute} {
+		chunk := &Chunk{SessionID: "s", SequenceNum: 1, TotalChunks: 1, Timestamp: time.Now().Add(offset)}
+		if err := guard.Check(chunk); !errors.Is(err, ErrStaleChunk) {
+			t.Errorf("timestamp %v from now: got %v, want ErrStaleChunk", offset, err)
+		}
+	}
+}
+
+func TestReplayGuardRejectsDuplicatesWithinWindow(t *testing.T) {
+	guard := NewReplayGuard(time.Minute)
+	chunk := &Chunk{SessionID: "s", SequenceNum: 1, TotalChunks: 2, Timestamp: time.Now()}
+
+	if err := guard.Check(chunk); err != nil {
+		t.Fatalf("first copy: %v", err)
+	}
+	if err := guard.Check(chunk); !errors.Is(err, ErrReplayedChunk) {
+		t.Errorf("second copy: got %v, want ErrReplayedChunk", err)
+	}
+
+	next := &Chunk{SessionID: "s", SequenceNum: 2, TotalChunks: 2, Timestamp: time.Now()}
+	if err := guard.Check(next); err != nil {
+		t.Errorf("next chunk of the session: %v", err)
+	}
+}
+
+func TestReplayGuardTellsChunkTypesApart(t *testing.T) {
+	guard := NewReplayGuard(time.Minute)
+
+	handshake := &Chunk{SessionID: "s", SequenceNum: 0, TotalChunks: 1, ChunkType: ChunkTypeHandshake, Timestamp: time.Now()}
+	cancel := &Chunk{SessionID: "s", SequenceNum: 0, TotalChunks: 1, ChunkType: ChunkTypeCancel, Timestamp: time.Now()}
+	if err := guard.Check(handshake); err != nil {
+		t.Fatal(err)
+	}
+	if err := guard.Check(cancel); err != nil {
+		t.Errorf("cancel after handshake, both numbered 0: %v", err)
+	}
+}
+
+func TestReplayGuardCleanup(t *testing.T) {
+	guard := NewReplayGuard(time.Millisecond)
+	guard.Check(&Chunk{SessionID: "s", SequenceNum: 1, TotalChunks: 1, Timestamp: time.Now()})
+
+	time.Sleep(5 * time.Millisecond)
+	guard.Cleanup()
+	if guard.Size() != 0 {
+		t.Errorf("%d entries left after the window passed twice", guard.Size())
+	}
+}
+
+func TestCheckChunkAge(t *testing.T) {
+	tests := []struct {
+		age  time.Duration
+		ttl  time.Duration
+		want error
+	}{
+		{time.Second, time.Minute, nil},
+		{2 * time.Minute, time.Minute, ErrExpiredChunk},
+		{time.Hour, 0, nil},
+	}
+	for _, tt := range tests {
+		chunk := &Chunk{Timestamp: time.Now().Add(-tt.age)}
+		if err := CheckChunkAge(chunk, tt.ttl); !errors.Is(err, tt.want) {
+			t.Errorf("age %v, ttl %v: got %v, want %v", tt.age, tt.ttl, err, tt.want)
+		}
+	}
+}
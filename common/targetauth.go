@@ -0,0 +1,49 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTargetAuthUnsealed is returned for target credentials without a session
+// key to open them, as every hop could read them otherwise
+var ErrTargetAuthUnsealed = errors.New("target auth requires session keys")
+
+// SealTargetAuth encrypts credential, the Authorization value for the
+// target, into chunk.TargetAuth with the session key. Unlike headers, which
+// every hop can read and may log, only the central proxy can open it.
+func SealTargetAuth(chunk *Chunk, key []byte, credential string) error {
+	if key == nil {
+		return ErrTargetAuthUnsealed
+	}
+
+	sealed, err := EncryptAESWithAAD([]byte(credential), key, targetAuthAAD(chunk))
+	if err != nil {
+		return fmt.Errorf("target auth encryption failed: %w", err)
+	}
+	chunk.TargetAuth = sealed
+	return nil
+}
+
+// OpenTargetAuth decrypts the chunk's target credential, returning "" if it
+// carries none
+func OpenTargetAuth(chunk *Chunk, key []byte) (string, error) {
+	if len(chunk.TargetAuth) == 0 {
+		return "", nil
+	}
+	if key == nil {
+		return "", ErrTargetAuthUnsealed
+	}
+
+	credential, err := DecryptAESWithAAD(chunk.TargetAuth, key, targetAuthAAD(chunk))
+	if err != nil {
+		return "", fmt.Errorf("target auth decryption failed: %w", err)
+	}
+	return string(credential), nil
+}
+
+// targetAuthAAD binds the credential to its chunk, and keeps it from being
+// swapped with the chunk's data, which is sealed with the same key
+func targetAuthAAD(chunk *Chunk) []byte {
+	return append(chunk.AAD(), "\x00target_auth"...)
+}
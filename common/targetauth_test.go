@@ -0,0 +1,42 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestTargetAuthSealed(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	chunk := &Chunk{SessionID: "session", SequenceNum: 1, TotalChunks: 1}
+
+	if err := SealTargetAuth(chunk, key, "Bearer secret-token"); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(chunk.TargetAuth, []byte("secret-token")) {
+		t.Error("credential readable in the chunk")
+	}
+	if got, err := OpenTargetAuth(chunk, key); err != nil || got != "Bearer secret-token" {
+		t.Errorf("opened %q, %v", got, err)
+	}
+
+	// Bound to its chunk, and opened by the session key alone
+	moved := *chunk
+	moved.SessionID = "other"
+	if _, err := OpenTargetAuth(&moved, key); err == nil {
+		t.Error("credential opened on another session's chunk")
+	}
+	if _, err := OpenTargetAuth(chunk, bytes.Repeat([]byte{8}, 32)); err == nil {
+		t.Error("credential opened with the wrong key")
+	}
+}
+
+func TestTargetAuthNeedsSessionKey(t *testing.T) {
+	chunk := &Chunk{SessionID: "session", SequenceNum: 1, TotalChunks: 1}
+	if err := SealTargetAuth(chunk, nil, "Bearer secret-token"); !errors.Is(err, ErrTargetAuthUnsealed) {
+		t.Errorf("sealing without a key: %v", err)
+	}
+	if got, err := OpenTargetAuth(chunk, nil); got != "" || err != nil {
+		t.Errorf("chunk without a credential: %q, %v", got, err)
+	}
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"fmt"
+	rando "math/rand"
+	"strconv"
+	"strings"
+)
+
+// maxTemplateLength bounds the N of a {kind:N} placeholder
+const maxTemplateLength = 256
+
+const (
+	hexChars   = "0123456789abcdef"
+	alnumChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	digitChars = "0123456789"
+)
+
+// ExpandHeaderTemplate fills in a header value template. Text outside
+// braces is copied; each placeholder is replaced with a fresh random value:
+//
+//	{hex:N}      N hex digits
+//	{alnum:N}    N letters and digits
+//	{digits:N}   N decimal digits
+//	{uuid}       a version 4 UUID
+//	{choice:a|b} one of the listed values
+func ExpandHeaderTemplate(tmpl string) (string, error) {
+	var out strings.Builder
+
+	for {
+		open := strings.IndexByte(tmpl, '{')
+		if open < 0 {
+			out.WriteString(tmpl)
+			return out.String(), nil
+		}
+		end := strings.IndexByte(tmpl[open:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unclosed placeholder in %q", tmpl)
+		}
+
+		out.WriteString(tmpl[:open])
+		value, err := expandPlaceholder(tmpl[open+1 : open+end])
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(value)
+		tmpl = tmpl[open+end+1:]
+	}
+}
+
+// expandPlaceholder generates the value of one placeholder
+func expandPlaceholder(placeholder string) (string, error) {
+	kind, arg, _ := strings.Cut(placeholder, ":")
+
+	switch kind {
+	case "uuid":
+		b := []byte(randomHex(16))
+		b[12] = '4'
+		b[16] = "89ab"[rando.Intn(4)]
+		return fmt.Sprintf("%s-%s-%s-%s-%s", b[0:8], b[8:12], b[12:16], b[16:20], b[20:32]), nil
+	case "choice":
+		choices := strings.Split(arg, "|")
+		return choices[rando.Intn(len(choices))], nil
+	case "hex", "alnum", "digits":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > maxTemplateLength {
+			return "", fmt.Errorf("{%s} needs a length between 1 and %d", placeholder, maxTemplateLength)
+		}
+		chars := map[string]string{"hex": hexChars, "alnum": alnumChars, "digits": digitChars}[kind]
+		return randomString(chars, n), nil
+	default:
+		return "", fmt.Errorf("unknown placeholder {%s}", placeholder)
+	}
+}
+
+// randomString returns n characters drawn from chars
+func randomString(chars string, n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = chars[rando.Intn(len(chars))]
+	}
+	return string(b)
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestExpandHeaderTemplateFormat(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		{"req-{hex:12}", `^req-[0-9a-f]{12}$`},
+		{"session={alnum:20}; lang=en", `^session=[a-zA-Z0-9]{20}; lang=en$`},
+		{"{digits:6}", `^[0-9]{6}$`},
+		{"{uuid}", `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+		{"{choice:gzip|br|deflate}", `^(gzip|br|deflate)$`},
+		{"static", `^static$`},
+	}
+	for _, tt := range tests {
+		pattern := regexp.MustCompile(tt.want)
+		seen := make(map[string]bool)
+		for i := 0; i < 50; i++ {
+			value, err := ExpandHeaderTemplate(tt.tmpl)
+			if err != nil {
+				t.Fatalf("%q: %v", tt.tmpl, err)
+			}
+			if !pattern.MatchString(value) {
+				t.Fatalf("%q expanded to %q, not matching %s", tt.tmpl, value, tt.want)
+			}
+			seen[value] = true
+		}
+		if tt.tmpl != "static" && len(seen) < 2 {
+			t.Errorf("%q expanded to the same value 50 times", tt.tmpl)
+		}
+	}
+}
+
+func TestInvalidHeaderTemplates(t *testing.T) {
+	for _, tmpl := range []string{"{hex:0}", "{hex:999}", "{alnum:x}", "{unknown}", "open {hex:4"} {
+		if _, err := ExpandHeaderTemplate(tmpl); err == nil {
+			t.Errorf("%q accepted", tmpl)
+		}
+	}
+	if err := (ObfuscationConfig{HeaderTemplates: map[string]string{"X-Id": "{nope}"}}).Validate(); err == nil {
+		t.Error("config with an invalid header template accepted")
+	}
+}
+
+func TestObfuscatorExpandsTemplatesPerRequest(t *testing.T) {
+	obfuscator, err := NewObfuscator(ObfuscationConfig{HeaderTemplates: map[string]string{"X-Request-Id": "{uuid}"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "http://central/chunk", nil)
+		obfuscator.Obfuscate(req)
+		seen[req.Header.Get("X-Request-Id")] = true
+	}
+	if len(seen) != 10 {
+		t.Errorf("10 requests carried %d distinct X-Request-Id values", len(seen))
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"crypto/rand"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net/http"
 	"time"
 	rando "math/rand"
 )
@@ -22,6 +24,12 @@ type Chunk struct {
 	TargetURL    string    `json:"target_url"`
 	Method       string    `json:"method"`
 	Headers      map[string]string `json:"headers"`
+	KeyID        string            `json:"key_id,omitempty"` // keyring entry that encrypted Data
+	ChunkType    string            `json:"chunk_type,omitempty"` // data (default), control, handshake or stream
+	Compression  string            `json:"compression,omitempty"` // how Data was compressed before encryption
+	Deadline     time.Time         `json:"deadline,omitzero"`     // latency budget end; hops shorten their delays to meet it
+	TargetAuth   []byte            `json:"target_auth,omitempty"` // Authorization for the target, sealed with the session key
+	Checksum     uint32            `json:"checksum,omitempty"`    // CRC-32C of Data, set on encode and checked on decode
 }
 
 // ObfuscationConfig defines obfuscation settings
@@ -29,7 +37,21 @@ type ObfuscationConfig struct {
 	Type    string            `yaml:"type" json:"type"`
 	Headers map[string]string `yaml:"headers" json:"headers"`
 	Padding bool              `yaml:"padding" json:"padding"`
-	Jitter  int               `yaml:"jitter" json:"jitter"` // milliseconds
+	Jitter  int               `yaml:"jitter" json:"jitter"` // milliseconds, deprecated: same as jitter_max_ms
+
+	// Header values generated per use from templates (see
+	// ExpandHeaderTemplate), so successive chunks don't repeat them
+	HeaderTemplates map[string]string `yaml:"header_templates" json:"header_templates"`
+
+	// Random delay range in milliseconds and how delays are drawn from it
+	JitterMin          int    `yaml:"jitter_min_ms" json:"jitter_min_ms"`
+	JitterMax          int    `yaml:"jitter_max_ms" json:"jitter_max_ms"`
+	JitterDistribution string `yaml:"jitter_distribution" json:"jitter_distribution"` // uniform or exponential
+
+	// Domain fronting: connect to FrontDomain (a CDN edge) while the Host
+	// header names RealHost, the origin the CDN routes to
+	FrontDomain string `yaml:"front_domain" json:"front_domain"`
+	RealHost    string `yaml:"real_host" json:"real_host"`
 }
 
 // EncryptionConfig defines encryption settings
@@ -37,6 +59,24 @@ type EncryptionConfig struct {
 	Enabled   bool   `yaml:"enabled" json:"enabled"`
 	Algorithm string `yaml:"algorithm" json:"algorithm"`
 	Mode      string `yaml:"mode" json:"mode"` // "body_only" or "full_request"
+
+	// Keys maps key IDs to hex encoded 32-byte keys; ActiveKey selects the
+	// one used for encryption while the others remain valid for decryption
+	Keys      map[string]string `yaml:"keys" json:"-"`
+	ActiveKey string            `yaml:"active_key" json:"active_key"`
+
+	// Inline default key, hex or base64 encoded; decodes to 32 bytes
+	KeyHex string `yaml:"encryption_key_hex" json:"-"`
+	KeyB64 string `yaml:"encryption_key_b64" json:"-"`
+
+	// PreviousKeys are hex encoded keys tried in order when a chunk doesn't
+	// decrypt with the key it names, so senders still on an old untagged
+	// key keep working while a new one rolls out
+	PreviousKeys []string `yaml:"previous_keys" json:"-"`
+
+	// KeyPolicy decides what happens when encryption is enabled without a
+	// configured key: "warn" (default) or "strict"
+	KeyPolicy string `yaml:"key_policy" json:"key_policy"`
 }
 
 // ServerConfig common server configuration
@@ -52,14 +92,45 @@ type Session struct {
 	SessionID   string
 	Chunks      map[int]*Chunk
 	TotalChunks int
-	ReceivedAt  time.Time
+	ReceivedAt  time.Time // first chunk
+	LastChunkAt time.Time // most recent chunk
+	MaxSequence int       // highest data chunk sequence number received
 	TargetURL   string
 	Method      string
 	Headers     map[string]string
+	SessionKey  []byte // derived from the handshake when session keys are enabled
+
+	// Complete is set, under the lock guarding the session map, once every
+	// chunk is in and the session is handed off for processing. Chunk
+	// handlers must not change a complete session, so the processing
+	// goroutine can read it without locking.
+	Complete bool
+
+	// ContentLength is the body size announced by the response's control
+	// chunk, checked once the body is reassembled; -1 when unknown
+	ContentLength int64
+}
+
+// Expired reports why a session should be dropped at now: no chunk within
+// idle, or not complete within lifetime. It returns "" if neither applies.
+func (s *Session) Expired(now time.Time, idle, lifetime time.Duration) string {
+	if now.Sub(s.LastChunkAt) > idle {
+		return fmt.Sprintf("idle for %v", now.Sub(s.LastChunkAt).Round(time.Second))
+	}
+	if now.Sub(s.ReceivedAt) > lifetime {
+		return fmt.Sprintf("not complete after %v", now.Sub(s.ReceivedAt).Round(time.Second))
+	}
+	return ""
 }
 
 // EncryptAES encrypts data using AES-256-GCM
 func EncryptAES(plaintext []byte, key []byte) ([]byte, error) {
+	return EncryptAESWithAAD(plaintext, key, nil)
+}
+
+// EncryptAESWithAAD encrypts data using AES-256-GCM, authenticating aad
+// along with it; decryption must supply the same aad
+func EncryptAESWithAAD(plaintext []byte, key []byte, aad []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -75,12 +146,18 @@ func EncryptAES(plaintext []byte, key []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
+	ciphertext := gcm.Seal(nonce, nonce, plaintext, aad)
 	return ciphertext, nil
 }
 
 // DecryptAES decrypts data using AES-256-GCM
 func DecryptAES(ciphertext []byte, key []byte) ([]byte, error) {
+	return DecryptAESWithAAD(ciphertext, key, nil)
+}
+
+// DecryptAESWithAAD decrypts data encrypted by EncryptAESWithAAD. It fails
+// if aad differs from what was authenticated.
+func DecryptAESWithAAD(ciphertext []byte, key []byte, aad []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -97,7 +174,7 @@ func DecryptAES(ciphertext []byte, key []byte) ([]byte, error) {
 	}
 
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, aad)
 	if err != nil {
 		return nil, err
 	}
@@ -114,33 +191,136 @@ func GenerateSessionID() (string, error) {
 	return string(b), nil
 }
 
-// SerializeChunk converts chunk to JSON
+// SerializeChunk converts chunk to JSON, adding the checksum of its data
 func SerializeChunk(chunk *Chunk) ([]byte, error) {
-	return json.Marshal(chunk)
+	return json.Marshal(withChecksum(chunk))
 }
 
-// DeserializeChunk converts JSON to chunk
+// ErrInvalidChunk is returned for chunks that parse but lack required fields
+var ErrInvalidChunk = errors.New("invalid chunk")
+
+// DeserializeChunk converts JSON to chunk. It returns nil and an error for
+// malformed JSON, a chunk missing its session or chunk count, or one whose
+// data doesn't match its checksum.
 func DeserializeChunk(data []byte) (*Chunk, error) {
 	var chunk Chunk
-	err := json.Unmarshal(data, &chunk)
-	return &chunk, err
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return nil, err
+	}
+
+	if err := chunk.Validate(); err != nil {
+		return nil, err
+	}
+	if err := chunk.VerifyChecksum(); err != nil {
+		return nil, err
+	}
+
+	return &chunk, nil
 }
 
-// ApplyObfuscation adds obfuscation headers
-func ApplyObfuscation(headers map[string]string, config ObfuscationConfig) map[string]string {
-	obfuscated := make(map[string]string)
-	
-	// Copy original headers
+// AAD returns the chunk metadata authenticated with its encrypted data, so
+// ciphertext moved to another session or position fails to decrypt.
+// Compression is only appended when set.
+func (c *Chunk) AAD() []byte {
+	aad := fmt.Appendf(nil, "%s\x00%d\x00%d\x00%s", c.SessionID, c.SequenceNum, c.TotalChunks, c.ChunkType)
+	if c.Compression != "" {
+		aad = fmt.Appendf(aad, "\x00%s", c.Compression)
+	}
+	return aad
+}
+
+// Validate checks the fields every receiver relies on
+func (c *Chunk) Validate() error {
+	if c.SessionID == "" {
+		return fmt.Errorf("%w: missing session_id", ErrInvalidChunk)
+	}
+	if c.IsStream() {
+		if c.SequenceNum <= 0 || (c.TotalChunks != 0 && c.TotalChunks != c.SequenceNum) {
+			return fmt.Errorf("%w: stream chunk %d with total_chunks %d", ErrInvalidChunk, c.SequenceNum, c.TotalChunks)
+		}
+		return nil
+	}
+	if c.TotalChunks <= 0 {
+		return fmt.Errorf("%w: total_chunks must be positive, got %d", ErrInvalidChunk, c.TotalChunks)
+	}
+	if c.SequenceNum < 0 || c.SequenceNum > c.TotalChunks {
+		return fmt.Errorf("%w: sequence_num %d outside 0..%d", ErrInvalidChunk, c.SequenceNum, c.TotalChunks)
+	}
+	// Data is numbered from 1; sequence 0 is kept for chunks that stand
+	// apart from it
+	if c.SequenceNum == ControlSequence && !c.IsControl() && !c.IsError() &&
+		c.ChunkType != ChunkTypeHandshake && !c.IsCancel() {
+		return fmt.Errorf("%w: sequence_num 0 on a %q chunk", ErrInvalidChunk, c.ChunkType)
+	}
+	return nil
+}
+
+// DefaultMaxChunkSize is the largest chunk payload receivers accept by default
+const DefaultMaxChunkSize = 1 << 20
+
+// ErrChunkTooLarge is returned when a chunk exceeds the receiver's limit
+var ErrChunkTooLarge = errors.New("chunk too large")
+
+// DefaultMaxHeaderSize is the largest total size of request headers
+// accepted by default
+const DefaultMaxHeaderSize = 64 * 1024
+
+// ErrHeadersTooLarge is returned when headers exceed the receiver's limit
+var ErrHeadersTooLarge = errors.New("headers too large")
+
+// HeaderSize is the total length of all header names and values
+func HeaderSize(headers map[string]string) int {
+	size := 0
 	for k, v := range headers {
-		obfuscated[k] = v
+		size += len(k) + len(v)
 	}
-	
-	// Add obfuscation headers
+	return size
+}
+
+// CheckHeaderSize rejects header sets larger than maxSize bytes
+func CheckHeaderSize(headers map[string]string, maxSize int) error {
+	if size := HeaderSize(headers); size > maxSize {
+		return fmt.Errorf("%w: %d bytes exceeds limit of %d", ErrHeadersTooLarge, size, maxSize)
+	}
+	return nil
+}
+
+// ReadChunkBody reads a serialized chunk, refusing bodies that could not
+// hold a payload within maxData bytes (JSON base64 inflates data by 4/3)
+func ReadChunkBody(w http.ResponseWriter, r *http.Request, maxData int) ([]byte, error) {
+	limit := int64(maxData)*2 + 64*1024
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, ErrChunkTooLarge
+		}
+		return nil, err
+	}
+	return body, nil
+}
+
+// CheckChunkSize rejects chunks whose payload exceeds maxData bytes
+func CheckChunkSize(chunk *Chunk, maxData int) error {
+	if len(chunk.Data) > maxData {
+		return fmt.Errorf("%w: %d bytes exceeds limit of %d", ErrChunkTooLarge, len(chunk.Data), maxData)
+	}
+	return nil
+}
+
+// ApplyObfuscation sets the configured static and templated obfuscation
+// headers on a hop request's header
+func ApplyObfuscation(header http.Header, config ObfuscationConfig) {
 	for k, v := range config.Headers {
-		obfuscated[k] = v
+		header.Set(k, v)
+	}
+
+	// Templates were checked by Validate
+	for k, tmpl := range config.HeaderTemplates {
+		if v, err := ExpandHeaderTemplate(tmpl); err == nil {
+			header.Set(k, v)
+		}
 	}
-	
-	return obfuscated
 }
 
 // AddRandomPadding adds random padding to data
@@ -0,0 +1,128 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionIdleTimeout(t *testing.T) {
+	start := time.Now()
+	session := &Session{ReceivedAt: start, LastChunkAt: start}
+
+	if reason := session.Expired(start.Add(4*time.Second), 5*time.Second, time.Minute); reason != "" {
+		t.Errorf("expired before the idle timeout: %s", reason)
+	}
+	if reason := session.Expired(start.Add(6*time.Second), 5*time.Second, time.Minute); !strings.Contains(reason, "idle") {
+		t.Errorf("got %q, want an idle timeout", reason)
+	}
+}
+
+func TestSessionLifetime(t *testing.T) {
+	start := time.Now()
+	session := &Session{ReceivedAt: start}
+
+	// A transfer still making progress outlives the idle timeout...
+	for elapsed := time.Second; elapsed < 30*time.Second; elapsed += 4 * time.Second {
+		session.LastChunkAt = start.Add(elapsed)
+		if reason := session.Expired(start.Add(elapsed+time.Second), 5*time.Second, 30*time.Second); reason != "" {
+			t.Fatalf("progressing session expired after %v: %s", elapsed, reason)
+		}
+	}
+
+	// ...but not its total lifetime
+	session.LastChunkAt = start.Add(31 * time.Second)
+	if reason := session.Expired(start.Add(32*time.Second), 5*time.Second, 30*time.Second); !strings.Contains(reason, "not complete") {
+		t.Errorf("got %q, want the lifetime exceeded", reason)
+	}
+}
+
+func TestDeserializeMalformedChunk(t *testing.T) {
+	for _, data := range []string{"", "{", "not json", `{"session_id": 5}`} {
+		chunk, err := DeserializeChunk([]byte(data))
+		if err == nil {
+			t.Errorf("%q: no error", data)
+		}
+		if chunk != nil {
+			t.Errorf("%q: got a chunk alongside the error", data)
+		}
+	}
+}
+
+func TestDeserializeInvalidChunk(t *testing.T) {
+	tests := []struct {
+		json string
+		want string
+	}{
+		{`{"sequence_num": 1, "total_chunks": 1}`, "missing session_id"},
+		{`{"session_id": "s", "sequence_num": 1}`, "total_chunks must be positive"},
+		{`{"session_id": "s", "sequence_num": 3, "total_chunks": 2}`, "sequence_num 3 outside 0..2"},
+		{`{"session_id": "s", "sequence_num": 0, "total_chunks": 2}`, `sequence_num 0 on a "" chunk`},
+		{`{"session_id": "s", "sequence_num": 0, "total_chunks": 2, "chunk_type": "data"}`, `sequence_num 0 on a "data" chunk`},
+	}
+	for _, tt := range tests {
+		chunk, err := DeserializeChunk([]byte(tt.json))
+		if !errors.Is(err, ErrInvalidChunk) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.json, err, tt.want)
+		}
+		if chunk != nil {
+			t.Errorf("%s: got a chunk alongside the error", tt.json)
+		}
+	}
+
+	chunk, err := DeserializeChunk([]byte(`{"session_id": "s", "sequence_num": 1, "total_chunks": 1}`))
+	if err != nil || chunk.SessionID != "s" {
+		t.Errorf("valid chunk: got %+v, %v", chunk, err)
+	}
+	for _, chunkType := range []string{ChunkTypeControl, ChunkTypeHandshake, ChunkTypeCancel, ChunkTypeError} {
+		chunk := &Chunk{SessionID: "s", SequenceNum: ControlSequence, TotalChunks: 1, ChunkType: chunkType}
+		if err := chunk.Validate(); err != nil {
+			t.Errorf("%s chunk at sequence 0: %v", chunkType, err)
+		}
+	}
+}
+
+func TestAESWithAADBindsMetadata(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	chunk := &Chunk{SessionID: "s", SequenceNum: 2, TotalChunks: 3}
+	sealed, err := EncryptAESWithAAD([]byte("payload"), key, chunk.AAD())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plain, err := DecryptAESWithAAD(sealed, key, chunk.AAD()); err != nil || string(plain) != "payload" {
+		t.Fatalf("untouched metadata: got %q, %v", plain, err)
+	}
+
+	for name, tamper := range map[string]func(c *Chunk){
+		"sequence_num": func(c *Chunk) { c.SequenceNum = 1 },
+		"session_id":   func(c *Chunk) { c.SessionID = "other" },
+		"total_chunks": func(c *Chunk) { c.TotalChunks = 2 },
+		"chunk_type":   func(c *Chunk) { c.ChunkType = ChunkTypeControl },
+		"compression":  func(c *Chunk) { c.Compression = "gzip" },
+	} {
+		moved := *chunk
+		tamper(&moved)
+		if _, err := DecryptAESWithAAD(sealed, key, moved.AAD()); err == nil {
+			t.Errorf("decrypted with %s altered", name)
+		}
+	}
+}
+
+func TestKeyRingRejectsMovedCiphertext(t *testing.T) {
+	ring, err := NewKeyRing(map[string][]byte{"k": bytes.Repeat([]byte{7}, 32)}, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := &Chunk{SessionID: "s", SequenceNum: 2, TotalChunks: 3, Data: []byte("payload"), Timestamp: time.Now()}
+	if err := ring.EncryptChunk(chunk); err != nil {
+		t.Fatal(err)
+	}
+	chunk.SequenceNum = 3
+	if err := ring.DecryptChunk(chunk); err == nil {
+		t.Error("ciphertext moved to another position decrypted")
+	}
+}
@@ -0,0 +1,143 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Wire capture stages
+const (
+	CaptureWire      = "wire"      // encoded bytes as sent or received, after hop encryption
+	CapturePlaintext = "plaintext" // chunk before hop encryption or after decryption
+)
+
+// WireCapture enables capturing chunks for debugging. It is inlined into
+// component configs as wire_capture_dir and wire_capture_redact.
+type WireCapture struct {
+	Dir    string `yaml:"wire_capture_dir"`    // where captures are written, disabled if empty
+	Redact bool   `yaml:"wire_capture_redact"` // leave chunk data, headers and wire bytes out
+}
+
+// WireRecord is one captured chunk, written as a line of JSON
+type WireRecord struct {
+	Time      time.Time `json:"time"`
+	Role      string    `json:"role"`
+	Direction string    `json:"direction"` // in or out
+	Stage     string    `json:"stage"`     // CaptureWire or CapturePlaintext
+	Chunk     *Chunk    `json:"chunk,omitempty"`
+	DataSize  int       `json:"data_size"`
+	Wire      []byte    `json:"wire,omitempty"`
+	Error     string    `json:"error,omitempty"` // why a received chunk could not be decoded
+	Redacted  bool      `json:"redacted,omitempty"`
+}
+
+// WireTap writes every chunk a component encodes, decodes, encrypts or
+// decrypts to a capture file, so a developer can see exactly what crossed
+// the wire. Keys never appear in captures; with Redact set, payloads don't
+// either. A nil WireTap captures nothing.
+type WireTap struct {
+	role   string
+	redact bool
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewWireTap opens a capture file for role in config.Dir, or returns nil
+// when capture is disabled
+func NewWireTap(config WireCapture, role string) (*WireTap, error) {
+	if config.Dir == "" {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create wire capture directory: %w", err)
+	}
+
+	name := fmt.Sprintf("%s-%d.jsonl", role, os.Getpid())
+	file, err := os.OpenFile(filepath.Join(config.Dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wire capture file: %w", err)
+	}
+
+	log.Printf("WARNING: capturing chunks to %s, for debugging only", file.Name())
+	return &WireTap{role: role, redact: config.Redact, file: file}, nil
+}
+
+// Capture records chunk at stage. wire holds the encoded bytes for
+// CaptureWire and is nil otherwise.
+func (t *WireTap) Capture(direction, stage string, chunk *Chunk, wire []byte, captureErr error) {
+	if t == nil {
+		return
+	}
+
+	record := WireRecord{
+		Time:      time.Now(),
+		Role:      t.role,
+		Direction: direction,
+		Stage:     stage,
+		Wire:      wire,
+		Redacted:  t.redact,
+	}
+	if chunk != nil {
+		copied := *chunk
+		record.Chunk = &copied
+		record.DataSize = len(chunk.Data)
+	}
+	if captureErr != nil {
+		record.Error = captureErr.Error()
+	}
+
+	if t.redact {
+		record.Wire = nil
+		if record.Chunk != nil {
+			record.Chunk.Data = nil
+			record.Chunk.Headers = nil
+			record.Chunk.TargetAuth = nil
+		}
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Wire capture encoding error: %v", err)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Wire capture write error: %v", err)
+	}
+}
+
+// Codec wraps codec so every chunk it encodes or decodes is captured
+func (t *WireTap) Codec(codec ChunkCodec) ChunkCodec {
+	if t == nil {
+		return codec
+	}
+	return tapCodec{ChunkCodec: codec, tap: t}
+}
+
+type tapCodec struct {
+	ChunkCodec
+	tap *WireTap
+}
+
+func (c tapCodec) Encode(chunk *Chunk) ([]byte, error) {
+	data, err := c.ChunkCodec.Encode(chunk)
+	if err == nil {
+		c.tap.Capture("out", CaptureWire, chunk, data, nil)
+	}
+	return data, err
+}
+
+func (c tapCodec) Decode(data []byte) (*Chunk, error) {
+	chunk, err := c.ChunkCodec.Decode(data)
+	c.tap.Capture("in", CaptureWire, chunk, data, err)
+	return chunk, err
+}
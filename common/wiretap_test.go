@@ -0,0 +1,143 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// capturedRecords reads back every record written to the single capture
+// file in dir
+func capturedRecords(t *testing.T, dir string) []WireRecord {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("capture files %v, %v, want one", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records []WireRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var record WireRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("capture line %q: %v", scanner.Bytes(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// tappedRoundTrip sends a chunk through an encrypting key ring and a JSON
+// codec tapped by a capture in dir, and back
+func tappedRoundTrip(t *testing.T, capture WireCapture, key []byte) {
+	t.Helper()
+	tap, err := NewWireTap(capture, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyRing(map[string][]byte{"k1": key}, "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.SetWireTap(tap)
+	codec := tap.Codec(JSONCodec{})
+
+	chunk := &Chunk{
+		SessionID:   "session",
+		SequenceNum: 1,
+		TotalChunks: 1,
+		Data:        []byte("secret payload"),
+		Headers:     map[string]string{"Authorization": "Bearer token"},
+		Timestamp:   time.Now(),
+	}
+	if err := keys.EncryptChunk(chunk); err != nil {
+		t.Fatal(err)
+	}
+	wire, err := codec.Encode(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := codec.Decode(wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.DecryptChunk(received); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWireTapCapturesEachStage(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{0x42}, 32)
+	tappedRoundTrip(t, WireCapture{Dir: dir}, key)
+
+	records := capturedRecords(t, dir)
+	var stages []string
+	for _, record := range records {
+		stages = append(stages, record.Direction+" "+record.Stage)
+		if record.Role != "tester" || record.Time.IsZero() || record.Chunk == nil || record.Chunk.SessionID != "session" {
+			t.Errorf("record %+v lacks role, time or chunk", record)
+		}
+		switch record.Stage {
+		case CapturePlaintext:
+			if string(record.Chunk.Data) != "secret payload" {
+				t.Errorf("%s plaintext capture holds %q", record.Direction, record.Chunk.Data)
+			}
+		case CaptureWire:
+			if len(record.Wire) == 0 {
+				t.Errorf("%s wire capture without the encoded bytes", record.Direction)
+			}
+		}
+	}
+	want := []string{"out plaintext", "out wire", "in wire", "in plaintext"}
+	if len(stages) != len(want) {
+		t.Fatalf("captured %v, want %v", stages, want)
+	}
+	for i := range want {
+		if stages[i] != want[i] {
+			t.Errorf("captured %v, want %v", stages, want)
+			break
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	data, _ := os.ReadFile(files[0])
+	if bytes.Contains(data, []byte(hex.EncodeToString(key))) || bytes.Contains(data, key) {
+		t.Error("encryption key written to the capture")
+	}
+}
+
+func TestWireTapRedacts(t *testing.T) {
+	dir := t.TempDir()
+	tappedRoundTrip(t, WireCapture{Dir: dir, Redact: true}, bytes.Repeat([]byte{0x42}, 32))
+
+	for _, record := range capturedRecords(t, dir) {
+		if !record.Redacted || record.Wire != nil || record.Chunk.Data != nil || record.Chunk.Headers != nil {
+			t.Errorf("%s %s record not redacted: %+v", record.Direction, record.Stage, record)
+		}
+		if record.DataSize == 0 {
+			t.Errorf("%s %s record dropped the data size", record.Direction, record.Stage)
+		}
+	}
+}
+
+func TestWireTapDisabled(t *testing.T) {
+	tap, err := NewWireTap(WireCapture{}, "tester")
+	if tap != nil || err != nil {
+		t.Fatalf("got %v, %v, want no tap without wire_capture_dir", tap, err)
+	}
+	// A nil tap captures nothing and leaves the codec as it is
+	tap.Capture("out", CaptureWire, &Chunk{}, nil, nil)
+	if _, plain := tap.Codec(JSONCodec{}).(JSONCodec); !plain {
+		t.Error("nil tap wrapped the codec")
+	}
+}
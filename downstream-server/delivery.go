@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// DeliveryRetryConfig controls retries of chunks the client failed to accept
+type DeliveryRetryConfig struct {
+	MaxAttempts int `yaml:"max_attempts"` // attempts per chunk, including the first (default 3)
+	BaseDelay   int `yaml:"base_delay"`   // milliseconds, doubled per attempt (default 200)
+	MaxDelay    int `yaml:"max_delay"`    // milliseconds cap on a single backoff (default 2000)
+}
+
+// Validate checks the retry settings
+func (c DeliveryRetryConfig) Validate() error {
+	if c.MaxAttempts < 0 || c.BaseDelay < 0 || c.MaxDelay < 0 {
+		return errors.New("delivery_retry values must not be negative")
+	}
+	return nil
+}
+
+// errClientRejected marks a client answer that retrying won't change
+var errClientRejected = errors.New("client rejected chunk")
+
+// deliveryMetrics counts retried and abandoned deliveries to clients
+type deliveryMetrics struct {
+	Retries *common.Counter
+	Failed  *common.Counter
+}
+
+func newDeliveryMetrics(m *common.Metrics) *deliveryMetrics {
+	return &deliveryMetrics{
+		Retries: m.Counter("proxy_client_delivery_retries_total", "Response chunks sent to a client again after a failed attempt"),
+		Failed:  m.Counter("proxy_client_deliveries_failed_total", "Response chunks a client never accepted"),
+	}
+}
+
+// sendChunkToClient sends a response chunk, encoded by sealForClient, back
+// to the client. Connection errors and 5xx or 429 answers are retried with
+// jittered backoff, so a client that hiccups briefly doesn't lose the chunk.
+func (s *DownstreamServer) sendChunkToClient(chunk *common.Chunk, data []byte, clientAddr string) error {
+	var err error
+	retry := s.config.DeliveryRetry
+	for attempt := 0; attempt < retry.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			delay := common.RetryDelay(attempt, retry.BaseDelay, retry.MaxDelay)
+			log.Printf("Retrying chunk %d for session %s in %v (attempt %d/%d): %v",
+				chunk.SequenceNum, chunk.SessionID, delay, attempt+1, retry.MaxAttempts, err)
+			time.Sleep(delay)
+			s.delivery.Retries.Inc()
+		}
+
+		if err = s.sendOnce(data, clientAddr); err == nil {
+			log.Printf("Sent response chunk %d/%d to client", chunk.SequenceNum, chunk.TotalChunks)
+			return nil
+		}
+		if errors.Is(err, errClientRejected) {
+			break
+		}
+	}
+
+	s.delivery.Failed.Inc()
+	return fmt.Errorf("giving up on chunk %d: %w", chunk.SequenceNum, err)
+}
+
+// sendOnce makes a single attempt to post an encoded chunk to the client
+func (s *DownstreamServer) sendOnce(data []byte, clientAddr string) error {
+	url := fmt.Sprintf("http://%s/chunk", clientAddr)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", s.codec.ContentType())
+	if s.obfs != nil {
+		s.obfs.Obfuscate(req)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer common.DrainAndClose(resp)
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("client returned status %d", resp.StatusCode)
+	default:
+		return fmt.Errorf("%w: status %d", errClientRejected, resp.StatusCode)
+	}
+}
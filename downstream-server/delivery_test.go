@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// deliveryConfig retries deliveries to clients without waiting long
+const deliveryConfig = downstreamConfig + `
+delivery_retry:
+  max_attempts: 3
+  base_delay: 1
+  max_delay: 2
+`
+
+// flakyClient is a stub client answering its first failures requests with
+// status, then 200
+type flakyClient struct {
+	server   *httptest.Server
+	attempts atomic.Int32
+}
+
+func newFlakyClient(t *testing.T, failures int32, status int) *flakyClient {
+	t.Helper()
+	c := &flakyClient{}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.attempts.Add(1) <= failures {
+			http.Error(w, "not now", status)
+		}
+	}))
+	t.Cleanup(c.server.Close)
+	return c
+}
+
+func TestDeliveryRetriedAfterRejection(t *testing.T) {
+	client := newFlakyClient(t, 1, http.StatusServiceUnavailable)
+	server := newTestDownstream(t, deliveryConfig)
+
+	chunk := responseChunks("s", client.server.Listener.Addr().String(), []byte("body"), 8)[0]
+	data, err := server.sealForClient(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.sendChunkToClient(chunk, data, client.server.Listener.Addr().String()); err != nil {
+		t.Fatalf("delivery after one rejection: %v", err)
+	}
+	if got := client.attempts.Load(); got != 2 {
+		t.Errorf("client saw %d attempts, want 2", got)
+	}
+	if server.delivery.Retries.Value() != 1 || server.delivery.Failed.Value() != 0 {
+		t.Errorf("retries %d, failed %d, want 1 and 0", server.delivery.Retries.Value(), server.delivery.Failed.Value())
+	}
+}
+
+func TestDeliveryGivesUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		attempts int32
+	}{
+		{"unavailable", http.StatusServiceUnavailable, 3},
+		{"rejected", http.StatusBadRequest, 1},
+	}
+	for _, tt := range tests {
+		client := newFlakyClient(t, 100, tt.status)
+		server := newTestDownstream(t, deliveryConfig)
+		addr := client.server.Listener.Addr().String()
+
+		chunk := responseChunks(tt.name, addr, []byte("body"), 8)[0]
+		data, err := server.sealForClient(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		err = server.sendChunkToClient(chunk, data, addr)
+		if err == nil || !strings.Contains(err.Error(), "giving up on chunk 1") {
+			t.Errorf("%s: got %v, want the delivery abandoned", tt.name, err)
+		}
+		if got := client.attempts.Load(); got != tt.attempts {
+			t.Errorf("%s: client saw %d attempts, want %d", tt.name, got, tt.attempts)
+		}
+		if server.delivery.Failed.Value() != 1 {
+			t.Errorf("%s: failed counter %d, want 1", tt.name, server.delivery.Failed.Value())
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: gave up after %v", tt.name, elapsed)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// sendResponse posts a control chunk announcing length bytes, then the body
+// chunks, as a central proxy would
+func sendResponse(t *testing.T, s *DownstreamServer, chunks []*common.Chunk, length int64) {
+	t.Helper()
+	data, err := common.EncodeResponseMeta(&common.ResponseMeta{StatusCode: http.StatusOK, ContentLength: length})
+	if err != nil {
+		t.Fatal(err)
+	}
+	control := &common.Chunk{
+		SessionID:    chunks[0].SessionID,
+		SequenceNum:  common.ControlSequence,
+		TotalChunks:  chunks[0].TotalChunks,
+		ChunkType:    common.ChunkTypeControl,
+		Data:         data,
+		Timestamp:    time.Now(),
+		SourceClient: chunks[0].SourceClient,
+	}
+	for _, chunk := range append([]*common.Chunk{control}, chunks...) {
+		if rec := postChunk(t, s, chunk); rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d: status %d", chunk.SequenceNum, rec.Code)
+		}
+	}
+}
+
+func TestTruncatedResponseFailsLengthCheck(t *testing.T) {
+	client := newRecordingClient(t)
+	server := newTestDownstream(t, downstreamConfig)
+
+	chunks := responseChunks("truncated", client.addr(), []byte("twelve bytes"), 4)
+	chunks[2].Data = chunks[2].Data[:2]
+	sendResponse(t, server, chunks, 12)
+
+	got := client.waitFor(t, "truncated", func(chunks []*common.Chunk) bool {
+		return len(chunks) > 0 && chunks[len(chunks)-1].IsError()
+	})
+	report, err := common.DecodeErrorChunk(got[len(got)-1].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(report.Message, common.ErrLengthMismatch.Error()) || !strings.Contains(report.Message, "reassembled 10 bytes, expected 12") {
+		t.Errorf("notice %q, want the length mismatch", report.Message)
+	}
+	for _, chunk := range got {
+		if !chunk.IsControl() && !chunk.IsError() {
+			t.Errorf("truncated body chunk %d delivered", chunk.SequenceNum)
+		}
+	}
+}
+
+func TestLengthCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		cut    bool
+	}{
+		{"intact", downstreamConfig, false},
+		{"skipped", downstreamConfig + "skip_length_check: true\n", true},
+	}
+	for _, tt := range tests {
+		client := newRecordingClient(t)
+		server := newTestDownstream(t, tt.config)
+
+		chunks := responseChunks(tt.name, client.addr(), []byte("twelve bytes"), 4)
+		if tt.cut {
+			chunks[2].Data = chunks[2].Data[:2]
+		}
+		sendResponse(t, server, chunks, 12)
+
+		got := client.waitFor(t, tt.name, func(chunks []*common.Chunk) bool { return len(chunks) == 4 })
+		for _, chunk := range got {
+			if chunk.IsError() {
+				t.Errorf("%s: error chunk delivered", tt.name)
+			}
+		}
+	}
+}
@@ -1,63 +1,200 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/dudelovecamera/proxy-system/common"
-	"gopkg.in/yaml.v3"
 )
 
 // DownstreamConfig configuration for downstream server
 type DownstreamConfig struct {
-	ListenPort        int                      `yaml:"listen_port"`
-	Obfuscation       common.ObfuscationConfig `yaml:"obfuscation"`
-	Encryption        common.EncryptionConfig  `yaml:"encryption"`
-	EncryptionKey     []byte                   `yaml:"-"`
-	ReassemblyTimeout int                      `yaml:"reassembly_timeout"` // milliseconds
+	ListenPort         int                      `yaml:"listen_port"`
+	ListenAddress      string                   `yaml:"listen_address"` // interface to bind, all if empty
+	AdminToken         string                   `yaml:"admin_token"`    // enables POST /shutdown, disabled if empty
+	Obfuscation        common.ObfuscationConfig `yaml:"obfuscation"`
+	Encryption         common.EncryptionConfig  `yaml:"encryption"`
+	ReassemblyTimeout  int                      `yaml:"reassembly_timeout"`  // milliseconds, default for idle_timeout
+	IdleTimeout        int                      `yaml:"idle_timeout"`        // milliseconds without a chunk before a session is dropped
+	SessionLifetime    int                      `yaml:"session_lifetime"`    // milliseconds from first chunk before a session is dropped
+	CompletedRetention int                      `yaml:"completed_retention"` // milliseconds late chunks of a delivered session are discarded
+	MaxChunkSize       int                      `yaml:"max_chunk_size"`      // largest accepted chunk payload in bytes
+	ChunkTTL           int                      `yaml:"chunk_ttl"`           // milliseconds after a chunk was sent that it is dropped, 0 disables
+	SkipLengthCheck    bool                     `yaml:"skip_length_check"`   // deliver bodies whose size differs from the announced length
+	DeliveryRetry      DeliveryRetryConfig      `yaml:"delivery_retry"`      // retries of chunks the client failed to accept
+	PollBuffer         PollBufferConfig         `yaml:"poll_buffer"`         // undeliverable responses kept for /poll
+	ChunkCodec         string                   `yaml:"chunk_codec"`         // json or protobuf, must match every hop
+	Timeouts           common.HTTPTimeouts      `yaml:"timeouts"`            // outbound dial, TLS and response header timeouts
+	WireCapture        common.WireCapture       `yaml:",inline"`             // wire_capture_dir and wire_capture_redact, for debugging
 }
 
 // DownstreamServer handles response chunks and delivers to clients
 type DownstreamServer struct {
-	config   DownstreamConfig
-	sessions map[string]*common.Session
-	mu       sync.RWMutex
-	client   *http.Client
+	config     DownstreamConfig
+	sessions   map[string]*common.Session
+	mu         sync.RWMutex
+	client     *http.Client
+	obfs       common.Obfuscator
+	keys       *common.KeyRing
+	codec      common.ChunkCodec
+	metrics    *common.Metrics
+	loss       *common.LossMetrics
+	delivery   *deliveryMetrics
+	poll       *pollBuffer // nil unless poll_buffer is enabled
+	completed  *common.CompletedSessions
+	httpServer *http.Server
+}
+
+// loadDownstreamConfig reads and validates the config file, with settings
+// overridden by PROXY_DOWNSTREAM_* environment variables
+func loadDownstreamConfig(configPath string) (DownstreamConfig, error) {
+	return common.LoadConfig(configPath, "PROXY_DOWNSTREAM", setDownstreamDefaults)
+}
+
+// setDownstreamDefaults fills in settings left unset
+func setDownstreamDefaults(config *DownstreamConfig) {
+	if config.ReassemblyTimeout == 0 {
+		config.ReassemblyTimeout = 60000 // 60 seconds default
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = config.ReassemblyTimeout
+	}
+	if config.SessionLifetime == 0 {
+		config.SessionLifetime = 600000 // 10 minutes default
+	}
+	if config.CompletedRetention == 0 {
+		config.CompletedRetention = 120000 // 2 minutes default
+	}
+	if config.MaxChunkSize == 0 {
+		config.MaxChunkSize = common.DefaultMaxChunkSize
+	}
+	if config.DeliveryRetry.MaxAttempts == 0 {
+		config.DeliveryRetry.MaxAttempts = 3
+	}
+	if config.DeliveryRetry.BaseDelay == 0 {
+		config.DeliveryRetry.BaseDelay = 200
+	}
+	if config.DeliveryRetry.MaxDelay == 0 {
+		config.DeliveryRetry.MaxDelay = 2000
+	}
+	if config.PollBuffer.MaxEntries == 0 {
+		config.PollBuffer.MaxEntries = 1000
+	}
+	if config.PollBuffer.MaxBytes == 0 {
+		config.PollBuffer.MaxBytes = 64 << 20
+	}
+	if config.PollBuffer.TTL == 0 {
+		config.PollBuffer.TTL = 60000
+	}
+}
+
+// Validate reports every problem with the configuration
+func (c DownstreamConfig) Validate() error {
+	var errs []error
+
+	if c.ListenPort <= 0 || c.ListenPort > 65535 {
+		errs = append(errs, fmt.Errorf("listen_port must be between 1 and 65535, got %d", c.ListenPort))
+	}
+	if c.ReassemblyTimeout < 0 {
+		errs = append(errs, fmt.Errorf("reassembly_timeout must not be negative, got %d", c.ReassemblyTimeout))
+	}
+	if c.IdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("idle_timeout must not be negative, got %d", c.IdleTimeout))
+	}
+	if c.SessionLifetime < 0 {
+		errs = append(errs, fmt.Errorf("session_lifetime must not be negative, got %d", c.SessionLifetime))
+	}
+	if c.CompletedRetention < 0 {
+		errs = append(errs, fmt.Errorf("completed_retention must not be negative, got %d", c.CompletedRetention))
+	}
+	if c.MaxChunkSize < 0 {
+		errs = append(errs, fmt.Errorf("max_chunk_size must not be negative, got %d", c.MaxChunkSize))
+	}
+	if c.ChunkTTL < 0 {
+		errs = append(errs, fmt.Errorf("chunk_ttl must not be negative, got %d", c.ChunkTTL))
+	}
+	if c.Obfuscation.Type != "" {
+		if err := c.Obfuscation.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := c.Encryption.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.DeliveryRetry.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.PollBuffer.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := common.NewChunkCodec(c.ChunkCodec); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.Timeouts.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
 }
 
 // NewDownstreamServer creates a new downstream server instance
 func NewDownstreamServer(configPath string) (*DownstreamServer, error) {
-	data, err := os.ReadFile(configPath)
+	config, err := loadDownstreamConfig(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config: %w", err)
+		return nil, err
 	}
 
-	var config DownstreamConfig
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config: %w", err)
+	keys, err := common.NewKeyRingFromConfig(config.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption keys: %w", err)
 	}
 
-	if config.ReassemblyTimeout == 0 {
-		config.ReassemblyTimeout = 60000 // 60 seconds default
+	// Already checked by Validate
+	codec, _ := common.NewChunkCodec(config.ChunkCodec)
+
+	// Capture chunks for debugging when wire_capture_dir is set
+	tap, err := common.NewWireTap(config.WireCapture, "downstream")
+	if err != nil {
+		return nil, err
+	}
+	codec = tap.Codec(codec)
+	keys.SetWireTap(tap)
+
+	var obfs common.Obfuscator
+	if config.Obfuscation.Type != "" {
+		obfs, err = common.NewObfuscator(config.Obfuscation)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Generate or load encryption key
-	config.EncryptionKey = make([]byte, 32)
-	copy(config.EncryptionKey, []byte("your-32-byte-encryption-key-here"))
+	metrics := common.NewMetrics()
 
 	server := &DownstreamServer{
-		config:   config,
-		sessions: make(map[string]*common.Session),
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+		config:     config,
+		httpServer: &http.Server{},
+		obfs:       obfs,
+		keys:       keys,
+		codec:      codec,
+		metrics:    metrics,
+		loss:       common.NewLossMetrics(metrics),
+		delivery:   newDeliveryMetrics(metrics),
+		sessions:   make(map[string]*common.Session),
+		completed:  common.NewCompletedSessions(time.Duration(config.CompletedRetention) * time.Millisecond),
+		client:     common.NewHTTPClient(30*time.Second, config.Timeouts),
+	}
+
+	if config.PollBuffer.Enabled {
+		server.poll = newPollBuffer(config.PollBuffer, newPollMetrics(metrics))
 	}
 
 	// Start session cleanup
@@ -73,50 +210,101 @@ func (s *DownstreamServer) handleChunk(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
+	body, err := common.ReadChunkBody(w, r, s.config.MaxChunkSize)
 	if err != nil {
+		if errors.Is(err, common.ErrChunkTooLarge) {
+			http.Error(w, "Chunk too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Failed to read body", http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
 
-	chunk, err := common.DeserializeChunk(body)
+	chunk, err := s.codec.Decode(body)
 	if err != nil {
 		http.Error(w, "Invalid chunk format", http.StatusBadRequest)
+		log.Printf("Error deserializing chunk: %v", err)
+		return
+	}
+
+	// Reject oversized chunks before doing any work on them
+	if err := common.CheckChunkSize(chunk, s.config.MaxChunkSize); err != nil {
+		http.Error(w, "Chunk too large", http.StatusRequestEntityTooLarge)
+		log.Printf("Rejected chunk %d for session %s: %v", chunk.SequenceNum, chunk.SessionID, err)
+		return
+	}
+
+	// Drop chunks that spent too long in buffers or retries
+	if err := common.CheckChunkAge(chunk, time.Duration(s.config.ChunkTTL)*time.Millisecond); err != nil {
+		http.Error(w, "Chunk expired", http.StatusGone)
+		log.Printf("Rejected chunk %d for session %s: %v", chunk.SequenceNum, chunk.SessionID, err)
 		return
 	}
 
 	// Decrypt if enabled
 	if s.config.Encryption.Enabled {
-		decrypted, err := common.DecryptAES(chunk.Data, s.config.EncryptionKey)
-		if err != nil {
+		if err := s.keys.DecryptChunk(chunk); err != nil {
 			http.Error(w, "Decryption failed", http.StatusInternalServerError)
 			log.Printf("Decryption error: %v", err)
 			return
 		}
-		chunk.Data = decrypted
 	}
 
 	log.Printf("Downstream received chunk %d/%d for session %s",
 		chunk.SequenceNum, chunk.TotalChunks, chunk.SessionID)
 
-	// Add to session
+	// Control, error and stream chunks are not reassembled; pass them on
+	// before acknowledging so they reach the client in the order they were
+	// sent
+	if chunk.IsControl() || chunk.IsError() || chunk.IsStream() {
+		if chunk.IsControl() {
+			s.expectLength(chunk)
+		}
+		if err := s.forwardChunk(chunk, chunk.SourceClient); err != nil {
+			http.Error(w, "Failed to deliver chunk", http.StatusBadGateway)
+			log.Printf("Failed to send %s chunk for session %s: %v", chunk.ChunkType, chunk.SessionID, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Chunk delivered"))
+		return
+	}
+
+	// Add to session. A session still being delivered may outlive its entry
+	// in completed, so both are checked.
 	s.mu.Lock()
 	session, exists := s.sessions[chunk.SessionID]
+	if s.completed.Contains(chunk.SessionID) || (exists && session.Complete) {
+		s.mu.Unlock()
+		log.Printf("Discarding late chunk %d for delivered session %s", chunk.SequenceNum, chunk.SessionID)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Session already delivered"))
+		return
+	}
+
 	if !exists {
 		session = &common.Session{
-			SessionID:   chunk.SessionID,
-			Chunks:      make(map[int]*common.Chunk),
-			TotalChunks: chunk.TotalChunks,
-			ReceivedAt:  time.Now(),
+			SessionID:     chunk.SessionID,
+			Chunks:        make(map[int]*common.Chunk),
+			TotalChunks:   chunk.TotalChunks,
+			ReceivedAt:    time.Now(),
+			ContentLength: -1,
 		}
 		s.sessions[chunk.SessionID] = session
 	}
+	s.loss.Observe(session, chunk.SequenceNum)
 	session.Chunks[chunk.SequenceNum] = chunk
+	session.LastChunkAt = time.Now()
+	complete := len(session.Chunks) == session.TotalChunks
+	if complete {
+		session.Complete = true
+		s.completed.Add(chunk.SessionID)
+	}
 	s.mu.Unlock()
 
 	// Check if we have all chunks
-	if len(session.Chunks) == session.TotalChunks {
+	if complete {
 		go s.deliverToClient(session)
 	}
 
@@ -124,10 +312,18 @@ func (s *DownstreamServer) handleChunk(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Chunk received"))
 }
 
-// deliverToClient reassembles response and sends to client
+// deliverToClient reassembles response and sends to client. The session is
+// complete, so nothing else writes to it.
 func (s *DownstreamServer) deliverToClient(session *common.Session) {
 	log.Printf("Session %s complete, delivering to client", session.SessionID)
 
+	// Cleanup session
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, session.SessionID)
+		s.mu.Unlock()
+	}()
+
 	// Get client address from first chunk
 	clientAddr := session.Chunks[1].SourceClient
 	if clientAddr == "" {
@@ -135,6 +331,12 @@ func (s *DownstreamServer) deliverToClient(session *common.Session) {
 		return
 	}
 
+	if err := s.checkLength(session); err != nil {
+		log.Printf("Not delivering session %s: %v", session.SessionID, err)
+		s.notifyIncomplete(session, err.Error())
+		return
+	}
+
 	// Send each chunk back to client
 	for i := 1; i <= session.TotalChunks; i++ {
 		chunk, exists := session.Chunks[i]
@@ -143,65 +345,92 @@ func (s *DownstreamServer) deliverToClient(session *common.Session) {
 			continue
 		}
 
-		// Apply obfuscation if configured
-		if s.config.Obfuscation.Type != "" {
-			chunk.Headers = common.ApplyObfuscation(chunk.Headers, s.config.Obfuscation)
-		}
-
-		// Re-encrypt for client if needed
-		if s.config.Encryption.Enabled {
-			encrypted, err := common.EncryptAES(chunk.Data, s.config.EncryptionKey)
-			if err != nil {
-				log.Printf("Encryption error: %v", err)
-				continue
-			}
-			chunk.Data = encrypted
+		data, err := s.sealForClient(chunk)
+		if err == nil {
+			err = s.sendChunkToClient(chunk, data, clientAddr)
 		}
-
-		// Send chunk to client
-		if err := s.sendChunkToClient(chunk, clientAddr); err != nil {
+		if err != nil {
 			log.Printf("Failed to send chunk %d to client: %v", i, err)
+			// The client would otherwise wait out its timeout for this chunk.
+			// A buffered response is still announced, so it knows to poll.
+			message := fmt.Sprintf("response chunk %d could not be delivered: %v", i, err)
+			if s.poll != nil && data != nil && s.bufferForPoll(session, i, data) {
+				s.notifyClient(session, &common.ErrorChunk{
+					Code:     http.StatusServiceUnavailable,
+					Message:  message + "; buffered for polling",
+					Hop:      "downstream",
+					Buffered: true,
+				})
+				return
+			}
+			s.notifyIncomplete(session, message)
+			return
 		}
 	}
 
 	log.Printf("All %d chunks sent back to client %s", session.TotalChunks, clientAddr)
-
-	// Cleanup session
-	s.mu.Lock()
-	delete(s.sessions, session.SessionID)
-	s.mu.Unlock()
 }
 
-// sendChunkToClient sends a response chunk back to the client
-func (s *DownstreamServer) sendChunkToClient(chunk *common.Chunk, clientAddr string) error {
-	data, err := common.SerializeChunk(chunk)
-	if err != nil {
-		return err
+// forwardChunk obfuscates and re-encrypts a chunk and sends it to the client
+func (s *DownstreamServer) forwardChunk(chunk *common.Chunk, clientAddr string) error {
+	if clientAddr == "" {
+		return fmt.Errorf("no client address for session %s", chunk.SessionID)
 	}
 
-	url := fmt.Sprintf("http://%s/chunk", clientAddr)
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	data, err := s.sealForClient(chunk)
 	if err != nil {
 		return err
 	}
+	return s.sendChunkToClient(chunk, data, clientAddr)
+}
 
-	req.Header.Set("Content-Type", "application/json")
+// sealForClient re-encrypts a chunk and encodes it for the client
+func (s *DownstreamServer) sealForClient(chunk *common.Chunk) ([]byte, error) {
+	// Re-encrypt for client if needed
+	if s.config.Encryption.Enabled {
+		if err := s.keys.EncryptChunk(chunk); err != nil {
+			return nil, fmt.Errorf("encryption error: %w", err)
+		}
+	}
 
-	resp, err := s.client.Do(req)
-	if err != nil {
-		return err
+	return s.codec.Encode(chunk)
+}
+
+// bufferForPoll keeps the chunks of a session from first on, the first
+// already sealed as data, for its client to fetch from /poll. It reports
+// whether they were kept.
+func (s *DownstreamServer) bufferForPoll(session *common.Session, first int, data []byte) bool {
+	chunks := [][]byte{data}
+	for i := first + 1; i <= session.TotalChunks; i++ {
+		chunk, exists := session.Chunks[i]
+		if !exists {
+			continue
+		}
+		sealed, err := s.sealForClient(chunk)
+		if err != nil {
+			log.Printf("Failed to buffer chunk %d of session %s: %v", i, session.SessionID, err)
+			return false
+		}
+		chunks = append(chunks, sealed)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("client returned status %d", resp.StatusCode)
+	if !s.poll.Put(session.SessionID, chunks) {
+		log.Printf("Response for session %s is too large to buffer for polling", session.SessionID)
+		return false
 	}
+	log.Printf("Buffered %d chunks of session %s for polling", len(chunks), session.SessionID)
+	return true
+}
 
-	log.Printf("Sent response chunk %d/%d to client", chunk.SequenceNum, chunk.TotalChunks)
-	return nil
+// pollResponse is the answer to /poll: a session's remaining response
+// chunks, each encoded as it would have been posted to the client
+type pollResponse struct {
+	SessionID string   `json:"session_id"`
+	Chunks    [][]byte `json:"chunks"`
 }
 
-// handleClientPoll allows clients to retrieve assembled responses
+// handleClientPoll hands a client the response chunks that could not be
+// pushed to it, once; 404 if none are buffered for the session
 func (s *DownstreamServer) handleClientPoll(w http.ResponseWriter, r *http.Request) {
 	sessionID := r.URL.Query().Get("session_id")
 	if sessionID == "" {
@@ -209,63 +438,232 @@ func (s *DownstreamServer) handleClientPoll(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// In production, retrieve from cache/queue
-	// For now, return a placeholder
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Response data would be here"))
+	if s.poll == nil {
+		http.Error(w, "Polling not enabled", http.StatusNotFound)
+		return
+	}
+
+	chunks, exists := s.poll.Take(sessionID)
+	if !exists {
+		http.Error(w, "No buffered response", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pollResponse{SessionID: sessionID, Chunks: chunks})
 }
 
-// cleanupSessions removes expired sessions
+// cleanupSessions removes expired sessions and tells their clients. It runs
+// often enough that short timeouts fire close to when they are due.
 func (s *DownstreamServer) cleanupSessions() {
-	ticker := time.NewTicker(30 * time.Second)
+	idle := time.Duration(s.config.IdleTimeout) * time.Millisecond
+	ticker := time.NewTicker(min(30*time.Second, max(idle/4, time.Second)))
 	defer ticker.Stop()
 
-	timeout := time.Duration(s.config.ReassemblyTimeout) * time.Millisecond
-
 	for range ticker.C {
-		s.mu.Lock()
-		now := time.Now()
-		for sessionID, session := range s.sessions {
-			if now.Sub(session.ReceivedAt) > timeout {
-				log.Printf("Session %s timed out", sessionID)
-				delete(s.sessions, sessionID)
+		s.expireSessions(time.Now())
+
+		s.completed.Cleanup()
+		if s.poll != nil {
+			s.poll.Expire()
+		}
+	}
+}
+
+// expireSessions drops sessions idle or incomplete for too long at now and
+// notifies their clients
+func (s *DownstreamServer) expireSessions(now time.Time) {
+	idle := time.Duration(s.config.IdleTimeout) * time.Millisecond
+	lifetime := time.Duration(s.config.SessionLifetime) * time.Millisecond
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sessionID, session := range s.sessions {
+		if session.Complete {
+			continue // removed once delivered
+		}
+		if reason := session.Expired(now, idle, lifetime); reason != "" {
+			log.Printf("Session %s timed out: %s", sessionID, reason)
+			s.loss.Expire(session)
+			delete(s.sessions, sessionID)
+			// The client is told it failed, so later chunks can't revive it
+			s.completed.Add(sessionID)
+			if len(session.Chunks) > 0 {
+				go s.notifyIncomplete(session, fmt.Sprintf("downstream reassembly timed out (%s) with %d/%d response chunks",
+					reason, len(session.Chunks), session.TotalChunks))
 			}
 		}
-		s.mu.Unlock()
 	}
 }
 
+// notifyIncomplete sends the client of a session that can't be delivered,
+// as it timed out during reassembly, failed checkLength or a chunk of it
+// was never accepted, an error chunk, so it fails at once instead of
+// waiting for its own timeout. The session is no longer written to by
+// anything else.
+func (s *DownstreamServer) notifyIncomplete(session *common.Session, message string) {
+	var missing []int
+	for i := 1; i <= session.TotalChunks; i++ {
+		if _, exists := session.Chunks[i]; !exists {
+			missing = append(missing, i)
+		}
+	}
+
+	s.notifyClient(session, &common.ErrorChunk{
+		Code:    http.StatusGatewayTimeout,
+		Message: message,
+		Hop:     "downstream",
+		Missing: missing,
+	})
+}
+
+// notifyClient sends the client of a session the error chunk reporting e
+func (s *DownstreamServer) notifyClient(session *common.Session, e *common.ErrorChunk) {
+	var clientAddr string
+	for _, chunk := range session.Chunks {
+		clientAddr = chunk.SourceClient
+		break
+	}
+
+	chunk, err := common.NewErrorChunk(session.SessionID, clientAddr, e)
+	if err != nil {
+		log.Printf("Failed to encode notice for session %s: %v", session.SessionID, err)
+		return
+	}
+	if err := s.forwardChunk(chunk, clientAddr); err != nil {
+		log.Printf("Failed to notify client of session %s: %v", session.SessionID, err)
+	}
+}
+
+// expectLength records the body size a response's control chunk announces,
+// for checkLength. Control chunks sealed with a session key and streams
+// announce nothing the downstream can check.
+func (s *DownstreamServer) expectLength(chunk *common.Chunk) {
+	if s.config.SkipLengthCheck {
+		return
+	}
+
+	meta, err := common.DecodeResponseMeta(chunk.Data)
+	if err != nil || meta.Stream || meta.ContentLength < 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.completed.Contains(chunk.SessionID) {
+		return
+	}
+	session, exists := s.sessions[chunk.SessionID]
+	if !exists {
+		session = &common.Session{
+			SessionID:   chunk.SessionID,
+			Chunks:      make(map[int]*common.Chunk),
+			TotalChunks: chunk.TotalChunks,
+			ReceivedAt:  time.Now(),
+			LastChunkAt: time.Now(),
+		}
+		s.sessions[chunk.SessionID] = session
+	}
+	session.ContentLength = meta.ContentLength
+}
+
+// checkLength compares a complete session's body with the length its
+// control chunk announced. Compressed chunks can't be measured without
+// decompressing them, so those sessions pass.
+func (s *DownstreamServer) checkLength(session *common.Session) error {
+	if session.ContentLength < 0 {
+		return nil
+	}
+
+	var length int64
+	for _, chunk := range session.Chunks {
+		if chunk.Compression != "" {
+			return nil
+		}
+		length += int64(len(chunk.Data))
+	}
+
+	if length != session.ContentLength {
+		return fmt.Errorf("%w: reassembled %d bytes, expected %d", common.ErrLengthMismatch, length, session.ContentLength)
+	}
+	return nil
+}
+
 // healthCheck endpoint
 func (s *DownstreamServer) healthCheck(w http.ResponseWriter, r *http.Request) {
 	s.mu.RLock()
 	sessionCount := len(s.sessions)
 	s.mu.RUnlock()
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":          "healthy",
-		"role":            "downstream",
-		"active_sessions": sessionCount,
-		"time":            time.Now().Format(time.RFC3339),
-	})
+	extra := map[string]any{
+		"active_sessions":  sessionCount,
+		"completed_recent": s.completed.Size(),
+	}
+	if s.poll != nil {
+		extra["poll_buffered"], extra["poll_buffered_bytes"] = s.poll.Stats()
+	}
+	common.WriteHealth(w, common.NewHealthInfo("downstream", extra))
+}
+
+// ready always passes: clients are only known once their chunks arrive, so
+// serving requests is all the downstream server needs
+func (s *DownstreamServer) ready() error {
+	return nil
 }
 
 // Start begins the downstream server
 func (s *DownstreamServer) Start() error {
-	http.HandleFunc("/chunk", s.handleChunk)
-	http.HandleFunc("/poll", s.handleClientPoll)
-	http.HandleFunc("/health", s.healthCheck)
-
-	addr := fmt.Sprintf(":%d", s.config.ListenPort)
+	addr := common.ListenAddr(s.config.ListenAddress, s.config.ListenPort)
 	log.Printf("Downstream server starting on %s", addr)
 
-	return http.ListenAndServe(addr, nil)
+	s.httpServer.Addr = addr
+	s.httpServer.Handler = s.Handler()
+	if err := s.httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	log.Printf("Downstream server stopped")
+	return nil
+}
+
+// Shutdown stops accepting requests and waits for in-flight ones
+func (s *DownstreamServer) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// Handler returns the server's routes, for serving or in-process wiring
+func (s *DownstreamServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chunk", s.handleChunk)
+	mux.HandleFunc("/poll", s.handleClientPoll)
+	mux.HandleFunc("/health", s.healthCheck)
+	mux.HandleFunc("/ready", common.ReadyHandler(s.ready))
+	mux.Handle("/metrics", s.metrics)
+	if s.config.AdminToken != "" {
+		mux.HandleFunc("/shutdown", common.ShutdownHandler(s.config.AdminToken, s))
+	}
+	return mux
+}
+
+// SetTransport replaces the transport used to reach clients
+func (s *DownstreamServer) SetTransport(rt http.RoundTripper) {
+	s.client.Transport = rt
 }
 
 func main() {
+	check := flag.Bool("check", false, "Validate the config file and exit")
+	flag.Parse()
+
 	configPath := "config/downstream.yaml"
-	if len(os.Args) > 1 {
-		configPath = os.Args[1]
+	if flag.NArg() > 0 {
+		configPath = flag.Arg(0)
+	}
+
+	if *check {
+		_, err := loadDownstreamConfig(configPath)
+		common.ReportConfigCheck(configPath, err)
 	}
 
 	server, err := NewDownstreamServer(configPath)
@@ -273,6 +671,8 @@ func main() {
 		log.Fatalf("Failed to create server: %v", err)
 	}
 
+	common.ShutdownOnSignal(server)
+
 	if err := server.Start(); err != nil {
 		log.Fatalf("Server error: %v", err)
 	}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// writeConfig writes a YAML config to a temporary file and returns its path
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "downstream.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestDownstream builds a downstream server from yaml
+func newTestDownstream(t *testing.T, yaml string) *DownstreamServer {
+	t.Helper()
+	server, err := NewDownstreamServer(writeConfig(t, yaml))
+	if err != nil {
+		t.Fatalf("NewDownstreamServer: %v", err)
+	}
+	return server
+}
+
+// downstreamConfig is a config for tests against a recordingClient
+const downstreamConfig = `
+listen_port: 9001
+encryption:
+  enabled: false
+`
+
+// responseChunks fragments a response for the client at clientAddr into
+// chunks of size bytes as a central proxy would, without encryption
+func responseChunks(session, clientAddr string, body []byte, size int) []*common.Chunk {
+	pieces := common.SplitData(body, size)
+	chunks := make([]*common.Chunk, len(pieces))
+	for i, piece := range pieces {
+		chunks[i] = &common.Chunk{
+			SessionID:    session,
+			SequenceNum:  i + 1,
+			TotalChunks:  len(pieces),
+			Data:         piece,
+			Timestamp:    time.Now(),
+			SourceClient: clientAddr,
+		}
+	}
+	return chunks
+}
+
+// postChunk sends chunk to the server's /chunk handler as a central proxy
+// would
+func postChunk(t *testing.T, s *DownstreamServer, chunk *common.Chunk) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := s.codec.Encode(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	s.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/chunk", bytes.NewReader(data)))
+	return recorder
+}
+
+// recordingClient is a stub client keeping every chunk delivered to it and
+// answering with status
+type recordingClient struct {
+	server *httptest.Server
+	status int
+
+	mu     sync.Mutex
+	chunks []*common.Chunk
+}
+
+func newRecordingClient(t *testing.T) *recordingClient {
+	t.Helper()
+	c := &recordingClient{status: http.StatusOK}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		chunk, err := common.DeserializeChunk(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		c.mu.Lock()
+		c.chunks = append(c.chunks, chunk)
+		status := c.status
+		c.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(c.server.Close)
+	return c
+}
+
+// addr is the client's host:port as carried in SourceClient
+func (c *recordingClient) addr() string {
+	return c.server.Listener.Addr().String()
+}
+
+// received returns the chunks of session delivered so far
+func (c *recordingClient) received(session string) []*common.Chunk {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var chunks []*common.Chunk
+	for _, chunk := range c.chunks {
+		if chunk.SessionID == session {
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
+
+// waitFor waits until done reports true of the chunks of session, failing
+// the test after a few seconds
+func (c *recordingClient) waitFor(t *testing.T, session string, done func([]*common.Chunk) bool) []*common.Chunk {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		chunks := c.received(session)
+		if done(chunks) {
+			return chunks
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gave up waiting for session %s, have %d chunks", session, len(chunks))
+		}
+	}
+}
+
+// sessionCount returns the number of sessions being reassembled or
+// delivered
+func (s *DownstreamServer) sessionCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.sessions)
+}
+
+func TestInvalidConfigs(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want string
+	}{
+		{"listen_port: 99999\n", "listen_port must be between 1 and 65535"},
+		{"listen_port: 9001\nreassembly_timeout: -1\n", "reassembly_timeout must not be negative"},
+		{"listen_port: 9001\nidle_timeout: -1\n", "idle_timeout must not be negative"},
+		{"listen_port: 9001\nmax_chunk_size: -1\n", "max_chunk_size must not be negative"},
+		{"listen_port: 9001\nencryption:\n  enabled: true\n  key_policy: strict\n", "set encryption.encryption_key_hex, encryption.encryption_key_b64 or encryption.keys"},
+	}
+	for _, tt := range tests {
+		_, err := loadDownstreamConfig(writeConfig(t, tt.yaml))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.yaml, err, tt.want)
+		}
+	}
+}
+
+func TestShortEncryptionKeyFailsFast(t *testing.T) {
+	_, err := NewDownstreamServer(writeConfig(t, `
+listen_port: 9001
+encryption:
+  enabled: true
+  encryption_key_hex: "00112233445566778899"
+`))
+	if err == nil || !strings.Contains(err.Error(), "must decode to 32 bytes for AES-256, got 10") {
+		t.Errorf("got %v, want the 10 byte key rejected", err)
+	}
+}
+
+func TestConcurrentChunksOfOneSession(t *testing.T) {
+	client := newRecordingClient(t)
+	server := newTestDownstream(t, downstreamConfig)
+
+	chunks := responseChunks("hammer", client.addr(), bytes.Repeat([]byte("0123456789abcdef"), 8), 8)
+	encoded := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		data, err := server.codec.Encode(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded[i] = data
+	}
+
+	// Every goroutine posts every chunk, from a different starting point
+	const senders = 8
+	var wg sync.WaitGroup
+	for g := 0; g < senders; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range encoded {
+				data := encoded[(i+g)%len(encoded)]
+				server.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/chunk", bytes.NewReader(data)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	client.waitFor(t, "hammer", func(got []*common.Chunk) bool { return len(got) >= len(chunks) })
+	for deadline := time.Now().Add(time.Second); server.sessionCount() > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("delivered session never removed")
+		}
+	}
+
+	seen := make(map[int]int)
+	for _, chunk := range client.received("hammer") {
+		seen[chunk.SequenceNum]++
+	}
+	for seq := 1; seq <= len(chunks); seq++ {
+		if seen[seq] != 1 {
+			t.Errorf("chunk %d delivered %d times, want once", seq, seen[seq])
+		}
+	}
+}
+
+func TestIncompleteSessionNotifiesClient(t *testing.T) {
+	client := newRecordingClient(t)
+	server := newTestDownstream(t, downstreamConfig+"idle_timeout: 5000\n")
+
+	// Chunk 2 of 3 never arrives
+	chunks := responseChunks("dropped", client.addr(), []byte("twelve bytes"), 4)
+	for _, chunk := range []*common.Chunk{chunks[0], chunks[2]} {
+		if rec := postChunk(t, server, chunk); rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d: status %d", chunk.SequenceNum, rec.Code)
+		}
+	}
+
+	server.expireSessions(time.Now().Add(time.Hour))
+
+	got := client.waitFor(t, "dropped", func(chunks []*common.Chunk) bool { return len(chunks) > 0 })
+	if !got[0].IsError() {
+		t.Fatalf("client got chunk %d of type %q, want an error chunk", got[0].SequenceNum, got[0].ChunkType)
+	}
+	report, err := common.DecodeErrorChunk(got[0].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Code != http.StatusGatewayTimeout || report.Hop != "downstream" || len(report.Missing) != 1 || report.Missing[0] != 2 {
+		t.Errorf("notice %+v, want a 504 from the downstream missing chunk 2", report)
+	}
+
+	// The chunk turning up late doesn't reopen the session
+	if rec := postChunk(t, server, chunks[1]); rec.Code != http.StatusOK || server.sessionCount() != 0 {
+		t.Errorf("late chunk: status %d, %d sessions open", rec.Code, server.sessionCount())
+	}
+}
+
+func TestExpiredChunkDropped(t *testing.T) {
+	client := newRecordingClient(t)
+	server := newTestDownstream(t, downstreamConfig+"chunk_ttl: 60000\n")
+
+	chunk := responseChunks("old", client.addr(), []byte("body"), 8)[0]
+	chunk.Timestamp = time.Now().Add(-2 * time.Minute)
+	if rec := postChunk(t, server, chunk); rec.Code != http.StatusGone {
+		t.Errorf("status %d, want 410", rec.Code)
+	}
+	if server.sessionCount() != 0 || len(client.received("old")) != 0 {
+		t.Error("expired chunk was processed")
+	}
+}
+
+func TestErrorChunkPassedToClient(t *testing.T) {
+	client := newRecordingClient(t)
+	server := newTestDownstream(t, downstreamConfig)
+
+	notice, err := common.NewErrorChunk("failed", client.addr(), &common.ErrorChunk{
+		Code:    http.StatusBadGateway,
+		Message: "target unreachable",
+		Hop:     "central-proxy",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := postChunk(t, server, notice); rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+
+	got := client.waitFor(t, "failed", func(chunks []*common.Chunk) bool { return len(chunks) > 0 })
+	report, err := common.DecodeErrorChunk(got[0].Data)
+	if err != nil || !got[0].IsError() || report.Message != "target unreachable" {
+		t.Errorf("client got %+v (%v), want the error chunk as sent", got[0], err)
+	}
+	if server.sessionCount() != 0 {
+		t.Error("error chunk opened a session")
+	}
+}
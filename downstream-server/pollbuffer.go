@@ -0,0 +1,156 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// PollBufferConfig bounds the responses kept for clients to fetch from
+// /poll when pushing them failed
+type PollBufferConfig struct {
+	Enabled    bool `yaml:"enabled"`
+	MaxEntries int  `yaml:"max_entries"` // responses kept at once (default 1000)
+	MaxBytes   int  `yaml:"max_bytes"`   // total size of the encoded chunks kept (default 64 MiB)
+	TTL        int  `yaml:"ttl"`         // milliseconds a response is kept (default 60000)
+}
+
+// Validate checks the buffer bounds
+func (c PollBufferConfig) Validate() error {
+	if c.MaxEntries < 0 || c.MaxBytes < 0 || c.TTL < 0 {
+		return errors.New("poll_buffer values must not be negative")
+	}
+	return nil
+}
+
+// pollMetrics counts responses dropped from the poll buffer unfetched
+type pollMetrics struct {
+	Evicted *common.Counter
+	Expired *common.Counter
+}
+
+func newPollMetrics(m *common.Metrics) *pollMetrics {
+	return &pollMetrics{
+		Evicted: m.Counter("proxy_poll_buffer_evicted_total", "Buffered responses evicted to stay within max_entries or max_bytes"),
+		Expired: m.Counter("proxy_poll_buffer_expired_total", "Buffered responses dropped unfetched after their TTL"),
+	}
+}
+
+// pollEntry is one buffered response: its chunks encoded as they would
+// have been posted to the client
+type pollEntry struct {
+	sessionID string
+	chunks    [][]byte
+	size      int
+	expires   time.Time
+}
+
+// pollBuffer keeps undeliverable responses until their client polls for
+// them. Once it holds max_entries responses or max_bytes of chunks, the
+// oldest ones are evicted to make room. A response is fetched at most once
+// and never touched before that, so store order is also use order.
+type pollBuffer struct {
+	config  PollBufferConfig
+	metrics *pollMetrics
+
+	mu      sync.Mutex
+	order   *list.List // of *pollEntry, most recently stored first
+	entries map[string]*list.Element
+	size    int
+}
+
+func newPollBuffer(config PollBufferConfig, metrics *pollMetrics) *pollBuffer {
+	return &pollBuffer{
+		config:  config,
+		metrics: metrics,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Put stores the chunks of a session's response, replacing any stored
+// before. A response larger than max_bytes on its own is not kept; Put
+// reports whether it was.
+func (b *pollBuffer) Put(sessionID string, chunks [][]byte) bool {
+	size := 0
+	for _, chunk := range chunks {
+		size += len(chunk)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if elem, exists := b.entries[sessionID]; exists {
+		b.remove(elem)
+	}
+	if size > b.config.MaxBytes {
+		b.metrics.Evicted.Inc()
+		return false
+	}
+
+	b.expire(time.Now())
+	for b.order.Len() >= b.config.MaxEntries || b.size+size > b.config.MaxBytes {
+		b.remove(b.order.Back())
+		b.metrics.Evicted.Inc()
+	}
+
+	entry := &pollEntry{
+		sessionID: sessionID,
+		chunks:    chunks,
+		size:      size,
+		expires:   time.Now().Add(time.Duration(b.config.TTL) * time.Millisecond),
+	}
+	b.entries[sessionID] = b.order.PushFront(entry)
+	b.size += size
+	return true
+}
+
+// Take removes and returns the chunks buffered for a session
+func (b *pollBuffer) Take(sessionID string) ([][]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire(time.Now())
+	elem, exists := b.entries[sessionID]
+	if !exists {
+		return nil, false
+	}
+	b.remove(elem)
+	return elem.Value.(*pollEntry).chunks, true
+}
+
+// Expire drops responses past their TTL
+func (b *pollBuffer) Expire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire(time.Now())
+}
+
+// Stats returns the number of buffered responses and their total size
+func (b *pollBuffer) Stats() (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.order.Len(), b.size
+}
+
+// expire drops entries past their TTL. Entries are stored with the same
+// TTL, so the oldest expire first. The caller holds mu.
+func (b *pollBuffer) expire(now time.Time) {
+	for elem := b.order.Back(); elem != nil; elem = b.order.Back() {
+		if now.Before(elem.Value.(*pollEntry).expires) {
+			return
+		}
+		b.remove(elem)
+		b.metrics.Expired.Inc()
+	}
+}
+
+// remove unlinks an entry. The caller holds mu.
+func (b *pollBuffer) remove(elem *list.Element) {
+	entry := b.order.Remove(elem).(*pollEntry)
+	delete(b.entries, entry.sessionID)
+	b.size -= entry.size
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// newTestPollBuffer returns a buffer with config and its metrics
+func newTestPollBuffer(config PollBufferConfig) (*pollBuffer, *pollMetrics) {
+	metrics := newPollMetrics(common.NewMetrics())
+	return newPollBuffer(config, metrics), metrics
+}
+
+// response is a buffered response of one chunk of size bytes
+func response(size int) [][]byte {
+	return [][]byte{bytes.Repeat([]byte("x"), size)}
+}
+
+func TestPollBufferEvictsLeastRecent(t *testing.T) {
+	buffer, metrics := newTestPollBuffer(PollBufferConfig{MaxEntries: 2, MaxBytes: 1000, TTL: 60000})
+
+	buffer.Put("first", response(10))
+	buffer.Put("second", response(10))
+	buffer.Put("third", response(10))
+
+	if _, ok := buffer.Take("first"); ok {
+		t.Error("oldest response kept past max_entries")
+	}
+	for _, session := range []string{"second", "third"} {
+		if _, ok := buffer.Take(session); !ok {
+			t.Errorf("%s evicted", session)
+		}
+	}
+	if got := metrics.Evicted.Value(); got != 1 {
+		t.Errorf("evicted counter %d, want 1", got)
+	}
+}
+
+func TestPollBufferBoundsBytes(t *testing.T) {
+	buffer, metrics := newTestPollBuffer(PollBufferConfig{MaxEntries: 100, MaxBytes: 100, TTL: 60000})
+
+	buffer.Put("first", response(40))
+	buffer.Put("second", response(40))
+	buffer.Put("third", response(40))
+	if entries, size := buffer.Stats(); entries != 2 || size != 80 {
+		t.Errorf("holding %d responses of %d bytes, want 2 of 80", entries, size)
+	}
+	if _, ok := buffer.Take("first"); ok {
+		t.Error("oldest response kept past max_bytes")
+	}
+
+	if buffer.Put("huge", response(101)) {
+		t.Error("response larger than max_bytes kept")
+	}
+	if got := metrics.Evicted.Value(); got != 2 {
+		t.Errorf("evicted counter %d, want 2", got)
+	}
+}
+
+func TestPollBufferExpiresAfterTTL(t *testing.T) {
+	buffer, metrics := newTestPollBuffer(PollBufferConfig{MaxEntries: 10, MaxBytes: 1000, TTL: 20})
+
+	buffer.Put("stale", response(10))
+	time.Sleep(40 * time.Millisecond)
+	buffer.Put("fresh", response(10))
+
+	if _, ok := buffer.Take("stale"); ok {
+		t.Error("response fetched after its TTL")
+	}
+	if _, ok := buffer.Take("fresh"); !ok {
+		t.Error("fresh response expired")
+	}
+	if got := metrics.Expired.Value(); got != 1 {
+		t.Errorf("expired counter %d, want 1", got)
+	}
+
+	// Fetched responses are gone
+	if _, ok := buffer.Take("fresh"); ok {
+		t.Error("response fetched twice")
+	}
+}
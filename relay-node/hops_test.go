@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRelayLoopDroppedAfterMaxHops(t *testing.T) {
+	// Two relays whose next_hops point at each other
+	var relays [2]*RelayNode
+	var received atomic.Int32
+	var servers [2]*httptest.Server
+	for i := range servers {
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received.Add(1)
+			relays[i].handleRelay(w, r)
+		}))
+		t.Cleanup(servers[i].Close)
+	}
+	for i := range relays {
+		other := servers[1-i].Listener.Addr().String()
+		relays[i] = newTestRelay(t, fmt.Sprintf(`
+listen_port: 9000
+node_id: relay-%d
+next_hops: ["%s"]
+max_hops: 4
+retry:
+  max_attempts: 3
+  base_delay: 1
+  max_delay: 2
+`, i, other))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, servers[0].URL+"/relay", strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Request-ID", "looping")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Errorf("status %d, want 508", resp.StatusCode)
+	}
+	// Four relays pass it on and the fifth refuses it, without retries
+	if got := received.Load(); got != 5 {
+		t.Errorf("relays saw the traffic %d times, want 5", got)
+	}
+}
+
+func TestHopCountIncremented(t *testing.T) {
+	var seen string
+	hop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get(hopCountHeader)
+	}))
+	defer hop.Close()
+	relay := newTestRelay(t, relayConfig(hop.Listener.Addr().String()))
+
+	for _, tc := range []struct {
+		header, want string
+	}{
+		{"", "1"},
+		{"2", "3"},
+		{"garbage", "1"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/relay", strings.NewReader("data"))
+		if tc.header != "" {
+			req.Header.Set(hopCountHeader, tc.header)
+		}
+		recorder := httptest.NewRecorder()
+		relay.handleRelay(recorder, req)
+		if recorder.Code != http.StatusOK || seen != tc.want {
+			t.Errorf("%s %q: status %d, forwarded with %q, want %s", hopCountHeader, tc.header, recorder.Code, seen, tc.want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/relay", strings.NewReader("data"))
+	req.Header.Set(hopCountHeader, strconv.Itoa(relay.config.MaxHops))
+	recorder := httptest.NewRecorder()
+	relay.handleRelay(recorder, req)
+	if recorder.Code != http.StatusLoopDetected {
+		t.Errorf("at max_hops: status %d, want 508", recorder.Code)
+	}
+}
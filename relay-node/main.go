@@ -2,29 +2,75 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
-	"os"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/dudelovecamera/proxy-system/common"
 	"gopkg.in/yaml.v3"
 )
 
 // RelayConfig configuration for relay node
 type RelayConfig struct {
-	ListenPort    int      `yaml:"listen_port"`
-	NodeID        string   `yaml:"node_id"`
-	NextHops      []string `yaml:"next_hops"`      // Next relay nodes or gateway
-	PrevHops      []string `yaml:"prev_hops"`      // Previous relay nodes or operational nodes
-	GatewayURL    string   `yaml:"gateway_url"`    // If this is the final relay before gateway
-	AuthToken     string   `yaml:"auth_token"`     // Token for gateway authentication
-	Secret        string   `yaml:"secret"`         // Secret for node authentication
-	TrafficMixing bool     `yaml:"traffic_mixing"`
-	RotationTime  int      `yaml:"rotation_time"`  // seconds between route rotations
+	ListenPort     int                 `yaml:"listen_port"`
+	ListenAddress  string              `yaml:"listen_address"` // interface to bind, all if empty
+	AdminToken     string              `yaml:"admin_token"`    // enables POST /shutdown, disabled if empty
+	NodeID         string              `yaml:"node_id"`
+	NextHops       []NextHop           `yaml:"next_hops"`   // Next relay nodes or gateway
+	PrevHops       []string            `yaml:"prev_hops"`   // Previous relay nodes or operational nodes
+	GatewayURL     string              `yaml:"gateway_url"` // If this is the final relay before gateway
+	AuthToken      string              `yaml:"auth_token"`  // Token for gateway authentication
+	Secret         string              `yaml:"secret"`      // Secret for node authentication
+	Capability     string              `yaml:"capability"`  // signed token granting access to the gateway
+	TrafficMixing  bool                `yaml:"traffic_mixing"`
+	RotationTime   int                 `yaml:"rotation_time"`    // seconds between route rotations
+	ProbeInterval  int                 `yaml:"probe_interval"`   // seconds between next hop health probes (default 30)
+	BufferStore    string              `yaml:"buffer_store"`     // file persisting buffered traffic across restarts
+	WorkerPoolSize int                 `yaml:"worker_pool_size"` // concurrent forwards of buffered traffic
+	MaxHops        int                 `yaml:"max_hops"`         // relays traffic may cross before it is dropped as a routing loop
+	MaxBodySize    int                 `yaml:"max_body_size"`    // bytes of traffic accepted per request (default 16 MiB)
+	Retry          RetryConfig         `yaml:"retry"`
+	Timeouts       common.HTTPTimeouts `yaml:"timeouts"` // outbound dial, TLS and response header timeouts
+}
+
+// NextHop is a next relay with an optional selection weight. In config it
+// may be a plain "host:port" string or a mapping with address and weight.
+type NextHop struct {
+	Address string `yaml:"address"`
+	Weight  int    `yaml:"weight"`
+}
+
+// UnmarshalYAML accepts both the plain string and the weighted form
+func (h *NextHop) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		h.Address = value.Value
+		return nil
+	}
+
+	type plain NextHop
+	return value.Decode((*plain)(h))
+}
+
+// String returns the hop address
+func (h NextHop) String() string {
+	return h.Address
+}
+
+// RetryConfig controls retries of failed forwards
+type RetryConfig struct {
+	MaxAttempts       int `yaml:"max_attempts"`        // attempts per forward, including the first
+	BaseDelay         int `yaml:"base_delay"`          // milliseconds, doubled per attempt
+	MaxDelay          int `yaml:"max_delay"`           // milliseconds cap on a single backoff
+	DeadLetterRetries int `yaml:"dead_letter_retries"` // buffer ticks a failed item is retried before dropping
 }
 
 // RelayNode provides isolation between gateway and operational nodes
@@ -33,35 +79,182 @@ type RelayNode struct {
 	client        *http.Client
 	mu            sync.RWMutex
 	currentHopIdx int
+	weighted      bool
 	trafficBuffer []RelayTraffic
+	deadLetters   []deadLetter
+	dropped       int
+	unhealthyHops map[string]bool
+	store         *trafficStore
+	workers       *common.WorkerPool
+	reregister    chan struct{} // wakes registerWithGateway when the gateway rejects the token
+	regFailures   int           // consecutive failed registration attempts
+	regError      string        // last registration failure
+	httpServer    *http.Server
+}
+
+// deadLetter is buffered traffic whose forward failed
+type deadLetter struct {
+	traffic  RelayTraffic
+	attempts int
 }
 
+// bufferInterval is how often traffic buffered for mixing is forwarded
+const bufferInterval = 3 * time.Second
+
+// hopCountHeader carries how many relays traffic has crossed, so a cycle in
+// next_hops can't pass it around forever
+const hopCountHeader = "X-Hop-Count"
+
+// errRoutingLoop is returned when a relay refuses traffic that has crossed
+// max_hops relays. Retrying can't help, so it is passed back, not retried.
+var errRoutingLoop = errors.New("routing loop: max_hops exceeded")
+
 // RelayTraffic represents traffic passing through relay
 type RelayTraffic struct {
 	RequestID string
 	Data      []byte
 	Timestamp time.Time
 	FromNode  string
+	Deadline  time.Time // latency budget end from DeadlineHeader, zero without one
+	HopCount  int       // relays crossed, this one included
+	storeID   uint64
+}
+
+// loadRelayConfig reads and validates the config file, with settings
+// overridden by PROXY_RELAY_* environment variables
+func loadRelayConfig(configPath string) (RelayConfig, error) {
+	return common.LoadConfig(configPath, "PROXY_RELAY", setRelayDefaults)
+}
+
+// setRelayDefaults fills in settings left unset
+func setRelayDefaults(config *RelayConfig) {
+	// Set retry defaults
+	if config.Retry.MaxAttempts == 0 {
+		config.Retry.MaxAttempts = 3
+	}
+	if config.Retry.BaseDelay == 0 {
+		config.Retry.BaseDelay = 200
+	}
+	if config.Retry.MaxDelay == 0 {
+		config.Retry.MaxDelay = 5000
+	}
+	if config.Retry.DeadLetterRetries == 0 {
+		config.Retry.DeadLetterRetries = 5
+	}
+	if config.WorkerPoolSize == 0 {
+		config.WorkerPoolSize = 16
+	}
+	if config.MaxHops == 0 {
+		config.MaxHops = 16
+	}
+	if config.MaxBodySize == 0 {
+		config.MaxBodySize = 16 * 1024 * 1024
+	}
+	// Hops marked failed are only cleared by a probe, so there is always one
+	if config.ProbeInterval == 0 {
+		config.ProbeInterval = 30
+	}
+}
+
+// Validate reports every problem with the configuration
+func (c RelayConfig) Validate() error {
+	var errs []error
+
+	if c.ListenPort <= 0 || c.ListenPort > 65535 {
+		errs = append(errs, fmt.Errorf("listen_port must be between 1 and 65535, got %d", c.ListenPort))
+	}
+	if c.NodeID == "" {
+		errs = append(errs, fmt.Errorf("node_id must be set"))
+	}
+	if len(c.NextHops) == 0 && c.GatewayURL == "" {
+		errs = append(errs, fmt.Errorf("next_hops or gateway_url must be set"))
+	}
+	for _, hop := range c.NextHops {
+		if hop.Address == "" {
+			errs = append(errs, fmt.Errorf("next_hops entry has no address"))
+		}
+		if hop.Weight < 0 {
+			errs = append(errs, fmt.Errorf("next hop %s has negative weight %d", hop.Address, hop.Weight))
+		}
+	}
+	if c.RotationTime < 0 {
+		errs = append(errs, fmt.Errorf("rotation_time must not be negative, got %d", c.RotationTime))
+	}
+	if c.ProbeInterval < 0 {
+		errs = append(errs, fmt.Errorf("probe_interval must not be negative, got %d", c.ProbeInterval))
+	}
+	if c.Retry.MaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("retry.max_attempts must be at least 1, got %d", c.Retry.MaxAttempts))
+	}
+	if c.Retry.BaseDelay < 0 || c.Retry.MaxDelay < 0 {
+		errs = append(errs, fmt.Errorf("retry delays must not be negative"))
+	}
+	if c.WorkerPoolSize < 0 {
+		errs = append(errs, fmt.Errorf("worker_pool_size must not be negative, got %d", c.WorkerPoolSize))
+	}
+	if c.MaxHops < 0 {
+		errs = append(errs, fmt.Errorf("max_hops must not be negative, got %d", c.MaxHops))
+	}
+	if c.BufferStore != "" && !c.TrafficMixing {
+		errs = append(errs, fmt.Errorf("buffer_store requires traffic_mixing"))
+	}
+	if c.MaxBodySize < 0 {
+		errs = append(errs, fmt.Errorf("max_body_size must not be negative, got %d", c.MaxBodySize))
+	}
+	// A stored item must fit one line of the store, or the relay could not
+	// load it again on restart
+	if c.BufferStore != "" && c.MaxBodySize > maxStoredBody {
+		errs = append(errs, fmt.Errorf("max_body_size must be at most %d with buffer_store, got %d", maxStoredBody, c.MaxBodySize))
+	}
+
+	if err := c.Timeouts.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
 }
 
 // NewRelayNode creates a new relay node instance
 func NewRelayNode(configPath string) (*RelayNode, error) {
-	data, err := os.ReadFile(configPath)
+	config, err := loadRelayConfig(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config: %w", err)
+		return nil, err
 	}
 
-	var config RelayConfig
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config: %w", err)
+	// Weighted selection applies once any hop has a weight; unweighted hops
+	// then count as weight 1
+	weighted := false
+	for i, hop := range config.NextHops {
+		if hop.Weight > 0 {
+			weighted = true
+		}
+		if hop.Weight == 0 {
+			config.NextHops[i].Weight = 1
+		}
 	}
 
 	relay := &RelayNode{
-		config: config,
-		client: &http.Client{
-			Timeout: 60 * time.Second,
-		},
+		httpServer:    &http.Server{},
+		weighted:      weighted,
+		config:        config,
+		client:        common.NewHTTPClient(60*time.Second, config.Timeouts),
 		trafficBuffer: make([]RelayTraffic, 0),
+		unhealthyHops: make(map[string]bool),
+		workers:       common.NewWorkerPool(config.WorkerPoolSize),
+		reregister:    make(chan struct{}, 1),
+	}
+
+	// Restore traffic that was buffered but not forwarded before a restart
+	if config.TrafficMixing && config.BufferStore != "" {
+		store, err := openTrafficStore(config.BufferStore)
+		if err != nil {
+			return nil, err
+		}
+		relay.store = store
+		relay.trafficBuffer = append(relay.trafficBuffer, store.Pending()...)
+		if len(relay.trafficBuffer) > 0 {
+			log.Printf("Restored %d buffered items from %s", len(relay.trafficBuffer), config.BufferStore)
+		}
 	}
 
 	// Start route rotation if configured
@@ -69,8 +262,13 @@ func NewRelayNode(configPath string) (*RelayNode, error) {
 		go relay.rotateRoutes()
 	}
 
+	// Probe next hop health so rotation avoids dead hops
+	if config.ProbeInterval > 0 && len(config.NextHops) > 0 {
+		go relay.probeHops()
+	}
+
 	// Register with gateway if this is the final relay
-	if config.GatewayURL != "" && config.AuthToken == "" {
+	if config.GatewayURL != "" {
 		go relay.registerWithGateway()
 	}
 
@@ -85,27 +283,59 @@ func (r *RelayNode) handleRelay(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// Read the relay data
-	body, err := io.ReadAll(req.Body)
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, int64(r.config.MaxBodySize)))
 	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, "Traffic too large", http.StatusRequestEntityTooLarge)
+			log.Printf("Refusing traffic from %s larger than max_body_size %d", req.Header.Get("X-From-Node"), r.config.MaxBodySize)
+			return
+		}
 		http.Error(w, "Failed to read body", http.StatusBadRequest)
 		return
 	}
 	defer req.Body.Close()
 
-	fromNode := req.Header.Get("X-From-Node")
-	requestID := req.Header.Get("X-Request-ID")
+	traffic := RelayTraffic{
+		RequestID: req.Header.Get("X-Request-ID"),
+		Data:      body,
+		Timestamp: time.Now(),
+		FromNode:  req.Header.Get("X-From-Node"),
+		Deadline:  common.DeadlineFromHeader(req.Header),
+	}
 
-	log.Printf("Relay received traffic from %s (request: %s)", fromNode, requestID)
+	log.Printf("Relay received traffic from %s (request: %s)", traffic.FromNode, traffic.RequestID)
+
+	// A missing or malformed count is taken as traffic entering the relays
+	hops, _ := strconv.Atoi(req.Header.Get(hopCountHeader))
+	traffic.HopCount = max(hops, 0) + 1
+	if traffic.HopCount > r.config.MaxHops {
+		http.Error(w, "Routing loop detected", http.StatusLoopDetected)
+		log.Printf("Dropping request %s from %s after %d relays, next_hops may form a loop",
+			traffic.RequestID, traffic.FromNode, traffic.HopCount-1)
+		return
+	}
+
+	// Waiting for the next flush must fit the request's latency budget
+	mix := r.config.TrafficMixing
+	if mix && common.BudgetDelay(bufferInterval, traffic.Deadline) < bufferInterval {
+		log.Printf("Latency budget too tight to buffer request %s, forwarding now", traffic.RequestID)
+		mix = false
+	}
 
 	// Add to traffic buffer if mixing enabled
-	if r.config.TrafficMixing {
+	if mix {
+		// Persist before acknowledging so a restart cannot lose it
+		if r.store != nil {
+			if err := r.store.Add(&traffic); err != nil {
+				http.Error(w, "Failed to queue traffic", http.StatusInternalServerError)
+				log.Printf("Buffer store error: %v", err)
+				return
+			}
+		}
+
 		r.mu.Lock()
-		r.trafficBuffer = append(r.trafficBuffer, RelayTraffic{
-			RequestID: requestID,
-			Data:      body,
-			Timestamp: time.Now(),
-			FromNode:  fromNode,
-		})
+		r.trafficBuffer = append(r.trafficBuffer, traffic)
 		r.mu.Unlock()
 
 		w.WriteHeader(http.StatusAccepted)
@@ -114,7 +344,12 @@ func (r *RelayNode) handleRelay(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// Forward immediately
-	if err := r.forwardTraffic(body, requestID, fromNode); err != nil {
+	if err := r.forwardTraffic(traffic); err != nil {
+		if errors.Is(err, errRoutingLoop) {
+			http.Error(w, "Routing loop detected", http.StatusLoopDetected)
+			log.Printf("Forward error: %v", err)
+			return
+		}
 		http.Error(w, "Forward failed", http.StatusInternalServerError)
 		log.Printf("Forward error: %v", err)
 		return
@@ -124,83 +359,215 @@ func (r *RelayNode) handleRelay(w http.ResponseWriter, req *http.Request) {
 	w.Write([]byte("Traffic relayed"))
 }
 
-// forwardTraffic sends traffic to next hop
-func (r *RelayNode) forwardTraffic(data []byte, requestID, fromNode string) error {
+// forwardTraffic sends traffic to next hop, retrying with jittered backoff
+func (r *RelayNode) forwardTraffic(t RelayTraffic) error {
+	var err error
+	for attempt := 0; attempt < r.config.Retry.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			delay := common.RetryDelay(attempt, r.config.Retry.BaseDelay, r.config.Retry.MaxDelay)
+			log.Printf("Retrying request %s in %v (attempt %d/%d): %v",
+				t.RequestID, delay, attempt+1, r.config.Retry.MaxAttempts, err)
+			time.Sleep(delay)
+		}
+
+		if err = r.forwardOnce(t); err == nil || errors.Is(err, errRoutingLoop) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("giving up after %d attempts: %w", r.config.Retry.MaxAttempts, err)
+}
+
+// forwardOnce makes a single attempt to send traffic to the next hop
+func (r *RelayNode) forwardOnce(t RelayTraffic) error {
 	// Determine next hop
-	var targetURL string
-	
+	var targetURL, nextHop string
+
 	if r.config.GatewayURL != "" {
 		// This is the final relay before gateway
-		targetURL = r.config.GatewayURL
+		targetURL = r.config.GatewayURL + "/proxy"
 	} else {
 		// Select next relay node
-		r.mu.Lock()
-		nextHop := r.config.NextHops[r.currentHopIdx]
-		r.mu.Unlock()
+		nextHop = r.selectHop()
 		targetURL = fmt.Sprintf("http://%s/relay", nextHop)
 	}
 
 	// Create request
-	httpReq, err := http.NewRequest(http.MethodPost, targetURL, bytes.NewReader(data))
+	httpReq, err := http.NewRequest(http.MethodPost, targetURL, bytes.NewReader(t.Data))
 	if err != nil {
 		return fmt.Errorf("request creation error: %w", err)
 	}
 
 	// Set headers
 	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("X-Request-ID", requestID)
+	httpReq.Header.Set("X-Request-ID", t.RequestID)
 	httpReq.Header.Set("X-From-Node", r.config.NodeID)
-	
+	httpReq.Header.Set(hopCountHeader, strconv.Itoa(t.HopCount))
+	common.SetDeadlineHeader(httpReq.Header, t.Deadline)
+
 	// Add authentication if forwarding to gateway
-	if r.config.GatewayURL != "" && r.config.AuthToken != "" {
+	r.mu.RLock()
+	authToken := r.config.AuthToken
+	r.mu.RUnlock()
+	if r.config.GatewayURL != "" && authToken != "" {
 		httpReq.Header.Set("X-Node-ID", r.config.NodeID)
-		httpReq.Header.Set("X-Auth-Token", r.config.AuthToken)
+		httpReq.Header.Set("X-Auth-Token", authToken)
+		if r.config.Capability != "" {
+			httpReq.Header.Set("X-Capability", r.config.Capability)
+		}
 	}
 
 	// Send request
 	resp, err := r.client.Do(httpReq)
 	if err != nil {
+		r.markHopFailed(nextHop)
 		return fmt.Errorf("request error: %w", err)
 	}
-	defer resp.Body.Close()
+	defer common.DrainAndClose(resp)
+
+	if resp.StatusCode == http.StatusUnauthorized && r.config.GatewayURL != "" {
+		// The gateway restarted or dropped our token
+		r.invalidateToken(authToken)
+	}
+
+	if resp.StatusCode == http.StatusLoopDetected {
+		return errRoutingLoop
+	}
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		if resp.StatusCode >= http.StatusInternalServerError {
+			r.markHopFailed(nextHop)
+		}
 		return fmt.Errorf("next hop returned status %d", resp.StatusCode)
 	}
 
-	log.Printf("Forwarded request %s to %s", requestID, targetURL)
+	log.Printf("Forwarded request %s to %s", t.RequestID, targetURL)
 	return nil
 }
 
 // processBufferedTraffic handles batched traffic
 func (r *RelayNode) processBufferedTraffic() {
-	ticker := time.NewTicker(3 * time.Second)
+	ticker := time.NewTicker(bufferInterval)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		r.mu.Lock()
-		if len(r.trafficBuffer) == 0 {
-			r.mu.Unlock()
-			continue
-		}
+		r.flushBuffer()
+	}
+}
 
-		buffer := make([]RelayTraffic, len(r.trafficBuffer))
-		copy(buffer, r.trafficBuffer)
-		r.trafficBuffer = r.trafficBuffer[:0]
+// flushBuffer hands everything buffered to the workers in random order
+func (r *RelayNode) flushBuffer() {
+	r.mu.Lock()
+	if len(r.trafficBuffer) == 0 {
 		r.mu.Unlock()
+		return
+	}
+
+	buffer := make([]RelayTraffic, len(r.trafficBuffer))
+	copy(buffer, r.trafficBuffer)
+	r.trafficBuffer = r.trafficBuffer[:0]
+	r.mu.Unlock()
 
-		log.Printf("Processing buffered traffic: %d items", len(buffer))
+	log.Printf("Processing buffered traffic: %d items", len(buffer))
 
-		for _, traffic := range buffer {
-			go func(t RelayTraffic) {
-				if err := r.forwardTraffic(t.Data, t.RequestID, t.FromNode); err != nil {
-					log.Printf("Buffered forward error for %s: %v", t.RequestID, err)
+	// Workers take items in order, so shuffle to keep departures
+	// unlinked from arrivals
+	rand.Shuffle(len(buffer), func(i, j int) {
+		buffer[i], buffer[j] = buffer[j], buffer[i]
+	})
+
+	for _, traffic := range buffer {
+		t := traffic
+		r.workers.Submit(func() {
+			if err := r.forwardTraffic(t); err != nil {
+				log.Printf("Buffered forward error for %s: %v", t.RequestID, err)
+				if errors.Is(err, errRoutingLoop) {
+					r.dropLooping(t)
+					return
 				}
-			}(traffic)
+				r.addDeadLetter(deadLetter{traffic: t, attempts: 1})
+				return
+			}
+			r.completeTraffic(t)
+		})
+	}
+}
+
+// processDeadLetters periodically retries failed buffered traffic
+func (r *RelayNode) processDeadLetters() {
+	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.retryDeadLetters()
+	}
+}
+
+// retryDeadLetters makes one more attempt at each dead-lettered item and
+// drops items that keep failing
+func (r *RelayNode) retryDeadLetters() {
+	r.mu.Lock()
+	if len(r.deadLetters) == 0 {
+		r.mu.Unlock()
+		return
+	}
+
+	letters := make([]deadLetter, len(r.deadLetters))
+	copy(letters, r.deadLetters)
+	r.deadLetters = r.deadLetters[:0]
+	r.mu.Unlock()
+
+	log.Printf("Retrying dead-lettered traffic: %d items", len(letters))
+
+	for _, letter := range letters {
+		t := letter.traffic
+		if err := r.forwardOnce(t); err != nil {
+			if errors.Is(err, errRoutingLoop) {
+				r.dropLooping(t)
+				continue
+			}
+			letter.attempts++
+			if letter.attempts > r.config.Retry.DeadLetterRetries {
+				r.mu.Lock()
+				r.dropped++
+				dropped := r.dropped
+				r.mu.Unlock()
+				log.Printf("Dropping request %s after %d dead-letter retries: %v (total dropped: %d)",
+					t.RequestID, r.config.Retry.DeadLetterRetries, err, dropped)
+				r.completeTraffic(t)
+				continue
+			}
+			r.addDeadLetter(letter)
+			continue
 		}
+		r.completeTraffic(t)
 	}
 }
 
+// dropLooping gives up on traffic a later relay refused as looping
+func (r *RelayNode) dropLooping(t RelayTraffic) {
+	r.mu.Lock()
+	r.dropped++
+	dropped := r.dropped
+	r.mu.Unlock()
+	log.Printf("Dropping looping request %s (total dropped: %d)", t.RequestID, dropped)
+	r.completeTraffic(t)
+}
+
+// completeTraffic removes forwarded or dropped traffic from the buffer store
+func (r *RelayNode) completeTraffic(t RelayTraffic) {
+	if r.store != nil {
+		r.store.Done(t)
+	}
+}
+
+// addDeadLetter queues failed traffic for a later retry
+func (r *RelayNode) addDeadLetter(letter deadLetter) {
+	r.mu.Lock()
+	r.deadLetters = append(r.deadLetters, letter)
+	r.mu.Unlock()
+}
+
 // rotateRoutes periodically changes routing paths
 func (r *RelayNode) rotateRoutes() {
 	ticker := time.NewTicker(time.Duration(r.config.RotationTime) * time.Second)
@@ -212,20 +579,169 @@ func (r *RelayNode) rotateRoutes() {
 		}
 
 		r.mu.Lock()
-		r.currentHopIdx = (r.currentHopIdx + 1) % len(r.config.NextHops)
+		r.advanceHop()
+		idx := r.currentHopIdx
 		r.mu.Unlock()
 
-		log.Printf("Rotated to next hop index %d", r.currentHopIdx)
+		log.Printf("Rotated to next hop index %d", idx)
+	}
+}
+
+// selectHop picks the next relay: weighted random among healthy hops when
+// weights are configured, otherwise the current rotation hop
+func (r *RelayNode) selectHop() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.weighted {
+		return r.config.NextHops[r.currentHopIdx].Address
+	}
+
+	candidates := make([]NextHop, 0, len(r.config.NextHops))
+	for _, hop := range r.config.NextHops {
+		if !r.unhealthyHops[hop.Address] {
+			candidates = append(candidates, hop)
+		}
+	}
+
+	// All hops unhealthy: fall back to the full set rather than stalling
+	if len(candidates) == 0 {
+		candidates = r.config.NextHops
+	}
+
+	total := 0
+	for _, hop := range candidates {
+		total += hop.Weight
+	}
+
+	pick := rand.Intn(total)
+	for _, hop := range candidates {
+		if pick < hop.Weight {
+			return hop.Address
+		}
+		pick -= hop.Weight
+	}
+
+	return candidates[len(candidates)-1].Address
+}
+
+// advanceHop moves to the next healthy hop, staying put if none is healthy.
+// Callers must hold r.mu.
+func (r *RelayNode) advanceHop() {
+	hops := len(r.config.NextHops)
+	for step := 1; step <= hops; step++ {
+		idx := (r.currentHopIdx + step) % hops
+		if !r.unhealthyHops[r.config.NextHops[idx].Address] {
+			r.currentHopIdx = idx
+			return
+		}
+	}
+}
+
+// markHopFailed records a failed forward and switches away from the hop
+// immediately if it is the current one
+func (r *RelayNode) markHopFailed(hop string) {
+	if hop == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.unhealthyHops[hop] = true
+	if len(r.config.NextHops) > 1 && r.config.NextHops[r.currentHopIdx].Address == hop {
+		r.advanceHop()
+		log.Printf("Next hop %s failing, switched to %s", hop, r.config.NextHops[r.currentHopIdx].Address)
+	}
+}
+
+// probeHops periodically checks each next hop's /health endpoint
+func (r *RelayNode) probeHops() {
+	ticker := time.NewTicker(time.Duration(r.config.ProbeInterval) * time.Second)
+	defer ticker.Stop()
+
+	probeClient := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: r.client.Transport,
+	}
+
+	for range ticker.C {
+		r.probeAll(probeClient)
+	}
+}
+
+// probeAll checks every next hop once, recording its health and moving off
+// the current hop if it is down
+func (r *RelayNode) probeAll(client *http.Client) {
+	for _, next := range r.config.NextHops {
+		hop := next.Address
+		healthy := probeHop(client, hop)
+
+		r.mu.Lock()
+		wasUnhealthy := r.unhealthyHops[hop]
+		r.unhealthyHops[hop] = !healthy
+		if !healthy && len(r.config.NextHops) > 1 && r.config.NextHops[r.currentHopIdx].Address == hop {
+			r.advanceHop()
+		}
+		r.mu.Unlock()
+
+		if wasUnhealthy != !healthy {
+			log.Printf("Next hop %s healthy: %v", hop, healthy)
+		}
 	}
 }
 
-// registerWithGateway obtains authentication token from gateway
+// probeHop reports whether a hop answers its health check
+func probeHop(client *http.Client, hop string) bool {
+	resp, err := client.Get(fmt.Sprintf("http://%s/health", hop))
+	if err != nil {
+		return false
+	}
+	defer common.DrainAndClose(resp)
+
+	return resp.StatusCode == http.StatusOK
+}
+
+// registrationDelay is how long a relay waits after starting before it
+// first registers with the gateway
+var registrationDelay = 2 * time.Second
+
+// registerWithGateway keeps the relay registered with the gateway. It
+// retries with backoff until a token is obtained, then waits until a forward
+// is rejected with 401 and registers again.
 func (r *RelayNode) registerWithGateway() {
 	// Wait a bit before registering
-	time.Sleep(2 * time.Second)
+	time.Sleep(registrationDelay)
+
+	for {
+		r.mu.RLock()
+		hasToken := r.config.AuthToken != ""
+		r.mu.RUnlock()
+
+		for attempt := 1; !hasToken; attempt++ {
+			err := r.registerOnce()
+			if err == nil {
+				break
+			}
+
+			delay := common.RetryDelay(attempt, r.config.Retry.BaseDelay, r.config.Retry.MaxDelay)
+			r.mu.Lock()
+			r.regFailures = attempt
+			r.regError = err.Error()
+			r.mu.Unlock()
 
+			log.Printf("Registration failed, retrying in %v (attempt %d): %v", delay, attempt, err)
+			time.Sleep(delay)
+		}
+
+		<-r.reregister
+	}
+}
+
+// registerOnce obtains an authentication token from the gateway
+func (r *RelayNode) registerOnce() error {
 	regURL := r.config.GatewayURL + "/register"
-	
+
 	regData := map[string]string{
 		"node_id": r.config.NodeID,
 		"secret":  r.config.Secret,
@@ -233,28 +749,27 @@ func (r *RelayNode) registerWithGateway() {
 
 	body, err := json.Marshal(regData)
 	if err != nil {
-		log.Printf("Registration marshal error: %v", err)
-		return
+		return fmt.Errorf("marshal error: %w", err)
 	}
 
 	req, err := http.NewRequest(http.MethodPost, regURL, bytes.NewReader(body))
 	if err != nil {
-		log.Printf("Registration request error: %v", err)
-		return
+		return fmt.Errorf("request creation error: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	if r.config.Capability != "" {
+		req.Header.Set("X-Capability", r.config.Capability)
+	}
 
 	resp, err := r.client.Do(req)
 	if err != nil {
-		log.Printf("Registration failed: %v", err)
-		return
+		return fmt.Errorf("request error: %w", err)
 	}
-	defer resp.Body.Close()
+	defer common.DrainAndClose(resp)
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Registration returned status %d", resp.StatusCode)
-		return
+		return fmt.Errorf("gateway returned status %d", resp.StatusCode)
 	}
 
 	var regResp struct {
@@ -263,57 +778,137 @@ func (r *RelayNode) registerWithGateway() {
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&regResp); err != nil {
-		log.Printf("Registration response error: %v", err)
-		return
+		return fmt.Errorf("response error: %w", err)
+	}
+	if regResp.Token == "" {
+		return errors.New("gateway returned no token")
 	}
 
 	r.mu.Lock()
 	r.config.AuthToken = regResp.Token
+	r.regFailures = 0
+	r.regError = ""
 	r.mu.Unlock()
 
 	log.Printf("Successfully registered with gateway, token received")
+	return nil
+}
+
+// invalidateToken drops a token the gateway rejected and wakes the
+// registration loop. Tokens replaced in the meantime are left alone.
+func (r *RelayNode) invalidateToken(token string) {
+	r.mu.Lock()
+	if token == "" || r.config.AuthToken != token {
+		r.mu.Unlock()
+		return
+	}
+	r.config.AuthToken = ""
+	r.mu.Unlock()
+
+	log.Printf("Gateway rejected our token, registering again")
+
+	select {
+	case r.reregister <- struct{}{}:
+	default:
+	}
 }
 
 // healthCheck endpoint
 func (r *RelayNode) healthCheck(w http.ResponseWriter, req *http.Request) {
 	r.mu.RLock()
 	bufferSize := len(r.trafficBuffer)
+	deadLetters := len(r.deadLetters)
+	dropped := r.dropped
+	unhealthy := 0
+	for _, down := range r.unhealthyHops {
+		if down {
+			unhealthy++
+		}
+	}
 	hasToken := r.config.AuthToken != ""
+	regFailures := r.regFailures
+	regError := r.regError
 	r.mu.RUnlock()
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":           "healthy",
-		"role":             "relay-node",
-		"node_id":          r.config.NodeID,
-		"buffered_traffic": bufferSize,
-		"registered":       hasToken,
-		"next_hops":        len(r.config.NextHops),
-		"time":             time.Now().Format(time.RFC3339),
-	})
+	common.WriteHealth(w, common.NewHealthInfo("relay-node", map[string]any{
+		"node_id":               r.config.NodeID,
+		"buffered_traffic":      bufferSize,
+		"dead_letters":          deadLetters,
+		"dropped_traffic":       dropped,
+		"registered":            hasToken,
+		"registration_failures": regFailures,
+		"registration_error":    regError,
+		"next_hops":             len(r.config.NextHops),
+		"unhealthy_hops":        unhealthy,
+	}))
+}
+
+// ready reports whether traffic can be forwarded: the final relay needs a
+// gateway token, others a next hop not marked unhealthy
+func (r *RelayNode) ready() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.config.GatewayURL != "" {
+		if r.config.AuthToken == "" {
+			return errors.New("not registered with gateway")
+		}
+		return nil
+	}
+
+	for _, hop := range r.config.NextHops {
+		if !r.unhealthyHops[hop.Address] {
+			return nil
+		}
+	}
+	return errors.New("no healthy next hop")
 }
 
 // Start begins the relay node server
 func (r *RelayNode) Start() error {
 	http.HandleFunc("/relay", r.handleRelay)
 	http.HandleFunc("/health", r.healthCheck)
+	http.HandleFunc("/ready", common.ReadyHandler(r.ready))
+	if r.config.AdminToken != "" {
+		http.HandleFunc("/shutdown", common.ShutdownHandler(r.config.AdminToken, r))
+	}
 
 	// Start traffic buffer processor if mixing enabled
 	if r.config.TrafficMixing {
 		go r.processBufferedTraffic()
+		go r.processDeadLetters()
 	}
 
-	addr := fmt.Sprintf(":%d", r.config.ListenPort)
+	addr := common.ListenAddr(r.config.ListenAddress, r.config.ListenPort)
 	log.Printf("Relay node %s starting on %s", r.config.NodeID, addr)
 	log.Printf("Next hops: %v", r.config.NextHops)
-	
-	return http.ListenAndServe(addr, nil)
+
+	r.httpServer.Addr = addr
+	if err := r.httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	log.Printf("Relay node stopped")
+	return nil
+}
+
+// Shutdown stops accepting requests and waits for in-flight ones
+func (r *RelayNode) Shutdown(ctx context.Context) error {
+	return r.httpServer.Shutdown(ctx)
 }
 
 func main() {
+	check := flag.Bool("check", false, "Validate the config file and exit")
+	flag.Parse()
+
 	configPath := "config/relay.yaml"
-	if len(os.Args) > 1 {
-		configPath = os.Args[1]
+	if flag.NArg() > 0 {
+		configPath = flag.Arg(0)
+	}
+
+	if *check {
+		_, err := loadRelayConfig(configPath)
+		common.ReportConfigCheck(configPath, err)
 	}
 
 	relay, err := NewRelayNode(configPath)
@@ -321,6 +916,8 @@ func main() {
 		log.Fatalf("Failed to create relay: %v", err)
 	}
 
+	common.ShutdownOnSignal(relay)
+
 	if err := relay.Start(); err != nil {
 		log.Fatalf("Server error: %v", err)
 	}
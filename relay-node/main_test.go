@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// writeConfig writes a YAML config to a temporary file and returns its path
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "relay.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestRelay builds a relay node from yaml
+func newTestRelay(t *testing.T, yaml string) *RelayNode {
+	t.Helper()
+	relay, err := NewRelayNode(writeConfig(t, yaml))
+	if err != nil {
+		t.Fatalf("NewRelayNode: %v", err)
+	}
+	return relay
+}
+
+// flakyHop is a next hop failing its first failures requests with 503
+type flakyHop struct {
+	server   *httptest.Server
+	failures int
+
+	mu        sync.Mutex
+	attempts  int
+	delivered []string
+}
+
+func newFlakyHop(t *testing.T, failures int) *flakyHop {
+	t.Helper()
+	h := &flakyHop{failures: failures}
+	h.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.attempts++
+		if h.attempts <= h.failures {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		h.delivered = append(h.delivered, r.Header.Get("X-Request-ID"))
+	}))
+	t.Cleanup(h.server.Close)
+	return h
+}
+
+// addr is the hop's host:port as used in config
+func (h *flakyHop) addr() string {
+	return h.server.Listener.Addr().String()
+}
+
+// counts returns how many forwards the hop saw and how many it accepted
+func (h *flakyHop) counts() (attempts, delivered int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.attempts, len(h.delivered)
+}
+
+// relayConfig is a config forwarding to hop with fast retries
+func relayConfig(hop string) string {
+	return fmt.Sprintf(`
+listen_port: 9000
+node_id: relay-test
+next_hops: ["%s"]
+retry:
+  max_attempts: 3
+  base_delay: 1
+  max_delay: 2
+  dead_letter_retries: 2
+`, hop)
+}
+
+func TestForwardRetriesFlakyHop(t *testing.T) {
+	hop := newFlakyHop(t, 2)
+	relay := newTestRelay(t, relayConfig(hop.addr()))
+
+	if err := relay.forwardTraffic(RelayTraffic{RequestID: "req-1", Data: []byte("data"), HopCount: 1}); err != nil {
+		t.Fatalf("forward after two failures: %v", err)
+	}
+	if attempts, delivered := hop.counts(); attempts != 3 || delivered != 1 {
+		t.Errorf("hop saw %d attempts and %d deliveries, want 3 and 1", attempts, delivered)
+	}
+}
+
+func TestForwardGivesUpAfterMaxAttempts(t *testing.T) {
+	hop := newFlakyHop(t, 100)
+	relay := newTestRelay(t, relayConfig(hop.addr()))
+
+	if err := relay.forwardTraffic(RelayTraffic{RequestID: "req-1", Data: []byte("data"), HopCount: 1}); err == nil {
+		t.Fatal("forward to a dead hop succeeded")
+	}
+	if attempts, _ := hop.counts(); attempts != 3 {
+		t.Errorf("hop saw %d attempts, want max_attempts 3", attempts)
+	}
+}
+
+func TestDeadLetterDelivery(t *testing.T) {
+	hop := newFlakyHop(t, 1)
+	relay := newTestRelay(t, relayConfig(hop.addr()))
+
+	relay.addDeadLetter(deadLetter{traffic: RelayTraffic{RequestID: "req-1", Timestamp: time.Now(), HopCount: 1}, attempts: 1})
+	relay.retryDeadLetters()
+	if len(relay.deadLetters) != 1 {
+		t.Fatalf("failed retry left %d dead letters, want 1", len(relay.deadLetters))
+	}
+	relay.retryDeadLetters()
+	if len(relay.deadLetters) != 0 || relay.dropped != 0 {
+		t.Errorf("after delivery: %d dead letters, %d dropped", len(relay.deadLetters), relay.dropped)
+	}
+	if _, delivered := hop.counts(); delivered != 1 {
+		t.Errorf("hop accepted %d items, want 1", delivered)
+	}
+}
+
+func TestDeadLetterDroppedAfterRetries(t *testing.T) {
+	hop := newFlakyHop(t, 100)
+	relay := newTestRelay(t, relayConfig(hop.addr()))
+
+	relay.addDeadLetter(deadLetter{traffic: RelayTraffic{RequestID: "req-1", Timestamp: time.Now(), HopCount: 1}, attempts: 1})
+	for i := 0; i < 2; i++ {
+		relay.retryDeadLetters()
+	}
+	if len(relay.deadLetters) != 0 || relay.dropped != 1 {
+		t.Errorf("after exhausting retries: %d dead letters, %d dropped, want 0 and 1", len(relay.deadLetters), relay.dropped)
+	}
+	if attempts, _ := hop.counts(); attempts != 2 {
+		t.Errorf("hop saw %d dead-letter retries, want dead_letter_retries 2", attempts)
+	}
+}
+
+func TestInvalidConfigs(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want string
+	}{
+		{"listen_port: 9000\nnode_id: r\n", "next_hops or gateway_url must be set"},
+		{"listen_port: 9000\nnext_hops: [\"a:1\"]\n", "node_id must be set"},
+		{"listen_port: 0\nnode_id: r\nnext_hops: [\"a:1\"]\n", "listen_port must be between 1 and 65535"},
+		{"listen_port: 9000\nnode_id: r\nnext_hops: [{address: \"a:1\", weight: -1}]\n", "negative weight"},
+		{"listen_port: 9000\nnode_id: r\nnext_hops: [\"a:1\"]\nbuffer_store: /tmp/buf\n", "buffer_store requires traffic_mixing"},
+	}
+	for _, tt := range tests {
+		_, err := loadRelayConfig(writeConfig(t, tt.yaml))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.yaml, err, tt.want)
+		}
+	}
+}
+
+func TestTightBudgetSkipsBuffering(t *testing.T) {
+	hop := newFlakyHop(t, 0)
+	relay := newTestRelay(t, relayConfig(hop.addr())+"traffic_mixing: true\n")
+
+	relayRequest := func(id string, deadline time.Time) int {
+		req := httptest.NewRequest(http.MethodPost, "/relay", strings.NewReader("data"))
+		req.Header.Set("X-Request-ID", id)
+		common.SetDeadlineHeader(req.Header, deadline)
+		recorder := httptest.NewRecorder()
+		relay.handleRelay(recorder, req)
+		return recorder.Code
+	}
+
+	if code := relayRequest("relaxed", time.Time{}); code != http.StatusAccepted {
+		t.Errorf("no budget: status %d, want 202 buffered", code)
+	}
+	if code := relayRequest("urgent", time.Now()); code != http.StatusOK {
+		t.Errorf("spent budget: status %d, want 200 forwarded at once", code)
+	}
+	if _, delivered := hop.counts(); delivered != 1 {
+		t.Errorf("hop received %d requests, want only the urgent one", delivered)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// registrationGateway is a stub gateway handing out numbered tokens
+type registrationGateway struct {
+	mu            sync.Mutex
+	registrations int
+}
+
+func (g *registrationGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	g.registrations++
+	token := fmt.Sprintf("token-%d", g.registrations)
+	g.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]string{"node_id": "relay-test", "token": token})
+}
+
+func (g *registrationGateway) count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.registrations
+}
+
+// token returns the relay's current gateway token
+func (r *RelayNode) token() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.config.AuthToken
+}
+
+// waitForToken waits until the relay holds a gateway token other than old
+func waitForToken(t *testing.T, relay *RelayNode, old string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if token := relay.token(); token != "" && token != old {
+			return token
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("relay never registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// noRegistrationDelay lets relays register as soon as they start for the
+// rest of the test
+func noRegistrationDelay(t *testing.T) {
+	saved := registrationDelay
+	registrationDelay = 0
+	t.Cleanup(func() { registrationDelay = saved })
+}
+
+// gatewayRelayConfig is a final relay config registering at gatewayURL
+func gatewayRelayConfig(gatewayURL string) string {
+	return fmt.Sprintf(`
+listen_port: 9000
+node_id: relay-test
+gateway_url: "%s"
+retry:
+  base_delay: 10
+  max_delay: 20
+`, gatewayURL)
+}
+
+func TestRegistersOnceGatewayComesUp(t *testing.T) {
+	noRegistrationDelay(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	relay := newTestRelay(t, gatewayRelayConfig("http://"+addr))
+
+	// Registration fails while nothing listens
+	time.Sleep(100 * time.Millisecond)
+	relay.mu.RLock()
+	failures := relay.regFailures
+	relay.mu.RUnlock()
+	if failures == 0 || relay.ready() == nil {
+		t.Fatalf("%d registration failures recorded and ready %v before the gateway is up", failures, relay.ready())
+	}
+
+	gateway := &registrationGateway{}
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("port %s taken in the meantime: %v", addr, err)
+	}
+	server := httptest.NewUnstartedServer(gateway)
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	waitForToken(t, relay, "")
+	if err := relay.ready(); err != nil {
+		t.Errorf("not ready once registered: %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	relay.healthCheck(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var health map[string]any
+	json.NewDecoder(recorder.Body).Decode(&health)
+	if health["registered"] != true || health["registration_failures"] != 0.0 {
+		t.Errorf("health %v, want registered with failures reset", health)
+	}
+}
+
+func TestReregistersAfterRejectedToken(t *testing.T) {
+	noRegistrationDelay(t)
+	gateway := &registrationGateway{}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	relay := newTestRelay(t, gatewayRelayConfig(server.URL))
+	first := waitForToken(t, relay, "")
+
+	relay.invalidateToken(first)
+	second := waitForToken(t, relay, first)
+	if gateway.count() != 2 {
+		t.Errorf("gateway saw %d registrations, want 2", gateway.count())
+	}
+
+	// A stale rejection doesn't drop the new token
+	relay.invalidateToken(first)
+	if relay.token() != second {
+		t.Errorf("token %q, want %q kept", relay.token(), second)
+	}
+}
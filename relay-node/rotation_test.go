@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// healthHop is a next hop whose /health answers with status
+func healthHop(t *testing.T, status int) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String()
+}
+
+func TestRotationSkipsUnhealthyHop(t *testing.T) {
+	a := healthHop(t, http.StatusOK)
+	b := healthHop(t, http.StatusServiceUnavailable)
+	c := healthHop(t, http.StatusOK)
+	relay := newTestRelay(t, fmt.Sprintf(`
+listen_port: 9000
+node_id: relay-test
+next_hops: ["%s", "%s", "%s"]
+`, a, b, c))
+
+	relay.probeAll(http.DefaultClient)
+
+	relay.mu.Lock()
+	relay.advanceHop()
+	relay.mu.Unlock()
+	if got := relay.selectHop(); got != c {
+		t.Errorf("rotated from the first hop to %s, want %s past the unhealthy one", got, c)
+	}
+}
+
+func TestProbeMovesOffDeadCurrentHop(t *testing.T) {
+	a := healthHop(t, http.StatusServiceUnavailable)
+	b := healthHop(t, http.StatusOK)
+	relay := newTestRelay(t, fmt.Sprintf(`
+listen_port: 9000
+node_id: relay-test
+next_hops: ["%s", "%s"]
+`, a, b))
+
+	relay.probeAll(http.DefaultClient)
+	if got := relay.selectHop(); got != b {
+		t.Errorf("current hop %s after probing, want the healthy %s", got, b)
+	}
+}
+
+func TestFailedForwardSwitchesHop(t *testing.T) {
+	relay := newTestRelay(t, `
+listen_port: 9000
+node_id: relay-test
+next_hops: ["a:1", "b:1"]
+`)
+
+	relay.markHopFailed("a:1")
+	if got := relay.selectHop(); got != "b:1" {
+		t.Errorf("current hop %s after a:1 failed, want b:1", got)
+	}
+}
+
+func TestWeightedHopSelection(t *testing.T) {
+	relay := newTestRelay(t, `
+listen_port: 9000
+node_id: relay-test
+next_hops:
+  - address: "a:1"
+    weight: 1
+  - address: "b:1"
+    weight: 3
+  - "c:1"
+`)
+
+	const picks = 20000
+	counts := make(map[string]int)
+	for i := 0; i < picks; i++ {
+		counts[relay.selectHop()]++
+	}
+
+	// The plain entry counts as weight 1, for a total of 5
+	for hop, weight := range map[string]int{"a:1": 1, "b:1": 3, "c:1": 1} {
+		want := float64(picks) * float64(weight) / 5
+		if got := float64(counts[hop]); got < want*0.9 || got > want*1.1 {
+			t.Errorf("%s picked %v times, want about %v", hop, got, want)
+		}
+	}
+}
+
+func TestWeightedSelectionAvoidsUnhealthyHops(t *testing.T) {
+	relay := newTestRelay(t, `
+listen_port: 9000
+node_id: relay-test
+next_hops:
+  - address: "a:1"
+    weight: 9
+  - address: "b:1"
+    weight: 1
+`)
+
+	relay.markHopFailed("a:1")
+	for i := 0; i < 100; i++ {
+		if got := relay.selectHop(); got != "b:1" {
+			t.Fatalf("picked unhealthy hop %s", got)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+// compactThreshold is the number of completed records after which the
+// store file is rewritten with only pending traffic
+const compactThreshold = 1000
+
+// maxStoreRecord is the longest line load accepts
+const maxStoreRecord = 64 * 1024 * 1024
+
+// maxStoredBody is the largest traffic body that fits a store record: JSON
+// base64 inflates it by 4/3, and the rest of the record is small
+const maxStoredBody = maxStoreRecord / 2
+
+// storeRecord is one line of the buffer store's write-ahead log
+type storeRecord struct {
+	Op      string        `json:"op"` // "add" or "done"
+	ID      uint64        `json:"id"`
+	Traffic *RelayTraffic `json:"traffic,omitempty"`
+}
+
+// trafficStore persists buffered traffic so a restarted relay can forward
+// whatever it accepted but had not yet sent
+type trafficStore struct {
+	path    string
+	file    *os.File
+	pending map[uint64]RelayTraffic
+	nextID  uint64
+	done    int
+	mu      sync.Mutex
+}
+
+// openTrafficStore opens or creates the store at path and loads the
+// traffic that was still pending when it was last written
+func openTrafficStore(path string) (*trafficStore, error) {
+	store := &trafficStore{
+		path:    path,
+		pending: make(map[uint64]RelayTraffic),
+	}
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	// Start from a compacted file so old records don't accumulate
+	if err := store.compact(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// load replays the write-ahead log
+func (s *trafficStore) load() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open buffer store: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxStoreRecord)
+	for scanner.Scan() {
+		var rec storeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A torn final write after a crash; everything before it is intact
+			break
+		}
+
+		switch rec.Op {
+		case "add":
+			if rec.Traffic != nil {
+				traffic := *rec.Traffic
+				traffic.storeID = rec.ID
+				s.pending[rec.ID] = traffic
+			}
+		case "done":
+			delete(s.pending, rec.ID)
+		}
+
+		if rec.ID >= s.nextID {
+			s.nextID = rec.ID + 1
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Pending returns unforwarded traffic in arrival order
+func (s *trafficStore) Pending() []RelayTraffic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	traffic := make([]RelayTraffic, 0, len(s.pending))
+	for _, t := range s.pending {
+		traffic = append(traffic, t)
+	}
+	sort.Slice(traffic, func(i, j int) bool {
+		return traffic[i].storeID < traffic[j].storeID
+	})
+
+	return traffic
+}
+
+// Add persists traffic before it is acknowledged and assigns its store ID
+func (s *trafficStore) Add(traffic *RelayTraffic) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	traffic.storeID = s.nextID
+	s.nextID++
+
+	if err := s.append(storeRecord{Op: "add", ID: traffic.storeID, Traffic: traffic}); err != nil {
+		return err
+	}
+
+	s.pending[traffic.storeID] = *traffic
+	return nil
+}
+
+// Done removes traffic that was forwarded or dropped
+func (s *trafficStore) Done(traffic RelayTraffic) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.pending[traffic.storeID]; !exists {
+		return
+	}
+	delete(s.pending, traffic.storeID)
+
+	if err := s.append(storeRecord{Op: "done", ID: traffic.storeID}); err != nil {
+		// Worst case the item is forwarded again after a restart
+		log.Printf("Buffer store error: %v", err)
+		return
+	}
+
+	s.done++
+	if s.done >= compactThreshold {
+		if err := s.compact(); err != nil {
+			log.Printf("Buffer store error: %v", err)
+		}
+	}
+}
+
+// append writes one record and syncs it to disk. Callers must hold s.mu.
+func (s *trafficStore) append(rec storeRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("buffer store write error: %w", err)
+	}
+	return s.file.Sync()
+}
+
+// compact rewrites the store with only pending traffic. Callers must hold
+// s.mu or have exclusive access.
+func (s *trafficStore) compact() error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create buffer store: %w", err)
+	}
+
+	ids := make([]uint64, 0, len(s.pending))
+	for id := range s.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	writer := bufio.NewWriter(tmp)
+	for _, id := range ids {
+		traffic := s.pending[id]
+		line, err := json.Marshal(storeRecord{Op: "add", ID: id, Traffic: &traffic})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		writer.Write(append(line, '\n'))
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("buffer store write error: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to replace buffer store: %w", err)
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to reopen buffer store: %w", err)
+	}
+
+	s.done = 0
+	return nil
+}
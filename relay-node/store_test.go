@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBufferedTrafficSurvivesRestart(t *testing.T) {
+	hop := newFlakyHop(t, 0)
+	config := fmt.Sprintf(`
+listen_port: 9000
+node_id: relay-test
+next_hops: ["%s"]
+traffic_mixing: true
+buffer_store: %s
+`, hop.addr(), filepath.Join(t.TempDir(), "buffer.log"))
+
+	first := newTestRelay(t, config)
+	for _, id := range []string{"req-1", "req-2", "req-3"} {
+		req := httptest.NewRequest(http.MethodPost, "/relay", strings.NewReader("data "+id))
+		req.Header.Set("X-Request-ID", id)
+		recorder := httptest.NewRecorder()
+		first.handleRelay(recorder, req)
+		if recorder.Code != http.StatusAccepted {
+			t.Fatalf("%s: status %d, want 202", id, recorder.Code)
+		}
+	}
+
+	// A relay restarted over the same store forwards what the first one
+	// accepted but never sent
+	second := newTestRelay(t, config)
+	if len(second.trafficBuffer) != 3 {
+		t.Fatalf("restored %d items, want 3", len(second.trafficBuffer))
+	}
+	second.flushBuffer()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, delivered := hop.counts(); delivered == 3 && len(second.store.Pending()) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			_, delivered := hop.counts()
+			t.Fatalf("%d of 3 items delivered, %d still pending", delivered, len(second.store.Pending()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	hop.mu.Lock()
+	delivered := slices.Sorted(slices.Values(hop.delivered))
+	hop.mu.Unlock()
+	if !slices.Equal(delivered, []string{"req-1", "req-2", "req-3"}) {
+		t.Errorf("delivered %v", delivered)
+	}
+
+	// Forwarded items are gone from the store
+	if third := newTestRelay(t, config); len(third.trafficBuffer) != 0 {
+		t.Errorf("restored %d forwarded items", len(third.trafficBuffer))
+	}
+}
+
+func TestOversizedTrafficRefused(t *testing.T) {
+	hop := newFlakyHop(t, 0)
+	config := fmt.Sprintf(`
+listen_port: 9000
+node_id: relay-test
+next_hops: ["%s"]
+traffic_mixing: true
+buffer_store: %s
+max_body_size: 1024
+`, hop.addr(), filepath.Join(t.TempDir(), "buffer.log"))
+
+	relay := newTestRelay(t, config)
+	req := httptest.NewRequest(http.MethodPost, "/relay", bytes.NewReader(make([]byte, 1025)))
+	req.Header.Set("X-Request-ID", "huge")
+	recorder := httptest.NewRecorder()
+	relay.handleRelay(recorder, req)
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413", recorder.Code)
+	}
+	if pending := relay.store.Pending(); len(pending) != 0 {
+		t.Errorf("%d oversized items stored", len(pending))
+	}
+
+	// The relay still starts over its store
+	newTestRelay(t, config)
+}
+
+func TestLargestStoredBodyReloads(t *testing.T) {
+	line, err := json.Marshal(storeRecord{Op: "add", ID: 1, Traffic: &RelayTraffic{
+		RequestID: "largest",
+		Data:      make([]byte, maxStoredBody),
+		FromNode:  "relay-1",
+		Timestamp: time.Now(),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(line) >= maxStoreRecord {
+		t.Errorf("a %d-byte body is stored in a %d-byte record, over the %d load accepts", maxStoredBody, len(line), maxStoreRecord)
+	}
+
+	_, err = loadRelayConfig(writeConfig(t, fmt.Sprintf(`
+listen_port: 9000
+node_id: relay-test
+next_hops: ["a:1"]
+traffic_mixing: true
+buffer_store: /tmp/buf
+max_body_size: %d
+`, maxStoredBody+1)))
+	if err == nil || !strings.Contains(err.Error(), "max_body_size must be at most") {
+		t.Errorf("got %v, want a body too large to store refused", err)
+	}
+}
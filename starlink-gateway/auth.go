@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"slices"
+)
+
+// Authenticator decides whether a node may use the gateway, so deployments
+// can verify JWTs, ask an external auth service or trust an mTLS identity
+// instead of the built-in checks. An error means the decision could not be
+// made, as opposed to a rejected credential.
+type Authenticator interface {
+	Authenticate(nodeID, credential string) (bool, error)
+}
+
+// tokenAuthenticator is the default for /proxy: the credential must be a
+// token issued at startup, by /register or /rotate, or the node's
+// pre-shared key
+type tokenAuthenticator struct {
+	g *StarlinkGateway
+}
+
+func (a tokenAuthenticator) Authenticate(nodeID, token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+
+	a.g.mu.RLock()
+	defer a.g.mu.RUnlock()
+
+	if expected, exists := a.g.config.NodeTokens[nodeID]; exists &&
+		subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1 {
+		return true, nil
+	}
+
+	expected, exists := a.g.config.PreSharedKeys[nodeID]
+	return exists && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1, nil
+}
+
+// nodeListAuthenticator is the default for /register: any node listed in
+// authenticated_nodes may register, whatever secret it sends
+type nodeListAuthenticator struct {
+	nodes []string
+}
+
+func (a nodeListAuthenticator) Authenticate(nodeID, _ string) (bool, error) {
+	return slices.Contains(a.nodes, nodeID), nil
+}
+
+// SetAuthenticators replaces how nodes are checked: proxy receives the
+// X-Auth-Token of /proxy requests, register the secret sent to /register.
+// A nil authenticator keeps the current one. Revoked nodes are refused
+// whatever the authenticators say.
+func (g *StarlinkGateway) SetAuthenticators(proxy, register Authenticator) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if proxy != nil {
+		g.proxyAuth = proxy
+	}
+	if register != nil {
+		g.registerAuth = register
+	}
+}
+
+// authenticate checks a node's credential with auth, answering the request
+// itself and returning false if the node is refused
+func (g *StarlinkGateway) authenticate(w http.ResponseWriter, auth Authenticator, nodeID, credential string) bool {
+	if g.isRevoked(nodeID) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		log.Printf("Refused revoked node %s", nodeID)
+		return false
+	}
+
+	ok, err := auth.Authenticate(nodeID, credential)
+	if err != nil {
+		http.Error(w, "Authentication unavailable", http.StatusServiceUnavailable)
+		log.Printf("Authentication error for node %s: %v", nodeID, err)
+		return false
+	}
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		log.Printf("Authentication failed for node %s", nodeID)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mockAuthenticator accepts the credentials it lists, failing every check
+// with err if set, and remembers the nodes it was asked about
+type mockAuthenticator struct {
+	credentials map[string]string
+	err         error
+
+	mu    sync.Mutex
+	asked []string
+}
+
+func (a *mockAuthenticator) Authenticate(nodeID, credential string) (bool, error) {
+	a.mu.Lock()
+	a.asked = append(a.asked, nodeID)
+	a.mu.Unlock()
+
+	if a.err != nil {
+		return false, a.err
+	}
+	expected, exists := a.credentials[nodeID]
+	return exists && expected == credential, nil
+}
+
+func TestMockProxyAuthenticator(t *testing.T) {
+	gateway := newTestGateway(t, "listen_port: 8443\n")
+	auth := &mockAuthenticator{credentials: map[string]string{"relay-jwt": "signed-token"}}
+	gateway.SetAuthenticators(auth, nil)
+
+	if code := authStatus(gateway, "relay-jwt", "signed-token"); code != http.StatusBadRequest {
+		t.Errorf("accepted credential: status %d, want past authentication", code)
+	}
+	if code := authStatus(gateway, "relay-jwt", "forged-token"); code != http.StatusUnauthorized {
+		t.Errorf("rejected credential: status %d, want 401", code)
+	}
+	if len(auth.asked) != 2 {
+		t.Errorf("authenticator asked %d times, want every /proxy request checked", len(auth.asked))
+	}
+
+	auth.err = errors.New("auth service down")
+	if code := authStatus(gateway, "relay-jwt", "signed-token"); code != http.StatusServiceUnavailable {
+		t.Errorf("authenticator error: status %d, want 503", code)
+	}
+}
+
+func TestMockRegisterAuthenticator(t *testing.T) {
+	gateway := newTestGateway(t, "listen_port: 8443\nauthenticated_nodes: [relay-listed]\n")
+	gateway.SetAuthenticators(nil, &mockAuthenticator{credentials: map[string]string{"relay-mtls": "cert-identity"}})
+
+	register := func(node, secret string) int {
+		body := `{"node_id": "` + node + `", "secret": "` + secret + `"}`
+		recorder := httptest.NewRecorder()
+		gateway.handleNodeRegistration(recorder, httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body)))
+		return recorder.Code
+	}
+
+	if code := register("relay-mtls", "cert-identity"); code != http.StatusOK {
+		t.Errorf("accepted node: status %d, want 200", code)
+	}
+	if _, issued := gateway.config.NodeTokens["relay-mtls"]; !issued {
+		t.Error("no token issued to the accepted node")
+	}
+	if code := register("relay-mtls", "other-identity"); code != http.StatusUnauthorized {
+		t.Errorf("rejected secret: status %d, want 401", code)
+	}
+	// The node list no longer decides once replaced
+	if code := register("relay-listed", ""); code != http.StatusUnauthorized {
+		t.Errorf("listed node: status %d, want 401 with the mock in charge", code)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// callbackNode is a stub origin node receiving batched results
+type callbackNode struct {
+	server    *httptest.Server
+	responses chan *common.GatewayResponse
+}
+
+func newCallbackNode(t *testing.T) *callbackNode {
+	t.Helper()
+	n := &callbackNode{responses: make(chan *common.GatewayResponse, 10)}
+	n.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var response common.GatewayResponse
+		if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if id := r.Header.Get("X-Request-ID"); id != response.RequestID {
+			t.Errorf("X-Request-ID %q for response %q", id, response.RequestID)
+		}
+		n.responses <- &response
+	}))
+	t.Cleanup(n.server.Close)
+	return n
+}
+
+// wait returns the next response delivered to the node
+func (n *callbackNode) wait(t *testing.T) *common.GatewayResponse {
+	t.Helper()
+	select {
+	case response := <-n.responses:
+		return response
+	case <-time.After(5 * time.Second):
+		t.Fatal("no response delivered to the callback")
+		return nil
+	}
+}
+
+// waitQueued waits until n requests are queued for the next batch
+func waitQueued(t *testing.T, g *StarlinkGateway, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		g.mu.RLock()
+		queued := len(g.trafficBatch)
+		g.mu.RUnlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d requests queued", queued, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startRelay builds the relay node, runs it with config on port and waits
+// until its /health answers
+func startRelay(t *testing.T, port int, config string) {
+	t.Helper()
+	work := t.TempDir()
+
+	binary := filepath.Join(work, "relay-node")
+	build := exec.Command("go", "build", "-o", binary, "./relay-node")
+	build.Dir = ".."
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building relay-node: %v\n%s", err, out)
+	}
+
+	configPath := filepath.Join(work, "relay.yaml")
+	if err := os.WriteFile(configPath, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	cmd := exec.Command(binary, configPath)
+	cmd.Stdout, cmd.Stderr = &logs, &logs
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("relay-node output:\n%s", logs.String())
+		}
+	})
+
+	health := fmt.Sprintf("http://127.0.0.1:%d/health", port)
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if resp, err := http.Get(health); err == nil {
+			resp.Body.Close()
+			return
+		}
+	}
+	t.Fatalf("relay-node did not come up on port %d", port)
+}
+
+func TestBatchedResponseDeliveredToCallback(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Target", "reached")
+		w.Write([]byte("batched"))
+	}))
+	defer target.Close()
+	node := newCallbackNode(t)
+
+	gateway := newTestGateway(t, `
+listen_port: 8443
+authenticated_nodes: ["relay-1"]
+anonymization:
+  traffic_mixing: true
+destinations:
+  allow: ["127.0.0.1/32"]
+`)
+
+	body := `{"request_id": "req-7", "target_url": "` + target.URL + `/", "method": "GET", "callback_url": "` + node.server.URL + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/proxy", strings.NewReader(body))
+	req.Header.Set("X-Node-ID", "relay-1")
+	req.Header.Set("X-Auth-Token", gateway.config.NodeTokens["relay-1"])
+	recorder := httptest.NewRecorder()
+	gateway.handleProxyRequest(recorder, req)
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("status %d, want 202 queued", recorder.Code)
+	}
+
+	gateway.processBatch()
+	response := node.wait(t)
+	if response.RequestID != "req-7" || response.StatusCode != http.StatusOK || string(response.Body) != "batched" {
+		t.Errorf("callback got %s %d %q", response.RequestID, response.StatusCode, response.Body)
+	}
+	if response.Headers["X-Target"] != "reached" {
+		t.Errorf("callback headers %v, want the target's", response.Headers)
+	}
+}
+
+func TestInvalidCallbackRejectedAtIngest(t *testing.T) {
+	gateway := newTestGateway(t, `
+listen_port: 8443
+authenticated_nodes: ["relay-1"]
+anonymization:
+  traffic_mixing: true
+`)
+
+	for _, callback := range []string{"ftp://node/", "/relative", "http://"} {
+		body := `{"request_id": "r", "target_url": "http://example.com/", "method": "GET", "callback_url": "` + callback + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/proxy", strings.NewReader(body))
+		req.Header.Set("X-Node-ID", "relay-1")
+		req.Header.Set("X-Auth-Token", gateway.config.NodeTokens["relay-1"])
+		recorder := httptest.NewRecorder()
+		gateway.handleProxyRequest(recorder, req)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", callback, recorder.Code)
+		}
+	}
+}
+
+func TestGatewayResponseHeadersWritten(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Target", "reached")
+		w.Write([]byte(`{}`))
+	}))
+	defer target.Close()
+
+	gateway := newTestGateway(t, `
+listen_port: 8443
+authenticated_nodes: ["relay-1"]
+destinations:
+  allow: ["127.0.0.1/32"]
+`)
+
+	rec := proxyRequest(gateway, "relay-1", target.URL+"/")
+	if rec.Code != http.StatusOK || rec.Body.String() != "{}" {
+		t.Fatalf("got %d %q", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("X-Target") != "reached" || rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("headers %v, want the target's", rec.Header())
+	}
+}
+
+// TestCallbackThroughRelay sends a batched request through a real relay
+// node and checks the result reaches the node that asked for it
+func TestCallbackThroughRelay(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs a relay node")
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Target", "reached")
+		w.Write([]byte("via relay"))
+	}))
+	defer target.Close()
+	node := newCallbackNode(t)
+
+	gateway := newTestGateway(t, `
+listen_port: 8443
+authenticated_nodes: ["relay-1"]
+anonymization:
+  traffic_mixing: true
+destinations:
+  allow: ["127.0.0.1/32"]
+`)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy", gateway.handleProxyRequest)
+	mux.HandleFunc("/register", gateway.handleNodeRegistration)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	gateway.mu.RLock()
+	token := gateway.config.NodeTokens["relay-1"]
+	gateway.mu.RUnlock()
+	startRelay(t, port, fmt.Sprintf(`
+listen_port: %d
+node_id: relay-1
+gateway_url: "%s"
+auth_token: "%s"
+traffic_mixing: false
+`, port, server.URL, token))
+
+	body := `{"request_id": "req-relayed", "target_url": "` + target.URL + `/", "method": "GET", "callback_url": "` + node.server.URL + `"}`
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/relay", port), strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Request-ID", "req-relayed")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("relay answered %d", resp.StatusCode)
+	}
+
+	waitQueued(t, gateway, 1)
+	gateway.processBatch()
+	response := node.wait(t)
+	if response.RequestID != "req-relayed" || response.StatusCode != http.StatusOK || string(response.Body) != "via relay" {
+		t.Errorf("callback got %s %d %q", response.RequestID, response.StatusCode, response.Body)
+	}
+	if response.Headers["X-Target"] != "reached" {
+		t.Errorf("callback headers %v, want the target's", response.Headers)
+	}
+}
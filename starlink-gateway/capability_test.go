@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+func TestCapabilityCheck(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, forger, _ := ed25519.GenerateKey(nil)
+
+	gateway := newTestGateway(t, `
+listen_port: 8443
+gateway_id: gw-a
+capability_public_key: "`+hex.EncodeToString(public)+`"
+`)
+
+	sign := func(key ed25519.PrivateKey, node, gatewayID string, expires time.Duration) string {
+		token, err := common.SignCapability(common.Capability{NodeID: node, Gateways: []string{gatewayID}, ExpiresAt: time.Now().Add(expires)}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", sign(private, "relay-1", "gw-a", time.Hour), true},
+		{"missing", "", false},
+		{"forged", sign(forger, "relay-1", "gw-a", time.Hour), false},
+		{"expired", sign(private, "relay-1", "gw-a", -time.Minute), false},
+		{"other node", sign(private, "relay-2", "gw-a", time.Hour), false},
+		{"other gateway", sign(private, "relay-1", "gw-b", time.Hour), false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/proxy", nil)
+		if tt.token != "" {
+			req.Header.Set("X-Capability", tt.token)
+		}
+		if err := gateway.checkCapability(req, "relay-1"); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestCapabilityNotRequiredWithoutKey(t *testing.T) {
+	gateway := newTestGateway(t, "listen_port: 8443\n")
+	if err := gateway.checkCapability(httptest.NewRequest(http.MethodPost, "/proxy", nil), "relay-1"); err != nil {
+		t.Errorf("got %v with no capability key configured", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBlockedDestinationRefused(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("reached"))
+	}))
+	defer target.Close()
+	port := target.URL[strings.LastIndex(target.URL, ":"):]
+
+	gateway := newTestGateway(t, `
+listen_port: 8443
+authenticated_nodes: ["relay-1"]
+destinations:
+  hosts: ["blocked.example"]
+  allow: ["127.0.0.1/32"]
+`)
+
+	if rec := proxyRequest(gateway, "relay-1", target.URL+"/"); rec.Code != http.StatusOK || rec.Body.String() != "reached" {
+		t.Fatalf("allowed target: %d %q", rec.Code, rec.Body)
+	}
+
+	for _, blocked := range []string{
+		"http://blocked.example/",
+		"http://api.blocked.example/",
+		"ftp://127.0.0.1" + port + "/",
+		"http://169.254.169.254/",
+	} {
+		if rec := proxyRequest(gateway, "relay-1", blocked); rec.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", blocked, rec.Code)
+		}
+	}
+	if got := gateway.blocked.Value(); got != 4 {
+		t.Errorf("blocked counter %d, want 4", got)
+	}
+}
+
+func TestHostnameResolvingToDeniedAddressRefused(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("denied target reached")
+	}))
+	defer target.Close()
+	port := target.URL[strings.LastIndex(target.URL, ":"):]
+
+	// Loopback is denied by default; localhost only resolves to it at dial time
+	gateway := newTestGateway(t, "listen_port: 8443\nauthenticated_nodes: [\"relay-1\"]\n")
+
+	if rec := proxyRequest(gateway, "relay-1", "http://localhost"+port+"/"); rec.Code != http.StatusForbidden {
+		t.Errorf("status %d, want 403", rec.Code)
+	}
+	if got := gateway.blocked.Value(); got != 1 {
+		t.Errorf("blocked counter %d, want 1", got)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimingJitterVariesWithinBounds(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	for _, distribution := range []string{"uniform", "exponential"} {
+		gateway := newTestGateway(t, `
+listen_port: 8443
+authenticated_nodes: ["relay-1"]
+anonymization:
+  timing_jitter: 40
+  jitter_distribution: `+distribution+`
+destinations:
+  allow: ["127.0.0.1/32"]
+`)
+
+		shortest, longest := time.Hour, time.Duration(0)
+		for i := 0; i < 20; i++ {
+			start := time.Now()
+			if rec := proxyRequest(gateway, "relay-1", target.URL+"/"); rec.Code != http.StatusOK {
+				t.Fatalf("%s: status %d", distribution, rec.Code)
+			}
+			elapsed := time.Since(start)
+			shortest, longest = min(shortest, elapsed), max(longest, elapsed)
+		}
+
+		// The target answers at once, so the spread is the jitter's
+		if longest > 40*time.Millisecond+250*time.Millisecond {
+			t.Errorf("%s: a request took %v, beyond the 40ms jitter", distribution, longest)
+		}
+		if longest-shortest < 5*time.Millisecond {
+			t.Errorf("%s: requests took %v to %v, want the delay to vary", distribution, shortest, longest)
+		}
+	}
+}
+
+func TestUnknownJitterDistributionRejected(t *testing.T) {
+	_, err := loadGatewayConfig(writeConfig(t, "listen_port: 8443\nanonymization:\n  jitter_distribution: normal\n"))
+	if err == nil || !strings.Contains(err.Error(), `unknown anonymization.jitter_distribution "normal"`) {
+		t.Errorf("got %v, want the distribution rejected", err)
+	}
+}
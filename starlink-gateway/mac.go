@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// MACRandomizer changes the hardware address of a network interface
+type MACRandomizer interface {
+	Randomize(iface string) error
+}
+
+// commandRandomizer runs an operator-supplied command. The interface name
+// and a generated MAC are appended as the final two arguments.
+type commandRandomizer struct {
+	command string
+}
+
+func (c *commandRandomizer) Randomize(iface string) error {
+	fields := strings.Fields(c.command)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty mac_command")
+	}
+
+	mac := randomMAC()
+	args := append(fields[1:], iface, mac.String())
+	output, err := exec.Command(fields[0], args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w: %s", fields[0], err, strings.TrimSpace(string(output)))
+	}
+
+	log.Printf("Randomized MAC of %s to %s via %s", iface, mac, fields[0])
+	return nil
+}
+
+// newMACRandomizer returns the configured command hook, or the platform
+// implementation when no command is set
+func newMACRandomizer(command string) MACRandomizer {
+	if command != "" {
+		return &commandRandomizer{command: command}
+	}
+	return platformMACRandomizer()
+}
+
+// randomizeMAC applies the randomizer to the configured interface. Only
+// the named interface is touched: taking down every link on the host would
+// cut off the operator as well as the gateway.
+func randomizeMAC(randomizer MACRandomizer, iface string) {
+	if err := randomizer.Randomize(iface); err != nil {
+		log.Printf("MAC randomization failed for %s: %v", iface, err)
+	}
+}
+
+// randomMAC generates a locally administered unicast address
+func randomMAC() net.HardwareAddr {
+	mac := make(net.HardwareAddr, 6)
+	rand.Read(mac)
+	mac[0] = (mac[0] | 0x02) & 0xfe
+	return mac
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// linuxRandomizer sets the address with iproute2; the link is taken down
+// for the change, which briefly interrupts traffic on it
+type linuxRandomizer struct{}
+
+func platformMACRandomizer() MACRandomizer {
+	return &linuxRandomizer{}
+}
+
+func (l *linuxRandomizer) Randomize(iface string) (err error) {
+	mac := randomMAC()
+
+	if err := ip("link", "set", "dev", iface, "down"); err != nil {
+		return err
+	}
+	// The link comes back up even if the new address was refused
+	defer func() {
+		if upErr := ip("link", "set", "dev", iface, "up"); upErr != nil {
+			err = errors.Join(err, upErr)
+		}
+	}()
+
+	if err := ip("link", "set", "dev", iface, "address", mac.String()); err != nil {
+		return err
+	}
+
+	log.Printf("Randomized MAC of %s to %s", iface, mac)
+	return nil
+}
+
+// ip runs one iproute2 command
+func ip(args ...string) error {
+	output, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// unsupportedRandomizer reports that no built-in implementation exists
+type unsupportedRandomizer struct{}
+
+func platformMACRandomizer() MACRandomizer {
+	return &unsupportedRandomizer{}
+}
+
+func (u *unsupportedRandomizer) Randomize(iface string) error {
+	return fmt.Errorf("MAC randomization is not supported on %s; set mac_command to a platform script", runtime.GOOS)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mockRandomizer records the interfaces it was asked to randomize
+type mockRandomizer struct {
+	calls []string
+	err   error
+}
+
+func (m *mockRandomizer) Randomize(iface string) error {
+	m.calls = append(m.calls, iface)
+	return m.err
+}
+
+func TestRandomizeMACUsesConfiguredInterface(t *testing.T) {
+	mock := &mockRandomizer{}
+	randomizeMAC(mock, "wlan0")
+	if len(mock.calls) != 1 || mock.calls[0] != "wlan0" {
+		t.Errorf("randomizer calls %v, want [wlan0]", mock.calls)
+	}
+
+	// A failing randomizer is logged, not fatal
+	randomizeMAC(&mockRandomizer{err: errors.New("unsupported")}, "wlan0")
+}
+
+// hookScript writes a mac_command script recording its arguments to a
+// file, and returns the script and that file
+func hookScript(t *testing.T) (script, record string) {
+	t.Helper()
+	dir := t.TempDir()
+	script, record = filepath.Join(dir, "randomize.sh"), filepath.Join(dir, "calls")
+	body := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\n", record)
+	if err := os.WriteFile(script, []byte(body), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return script, record
+}
+
+func TestMACHookInvokedOnStartup(t *testing.T) {
+	script, record := hookScript(t)
+	newTestGateway(t, fmt.Sprintf(`
+listen_port: 8443
+anonymization:
+  mac_randomization: true
+  mac_interface: wlan0
+  mac_command: %s
+`, script))
+
+	calls, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatalf("hook not invoked: %v", err)
+	}
+	args := strings.Fields(string(calls))
+	if len(args) != 2 || args[0] != "wlan0" {
+		t.Fatalf("hook called with %q, want the interface and a MAC", calls)
+	}
+	if _, err := net.ParseMAC(args[1]); err != nil {
+		t.Errorf("hook got invalid MAC %q", args[1])
+	}
+}
+
+func TestMACHookNotInvokedWhenDisabled(t *testing.T) {
+	script, record := hookScript(t)
+	newTestGateway(t, fmt.Sprintf(`
+listen_port: 8443
+anonymization:
+  mac_interface: wlan0
+  mac_command: %s
+`, script))
+
+	if _, err := os.Stat(record); !os.IsNotExist(err) {
+		t.Error("hook invoked with mac_randomization off")
+	}
+}
+
+func TestRandomMACIsLocalUnicast(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		mac := randomMAC()
+		if mac[0]&0x02 == 0 || mac[0]&0x01 != 0 {
+			t.Fatalf("%s is not a locally administered unicast address", mac)
+		}
+	}
+}
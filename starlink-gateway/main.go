@@ -1,35 +1,56 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	rando "math/rand"
 	"net"
 	"net/http"
-	"os"
+	"net/url"
 	"sync"
 	"time"
 
-	"gopkg.in/yaml.v3"
+	"github.com/dudelovecamera/proxy-system/common"
 )
 
 // GatewayConfig configuration for Starlink gateway
 type GatewayConfig struct {
-	ListenPort         int      `yaml:"listen_port"`
-	AuthenticatedNodes []string `yaml:"authenticated_nodes"`
+	ListenPort         int               `yaml:"listen_port"`
+	ListenAddress      string            `yaml:"listen_address"` // interface to bind, all if empty
+	AdminToken         string            `yaml:"admin_token"`    // enables POST /shutdown, /panic, /resume, /revoke and /rotate, disabled if empty
+	AuthenticatedNodes []string          `yaml:"authenticated_nodes"`
+	PreSharedKeys      map[string]string `yaml:"pre_shared_keys"`       // node ID to a key provisioned out of band, used as the node's auth_token
+	GatewayID          string            `yaml:"gateway_id"`            // name relay capabilities must grant
+	CapabilityKey      string            `yaml:"capability_public_key"` // hex ed25519 trust root key, capabilities not required if empty
 	Anonymization      struct {
-		TrafficMixing      bool `yaml:"traffic_mixing"`
-		SourceRotation     bool `yaml:"source_rotation"`
-		MACRandomization   bool `yaml:"mac_randomization"`
-		TimingJitter       int  `yaml:"timing_jitter"` // milliseconds
+		TrafficMixing      bool   `yaml:"traffic_mixing"`
+		SourceRotation     bool   `yaml:"source_rotation"`
+		MACRandomization   bool   `yaml:"mac_randomization"`
+		MACInterface       string `yaml:"mac_interface"`       // interface to randomize, required with mac_randomization
+		MACCommand         string `yaml:"mac_command"`         // external hook, called with interface and MAC
+		TimingJitter       int    `yaml:"timing_jitter"`       // milliseconds, upper bound of the random delay
+		JitterDistribution string `yaml:"jitter_distribution"` // uniform (default) or exponential
 	} `yaml:"anonymization"`
 	Isolation struct {
-		HideGatewayIP  bool `yaml:"hide_gateway_ip"`
-		UseRelayNodes  bool `yaml:"use_relay_nodes"`
+		HideGatewayIP bool `yaml:"hide_gateway_ip"`
+		UseRelayNodes bool `yaml:"use_relay_nodes"`
 	} `yaml:"isolation"`
-	NodeTokens map[string]string `yaml:"-"` // Node authentication tokens
+	SourceAddresses  []string                 `yaml:"source_addresses"`   // local IPs to rotate through; auto-discovered if empty
+	MaxBatchQueue    int                      `yaml:"max_batch_queue"`    // queued requests before backpressure, 0 = unbounded
+	QueueFullPolicy  string                   `yaml:"queue_full_policy"`  // "reject" (503) or "block"
+	QueueFullTimeout int                      `yaml:"queue_full_timeout"` // milliseconds to block before rejecting
+	WorkerPoolSize   int                      `yaml:"worker_pool_size"`   // concurrent requests when processing a batch
+	NodeTokens       map[string]string        `yaml:"-"`                  // Node authentication tokens
+	Timeouts         common.HTTPTimeouts      `yaml:"timeouts"`           // outbound dial, TLS and response header timeouts
+	Destinations     common.DestinationConfig `yaml:"destinations"`       // schemes, hosts and address ranges targets may not use
 }
 
 // TrafficBatch aggregates traffic from multiple nodes
@@ -39,15 +60,42 @@ type TrafficBatch struct {
 	BatchID   string
 }
 
+// batchInterval is how often batched requests are processed when traffic
+// mixing is enabled
+const batchInterval = 5 * time.Second
+
 // TrafficRequest represents a proxied request
 type TrafficRequest struct {
-	RequestID   string
-	NodeID      string
-	TargetURL   string
-	Method      string
-	Body        []byte
-	Headers     map[string]string
-	ReceivedAt  time.Time
+	RequestID  string
+	NodeID     string
+	TargetURL  string
+	Method     string
+	Body       []byte
+	Headers    map[string]string
+	ReceivedAt time.Time
+	Deadline   time.Time // latency budget end from DeadlineHeader, zero without one
+
+	// CallbackURL is where the result of a batched request is POSTed; see
+	// common.GatewayResponse
+	CallbackURL string
+
+	// result receives the outcome of a batched request without a callback,
+	// which the node that sent it is still waiting for
+	result chan *common.GatewayResponse
+}
+
+// proxyMethods are the HTTP methods relays may ask the gateway to use. An
+// empty method means GET, as in net/http.
+var proxyMethods = map[string]bool{
+	"":                 true,
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
 }
 
 // StarlinkGateway provides internet access with anonymization
@@ -57,18 +105,107 @@ type StarlinkGateway struct {
 	mu            sync.RWMutex
 	batchTicker   *time.Ticker
 	client        *http.Client
+	callbacks     *http.Client // delivers batched results to nodes, which the destination filter would refuse
+	rejected      int
+	macRandomizer MACRandomizer
+	workers       *common.WorkerPool
+	capabilityKey ed25519.PublicKey
+	destinations  *common.DestinationFilter
+	metrics       *common.Metrics
+	blocked       *common.Counter // requests refused by the destination filter
+	killSwitch    *common.KillSwitch
+	revoked       map[string]bool // nodes locked out by /revoke until /rotate
+	proxyAuth     Authenticator   // checks /proxy requests, tokenAuthenticator by default
+	registerAuth  Authenticator   // checks /register requests, nodeListAuthenticator by default
+	httpServer    *http.Server
+}
+
+// loadGatewayConfig reads and validates the config file, with settings
+// overridden by PROXY_GATEWAY_* environment variables
+func loadGatewayConfig(configPath string) (GatewayConfig, error) {
+	return common.LoadConfig(configPath, "PROXY_GATEWAY", setGatewayDefaults)
+}
+
+// setGatewayDefaults fills in settings left unset
+func setGatewayDefaults(config *GatewayConfig) {
+	if config.QueueFullPolicy == "" {
+		config.QueueFullPolicy = "reject"
+	}
+	if config.QueueFullTimeout == 0 {
+		config.QueueFullTimeout = 1000
+	}
+	if config.WorkerPoolSize == 0 {
+		config.WorkerPoolSize = 16
+	}
+	config.Destinations.SetDefaults()
+}
+
+// Validate reports every problem with the configuration
+func (c GatewayConfig) Validate() error {
+	var errs []error
+
+	if c.ListenPort <= 0 || c.ListenPort > 65535 {
+		errs = append(errs, fmt.Errorf("listen_port must be between 1 and 65535, got %d", c.ListenPort))
+	}
+	if c.Anonymization.TimingJitter < 0 {
+		errs = append(errs, fmt.Errorf("anonymization.timing_jitter must not be negative, got %d", c.Anonymization.TimingJitter))
+	}
+	if !common.ValidJitterDistribution(c.Anonymization.JitterDistribution) {
+		errs = append(errs, fmt.Errorf("unknown anonymization.jitter_distribution %q", c.Anonymization.JitterDistribution))
+	}
+	for _, addr := range c.SourceAddresses {
+		if net.ParseIP(addr) == nil {
+			errs = append(errs, fmt.Errorf("invalid source address %q", addr))
+		}
+	}
+	if c.Anonymization.MACRandomization && c.Anonymization.MACInterface == "" {
+		errs = append(errs, fmt.Errorf("anonymization.mac_interface is required with mac_randomization"))
+	}
+	if c.MaxBatchQueue < 0 {
+		errs = append(errs, fmt.Errorf("max_batch_queue must not be negative, got %d", c.MaxBatchQueue))
+	}
+	switch c.QueueFullPolicy {
+	case "reject", "block":
+	default:
+		errs = append(errs, fmt.Errorf("unknown queue_full_policy %q", c.QueueFullPolicy))
+	}
+	if c.WorkerPoolSize < 0 {
+		errs = append(errs, fmt.Errorf("worker_pool_size must not be negative, got %d", c.WorkerPoolSize))
+	}
+	if c.QueueFullTimeout < 0 {
+		errs = append(errs, fmt.Errorf("queue_full_timeout must not be negative, got %d", c.QueueFullTimeout))
+	}
+
+	for nodeID, key := range c.PreSharedKeys {
+		if len(key) < 16 {
+			errs = append(errs, fmt.Errorf("pre_shared_keys[%s] must be at least 16 characters", nodeID))
+		}
+	}
+
+	if c.CapabilityKey != "" {
+		if _, err := common.ParseCapabilityKey(c.CapabilityKey); err != nil {
+			errs = append(errs, err)
+		}
+		if c.GatewayID == "" {
+			errs = append(errs, errors.New("gateway_id is required when capability_public_key is set"))
+		}
+	}
+
+	if err := c.Timeouts.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Destinations.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
 }
 
 // NewStarlinkGateway creates a new gateway instance
 func NewStarlinkGateway(configPath string) (*StarlinkGateway, error) {
-	data, err := os.ReadFile(configPath)
+	config, err := loadGatewayConfig(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config: %w", err)
-	}
-
-	var config GatewayConfig
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config: %w", err)
+		return nil, err
 	}
 
 	// Generate authentication tokens for nodes
@@ -79,24 +216,69 @@ func NewStarlinkGateway(configPath string) (*StarlinkGateway, error) {
 		log.Printf("Generated token for node %s: %s", nodeID, token)
 	}
 
+	destinations, err := common.NewDestinationFilter(config.Destinations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destinations: %w", err)
+	}
+
+	// The rotator copies this dialer, so the filter applies to it too
+	dialer := common.NewDialer(config.Timeouts)
+	dialer.Control = destinations.Control
+	transport := common.NewHTTPTransport(config.Timeouts)
+	transport.DialContext = dialer.DialContext
+
+	// Rotate source IPs if multiple interfaces available
+	if config.Anonymization.SourceRotation {
+		rotator, err := newSourceRotator(config.SourceAddresses, dialer)
+		if err != nil {
+			return nil, err
+		}
+		if len(rotator.addrs) > 1 {
+			transport.DialContext = rotator.DialContext
+			// Pooled connections would pin every request to one source
+			transport.DisableKeepAlives = true
+			log.Printf("Rotating source addresses: %v", rotator.addrs)
+		} else {
+			log.Printf("Source rotation enabled but only %d local address available", len(rotator.addrs))
+		}
+	}
+
+	metrics := common.NewMetrics()
+
 	gateway := &StarlinkGateway{
+		httpServer:   &http.Server{},
 		config:       config,
 		trafficBatch: make([]TrafficRequest, 0),
+		workers:      common.NewWorkerPool(config.WorkerPoolSize),
+		revoked:      make(map[string]bool),
+		destinations: destinations,
+		metrics:      metrics,
+		blocked:      metrics.Counter("gateway_destinations_blocked_total", "Requests refused because their target is blocked"),
 		client: &http.Client{
-			Timeout: 60 * time.Second,
-			Transport: &http.Transport{
-				// Configure to rotate source IPs if multiple interfaces available
-				DialContext: (&net.Dialer{
-					Timeout:   30 * time.Second,
-					KeepAlive: 30 * time.Second,
-				}).DialContext,
-			},
+			Timeout:   60 * time.Second,
+			Transport: transport,
 		},
+		callbacks: common.NewHTTPClient(30*time.Second, config.Timeouts),
+	}
+	gateway.killSwitch = common.NewKillSwitch(gateway.dropTraffic)
+	gateway.proxyAuth = tokenAuthenticator{g: gateway}
+	gateway.registerAuth = nodeListAuthenticator{nodes: config.AuthenticatedNodes}
+
+	if config.CapabilityKey != "" {
+		// Already checked by Validate
+		gateway.capabilityKey, _ = common.ParseCapabilityKey(config.CapabilityKey)
+		log.Printf("Requiring relay capabilities for gateway %s", config.GatewayID)
+	}
+
+	// Randomize the MAC before any outgoing connection is made
+	if config.Anonymization.MACRandomization {
+		gateway.macRandomizer = newMACRandomizer(config.Anonymization.MACCommand)
+		randomizeMAC(gateway.macRandomizer, config.Anonymization.MACInterface)
 	}
 
 	// Start traffic batching if mixing is enabled
 	if config.Anonymization.TrafficMixing {
-		gateway.batchTicker = time.NewTicker(5 * time.Second)
+		gateway.batchTicker = time.NewTicker(batchInterval)
 		go gateway.processBatches()
 	}
 
@@ -107,21 +289,33 @@ func NewStarlinkGateway(configPath string) (*StarlinkGateway, error) {
 func (g *StarlinkGateway) handleProxyRequest(w http.ResponseWriter, r *http.Request) {
 	// Authenticate node
 	nodeID := r.Header.Get("X-Node-ID")
-	token := r.Header.Get("X-Auth-Token")
-	
-	if !g.authenticateNode(nodeID, token) {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		log.Printf("Authentication failed for node %s", nodeID)
+	g.mu.RLock()
+	auth := g.proxyAuth
+	g.mu.RUnlock()
+
+	if !g.authenticate(w, auth, nodeID, r.Header.Get("X-Auth-Token")) {
+		return
+	}
+
+	if err := g.checkCapability(r, nodeID); err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		log.Printf("Capability check failed for node %s: %v", nodeID, err)
+		return
+	}
+
+	if g.killSwitch.Engaged() {
+		http.Error(w, "Kill switch engaged", http.StatusServiceUnavailable)
 		return
 	}
 
 	// Parse request
 	var proxyReq struct {
-		RequestID string            `json:"request_id"`
-		TargetURL string            `json:"target_url"`
-		Method    string            `json:"method"`
-		Body      []byte            `json:"body"`
-		Headers   map[string]string `json:"headers"`
+		RequestID   string            `json:"request_id"`
+		TargetURL   string            `json:"target_url"`
+		Method      string            `json:"method"`
+		Body        []byte            `json:"body"`
+		Headers     map[string]string `json:"headers"`
+		CallbackURL string            `json:"callback_url"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&proxyReq); err != nil {
@@ -129,86 +323,278 @@ func (g *StarlinkGateway) handleProxyRequest(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	// Catch malformed requests before they wait for a batch
+	if !proxyMethods[proxyReq.Method] {
+		http.Error(w, "Invalid method", http.StatusBadRequest)
+		log.Printf("Refused request %s from node %s: invalid method %q", proxyReq.RequestID, nodeID, proxyReq.Method)
+		return
+	}
+
+	target, err := url.Parse(proxyReq.TargetURL)
+	if err != nil {
+		http.Error(w, "Invalid target URL", http.StatusBadRequest)
+		return
+	}
+
+	// A batched result has nowhere to go without a usable callback
+	if proxyReq.CallbackURL != "" {
+		callback, err := url.Parse(proxyReq.CallbackURL)
+		if err != nil || (callback.Scheme != "http" && callback.Scheme != "https") || callback.Host == "" {
+			http.Error(w, "Invalid callback URL", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Refuse blocked targets now rather than after queueing them
+	if err := g.checkDestination(target); err != nil {
+		http.Error(w, "Destination blocked", http.StatusForbidden)
+		log.Printf("Refused request %s from node %s: %v", proxyReq.RequestID, nodeID, err)
+		return
+	}
+
 	trafficReq := TrafficRequest{
-		RequestID:  proxyReq.RequestID,
-		NodeID:     nodeID,
-		TargetURL:  proxyReq.TargetURL,
-		Method:     proxyReq.Method,
-		Body:       proxyReq.Body,
-		Headers:    proxyReq.Headers,
-		ReceivedAt: time.Now(),
-	}
-
-	// Add timing jitter
-	if g.config.Anonymization.TimingJitter > 0 {
-		jitter := time.Duration(g.config.Anonymization.TimingJitter) * time.Millisecond
+		RequestID:   proxyReq.RequestID,
+		NodeID:      nodeID,
+		TargetURL:   proxyReq.TargetURL,
+		Method:      proxyReq.Method,
+		Body:        proxyReq.Body,
+		Headers:     proxyReq.Headers,
+		ReceivedAt:  time.Now(),
+		Deadline:    common.DeadlineFromHeader(r.Header),
+		CallbackURL: proxyReq.CallbackURL,
+	}
+
+	// Add a random delay of up to timing_jitter, within the request's
+	// latency budget
+	anon := g.config.Anonymization
+	jitter := common.JitterDelay(0, anon.TimingJitter, anon.JitterDistribution)
+	if jitter = common.BudgetDelay(jitter, trafficReq.Deadline); jitter > 0 {
 		time.Sleep(jitter)
 	}
 
-	if g.config.Anonymization.TrafficMixing {
-		// Add to batch for later processing
-		g.mu.Lock()
-		g.trafficBatch = append(g.trafficBatch, trafficReq)
-		g.mu.Unlock()
-		
-		w.WriteHeader(http.StatusAccepted)
-		json.NewEncoder(w).Encode(map[string]string{
-			"status": "queued",
-			"request_id": proxyReq.RequestID,
-		})
-	} else {
-		// Process immediately
-		response, err := g.performProxyRequest(trafficReq)
-		if err != nil {
-			http.Error(w, "Proxy error", http.StatusInternalServerError)
-			log.Printf("Proxy error: %v", err)
+	// Waiting for the next batch must fit the latency budget too
+	mix := g.config.Anonymization.TrafficMixing
+	if mix && common.BudgetDelay(batchInterval, trafficReq.Deadline) < batchInterval {
+		log.Printf("Latency budget too tight to batch request %s, processing now", trafficReq.RequestID)
+		mix = false
+	}
+
+	if mix {
+		// Add to batch for later processing. Without a callback the node's
+		// request is held open until its batch runs.
+		if trafficReq.CallbackURL == "" {
+			trafficReq.result = make(chan *common.GatewayResponse, 1)
+		}
+		if !g.enqueue(trafficReq) {
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Queue full", http.StatusServiceUnavailable)
+			log.Printf("Batch queue full, rejected request %s", proxyReq.RequestID)
 			return
 		}
-		
-		w.WriteHeader(http.StatusOK)
-		w.Write(response)
+
+		if trafficReq.CallbackURL != "" {
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":     "queued",
+				"request_id": proxyReq.RequestID,
+			})
+			return
+		}
+
+		select {
+		case response := <-trafficReq.result:
+			writeGatewayResponse(w, response)
+		case <-r.Context().Done():
+			log.Printf("Node %s gave up on batched request %s", nodeID, proxyReq.RequestID)
+		}
+		return
+	}
+
+	// Process immediately
+	response, err := g.performProxyRequest(trafficReq)
+	if err != nil {
+		log.Printf("Proxy error for %s from node %s: %v", proxyReq.RequestID, nodeID, err)
+		response = failedResponse(trafficReq.RequestID, err)
 	}
+	writeGatewayResponse(w, response)
 }
 
-// authenticateNode verifies node credentials
-func (g *StarlinkGateway) authenticateNode(nodeID, token string) bool {
-	g.mu.RLock()
-	defer g.mu.RUnlock()
-	
-	expectedToken, exists := g.config.NodeTokens[nodeID]
-	return exists && expectedToken == token
+// failedResponse describes a request the gateway could not perform
+func failedResponse(requestID string, err error) *common.GatewayResponse {
+	response := &common.GatewayResponse{
+		RequestID:  requestID,
+		StatusCode: http.StatusBadGateway,
+		Error:      err.Error(),
+	}
+	if errors.Is(err, common.ErrDestinationBlocked) {
+		response.StatusCode = http.StatusForbidden
+	}
+	if errors.Is(err, common.ErrKillSwitchEngaged) {
+		response.StatusCode = http.StatusServiceUnavailable
+	}
+	return response
 }
 
-// processBatches handles batched traffic mixing
-func (g *StarlinkGateway) processBatches() {
-	for range g.batchTicker.C {
+// writeGatewayResponse answers a node with the target's response, or with
+// why there is none
+func writeGatewayResponse(w http.ResponseWriter, response *common.GatewayResponse) {
+	if response.Error != "" {
+		http.Error(w, response.Error, response.StatusCode)
+		return
+	}
+	for k, v := range response.Headers {
+		// The body is written here, so its framing is too
+		if k == "Content-Length" || k == "Transfer-Encoding" || k == "Connection" {
+			continue
+		}
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(response.StatusCode)
+	w.Write(response.Body)
+}
+
+// enqueue adds a request to the batch queue, applying the configured
+// full-queue policy. It reports whether the request was queued.
+func (g *StarlinkGateway) enqueue(req TrafficRequest) bool {
+	deadline := time.Now().Add(time.Duration(g.config.QueueFullTimeout) * time.Millisecond)
+
+	for {
 		g.mu.Lock()
-		if len(g.trafficBatch) == 0 {
+		if g.config.MaxBatchQueue <= 0 || len(g.trafficBatch) < g.config.MaxBatchQueue {
+			g.trafficBatch = append(g.trafficBatch, req)
 			g.mu.Unlock()
-			continue
+			return true
 		}
 
-		batch := make([]TrafficRequest, len(g.trafficBatch))
-		copy(batch, g.trafficBatch)
-		g.trafficBatch = g.trafficBatch[:0] // Clear batch
+		if g.config.QueueFullPolicy != "block" || time.Now().After(deadline) {
+			g.rejected++
+			g.mu.Unlock()
+			return false
+		}
 		g.mu.Unlock()
 
-		log.Printf("Processing batch of %d requests", len(batch))
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// checkCapability verifies the signed capability a relay presents in the
+// X-Capability header: it must be issued to nodeID and grant this gateway.
+// Nothing is required when no capability key is configured.
+func (g *StarlinkGateway) checkCapability(r *http.Request, nodeID string) error {
+	if g.capabilityKey == nil {
+		return nil
+	}
+
+	token := r.Header.Get("X-Capability")
+	if token == "" {
+		return errors.New("no capability presented")
+	}
+
+	capability, err := common.VerifyCapability(token, g.capabilityKey, time.Now())
+	if err != nil {
+		return err
+	}
+	if capability.NodeID != nodeID {
+		return fmt.Errorf("capability issued to node %s", capability.NodeID)
+	}
+	if !capability.Allows(g.config.GatewayID) {
+		return fmt.Errorf("capability does not grant gateway %s", g.config.GatewayID)
+	}
+
+	return nil
+}
+
+// checkDestination runs a target past the destination filter, counting
+// refusals
+func (g *StarlinkGateway) checkDestination(target *url.URL) error {
+	if err := g.destinations.CheckURL(target); err != nil {
+		g.blocked.Inc()
+		return err
+	}
+	return nil
+}
+
+// processBatches handles batched traffic mixing
+func (g *StarlinkGateway) processBatches() {
+	for range g.batchTicker.C {
+		g.processBatch()
+	}
+}
+
+// processBatch performs every queued request in random order, handing each
+// result back to its node
+func (g *StarlinkGateway) processBatch() {
+	g.mu.Lock()
+	if len(g.trafficBatch) == 0 {
+		g.mu.Unlock()
+		return
+	}
+
+	batch := make([]TrafficRequest, len(g.trafficBatch))
+	copy(batch, g.trafficBatch)
+	g.trafficBatch = g.trafficBatch[:0] // Clear batch
+	g.mu.Unlock()
 
-		// Process each request in the batch
-		for _, req := range batch {
-			go func(r TrafficRequest) {
-				_, err := g.performProxyRequest(r)
-				if err != nil {
-					log.Printf("Batch request error for %s: %v", r.RequestID, err)
-				}
-			}(req)
+	log.Printf("Processing batch of %d requests", len(batch))
+
+	// Workers take requests in order, so shuffle to keep the order of
+	// outgoing requests unlinked from arrivals
+	rando.Shuffle(len(batch), func(i, j int) {
+		batch[i], batch[j] = batch[j], batch[i]
+	})
+
+	// Process each request in the batch
+	for _, req := range batch {
+		r := req
+		g.workers.Submit(func() {
+			response, err := g.performProxyRequest(r)
+			if err != nil {
+				log.Printf("Batch request error for %s: %v", r.RequestID, err)
+				response = failedResponse(r.RequestID, err)
+			}
+			g.reply(r, response)
+		})
+	}
+}
+
+// dropTraffic runs when the kill switch is engaged: queued requests are
+// dropped and their nodes told why
+func (g *StarlinkGateway) dropTraffic() {
+	g.mu.Lock()
+	dropped := g.trafficBatch
+	g.trafficBatch = make([]TrafficRequest, 0)
+	g.mu.Unlock()
+
+	log.Printf("Kill switch engaged: dropped %d queued requests", len(dropped))
+
+	for _, req := range dropped {
+		g.reply(req, failedResponse(req.RequestID, common.ErrKillSwitchEngaged))
+	}
+}
+
+// reply hands the result of a batched request to its node: POSTed to the
+// callback it named, or to its request still waiting for it
+func (g *StarlinkGateway) reply(req TrafficRequest, response *common.GatewayResponse) {
+	if req.CallbackURL == "" {
+		if req.result != nil {
+			req.result <- response
 		}
+		return
+	}
+
+	if err := common.PostGatewayResponse(g.callbacks, req.CallbackURL, response); err != nil {
+		log.Printf("Callback delivery failed for %s: %v", req.RequestID, err)
+		return
 	}
+	log.Printf("Delivered batched response %s to %s", req.RequestID, req.CallbackURL)
 }
 
 // performProxyRequest makes the actual HTTP request to the internet
-func (g *StarlinkGateway) performProxyRequest(trafficReq TrafficRequest) ([]byte, error) {
+func (g *StarlinkGateway) performProxyRequest(trafficReq TrafficRequest) (*common.GatewayResponse, error) {
+	if err := g.killSwitch.Check(); err != nil {
+		return nil, err
+	}
+
 	// Create HTTP request
 	req, err := http.NewRequest(
 		trafficReq.Method,
@@ -218,10 +604,13 @@ func (g *StarlinkGateway) performProxyRequest(trafficReq TrafficRequest) ([]byte
 	if err != nil {
 		return nil, fmt.Errorf("request creation error: %w", err)
 	}
+	if err := g.checkDestination(req.URL); err != nil {
+		return nil, err
+	}
 
 	// Set headers (remove internal headers)
 	for k, v := range trafficReq.Headers {
-		if k != "X-Node-ID" && k != "X-Auth-Token" {
+		if k != "X-Node-ID" && k != "X-Auth-Token" && k != "X-Capability" {
 			req.Header.Set(k, v)
 		}
 	}
@@ -229,16 +618,32 @@ func (g *StarlinkGateway) performProxyRequest(trafficReq TrafficRequest) ([]byte
 	// Perform request
 	resp, err := g.client.Do(req)
 	if err != nil {
+		// Hostnames resolving to a denied address fail at dial time
+		if errors.Is(err, common.ErrDestinationBlocked) {
+			g.blocked.Inc()
+		}
 		return nil, fmt.Errorf("request error: %w", err)
 	}
-	defer resp.Body.Close()
+	defer common.DrainAndClose(resp)
 
 	// Read response
-	body := make([]byte, 0)
-	// In production, read the actual response body
-	
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("response read error: %w", err)
+	}
+
+	headers := make(map[string]string)
+	for k := range resp.Header {
+		headers[k] = resp.Header.Get(k)
+	}
+
 	log.Printf("Proxied request %s to %s", trafficReq.RequestID, trafficReq.TargetURL)
-	return body, nil
+	return &common.GatewayResponse{
+		RequestID:  trafficReq.RequestID,
+		StatusCode: resp.StatusCode,
+		Headers:    headers,
+		Body:       body,
+	}, nil
 }
 
 // handleNodeRegistration allows new nodes to register
@@ -258,24 +663,23 @@ func (g *StarlinkGateway) handleNodeRegistration(w http.ResponseWriter, r *http.
 		return
 	}
 
-	// Verify secret (in production, use proper authentication)
-	// For now, check if node is in authenticated list
-	authorized := false
-	for _, nodeID := range g.config.AuthenticatedNodes {
-		if nodeID == regReq.NodeID {
-			authorized = true
-			break
-		}
+	g.mu.RLock()
+	auth := g.registerAuth
+	g.mu.RUnlock()
+
+	if !g.authenticate(w, auth, regReq.NodeID, regReq.Secret) {
+		return
 	}
 
-	if !authorized {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if err := g.checkCapability(r, regReq.NodeID); err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		log.Printf("Capability check failed for node %s: %v", regReq.NodeID, err)
 		return
 	}
 
 	// Generate token
 	token := generateToken()
-	
+
 	g.mu.Lock()
 	g.config.NodeTokens[regReq.NodeID] = token
 	g.mu.Unlock()
@@ -293,18 +697,35 @@ func (g *StarlinkGateway) handleNodeRegistration(w http.ResponseWriter, r *http.
 func (g *StarlinkGateway) healthCheck(w http.ResponseWriter, r *http.Request) {
 	g.mu.RLock()
 	batchSize := len(g.trafficBatch)
+	rejected := g.rejected
 	nodeCount := len(g.config.NodeTokens)
 	g.mu.RUnlock()
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":           "healthy",
-		"role":             "starlink-gateway",
+	common.WriteHealth(w, common.NewHealthInfo("starlink-gateway", map[string]any{
 		"queued_requests":  batchSize,
+		"max_batch_queue":  g.config.MaxBatchQueue,
+		"rejected_queue":   rejected,
+		"blocked_requests": g.blocked.Value(),
 		"registered_nodes": nodeCount,
 		"traffic_mixing":   g.config.Anonymization.TrafficMixing,
-		"time":             time.Now().Format(time.RFC3339),
-	})
+		"kill_switch":      g.killSwitch.Engaged(),
+	}))
+}
+
+// ready reports whether the kill switch is released and the batch queue
+// has room for more requests
+func (g *StarlinkGateway) ready() error {
+	if err := g.killSwitch.Check(); err != nil {
+		return err
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.config.MaxBatchQueue > 0 && len(g.trafficBatch) >= g.config.MaxBatchQueue {
+		return errors.New("batch queue full")
+	}
+	return nil
 }
 
 // Start begins the gateway server
@@ -312,13 +733,118 @@ func (g *StarlinkGateway) Start() error {
 	http.HandleFunc("/proxy", g.handleProxyRequest)
 	http.HandleFunc("/register", g.handleNodeRegistration)
 	http.HandleFunc("/health", g.healthCheck)
+	http.HandleFunc("/ready", common.ReadyHandler(g.ready))
+	http.Handle("/metrics", g.metrics)
+	if g.config.AdminToken != "" {
+		http.HandleFunc("/shutdown", common.ShutdownHandler(g.config.AdminToken, g))
+		http.HandleFunc("/panic", common.PanicHandler(g.config.AdminToken, g.killSwitch))
+		http.HandleFunc("/resume", common.ResumeHandler(g.config.AdminToken, g.killSwitch))
+		http.HandleFunc("/revoke", common.AdminHandler(g.config.AdminToken, "revoke", g.handleRevoke))
+		http.HandleFunc("/rotate", common.AdminHandler(g.config.AdminToken, "rotate", g.handleRotate))
+	}
 
-	addr := fmt.Sprintf(":%d", g.config.ListenPort)
+	addr := common.ListenAddr(g.config.ListenAddress, g.config.ListenPort)
 	log.Printf("Starlink Gateway starting on %s", addr)
 	log.Printf("Traffic mixing: %v", g.config.Anonymization.TrafficMixing)
 	log.Printf("Authenticated nodes: %v", g.config.AuthenticatedNodes)
-	
-	return http.ListenAndServe(addr, nil)
+
+	g.httpServer.Addr = addr
+	if err := g.httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	log.Printf("Starlink gateway stopped")
+	return nil
+}
+
+// Shutdown stops accepting requests and waits for in-flight ones
+func (g *StarlinkGateway) Shutdown(ctx context.Context) error {
+	return g.httpServer.Shutdown(ctx)
+}
+
+// sourceRotator round-robins the local address outgoing connections bind to
+type sourceRotator struct {
+	addrs  []net.IP
+	next   int
+	mu     sync.Mutex
+	dialer *net.Dialer
+}
+
+// newSourceRotator uses the configured addresses, or every non-loopback
+// unicast address on the host when none are configured
+func newSourceRotator(configured []string, dialer *net.Dialer) (*sourceRotator, error) {
+	rotator := &sourceRotator{dialer: dialer}
+
+	for _, addr := range configured {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source address %q", addr)
+		}
+		rotator.addrs = append(rotator.addrs, ip)
+	}
+
+	if len(rotator.addrs) == 0 {
+		ifaceAddrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list interface addresses: %w", err)
+		}
+		for _, a := range ifaceAddrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			rotator.addrs = append(rotator.addrs, ipNet.IP)
+		}
+	}
+
+	return rotator, nil
+}
+
+// nextAddr returns the next local address in rotation
+func (s *sourceRotator) nextAddr() net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ip := s.addrs[s.next%len(s.addrs)]
+	s.next++
+	return ip
+}
+
+// DialContext dials from the next local address, choosing a remote address
+// of the same IP family
+func (s *sourceRotator) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	remotes, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for range s.addrs {
+		local := s.nextAddr()
+		for _, remote := range remotes {
+			if (local.To4() == nil) != (remote.IP.To4() == nil) {
+				continue
+			}
+
+			dialer := *s.dialer
+			dialer.LocalAddr = &net.TCPAddr{IP: local}
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(remote.IP.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no source address matches the address family of %s", host)
+	}
+	return nil, lastErr
 }
 
 // generateToken creates a random authentication token
@@ -329,9 +855,17 @@ func generateToken() string {
 }
 
 func main() {
+	check := flag.Bool("check", false, "Validate the config file and exit")
+	flag.Parse()
+
 	configPath := "config/gateway.yaml"
-	if len(os.Args) > 1 {
-		configPath = os.Args[1]
+	if flag.NArg() > 0 {
+		configPath = flag.Arg(0)
+	}
+
+	if *check {
+		_, err := loadGatewayConfig(configPath)
+		common.ReportConfigCheck(configPath, err)
 	}
 
 	gateway, err := NewStarlinkGateway(configPath)
@@ -339,6 +873,8 @@ func main() {
 		log.Fatalf("Failed to create gateway: %v", err)
 	}
 
+	common.ShutdownOnSignal(gateway)
+
 	if err := gateway.Start(); err != nil {
 		log.Fatalf("Server error: %v", err)
 	}
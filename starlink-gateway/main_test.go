@@ -0,0 +1,296 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// writeConfig writes a YAML config to a temporary file and returns its path
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestGateway builds a gateway from yaml
+func newTestGateway(t *testing.T, yaml string) *StarlinkGateway {
+	t.Helper()
+	gateway, err := NewStarlinkGateway(writeConfig(t, yaml))
+	if err != nil {
+		t.Fatalf("NewStarlinkGateway: %v", err)
+	}
+	return gateway
+}
+
+// proxyRequest sends a /proxy request for target as node, authenticated
+// with the token the gateway generated for it
+func proxyRequest(g *StarlinkGateway, node, target string) *httptest.ResponseRecorder {
+	body := `{"request_id": "req-` + node + `", "target_url": "` + target + `", "method": "GET"}`
+	req := httptest.NewRequest(http.MethodPost, "/proxy", strings.NewReader(body))
+	req.Header.Set("X-Node-ID", node)
+	req.Header.Set("X-Auth-Token", g.config.NodeTokens[node])
+
+	recorder := httptest.NewRecorder()
+	g.handleProxyRequest(recorder, req)
+	return recorder
+}
+
+// authStatus sends a /proxy request as node with credential token. Its
+// method is invalid, so 400 shows authentication passed and 401 that it
+// failed.
+func authStatus(g *StarlinkGateway, node, token string) int {
+	req := httptest.NewRequest(http.MethodPost, "/proxy", strings.NewReader(`{"request_id": "r", "target_url": "http://example.com/", "method": "BREW"}`))
+	req.Header.Set("X-Node-ID", node)
+	req.Header.Set("X-Auth-Token", token)
+	recorder := httptest.NewRecorder()
+	g.handleProxyRequest(recorder, req)
+	return recorder.Code
+}
+
+func TestFullQueueRejects(t *testing.T) {
+	gateway := newTestGateway(t, `
+listen_port: 8443
+max_batch_queue: 2
+queue_full_policy: reject
+`)
+
+	for i := 0; i < 2; i++ {
+		if !gateway.enqueue(TrafficRequest{RequestID: "queued"}) {
+			t.Fatalf("request %d refused below max_batch_queue", i+1)
+		}
+	}
+	start := time.Now()
+	if gateway.enqueue(TrafficRequest{RequestID: "over"}) {
+		t.Fatal("request queued past max_batch_queue")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("reject policy waited %v", elapsed)
+	}
+	if gateway.rejected != 1 {
+		t.Errorf("rejected count %d, want 1", gateway.rejected)
+	}
+	if err := gateway.ready(); err == nil {
+		t.Error("ready with a full batch queue")
+	}
+}
+
+func TestFullQueueBlocksUntilTimeout(t *testing.T) {
+	gateway := newTestGateway(t, `
+listen_port: 8443
+max_batch_queue: 1
+queue_full_policy: block
+queue_full_timeout: 200
+`)
+	gateway.enqueue(TrafficRequest{RequestID: "queued"})
+
+	start := time.Now()
+	if gateway.enqueue(TrafficRequest{RequestID: "over"}) {
+		t.Fatal("request queued past max_batch_queue")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("block policy gave up after %v, want queue_full_timeout", elapsed)
+	}
+
+	// Room freed while blocking lets the request in
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		gateway.mu.Lock()
+		gateway.trafficBatch = gateway.trafficBatch[:0]
+		gateway.mu.Unlock()
+	}()
+	if !gateway.enqueue(TrafficRequest{RequestID: "waited"}) {
+		t.Error("request refused although the queue drained in time")
+	}
+}
+
+func TestFullQueueAnswers503(t *testing.T) {
+	gateway := newTestGateway(t, `
+listen_port: 8443
+authenticated_nodes: ["relay-1"]
+max_batch_queue: 1
+anonymization:
+  traffic_mixing: true
+`)
+	gateway.enqueue(TrafficRequest{RequestID: "queued"})
+
+	rec := proxyRequest(gateway, "relay-1", "http://example.com/")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("503 without Retry-After")
+	}
+}
+
+func TestBatchedResponsesReachTheirNodes(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("for " + r.URL.Path[1:]))
+	}))
+	defer target.Close()
+
+	gateway := newTestGateway(t, `
+listen_port: 8443
+authenticated_nodes: ["relay-1", "relay-2", "relay-3"]
+anonymization:
+  traffic_mixing: true
+destinations:
+  allow: ["127.0.0.1/32"]
+`)
+
+	nodes := []string{"relay-1", "relay-2", "relay-3"}
+	results := make(map[string]*httptest.ResponseRecorder)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := proxyRequest(gateway, node, target.URL+"/"+node)
+			mu.Lock()
+			results[node] = rec
+			mu.Unlock()
+		}()
+	}
+
+	// Nodes stay waiting until their batch runs
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		gateway.mu.RLock()
+		queued := len(gateway.trafficBatch)
+		gateway.mu.RUnlock()
+		if queued == len(nodes) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d requests queued", queued, len(nodes))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	gateway.processBatch()
+	wg.Wait()
+
+	for _, node := range nodes {
+		rec := results[node]
+		if rec.Code != http.StatusOK || rec.Body.String() != "for "+node {
+			t.Errorf("%s got %d %q", node, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestInvalidConfigs(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want string
+	}{
+		{"listen_port: 0\n", "listen_port must be between 1 and 65535"},
+		{"listen_port: 8443\nqueue_full_policy: drop\n", "unknown queue_full_policy"},
+		{"listen_port: 8443\nmax_batch_queue: -1\n", "max_batch_queue must not be negative"},
+		{"listen_port: 8443\nsource_addresses: [\"not-an-ip\"]\n", "invalid source address"},
+		{"listen_port: 8443\nanonymization:\n  mac_randomization: true\n", "mac_interface is required"},
+		{"listen_port: 8443\npre_shared_keys:\n  relay-1: short\n", "must be at least 16 characters"},
+	}
+	for _, tt := range tests {
+		_, err := loadGatewayConfig(writeConfig(t, tt.yaml))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.yaml, err, tt.want)
+		}
+	}
+}
+
+func TestPreSharedKeyAuthenticates(t *testing.T) {
+	gateway := newTestGateway(t, `
+listen_port: 8443
+pre_shared_keys:
+  relay-psk: provisioned-out-of-band
+`)
+
+	if code := authStatus(gateway, "relay-psk", "provisioned-out-of-band"); code != http.StatusBadRequest {
+		t.Errorf("pre-shared key: status %d, want past authentication", code)
+	}
+	if code := authStatus(gateway, "relay-psk", "some-other-key-entirely"); code != http.StatusUnauthorized {
+		t.Errorf("wrong key: status %d, want 401", code)
+	}
+	if code := authStatus(gateway, "relay-other", "provisioned-out-of-band"); code != http.StatusUnauthorized {
+		t.Errorf("key of another node: status %d, want 401", code)
+	}
+}
+
+func TestKillSwitchRefusesTraffic(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("reached"))
+	}))
+	defer target.Close()
+
+	gateway := newTestGateway(t, `
+listen_port: 8443
+admin_token: secret
+authenticated_nodes: ["relay-1"]
+destinations:
+  allow: ["127.0.0.1/32"]
+`)
+	admin := func(handler http.HandlerFunc) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status %d", recorder.Code)
+		}
+	}
+
+	admin(common.PanicHandler(gateway.config.AdminToken, gateway.killSwitch))
+	if rec := proxyRequest(gateway, "relay-1", target.URL); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("panicked: status %d, want 503", rec.Code)
+	}
+
+	admin(common.ResumeHandler(gateway.config.AdminToken, gateway.killSwitch))
+	if rec := proxyRequest(gateway, "relay-1", target.URL); rec.Code != http.StatusOK || rec.Body.String() != "reached" {
+		t.Errorf("after resume: %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestTightBudgetSkipsJitterAndBatching(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("reached"))
+	}))
+	defer target.Close()
+
+	gateway := newTestGateway(t, `
+listen_port: 8443
+authenticated_nodes: ["relay-1"]
+anonymization:
+  traffic_mixing: true
+  timing_jitter: 2000
+destinations:
+  allow: ["127.0.0.1/32"]
+`)
+
+	body := `{"request_id": "req-budget", "target_url": "` + target.URL + `", "method": "GET"}`
+	req := httptest.NewRequest(http.MethodPost, "/proxy", strings.NewReader(body))
+	req.Header.Set("X-Node-ID", "relay-1")
+	req.Header.Set("X-Auth-Token", gateway.config.NodeTokens["relay-1"])
+	common.SetDeadlineHeader(req.Header, time.Now())
+
+	start := time.Now()
+	recorder := httptest.NewRecorder()
+	gateway.handleProxyRequest(recorder, req)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "reached" {
+		t.Fatalf("got %d %q", recorder.Code, recorder.Body)
+	}
+	// Jitter of up to 2s and a 5s batch window would apply without the budget
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("answered after %v, want delays skipped", elapsed)
+	}
+}
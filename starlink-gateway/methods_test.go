@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInvalidMethodRejectedAtIngest(t *testing.T) {
+	// Batched, so a request that got past ingest would wait for its batch
+	gateway := newTestGateway(t, `
+listen_port: 8443
+authenticated_nodes: ["relay-1"]
+anonymization:
+  traffic_mixing: true
+`)
+
+	for _, method := range []string{"BREW", "get", "GET /admin", "CONNECT"} {
+		body, err := json.Marshal(map[string]string{"request_id": "r", "target_url": "http://example.com/", "method": method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/proxy", bytes.NewReader(body))
+		req.Header.Set("X-Node-ID", "relay-1")
+		req.Header.Set("X-Auth-Token", gateway.config.NodeTokens["relay-1"])
+
+		start := time.Now()
+		recorder := httptest.NewRecorder()
+		gateway.handleProxyRequest(recorder, req)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", method, recorder.Code)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%q: rejected after %v, want at once", method, elapsed)
+		}
+	}
+
+	gateway.mu.RLock()
+	queued := len(gateway.trafficBatch)
+	gateway.mu.RUnlock()
+	if queued != 0 {
+		t.Errorf("%d invalid requests queued", queued)
+	}
+}
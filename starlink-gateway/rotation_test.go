@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestSourceRotatorRoundRobin(t *testing.T) {
+	rotator, err := newSourceRotator([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1"}
+	for i, w := range want {
+		if got := rotator.nextAddr().String(); got != w {
+			t.Errorf("pick %d: %s, want %s", i, got, w)
+		}
+	}
+}
+
+func TestSourceRotatorDialsFromEachAddress(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	sources := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			sources <- host
+			conn.Close()
+		}
+	}()
+
+	// Only Linux routes all of 127/8 to loopback by default
+	alias := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}
+	conn, err := alias.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Skipf("no loopback alias 127.0.0.2: %v", err)
+	}
+	conn.Close()
+	<-sources
+
+	rotator, err := newSourceRotator([]string{"127.0.0.1", "127.0.0.2"}, &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.1"} {
+		conn, err := rotator.DialContext(context.Background(), "tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		conn.Close()
+		if got := <-sources; got != want {
+			t.Errorf("dial %d came from %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestSourceRotatorRejectsInvalidAddress(t *testing.T) {
+	if _, err := newSourceRotator([]string{"not-an-ip"}, &net.Dialer{}); err == nil {
+		t.Error("invalid source address accepted")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTargetSchemeAllowlist(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer target.Close()
+
+	gateway := newTestGateway(t, `
+listen_port: 8443
+authenticated_nodes: ["relay-1"]
+destinations:
+  allow: ["127.0.0.1/32"]
+`)
+	gateway.client.Transport = target.Client().Transport
+
+	if rec := proxyRequest(gateway, "relay-1", target.URL+"/"); rec.Code != http.StatusOK || rec.Body.String() != "secure" {
+		t.Errorf("https target: %d %q", rec.Code, rec.Body)
+	}
+	for _, blocked := range []string{"file:///etc/passwd", "gopher://127.0.0.1/"} {
+		if rec := proxyRequest(gateway, "relay-1", blocked); rec.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", blocked, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+)
+
+// handleRevoke serves POST /revoke: the node's token stops working at once,
+// and the node can neither register again nor use its pre-shared key until
+// an operator rotates it back in
+func (g *StarlinkGateway) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	nodeID, ok := g.adminNodeID(w, r)
+	if !ok {
+		return
+	}
+
+	g.mu.Lock()
+	delete(g.config.NodeTokens, nodeID)
+	g.revoked[nodeID] = true
+	g.mu.Unlock()
+
+	log.Printf("Revoked node %s (requested by %s)", nodeID, r.RemoteAddr)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"node_id": nodeID,
+		"status":  "revoked",
+	})
+}
+
+// handleRotate serves POST /rotate: the node gets a fresh token, replacing
+// its old one and lifting any revocation. The token is returned only here,
+// for the operator to hand to the node.
+func (g *StarlinkGateway) handleRotate(w http.ResponseWriter, r *http.Request) {
+	nodeID, ok := g.adminNodeID(w, r)
+	if !ok {
+		return
+	}
+
+	token := generateToken()
+
+	g.mu.Lock()
+	g.config.NodeTokens[nodeID] = token
+	delete(g.revoked, nodeID)
+	g.mu.Unlock()
+
+	log.Printf("Rotated token for node %s (requested by %s)", nodeID, r.RemoteAddr)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"node_id": nodeID,
+		"token":   token,
+	})
+}
+
+// adminNodeID reads the node a token request is for. Only nodes the gateway
+// knows of can be named.
+func (g *StarlinkGateway) adminNodeID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req struct {
+		NodeID string `json:"node_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NodeID == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return "", false
+	}
+
+	g.mu.RLock()
+	_, hasToken := g.config.NodeTokens[req.NodeID]
+	_, hasKey := g.config.PreSharedKeys[req.NodeID]
+	g.mu.RUnlock()
+
+	if !hasToken && !hasKey && !slices.Contains(g.config.AuthenticatedNodes, req.NodeID) {
+		http.Error(w, "Unknown node", http.StatusNotFound)
+		return "", false
+	}
+	return req.NodeID, true
+}
+
+// isRevoked reports whether nodeID was revoked and not rotated since
+func (g *StarlinkGateway) isRevoked(nodeID string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.revoked[nodeID]
+}
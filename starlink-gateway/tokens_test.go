@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// tokenAdmin sends an authenticated token request for node to handler
+func tokenAdmin(handler http.HandlerFunc, node string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"node_id": "`+node+`"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	handler(recorder, req)
+	return recorder
+}
+
+func TestRevokedTokenFailsAuth(t *testing.T) {
+	gateway := newTestGateway(t, "listen_port: 8443\nadmin_token: secret\nauthenticated_nodes: [relay-1]\n")
+	token := gateway.config.NodeTokens["relay-1"]
+	if code := authStatus(gateway, "relay-1", token); code != http.StatusBadRequest {
+		t.Fatalf("before revoking: status %d, want past authentication", code)
+	}
+
+	revoke := common.AdminHandler(gateway.config.AdminToken, "revoke", gateway.handleRevoke)
+	if rec := tokenAdmin(revoke, "relay-1"); rec.Code != http.StatusOK {
+		t.Fatalf("/revoke: status %d", rec.Code)
+	}
+	if code := authStatus(gateway, "relay-1", token); code != http.StatusUnauthorized {
+		t.Errorf("revoked token: status %d, want 401", code)
+	}
+
+	if rec := tokenAdmin(revoke, "relay-unknown"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown node: status %d, want 404", rec.Code)
+	}
+}
+
+func TestRotatedTokenReplacesOld(t *testing.T) {
+	gateway := newTestGateway(t, "listen_port: 8443\nadmin_token: secret\nauthenticated_nodes: [relay-1]\n")
+	old := gateway.config.NodeTokens["relay-1"]
+
+	// Rotating also lifts a revocation
+	tokenAdmin(common.AdminHandler(gateway.config.AdminToken, "revoke", gateway.handleRevoke), "relay-1")
+	rec := tokenAdmin(common.AdminHandler(gateway.config.AdminToken, "rotate", gateway.handleRotate), "relay-1")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/rotate: status %d", rec.Code)
+	}
+	var rotated struct {
+		NodeID string `json:"node_id"`
+		Token  string `json:"token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&rotated); err != nil || rotated.Token == "" || rotated.Token == old {
+		t.Fatalf("rotate returned %+v, %v, want a new token", rotated, err)
+	}
+
+	if code := authStatus(gateway, "relay-1", old); code != http.StatusUnauthorized {
+		t.Errorf("old token: status %d, want 401", code)
+	}
+	if code := authStatus(gateway, "relay-1", rotated.Token); code != http.StatusBadRequest {
+		t.Errorf("rotated token: status %d, want past authentication", code)
+	}
+}
+
+func TestTokenAdminNeedsAdminToken(t *testing.T) {
+	gateway := newTestGateway(t, "listen_port: 8443\nadmin_token: secret\nauthenticated_nodes: [relay-1]\n")
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"node_id": "relay-1"}`))
+	recorder := httptest.NewRecorder()
+	common.AdminHandler(gateway.config.AdminToken, "revoke", gateway.handleRevoke)(recorder, req)
+	if recorder.Code != http.StatusUnauthorized || gateway.isRevoked("relay-1") {
+		t.Errorf("unauthenticated /revoke: status %d, revoked %v", recorder.Code, gateway.isRevoked("relay-1"))
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// validateClientKeys reports client_keys entries that can't be used
+func (c UpstreamConfig) validateClientKeys() []error {
+	var errs []error
+	for keyID, secret := range c.ClientKeys {
+		if _, err := common.DecodeClientSecret(secret); err != nil {
+			errs = append(errs, fmt.Errorf("client_keys[%s]: %w", keyID, err))
+		}
+	}
+	return errs
+}
+
+// decodeClientKeys returns the client secrets by key ID, nil when clients
+// don't have to sign requests
+func decodeClientKeys(config UpstreamConfig) map[string][]byte {
+	if len(config.ClientKeys) == 0 {
+		return nil
+	}
+
+	keys := make(map[string][]byte, len(config.ClientKeys))
+	for keyID, secret := range config.ClientKeys {
+		keys[keyID], _ = common.DecodeClientSecret(secret) // checked by Validate
+	}
+	return keys
+}
+
+// authenticateClient checks the client's signature on a request whose body
+// is body, answering 401 itself and returning false if it doesn't hold up.
+// Every request passes when no client keys are configured.
+func (s *UpstreamServer) authenticateClient(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	if s.clientKeys == nil {
+		return true
+	}
+
+	if _, err := common.VerifyClientRequest(r, body, s.clientKeys, time.Now()); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		log.Printf("Refused request from %s: %v", r.RemoteAddr, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+	"gopkg.in/yaml.v3"
+)
+
+// sessionPinTTL is how long a session stays with the central proxy its
+// first chunk reached; longer than the central proxy's session lifetime
+const sessionPinTTL = 15 * time.Minute
+
+// unreachableCooldown is how long a central proxy that refused a connection
+// is tried only after the others
+const unreachableCooldown = 30 * time.Second
+
+// CentralList is the central_proxy setting: one address, or a list whose
+// first entry is the primary and the rest standbys in order of preference
+type CentralList []string
+
+// UnmarshalYAML accepts both a single address and a list
+func (l *CentralList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = CentralList{value.Value}
+		return nil
+	}
+
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// centralSelector orders the central proxies to try for a session. The
+// order depends only on the session ID, so every upstream, and every retry,
+// prefers the same central proxy and falls back to the same standby, which
+// keeps a session's chunks together. Once a chunk of a session reached a
+// central proxy, the session is pinned there, so a central proxy that was
+// briefly unreachable doesn't pull later chunks of that session away.
+// Central proxies that recently refused a connection go last for new
+// sessions, so they don't cost each one a failed dial.
+type centralSelector struct {
+	pool    *common.HashRing // central_proxies, nil without a pool
+	ordered []string         // central_proxy entries, used without a pool
+
+	mu          sync.Mutex
+	pinned      map[string]sessionPin
+	lastSweep   time.Time
+	unreachable map[string]time.Time // when each central proxy last refused a connection
+}
+
+// sessionPin is the central proxy a session's chunks were delivered to
+type sessionPin struct {
+	addr string
+	at   time.Time
+}
+
+func newCentralSelector(config UpstreamConfig) *centralSelector {
+	s := &centralSelector{
+		pinned:      make(map[string]sessionPin),
+		lastSweep:   time.Now(),
+		unreachable: make(map[string]time.Time),
+	}
+	if len(config.CentralPool) > 0 {
+		s.pool = common.NewHashRing(config.CentralPool)
+	} else {
+		s.ordered = config.CentralProxy
+	}
+	return s
+}
+
+// Candidates returns the central proxies to try for sessionID in order:
+// the one the session is pinned to if any, then the session's preference
+// order with those unreachable in the last unreachableCooldown moved behind
+// the rest
+func (s *centralSelector) Candidates(sessionID string) []string {
+	order := s.ordered
+	if s.pool != nil {
+		order = s.pool.Successors(sessionID)
+	}
+
+	s.mu.Lock()
+	pin, exists := s.pinned[sessionID]
+	var healthy, unhealthy []string
+	for _, addr := range order {
+		if at, down := s.unreachable[addr]; down && time.Since(at) < unreachableCooldown {
+			unhealthy = append(unhealthy, addr)
+		} else {
+			healthy = append(healthy, addr)
+		}
+	}
+	s.mu.Unlock()
+	order = append(healthy, unhealthy...)
+	if !exists || time.Since(pin.at) > sessionPinTTL || !slices.Contains(order, pin.addr) {
+		return order
+	}
+
+	candidates := []string{pin.addr}
+	for _, addr := range order {
+		if addr != pin.addr {
+			candidates = append(candidates, addr)
+		}
+	}
+	return candidates
+}
+
+// Pin records that a chunk of sessionID was delivered to addr, and forgets
+// pins of sessions that must have finished long ago
+func (s *centralSelector) Pin(sessionID, addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.pinned[sessionID] = sessionPin{addr: addr, at: now}
+	delete(s.unreachable, addr)
+
+	if now.Sub(s.lastSweep) > sessionPinTTL {
+		for id, pin := range s.pinned {
+			if now.Sub(pin.at) > sessionPinTTL {
+				delete(s.pinned, id)
+			}
+		}
+		s.lastSweep = now
+	}
+}
+
+// MarkUnreachable records that a connection to addr could not be made
+func (s *centralSelector) MarkUnreachable(addr string) {
+	s.mu.Lock()
+	s.unreachable[addr] = time.Now()
+	s.mu.Unlock()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestCentralPoolKeepsSessionsTogether(t *testing.T) {
+	a, b := newRecordingCentral(t), newRecordingCentral(t)
+	server := newTestUpstream(t, fmt.Sprintf(`
+listen_port: 8001
+central_proxies: ["%s", "%s"]
+encryption:
+  enabled: false
+`, a.addr(), b.addr()))
+
+	const sessions, chunks = 20, 5
+	for i := 0; i < sessions; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		for seq := 1; seq <= chunks; seq++ {
+			if rec := postChunk(t, server, testChunk(session, seq, chunks)); rec.Code != http.StatusOK {
+				t.Fatalf("chunk %d of %s: status %d", seq, session, rec.Code)
+			}
+		}
+	}
+
+	onA, onB := a.sessions(), b.sessions()
+	for session, n := range onA {
+		if onB[session] != 0 {
+			t.Errorf("session %s split: %d chunks on one central, %d on the other", session, n, onB[session])
+		}
+	}
+	for session, n := range onB {
+		if n != chunks && onA[session] == 0 {
+			t.Errorf("session %s has %d of %d chunks", session, n, chunks)
+		}
+	}
+	if len(onA) == 0 || len(onB) == 0 {
+		t.Errorf("all sessions went to one central (%d and %d)", len(onA), len(onB))
+	}
+}
+
+func TestFailoverToBackupCentral(t *testing.T) {
+	backup := newRecordingCentral(t)
+	down := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	server := newTestUpstream(t, fmt.Sprintf(`
+listen_port: 8001
+central_proxy: ["%s", "%s"]
+encryption:
+  enabled: false
+`, down, backup.addr()))
+
+	for seq := 1; seq <= 3; seq++ {
+		if rec := postChunk(t, server, testChunk("session", seq, 3)); rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d: status %d %s", seq, rec.Code, rec.Body)
+		}
+	}
+	if got := backup.sessions()["session"]; got != 3 {
+		t.Errorf("backup received %d of 3 chunks", got)
+	}
+}
+
+func TestNoFailoverOnceCentralReached(t *testing.T) {
+	primary, backup := newRecordingCentral(t), newRecordingCentral(t)
+	primary.status = http.StatusInternalServerError
+	server := newTestUpstream(t, fmt.Sprintf(`
+listen_port: 8001
+central_proxy: ["%s", "%s"]
+encryption:
+  enabled: false
+`, primary.addr(), backup.addr()))
+
+	// The primary may have taken the chunk, so it isn't sent twice
+	if rec := postChunk(t, server, testChunk("session", 1, 1)); rec.Code != http.StatusBadGateway {
+		t.Errorf("status %d, want 502", rec.Code)
+	}
+	if primary.received() != 1 || backup.received() != 0 {
+		t.Errorf("primary got %d and backup %d chunks, want 1 and 0", primary.received(), backup.received())
+	}
+}
+
+// dialRecorder is a transport noting the host of every request before
+// passing it on
+type dialRecorder struct {
+	next http.RoundTripper
+
+	mu    sync.Mutex
+	hosts []string
+}
+
+func (d *dialRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	d.mu.Lock()
+	d.hosts = append(d.hosts, req.URL.Host)
+	d.mu.Unlock()
+	return d.next.RoundTrip(req)
+}
+
+// attempts returns how many requests went to host
+func (d *dialRecorder) attempts(host string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var n int
+	for _, h := range d.hosts {
+		if h == host {
+			n++
+		}
+	}
+	return n
+}
+
+func TestUnreachableCentralTriedLast(t *testing.T) {
+	backup := newRecordingCentral(t)
+	down := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	server := newTestUpstream(t, fmt.Sprintf(`
+listen_port: 8001
+central_proxy: ["%s", "%s"]
+encryption:
+  enabled: false
+`, down, backup.addr()))
+	recorder := &dialRecorder{next: server.client.Transport}
+	server.client.Transport = recorder
+
+	// The first session finds the primary down; the second goes straight
+	// to the backup
+	for _, session := range []string{"first", "second"} {
+		if rec := postChunk(t, server, testChunk(session, 1, 1)); rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d %s", session, rec.Code, rec.Body)
+		}
+	}
+	if got := recorder.attempts(down); got != 1 {
+		t.Errorf("%d attempts on the unreachable primary, want 1", got)
+	}
+	if got := backup.received(); got != 2 {
+		t.Errorf("backup received %d of 2 chunks", got)
+	}
+}
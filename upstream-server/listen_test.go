@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// freePort returns a TCP port nothing is listening on
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestBindsConfiguredAddress(t *testing.T) {
+	port := freePort(t)
+	server := newTestUpstream(t, fmt.Sprintf(`
+listen_address: 127.0.0.2
+listen_port: %d
+central_proxy: "central:8080"
+`, port))
+
+	started := make(chan error, 1)
+	go func() { started <- server.Start() }()
+	defer server.Shutdown(context.Background())
+
+	// Only Linux routes all of 127/8 to loopback by default
+	bound := net.JoinHostPort("127.0.0.2", fmt.Sprint(port))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", bound)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		select {
+		case err := <-started:
+			t.Skipf("cannot listen on 127.0.0.2: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nothing listening on %s: %v", bound, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port))); err == nil {
+		conn.Close()
+		t.Errorf("also listening on 127.0.0.1:%d", port)
+	}
+}
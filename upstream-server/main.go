@@ -2,58 +2,162 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
-	"os"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/dudelovecamera/proxy-system/common"
-	"gopkg.in/yaml.v3"
 )
 
 // UpstreamConfig configuration for upstream server
 type UpstreamConfig struct {
 	ListenPort    int                      `yaml:"listen_port"`
-	CentralProxy  string                   `yaml:"central_proxy"`
+	ListenAddress string                   `yaml:"listen_address"` // interface to bind, all if empty
+	AdminToken    string                   `yaml:"admin_token"`    // enables POST /shutdown, disabled if empty
+	CentralProxy  CentralList              `yaml:"central_proxy"`
+	CentralPool   []string                 `yaml:"central_proxies"` // Pool selected by session hash, overrides central_proxy
 	Obfuscation   common.ObfuscationConfig `yaml:"obfuscation"`
 	Encryption    common.EncryptionConfig  `yaml:"encryption"`
-	EncryptionKey []byte                   `yaml:"-"` // 32 bytes for AES-256
+	ReplayWindow  int                      `yaml:"replay_window"`   // milliseconds, 0 disables
+	MaxChunkSize  int                      `yaml:"max_chunk_size"`  // largest accepted chunk payload in bytes
+	MaxHeaderSize int                      `yaml:"max_header_size"` // largest accepted total of request header names and values in bytes
+	ChunkTTL      int                      `yaml:"chunk_ttl"`       // milliseconds after a chunk was sent that it is dropped, 0 disables
+	ChunkCodec    string                   `yaml:"chunk_codec"`     // json or protobuf, must match every hop
+	ClientKeys    map[string]string        `yaml:"client_keys"`     // hex secrets by key ID; clients must sign requests when set
+	Timeouts      common.HTTPTimeouts      `yaml:"timeouts"`        // outbound dial, TLS and response header timeouts
+	WireCapture   common.WireCapture       `yaml:",inline"`         // wire_capture_dir and wire_capture_redact, for debugging
 }
 
 // UpstreamServer handles incoming chunks from clients
 type UpstreamServer struct {
-	config UpstreamConfig
-	client *http.Client
-	mu     sync.RWMutex
+	config     UpstreamConfig
+	client     *http.Client
+	mu         sync.RWMutex
+	central    *centralSelector
+	replay     *common.ReplayGuard
+	obfs       common.Obfuscator
+	keys       *common.KeyRing
+	codec      common.ChunkCodec
+	clientKeys map[string][]byte // nil unless client_keys is set
+	httpServer *http.Server
+}
+
+// loadUpstreamConfig reads and validates the config file, with settings
+// overridden by PROXY_UPSTREAM_* environment variables
+func loadUpstreamConfig(configPath string) (UpstreamConfig, error) {
+	return common.LoadConfig(configPath, "PROXY_UPSTREAM", setUpstreamDefaults)
+}
+
+// setUpstreamDefaults fills in settings left unset
+func setUpstreamDefaults(config *UpstreamConfig) {
+	if config.MaxChunkSize == 0 {
+		config.MaxChunkSize = common.DefaultMaxChunkSize
+	}
+	if config.MaxHeaderSize == 0 {
+		config.MaxHeaderSize = common.DefaultMaxHeaderSize
+	}
+}
+
+// Validate reports every problem with the configuration
+func (c UpstreamConfig) Validate() error {
+	var errs []error
+
+	if c.ListenPort <= 0 || c.ListenPort > 65535 {
+		errs = append(errs, fmt.Errorf("listen_port must be between 1 and 65535, got %d", c.ListenPort))
+	}
+	if len(c.CentralProxy) == 0 && len(c.CentralPool) == 0 {
+		errs = append(errs, fmt.Errorf("central_proxy or central_proxies must be set"))
+	}
+	if slices.Contains(c.CentralProxy, "") || slices.Contains(c.CentralPool, "") {
+		errs = append(errs, fmt.Errorf("central proxy addresses must not be empty"))
+	}
+	if c.ReplayWindow < 0 {
+		errs = append(errs, fmt.Errorf("replay_window must not be negative, got %d", c.ReplayWindow))
+	}
+	if c.MaxChunkSize < 0 {
+		errs = append(errs, fmt.Errorf("max_chunk_size must not be negative, got %d", c.MaxChunkSize))
+	}
+	if c.MaxHeaderSize < 0 {
+		errs = append(errs, fmt.Errorf("max_header_size must not be negative, got %d", c.MaxHeaderSize))
+	}
+	if c.ChunkTTL < 0 {
+		errs = append(errs, fmt.Errorf("chunk_ttl must not be negative, got %d", c.ChunkTTL))
+	}
+	if err := c.Obfuscation.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Encryption.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := common.NewChunkCodec(c.ChunkCodec); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, c.validateClientKeys()...)
+
+	if err := c.Timeouts.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
 }
 
 // NewUpstreamServer creates a new upstream server instance
 func NewUpstreamServer(configPath string) (*UpstreamServer, error) {
-	data, err := os.ReadFile(configPath)
+	config, err := loadUpstreamConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	obfs, err := common.NewObfuscator(config.Obfuscation)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config: %w", err)
+		return nil, err
 	}
 
-	var config UpstreamConfig
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config: %w", err)
+	keys, err := common.NewKeyRingFromConfig(config.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption keys: %w", err)
 	}
 
-	// Generate or load encryption key (in production, use secure key management)
-	config.EncryptionKey = make([]byte, 32)
-	// For demo: use a fixed key. In production: load from secure storage
-	copy(config.EncryptionKey, []byte("your-32-byte-encryption-key-here"))
+	// Already checked by Validate
+	codec, _ := common.NewChunkCodec(config.ChunkCodec)
+
+	// Capture chunks for debugging when wire_capture_dir is set
+	tap, err := common.NewWireTap(config.WireCapture, "upstream")
+	if err != nil {
+		return nil, err
+	}
+	codec = tap.Codec(codec)
+	keys.SetWireTap(tap)
 
-	return &UpstreamServer{
-		config: config,
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
-	}, nil
+	server := &UpstreamServer{
+		config:     config,
+		httpServer: &http.Server{},
+		obfs:       obfs,
+		keys:       keys,
+		codec:      codec,
+		central:    newCentralSelector(config),
+		clientKeys: decodeClientKeys(config),
+		client:     common.NewHTTPClient(30*time.Second, config.Timeouts),
+	}
+
+	// Start replay protection if configured
+	if config.ReplayWindow > 0 {
+		server.replay = common.NewReplayGuard(time.Duration(config.ReplayWindow) * time.Millisecond)
+		go server.cleanupReplayGuard()
+	}
+
+	return server, nil
 }
 
 // handleChunk processes incoming chunk from client
@@ -64,114 +168,273 @@ func (s *UpstreamServer) handleChunk(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Read chunk data
-	body, err := io.ReadAll(r.Body)
+	body, err := common.ReadChunkBody(w, r, s.config.MaxChunkSize)
 	if err != nil {
+		if errors.Is(err, common.ErrChunkTooLarge) {
+			http.Error(w, "Chunk too large", http.StatusRequestEntityTooLarge)
+			log.Printf("Rejected oversized chunk body")
+			return
+		}
 		http.Error(w, "Failed to read body", http.StatusBadRequest)
 		log.Printf("Error reading body: %v", err)
 		return
 	}
 	defer r.Body.Close()
 
+	if !s.authenticateClient(w, r, body) {
+		return
+	}
+
 	// Deserialize chunk
-	chunk, err := common.DeserializeChunk(body)
+	chunk, err := s.codec.Decode(body)
 	if err != nil {
 		http.Error(w, "Invalid chunk format", http.StatusBadRequest)
 		log.Printf("Error deserializing chunk: %v", err)
 		return
 	}
 
+	// Reject oversized chunks before doing any work on them
+	if err := common.CheckChunkSize(chunk, s.config.MaxChunkSize); err != nil {
+		http.Error(w, "Chunk too large", http.StatusRequestEntityTooLarge)
+		log.Printf("Rejected chunk %d for session %s: %v", chunk.SequenceNum, chunk.SessionID, err)
+		return
+	}
+	if err := common.CheckHeaderSize(chunk.Headers, s.config.MaxHeaderSize); err != nil {
+		http.Error(w, "Headers too large", http.StatusRequestHeaderFieldsTooLarge)
+		log.Printf("Rejected chunk %d for session %s: %v", chunk.SequenceNum, chunk.SessionID, err)
+		return
+	}
+
+	// Drop chunks that spent too long in buffers or retries
+	if err := common.CheckChunkAge(chunk, time.Duration(s.config.ChunkTTL)*time.Millisecond); err != nil {
+		http.Error(w, "Chunk expired", http.StatusGone)
+		log.Printf("Rejected chunk %d for session %s: %v", chunk.SequenceNum, chunk.SessionID, err)
+		return
+	}
+
+	// Reject stale or replayed chunks
+	if s.replay != nil {
+		if err := s.replay.Check(chunk); err != nil {
+			http.Error(w, "Replayed chunk", http.StatusBadRequest)
+			log.Printf("Rejected chunk %d for session %s: %v", chunk.SequenceNum, chunk.SessionID, err)
+			return
+		}
+	}
+
 	log.Printf("Received chunk %d/%d for session %s",
 		chunk.SequenceNum, chunk.TotalChunks, chunk.SessionID)
 
-	// Apply obfuscation
-	chunk.Headers = common.ApplyObfuscation(chunk.Headers, s.config.Obfuscation)
-
-	// Apply encryption if enabled
+	// Re-encrypt for the central proxy; the client encrypted for this hop,
+	// and the central proxy only removes one layer
 	if s.config.Encryption.Enabled {
-		encrypted, err := common.EncryptAES(chunk.Data, s.config.EncryptionKey)
-		if err != nil {
+		if err := s.keys.DecryptChunk(chunk); err != nil {
+			http.Error(w, "Decryption failed", http.StatusBadRequest)
+			log.Printf("Decryption error: %v", err)
+			return
+		}
+		if err := s.keys.EncryptChunk(chunk); err != nil {
 			http.Error(w, "Encryption failed", http.StatusInternalServerError)
 			log.Printf("Encryption error: %v", err)
 			return
 		}
-		chunk.Data = encrypted
 	}
 
-	// Add timing jitter if configured
-	if s.config.Obfuscation.Jitter > 0 {
-		jitter := time.Duration(s.config.Obfuscation.Jitter) * time.Millisecond
+	// Add timing jitter if configured, within the request's latency budget
+	if jitter := common.BudgetDelay(s.config.Obfuscation.JitterDelay(), chunk.Deadline); jitter > 0 {
 		time.Sleep(jitter)
 	}
 
+	ack := common.ChunkAck{
+		SessionID:   chunk.SessionID,
+		SequenceNum: chunk.SequenceNum,
+		Forwarded:   true,
+	}
+	status := http.StatusOK
+
 	// Forward to central proxy
 	if err := s.forwardToCentral(chunk); err != nil {
-		http.Error(w, "Failed to forward chunk", http.StatusInternalServerError)
 		log.Printf("Forwarding error: %v", err)
-		return
+		ack.Forwarded = false
+		ack.Error = err.Error()
+		status = http.StatusBadGateway
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Chunk received and forwarded"))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ack)
 }
 
 // forwardToCentral sends chunk to central proxy server
 func (s *UpstreamServer) forwardToCentral(chunk *common.Chunk) error {
-	data, err := common.SerializeChunk(chunk)
+	data, err := s.codec.Encode(chunk)
 	if err != nil {
 		return fmt.Errorf("serialization error: %w", err)
 	}
 
-	url := fmt.Sprintf("http://%s/chunk", s.config.CentralProxy)
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
-	if err != nil {
-		return fmt.Errorf("request creation error: %w", err)
+	// Pick the central proxy by session so all chunks of a request meet
+	// there, falling back in the same order everywhere if it can't be
+	// connected to. Any other failure may have reached the central proxy,
+	// so the chunk isn't sent to another one as well. A central proxy that
+	// can't be connected to is tried last until its cooldown passes.
+	for _, centralAddr := range s.central.Candidates(chunk.SessionID) {
+		err = s.sendToCentral(data, centralAddr)
+		if err == nil {
+			s.central.Pin(chunk.SessionID, centralAddr)
+		}
+		if !errors.Is(err, errCentralUnreachable) {
+			return err
+		}
+		s.central.MarkUnreachable(centralAddr)
+		log.Printf("Central proxy %s unreachable, trying the next: %v", centralAddr, err)
 	}
 
-	// Set obfuscation headers
-	for k, v := range s.config.Obfuscation.Headers {
-		req.Header.Set(k, v)
+	return err
+}
+
+// errCentralUnreachable marks failures to connect, the only ones worth
+// retrying on another central proxy: the chunk can't have arrived
+var errCentralUnreachable = errors.New("central proxy unreachable")
+
+// sendToCentral posts encoded chunk data to one central proxy
+func (s *UpstreamServer) sendToCentral(data []byte, centralAddr string) error {
+	req, err := s.newCentralRequest(centralAddr, "/chunk", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("request creation error: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", s.codec.ContentType())
 
 	resp, err := s.client.Do(req)
 	if err != nil {
+		if isDialError(err) {
+			return fmt.Errorf("%w: %w", errCentralUnreachable, err)
+		}
 		return fmt.Errorf("request error: %w", err)
 	}
-	defer resp.Body.Close()
+	defer common.DrainAndClose(resp)
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("central proxy returned status %d", resp.StatusCode)
+		return fmt.Errorf("central proxy %s returned status %d", centralAddr, resp.StatusCode)
 	}
 
 	return nil
 }
 
+// isDialError reports whether err happened while connecting, before any
+// of the request was sent
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// newCentralRequest builds a POST of body to path on one central proxy,
+// fronted and carrying obfuscation headers as configured
+func (s *UpstreamServer) newCentralRequest(centralAddr, path string, body io.Reader) (*http.Request, error) {
+	// With domain fronting the connection goes to the CDN edge and only the
+	// Host header carries the real central proxy
+	url := fmt.Sprintf("http://%s%s", centralAddr, path)
+	if s.config.Obfuscation.FrontDomain != "" {
+		url = fmt.Sprintf("https://%s%s", s.config.Obfuscation.FrontDomain, path)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.config.Obfuscation.FrontDomain != "" {
+		req.Host = s.config.Obfuscation.RealHost
+		if req.Host == "" {
+			req.Host = centralAddr
+		}
+	}
+
+	s.obfs.Obfuscate(req)
+	return req, nil
+}
+
+// cleanupReplayGuard periodically forgets chunks outside the replay window
+func (s *UpstreamServer) cleanupReplayGuard() {
+	ticker := time.NewTicker(time.Duration(s.config.ReplayWindow) * time.Millisecond)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.replay.Cleanup()
+	}
+}
+
 // healthCheck endpoint for monitoring
 func (s *UpstreamServer) healthCheck(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "healthy",
-		"role":   "upstream",
-		"time":   time.Now().Format(time.RFC3339),
-	})
+	common.WriteHealth(w, common.NewHealthInfo("upstream", nil))
+}
+
+// ready reports whether a central proxy can be reached. With domain
+// fronting it is only reachable through the CDN, so there is nothing to probe.
+func (s *UpstreamServer) ready() error {
+	if s.config.Obfuscation.FrontDomain != "" {
+		return nil
+	}
+
+	pool := s.config.CentralPool
+	if len(pool) == 0 {
+		pool = s.config.CentralProxy
+	}
+	return common.ProbeAny(s.client, pool)
 }
 
 // Start begins listening for incoming chunks
 func (s *UpstreamServer) Start() error {
-	http.HandleFunc("/chunk", s.handleChunk)
-	http.HandleFunc("/health", s.healthCheck)
-
-	addr := fmt.Sprintf(":%d", s.config.ListenPort)
+	addr := common.ListenAddr(s.config.ListenAddress, s.config.ListenPort)
 	log.Printf("Upstream server starting on %s", addr)
-	log.Printf("Forwarding to central proxy: %s", s.config.CentralProxy)
+	if len(s.config.CentralPool) > 0 {
+		log.Printf("Forwarding to central proxy pool: %v", s.config.CentralPool)
+	} else {
+		log.Printf("Forwarding to central proxy: %s", strings.Join(s.config.CentralProxy, ", then "))
+	}
+
+	s.httpServer.Addr = addr
+	s.httpServer.Handler = s.Handler()
+	if err := s.httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	log.Printf("Upstream server stopped")
+	return nil
+}
 
-	return http.ListenAndServe(addr, nil)
+// Shutdown stops accepting requests and waits for in-flight ones
+func (s *UpstreamServer) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// Handler returns the server's routes, for serving or in-process wiring
+func (s *UpstreamServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chunk", s.handleChunk)
+	mux.HandleFunc("/health", s.healthCheck)
+	mux.HandleFunc("/ready", common.ReadyHandler(s.ready))
+	if s.config.AdminToken != "" {
+		mux.HandleFunc("/shutdown", common.ShutdownHandler(s.config.AdminToken, s))
+	}
+	return mux
+}
+
+// SetTransport replaces the transport used to reach the central proxy
+func (s *UpstreamServer) SetTransport(rt http.RoundTripper) {
+	s.client.Transport = rt
 }
 
 func main() {
+	check := flag.Bool("check", false, "Validate the config file and exit")
+	flag.Parse()
+
 	configPath := "config/upstream.yaml"
-	if len(os.Args) > 1 {
-		configPath = os.Args[1]
+	if flag.NArg() > 0 {
+		configPath = flag.Arg(0)
+	}
+
+	if *check {
+		_, err := loadUpstreamConfig(configPath)
+		common.ReportConfigCheck(configPath, err)
 	}
 
 	server, err := NewUpstreamServer(configPath)
@@ -179,6 +442,8 @@ func main() {
 		log.Fatalf("Failed to create server: %v", err)
 	}
 
+	common.ShutdownOnSignal(server)
+
 	if err := server.Start(); err != nil {
 		log.Fatalf("Server error: %v", err)
 	}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dudelovecamera/proxy-system/common"
+)
+
+// writeConfig writes a YAML config to a temporary file and returns its path
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "upstream.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestUpstream builds an upstream server from yaml
+func newTestUpstream(t *testing.T, yaml string) *UpstreamServer {
+	t.Helper()
+	server, err := NewUpstreamServer(writeConfig(t, yaml))
+	if err != nil {
+		t.Fatalf("NewUpstreamServer: %v", err)
+	}
+	return server
+}
+
+// testChunk returns data chunk seq of total for session
+func testChunk(session string, seq, total int) *common.Chunk {
+	return &common.Chunk{
+		SessionID:   session,
+		SequenceNum: seq,
+		TotalChunks: total,
+		Data:        []byte(fmt.Sprintf("chunk %d", seq)),
+		Timestamp:   time.Now(),
+		TargetURL:   "http://target/",
+		Method:      http.MethodGet,
+	}
+}
+
+// postChunk sends chunk to the server's /chunk handler as a client would
+func postChunk(t *testing.T, s *UpstreamServer, chunk *common.Chunk) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := s.codec.Encode(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	s.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/chunk", bytes.NewReader(data)))
+	return recorder
+}
+
+// recordingCentral is a stub central proxy that keeps every chunk posted
+// to it and answers with status
+type recordingCentral struct {
+	server *httptest.Server
+	status int
+
+	mu       sync.Mutex
+	chunks   []*common.Chunk
+	requests []*http.Request
+}
+
+func newRecordingCentral(t *testing.T) *recordingCentral {
+	t.Helper()
+	c := &recordingCentral{status: http.StatusOK}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		chunk, err := common.DeserializeChunk(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		c.mu.Lock()
+		c.chunks = append(c.chunks, chunk)
+		c.requests = append(c.requests, r)
+		status := c.status
+		c.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(c.server.Close)
+	return c
+}
+
+// addr is the central's host:port as used in config
+func (c *recordingCentral) addr() string {
+	return c.server.Listener.Addr().String()
+}
+
+// sessions returns the number of chunks received per session
+func (c *recordingCentral) sessions() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int)
+	for _, chunk := range c.chunks {
+		counts[chunk.SessionID]++
+	}
+	return counts
+}
+
+// received returns how many chunks reached the central
+func (c *recordingCentral) received() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.chunks)
+}
+
+func TestReplayedChunkRejected(t *testing.T) {
+	central := newRecordingCentral(t)
+	server := newTestUpstream(t, fmt.Sprintf(`
+listen_port: 8001
+central_proxy: "%s"
+replay_window: 60000
+encryption:
+  enabled: false
+`, central.addr()))
+
+	chunk := testChunk("session", 1, 1)
+	if rec := postChunk(t, server, chunk); rec.Code != http.StatusOK {
+		t.Fatalf("first copy: status %d", rec.Code)
+	}
+	if rec := postChunk(t, server, chunk); rec.Code != http.StatusBadRequest {
+		t.Errorf("replayed copy: status %d, want 400", rec.Code)
+	}
+
+	stale := testChunk("other", 1, 1)
+	stale.Timestamp = time.Now().Add(-time.Hour)
+	if rec := postChunk(t, server, stale); rec.Code != http.StatusBadRequest {
+		t.Errorf("stale chunk: status %d, want 400", rec.Code)
+	}
+
+	if central.received() != 1 {
+		t.Errorf("central received %d chunks, want 1", central.received())
+	}
+}
+
+func TestConfiguredObfuscatorApplied(t *testing.T) {
+	central := newRecordingCentral(t)
+	server := newTestUpstream(t, fmt.Sprintf(`
+listen_port: 8001
+central_proxy: "%s"
+encryption:
+  enabled: false
+obfuscation:
+  type: cdn_fronting
+`, central.addr()))
+
+	if rec := postChunk(t, server, testChunk("session", 1, 1)); rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+
+	central.mu.Lock()
+	defer central.mu.Unlock()
+	if len(central.requests) != 1 || central.requests[0].Header.Get("Via") == "" {
+		t.Errorf("hop request to the central was not obfuscated")
+	}
+}
+
+// roundTripFunc adapts a function to http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestDomainFronting(t *testing.T) {
+	server := newTestUpstream(t, `
+listen_port: 8001
+central_proxy: "central.internal:8080"
+encryption:
+  enabled: false
+obfuscation:
+  front_domain: cdn.example.net
+  real_host: origin.example.org
+`)
+
+	var dialed, host string
+	server.SetTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		dialed, host = req.URL.Host, req.Host
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(nil)), Request: req}, nil
+	}))
+
+	if rec := postChunk(t, server, testChunk("session", 1, 1)); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if dialed != "cdn.example.net" {
+		t.Errorf("dialed %q, want the front domain", dialed)
+	}
+	if host != "origin.example.org" {
+		t.Errorf("Host header %q, want the real host", host)
+	}
+}
+
+func TestOversizedChunkRejected(t *testing.T) {
+	central := newRecordingCentral(t)
+	server := newTestUpstream(t, fmt.Sprintf(`
+listen_port: 8001
+central_proxy: "%s"
+max_chunk_size: 64
+encryption:
+  enabled: false
+`, central.addr()))
+
+	chunk := testChunk("session", 1, 1)
+	chunk.Data = bytes.Repeat([]byte("x"), 65)
+	if rec := postChunk(t, server, chunk); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("65 byte chunk: status %d, want 413", rec.Code)
+	}
+
+	huge := testChunk("session", 1, 1)
+	huge.Data = bytes.Repeat([]byte("x"), 4096)
+	if rec := postChunk(t, server, huge); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("4096 byte chunk: status %d, want 413", rec.Code)
+	}
+
+	if central.received() != 0 {
+		t.Errorf("central received %d oversized chunks", central.received())
+	}
+}
+
+func TestInvalidConfigs(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want string
+	}{
+		{"listen_port: 8001\n", "central_proxy or central_proxies must be set"},
+		{"listen_port: 8001\ncentral_proxy: \"\"\n", "central proxy addresses must not be empty"},
+		{"listen_port: 70000\ncentral_proxy: c:1\n", "listen_port must be between 1 and 65535"},
+		{"listen_port: 8001\ncentral_proxy: c:1\nreplay_window: -1\n", "replay_window must not be negative"},
+		{"listen_port: 8001\ncentral_proxy: c:1\nmax_chunk_size: -5\n", "max_chunk_size must not be negative"},
+		{"listen_port: 8001\ncentral_proxy: c:1\nobfuscation:\n  type: nope\n", "unknown obfuscation type"},
+	}
+	for _, tt := range tests {
+		_, err := loadUpstreamConfig(writeConfig(t, tt.yaml))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.yaml, err, tt.want)
+		}
+	}
+}
+
+func TestAckReportsForwardingFailure(t *testing.T) {
+	central := newRecordingCentral(t)
+	central.status = http.StatusInternalServerError
+	server := newTestUpstream(t, fmt.Sprintf(`
+listen_port: 8001
+central_proxy: "%s"
+encryption:
+  enabled: false
+`, central.addr()))
+
+	rec := postChunk(t, server, testChunk("session", 2, 3))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status %d, want 502", rec.Code)
+	}
+
+	var ack common.ChunkAck
+	if err := json.NewDecoder(rec.Body).Decode(&ack); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	if ack.SessionID != "session" || ack.SequenceNum != 2 || ack.Forwarded || ack.Error == "" {
+		t.Errorf("ack %+v, want chunk 2 of session not forwarded with a reason", ack)
+	}
+}
+
+func TestAckConfirmsForwarding(t *testing.T) {
+	central := newRecordingCentral(t)
+	server := newTestUpstream(t, fmt.Sprintf(`
+listen_port: 8001
+central_proxy: "%s"
+encryption:
+  enabled: false
+`, central.addr()))
+
+	var ack common.ChunkAck
+	json.NewDecoder(postChunk(t, server, testChunk("session", 1, 1)).Body).Decode(&ack)
+	if !ack.Forwarded || ack.SequenceNum != 1 {
+		t.Errorf("ack %+v, want chunk 1 forwarded", ack)
+	}
+}
+
+func TestShutdownEndpointNeedsAdminToken(t *testing.T) {
+	server := newTestUpstream(t, "listen_port: 8001\ncentral_proxy: c:1\n")
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/shutdown", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status %d, want /shutdown absent without admin_token", recorder.Code)
+	}
+
+	server = newTestUpstream(t, "listen_port: 8001\ncentral_proxy: c:1\nadmin_token: secret\n")
+	recorder = httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/shutdown", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated: status %d, want 401", recorder.Code)
+	}
+}
+
+// countingTransport answers every request with status and counts the
+// response bodies handed out and closed
+type countingTransport struct {
+	status int
+
+	mu     sync.Mutex
+	opened int
+	closed int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.opened++
+	return &http.Response{
+		StatusCode: c.status,
+		Body:       &countedBody{Reader: strings.NewReader("response body"), transport: c},
+		Request:    req,
+	}, nil
+}
+
+// counts returns how many bodies were handed out and how many closed
+func (c *countingTransport) counts() (opened, closed int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.opened, c.closed
+}
+
+type countedBody struct {
+	io.Reader
+	transport *countingTransport
+}
+
+func (b *countedBody) Close() error {
+	b.transport.mu.Lock()
+	defer b.transport.mu.Unlock()
+	b.transport.closed++
+	return nil
+}
+
+func TestForwardClosesResponseBodies(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusInternalServerError} {
+		server := newTestUpstream(t, `
+listen_port: 8001
+central_proxy: "central:8080"
+encryption:
+  enabled: false
+`)
+		transport := &countingTransport{status: status}
+		server.SetTransport(transport)
+
+		postChunk(t, server, testChunk("session", 1, 1))
+		opened, closed := transport.counts()
+		if opened == 0 {
+			t.Fatalf("status %d: central never reached", status)
+		}
+		if closed != opened {
+			t.Errorf("status %d: %d of %d response bodies left open", status, opened-closed, opened)
+		}
+	}
+}
+
+func TestShortEncryptionKeyFailsFast(t *testing.T) {
+	_, err := NewUpstreamServer(writeConfig(t, `
+listen_port: 8001
+central_proxy: c:1
+encryption:
+  enabled: true
+  encryption_key_hex: "00112233445566778899"
+`))
+	if err == nil || !strings.Contains(err.Error(), "must decode to 32 bytes for AES-256, got 10") {
+		t.Errorf("got %v, want the 10 byte key rejected", err)
+	}
+}
+
+func TestTightBudgetSkipsJitter(t *testing.T) {
+	central := newRecordingCentral(t)
+	server := newTestUpstream(t, fmt.Sprintf(`
+listen_port: 8001
+central_proxy: "%s"
+encryption:
+  enabled: false
+obfuscation:
+  jitter_min_ms: 1000
+  jitter_max_ms: 1000
+`, central.addr()))
+
+	chunk := testChunk("late", 1, 1)
+	chunk.Deadline = time.Now()
+	start := time.Now()
+	if rec := postChunk(t, server, chunk); rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("forwarding took %v, want the 1s jitter skipped", elapsed)
+	}
+}
+
+func TestExpiredChunkDropped(t *testing.T) {
+	central := newRecordingCentral(t)
+	server := newTestUpstream(t, fmt.Sprintf(`
+listen_port: 8001
+central_proxy: "%s"
+chunk_ttl: 60000
+encryption:
+  enabled: false
+`, central.addr()))
+
+	old := testChunk("old", 1, 1)
+	old.Timestamp = time.Now().Add(-2 * time.Minute)
+	if rec := postChunk(t, server, old); rec.Code != http.StatusGone {
+		t.Errorf("old chunk: status %d, want 410", rec.Code)
+	}
+	if rec := postChunk(t, server, testChunk("fresh", 1, 1)); rec.Code != http.StatusOK {
+		t.Errorf("fresh chunk: status %d", rec.Code)
+	}
+	if sessions := central.sessions(); sessions["old"] != 0 || sessions["fresh"] != 1 {
+		t.Errorf("central received %v, want only the fresh chunk", sessions)
+	}
+}
+
+func TestUnsignedChunkRefused(t *testing.T) {
+	central := newRecordingCentral(t)
+	server := newTestUpstream(t, fmt.Sprintf(`
+listen_port: 8001
+central_proxy: "%s"
+client_keys:
+  laptop: "00112233445566778899aabbccddeeff"
+encryption:
+  enabled: false
+`, central.addr()))
+	secret, _ := common.DecodeClientSecret("00112233445566778899aabbccddeeff")
+
+	send := func(chunk *common.Chunk, sign bool) int {
+		data, err := server.codec.Encode(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/chunk", bytes.NewReader(data))
+		if sign {
+			common.SignClientRequest(req, data, "laptop", secret)
+		}
+		recorder := httptest.NewRecorder()
+		server.Handler().ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	if code := send(testChunk("unsigned", 1, 1), false); code != http.StatusUnauthorized {
+		t.Errorf("unsigned chunk: status %d, want 401", code)
+	}
+	if code := send(testChunk("signed", 1, 1), true); code != http.StatusOK {
+		t.Errorf("signed chunk: status %d, want 200", code)
+	}
+	if sessions := central.sessions(); sessions["unsigned"] != 0 || sessions["signed"] != 1 {
+		t.Errorf("central received %v, want only the signed chunk", sessions)
+	}
+}